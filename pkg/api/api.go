@@ -291,10 +291,14 @@ func (a *API) RegisterStoreGateway(s *storegateway.StoreGateway) {
 	a.RegisterRoute("/store-gateway/ring", http.HandlerFunc(s.RingHandler), false, "GET", "POST")
 }
 
-// RegisterCompactor registers the ring UI page associated with the compactor.
+// RegisterCompactor registers the ring UI page and the cleanup trigger associated with the compactor.
 func (a *API) RegisterCompactor(c *compactor.Compactor) {
 	a.indexPage.AddLink(SectionAdminEndpoints, "/compactor/ring", "Compactor Ring Status")
 	a.RegisterRoute("/compactor/ring", http.HandlerFunc(c.RingHandler), false, "GET", "POST")
+	a.RegisterRoute("/compactor/cleanup", http.HandlerFunc(c.CleanupHandler), false, "POST")
+	a.RegisterRoute("/compactor/tenants_marked_for_deletion", http.HandlerFunc(c.TenantsMarkedForDeletionHandler), false, "GET")
+	a.indexPage.AddLink(SectionAdminEndpoints, "/compactor/cleaner_status", "Compactor Blocks Cleaner Status")
+	a.RegisterRoute("/compactor/cleaner_status", http.HandlerFunc(c.CleanerStatusHandler), false, "GET")
 }
 
 // RegisterQueryable registers the the default routes associated with the querier
@@ -2,58 +2,294 @@ package compactor
 
 import (
 	"context"
-	"path"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/thanos-io/thanos/pkg/block"
-	"github.com/thanos-io/thanos/pkg/block/metadata"
-	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
 
-	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
-	"github.com/cortexproject/cortex/pkg/util"
 	"github.com/cortexproject/cortex/pkg/util/concurrency"
 	"github.com/cortexproject/cortex/pkg/util/services"
 )
 
-type BlocksCleanerConfig struct {
-	DataDir             string
-	MetaSyncConcurrency int
-	DeletionDelay       time.Duration
-	CleanupInterval     time.Duration
-	CleanupConcurrency  int
-}
+// Reasons why the blocks of a tenant are deleted.
+const (
+	// The tenant deletion mark has been found by the users scan. The mark is written by the
+	// tenant deletion API as well.
+	tenantDeletionReasonMark = "tenant-deletion-mark"
+
+	// The deletion of the tenant has been requested on-demand.
+	tenantDeletionReasonOnDemand = "on-demand"
+
+	// The tenant is deleted because the bucket is decommissioned.
+	tenantDeletionReasonDecommission = "decommission"
+)
 
 type BlocksCleaner struct {
 	services.Service
 
 	cfg          BlocksCleanerConfig
+	cfgProvider  ConfigProvider
 	logger       log.Logger
 	bucketClient objstore.Bucket
 	usersScanner *cortex_tsdb.UsersScanner
 
+	// Time of the next scheduled run, as unix nanoseconds, and notifications of the schedule
+	// shifted by a run triggered on-demand.
+	nextRun         *atomic.Int64
+	scheduleShifted chan struct{}
+
+	// Whether a cleanup run is in progress, the runs in-flight, either scheduled or triggered on-demand,
+	// and the context of the runs triggered on-demand.
+	runInProgress       *atomic.Bool
+	runsInFlight        sync.WaitGroup
+	triggeredRunsCtx    context.Context
+	cancelTriggeredRuns context.CancelFunc
+
+	// Context of the tenants in-flight when a shutdown grace period is configured, canceled on shutdown
+	// once the grace period has elapsed.
+	tenantsInFlightCtx    context.Context
+	cancelTenantsInFlight context.CancelFunc
+
+	// The tenants marked for deletion discovered by the most recent run.
+	markedTenants markedTenants
+
+	// If empty, all tenants are enabled. If not empty, only tenants in the map are enabled.
+	enabledUsers map[string]struct{}
+
+	// If empty, no tenants are disabled. If not empty, tenants in the map are disabled.
+	disabledUsers map[string]struct{}
+
 	// Metrics.
-	runsStarted        prometheus.Counter
-	runsCompleted      prometheus.Counter
-	runsFailed         prometheus.Counter
-	runsLastSuccess    prometheus.Gauge
-	blocksCleanedTotal prometheus.Counter
-	blocksFailedTotal  prometheus.Counter
+	runsStarted     prometheus.Counter
+	runsCompleted   prometheus.Counter
+	runsFailed      prometheus.Counter
+	runsLastSuccess prometheus.Gauge
+	runsDuration    prometheus.Histogram
+
+	// Consecutive failed runs, and the resulting backoff of the next scheduled run.
+	consecutiveFailedRuns *atomic.Int64
+	backoffSeconds        prometheus.Gauge
+
+	nextRunTimestamp prometheus.Gauge
+
+	runsOverlappingSkipped  prometheus.Counter
+	blocksCleanedTotal      prometheus.Counter
+	blocksCleanedBytes      prometheus.Counter
+	deletionMarkAgeAtDelete prometheus.Histogram
+	blocksFailedTotal       prometheus.Counter
+	convergenceFailures     prometheus.Counter
+
+	// Blocks deleted and failed to be deleted, by phase, overall and by the current or last run.
+	blocksCleanedByPhase *prometheus.CounterVec
+	blocksFailedByPhase  *prometheus.CounterVec
+	runSummary           *runSummary
+
+	// Per-tenant blocks deletions. The series of a tenant are removed once fully deleted.
+	tenantBlocksCleaned *prometheus.CounterVec
+	tenantBlocksFailed  *prometheus.CounterVec
+
+	// Per-tenant failures to fetch the blocks metadata, separate from the failures to delete blocks.
+	metaSyncFailures *prometheus.CounterVec
+
+	// Block metas returned by the fetches, and the ones read from the local metas cache. The user
+	// label is empty unless the per-tenant meta files metrics are enabled.
+	metaFilesSynced    *prometheus.CounterVec
+	metaFilesCacheHits *prometheus.CounterVec
+
+	// Duration of the last cleanup of each tenant not marked for deletion, in order to identify the slow ones.
+	tenantCleanupDuration *prometheus.GaugeVec
+
+	// Timestamp of the last cleanup of each tenant completed without error.
+	tenantLastSuccess *prometheus.GaugeVec
+
+	// Partial blocks found by the last cleanup of each tenant, and partial blocks deleted.
+	tenantPartialBlocks  *prometheus.GaugeVec
+	partialBlocksDeleted prometheus.Counter
+
+	// Blocks marked for deletion which haven't reached the deletion delay yet, found by the last
+	// cleanup of each tenant.
+	tenantPendingDeletionBlocks *prometheus.GaugeVec
+	tenantPendingDeletionBytes  *prometheus.GaugeVec
+
+	// Age of the deletion mark of the oldest block which has reached the deletion delay but
+	// hasn't been deleted yet, found by the last cleanup of each tenant.
+	tenantOldestPendingDeletionAge *prometheus.GaugeVec
+
+	// Deletion budget of the current run, shared across all tenants.
+	runBlocksDeleted           *atomic.Int64
+	runBlocksFailed            *atomic.Int64
+	runDeletionBudgetExhausted *atomic.Bool
+	runBlocksDeletedGauge      prometheus.Gauge
+	runsDeletionBudgetHit      prometheus.Counter
+
+	// Blocks and bytes deleted by the current run, and the throughput of the last run.
+	runBlocksCleaned   *atomic.Int64
+	runBytesCleaned    *atomic.Int64
+	runBlocksPerSecond prometheus.Gauge
+	runBytesPerSecond  prometheus.Gauge
+
+	runSuccessRatio          prometheus.Gauge
+	effectiveConcurrency     prometheus.Gauge
+	tenantsActive            prometheus.Gauge
+	tenantsMarkedForDeletion prometheus.Gauge
+	tenantsOwned             prometheus.Gauge
+	tenantsSkipped           prometheus.Counter
+	tenantsSkippedUnchanged  prometheus.Counter
+	tenantsFailed            prometheus.Gauge
+	tenantsFailedTotal       prometheus.Counter
+	tenantsAlreadyGone       prometheus.Counter
+	tenantsSucceededTotal    prometheus.Counter
+	deletionTimeouts         prometheus.Counter
+	tenantTimeouts           prometheus.Counter
+	deletionRetries          prometheus.Counter
+	blocksCleanedDryRun      prometheus.Counter
+	bucketIndexWriteFailures prometheus.Counter
+	blocksExcluded           *prometheus.CounterVec
+	inconsistentScans        *prometheus.CounterVec
+
+	// Whether a tenants scan since the cleaner started has found an active tenant, and the
+	// tenants deletions skipped until then.
+	activeUsersSeen          *atomic.Bool
+	deletionsSkippedNoActive prometheus.Counter
+	maxBlocksMarked          prometheus.Counter
+	tenantRetentionMarked    prometheus.Counter
+	maxBlocksProtected       prometheus.Counter
+
+	// Semaphore limiting the concurrent deletions across all tenants. Nil if unlimited.
+	deletionsGate chan struct{}
+
+	// Limits the rate of block deletions if configured.
+	deletionsLimiter *rate.Limiter
+
+	// Reconciliation.
+	reconciliation *reconciliation
+
+	// Deletion marks exported as metrics. Nil if disabled.
+	deletionMarksExporter *deletionMarksExporter
+
+	// Tenants deletion deferred because not authorized by the tenant deletion token, or because
+	// the max tenants deleted per run has been reached.
+	tenantDeletionsDeferred  prometheus.Counter
+	completedTenantDeletions *completedTenantDeletions
+
+	// Cleanups of tenants marked for deletion, by the reason why the tenant is deleted.
+	tenantDeletions *prometheus.CounterVec
+
+	// Tenants deletion skipped because not approved by the deletion approver.
+	tenantDeletionsDenied prometheus.Counter
+
+	// Tenant deletion marks deleted once all the blocks of the tenant have been deleted.
+	tenantDeletionMarksDeleted prometheus.Counter
+
+	// Runs skipped because of the kill switch.
+	runsDisabledByKillSwitch prometheus.Counter
+
+	// Blocks of tenants marked for deletion marked for deletion because of the tenant deletion delay.
+	tenantBlocksStaged prometheus.Counter
+
+	// Block prefixes containing only markers cleaned up.
+	orphanPrefixesCleaned prometheus.Counter
+	orphanObjectsDeleted  prometheus.Counter
+
+	// Corrupted blocks detection. Nil if disabled.
+	corruptBlocks *corruptBlocks
+
+	// Blocks deletion or marking deferred because recently queried.
+	queryActivityDeferred prometheus.Counter
+
+	// Deletion marks failed to be written.
+	markingFailures prometheus.Counter
+
+	// Current role.
+	role        *atomic.String
+	roleStandby prometheus.Gauge
+
+	// Whether the cleanup is paused.
+	paused      *atomic.Bool
+	pausedGauge prometheus.Gauge
+
+	// Directories looking like blocks, but failing to be parsed as block, found by the current or last run.
+	malformedBlockDirs prometheus.Gauge
+
+	// Classification of tenants across runs.
+	classifier *tenantClassifier
+
+	// Tenants transitioned from active to deleted across runs.
+	transitions                *tenantTransitions
+	tenantTransitionsToDeleted prometheus.Counter
+
+	// Archive of the meta.json of the blocks deleted because their tenant is marked for deletion.
+	blockMetasArchived prometheus.Counter
+
+	// Governance file cutoffs. Nil if disabled.
+	governance *governance
+
+	// Last fetched blocks of each tenant. Nil if disabled.
+	metaCache *metaCache
+
+	// Retention selected by the block label. Nil if disabled.
+	labelRetention *labelRetention
+
+	// Plan, approve and apply cycle of deletions. Nil if disabled.
+	deletionPlan *deletionPlan
+
+	// Guard against listings unexpectedly returning no blocks.
+	fetchGuard             *fetchGuard
+	unchangedTenants       *unchangedTenants
+	emptyTenants           *emptyTenants
+	suspiciousEmptyFetches prometheus.Counter
+
+	// Recoveries from a corrupted local metas cache.
+	metaCacheCorruptionRecovered prometheus.Counter
+
+	// Blocks marked for deletion whose deletion has been excluded by the block delete filter.
+	blocksDeletionFiltered prometheus.Counter
+
+	// Blocks deletions aborted because the deletion mark is gone or has been replaced.
+	deletionsAbortedMarkChanged prometheus.Counter
+
+	// Stats of the tenants being cleaned up, and failures of the tenant cleaned hook.
+	tenantsCleanupStats       *tenantsCleanupStats
+	tenantsStatus             *tenantsStatus
+	tenantCleanedHookTimeout  time.Duration
+	tenantCleanedHookFailures prometheus.Counter
+	tenantEventHookFailures   prometheus.Counter
 }
 
-func NewBlocksCleaner(cfg BlocksCleanerConfig, bucketClient objstore.Bucket, usersScanner *cortex_tsdb.UsersScanner, logger log.Logger, reg prometheus.Registerer) *BlocksCleaner {
+func NewBlocksCleaner(cfg BlocksCleanerConfig, bucketClient objstore.Bucket, usersScanner *cortex_tsdb.UsersScanner, cfgProvider ConfigProvider, logger log.Logger, reg prometheus.Registerer) *BlocksCleaner {
+	// Track the object storage operations done by the cleaner.
+	bucketClient = newCleanupMetricsBucket(bucketClient, reg)
+
+	// Bound the object storage operations run concurrently across all tenants.
+	bucketOpsInflight := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_compactor_cleanup_bucket_operations_inflight",
+		Help: "Number of object storage operations currently run by the blocks cleaner, when the max concurrent bucket operations is configured.",
+	})
+	bucketOpsWaiting := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_compactor_cleanup_bucket_operations_waiting",
+		Help: "Number of object storage operations of the blocks cleaner waiting for the max concurrent bucket operations to allow them.",
+	})
+	if cfg.MaxConcurrentBucketOps > 0 {
+		bucketClient = newConcurrencyLimitBucket(bucketClient, cfg.MaxConcurrentBucketOps, bucketOpsInflight, bucketOpsWaiting)
+	}
+
 	c := &BlocksCleaner{
-		cfg:          cfg,
-		bucketClient: bucketClient,
-		usersScanner: usersScanner,
-		logger:       log.With(logger, "component", "cleaner"),
+		cfg:             cfg,
+		cfgProvider:     cfgProvider,
+		bucketClient:    bucketClient,
+		usersScanner:    usersScanner,
+		logger:          log.With(logger, "component", "cleaner"),
+		runInProgress:   atomic.NewBool(false),
+		nextRun:         atomic.NewInt64(0),
+		scheduleShifted: make(chan struct{}, 1),
 		runsStarted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Name: "cortex_compactor_block_cleanup_started_total",
 			Help: "Total number of blocks cleanup runs started.",
@@ -66,10 +302,38 @@ func NewBlocksCleaner(cfg BlocksCleanerConfig, bucketClient objstore.Bucket, use
 			Name: "cortex_compactor_block_cleanup_failed_total",
 			Help: "Total number of blocks cleanup runs failed.",
 		}),
+		consecutiveFailedRuns: atomic.NewInt64(0),
+		backoffSeconds: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_backoff_seconds",
+			Help: "Time by which the next scheduled blocks cleanup run is delayed, on top of the cleanup interval, because of consecutive failed runs.",
+		}),
 		runsLastSuccess: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 			Name: "cortex_compactor_block_cleanup_last_successful_run_timestamp_seconds",
 			Help: "Unix timestamp of the last successful blocks cleanup run.",
 		}),
+		nextRunTimestamp: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_next_run_timestamp_seconds",
+			Help: "Unix timestamp of the next scheduled blocks cleanup run.",
+		}),
+		runsOverlappingSkipped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_cleanup_overlapping_runs_skipped_total",
+			Help: "Total number of scheduled blocks cleanup runs skipped because another run was already in progress.",
+		}),
+		runsDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_compactor_block_cleanup_duration_seconds",
+			Help:    "Time taken to clean up the blocks of all tenants by a blocks cleanup run.",
+			Buckets: []float64{1, 10, 30, 60, 300, 600, 1800, 3600, 7200},
+		}),
+		deletionMarkAgeAtDelete: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name: "cortex_compactor_block_deletion_mark_age_at_delete_seconds",
+			Help: "Age of the deletion mark of the blocks marked for deletion, when the block is deleted.",
+			// From 1h to 30d.
+			Buckets: []float64{3600, 6 * 3600, 12 * 3600, 24 * 3600, 2 * 86400, 3 * 86400, 7 * 86400, 14 * 86400, 30 * 86400},
+		}),
+		blocksCleanedBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_cleaned_bytes_total",
+			Help: "Total number of bytes reclaimed by the deletion of blocks. Blocks whose size is unknown are not accounted.",
+		}),
 		blocksCleanedTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Name: "cortex_compactor_blocks_cleaned_total",
 			Help: "Total number of blocks deleted.",
@@ -78,9 +342,350 @@ func NewBlocksCleaner(cfg BlocksCleanerConfig, bucketClient objstore.Bucket, use
 			Name: "cortex_compactor_block_cleanup_failures_total",
 			Help: "Total number of blocks failed to be deleted.",
 		}),
+		blocksCleanedByPhase: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_cleaned_by_phase_total",
+			Help: "Total number of blocks deleted, by the cleanup phase (tenant_delete, marked_delete or partial_delete).",
+		}, []string{"phase"}),
+		blocksFailedByPhase: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_cleanup_failures_by_phase_total",
+			Help: "Total number of blocks failed to be deleted, by the cleanup phase (tenant_delete, marked_delete or partial_delete).",
+		}, []string{"phase"}),
+		runSummary: newRunSummary(),
+		tenantBlocksCleaned: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_blocks_cleaned_total",
+			Help: "Total number of blocks deleted, by tenant.",
+		}, []string{"user"}),
+		tenantBlocksFailed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_block_cleanup_failures_total",
+			Help: "Total number of blocks failed to be deleted, by tenant.",
+		}, []string{"user"}),
+		metaSyncFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_cleanup_meta_sync_failures_total",
+			Help: "Total number of times the blocks cleaner failed to fetch the blocks metadata of a tenant, by tenant.",
+		}, []string{"user"}),
+		metaFilesSynced: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_meta_files_synced_total",
+			Help: "Total number of block meta.json files synced by the blocks cleaner, either read from the storage or from the local metas cache. The user label is set only if the per-tenant meta files metrics are enabled.",
+		}, []string{"user"}),
+		metaFilesCacheHits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_meta_files_cache_hits_total",
+			Help: "Total number of block meta.json files synced by the blocks cleaner, which have been read from the local metas cache instead of the storage. The user label is set only if the per-tenant meta files metrics are enabled.",
+		}, []string{"user"}),
+		tenantCleanupDuration: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_tenant_block_cleanup_last_duration_seconds",
+			Help: "Time taken by the last blocks cleanup of the tenant.",
+		}, []string{"user"}),
+		tenantLastSuccess: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_tenant_block_cleanup_last_successful_run_timestamp_seconds",
+			Help: "Unix timestamp of the last successful blocks cleanup of the tenant.",
+		}, []string{"user"}),
+		tenantPartialBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_partial_blocks",
+			Help: "Number of partial blocks found by the last blocks cleanup of the tenant.",
+		}, []string{"user"}),
+		tenantPendingDeletionBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_blocks_marked_for_deletion",
+			Help: "Number of blocks marked for deletion, which haven't reached the deletion delay yet, found by the last blocks cleanup of the tenant.",
+		}, []string{"user"}),
+		tenantPendingDeletionBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_blocks_marked_for_deletion_bytes",
+			Help: "Size in bytes of the blocks marked for deletion, which haven't reached the deletion delay yet, found by the last blocks cleanup of the tenant. Only the files whose size is tracked in the block meta.json are accounted.",
+		}, []string{"user"}),
+		tenantOldestPendingDeletionAge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_oldest_pending_deletion_block_age_seconds",
+			Help: "Age of the deletion mark of the oldest block which has reached the deletion delay but hasn't been deleted yet, found by the last blocks cleanup of the tenant. 0 if there's no such block. A value growing over time means the blocks cleanup is falling behind for the tenant.",
+		}, []string{"user"}),
+		partialBlocksDeleted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_partial_blocks_deleted_total",
+			Help: "Total number of partial blocks deleted.",
+		}),
+		runBlocksDeleted:           atomic.NewInt64(0),
+		runBlocksFailed:            atomic.NewInt64(0),
+		runDeletionBudgetExhausted: atomic.NewBool(false),
+		runBlocksDeletedGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_run_blocks_deleted",
+			Help: "Number of blocks deleted across all tenants by the current or last blocks cleanup run.",
+		}),
+		runBlocksCleaned: atomic.NewInt64(0),
+		runBytesCleaned:  atomic.NewInt64(0),
+		runBlocksPerSecond: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_blocks_per_second",
+			Help: "Number of blocks deleted per second across all tenants by the last completed blocks cleanup run, over the run duration.",
+		}),
+		runBytesPerSecond: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_bytes_per_second",
+			Help: "Size in bytes of the blocks deleted per second across all tenants by the last completed blocks cleanup run, over the run duration.",
+		}),
+		tenantsActive: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_cleanup_tenants_active",
+			Help: "Number of tenants not marked for deletion discovered in the bucket by the current or last blocks cleanup run.",
+		}),
+		tenantsMarkedForDeletion: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_cleanup_tenants_marked_for_deletion",
+			Help: "Number of tenants marked for deletion discovered in the bucket by the current or last blocks cleanup run.",
+		}),
+		tenantsOwned: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_cleanup_tenants_owned",
+			Help: "Number of tenants, either active or marked for deletion, owned by this blocks cleaner shard and allowed by the config, in the current or last blocks cleanup run.",
+		}),
+		tenantsSkipped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenants_skipped_total",
+			Help: "Total number of tenants skipped by the blocks cleanup runs because not enabled or disabled in the config.",
+		}),
+		tenantsSkippedUnchanged: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenants_skipped_unchanged_total",
+			Help: "Total number of tenants skipped by the blocks cleanup runs because their bucket is unchanged since the previous run, which found nothing to clean up.",
+		}),
+		tenantsFailed: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_cleanup_tenants_failed",
+			Help: "Number of tenants whose cleanup failed in the last blocks cleanup run.",
+		}),
+		tenantsFailedTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenants_failed_total",
+			Help: "Total number of tenants whose cleanup, or deletion, failed or timed out in the blocks cleanup runs.",
+		}),
+		tenantsAlreadyGone: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenant_already_gone_total",
+			Help: "Total number of tenants whose cleanup, or deletion, has been skipped because the tenant location has been removed in the meanwhile, which is not accounted as a failure.",
+		}),
+		tenantsSucceededTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenants_succeeded_total",
+			Help: "Total number of tenants whose cleanup, or deletion, succeeded in the blocks cleanup runs.",
+		}),
+		effectiveConcurrency: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_cleanup_effective_concurrency",
+			Help: "Number of tenants cleaned up concurrently by the current or last blocks cleanup run, which is the configured concurrency capped to the number of tenants.",
+		}),
+		deletionTimeouts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_deletion_timeouts_total",
+			Help: "Total number of blocks whose deletion failed because it took longer than the per deletion timeout.",
+		}),
+		tenantTimeouts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_tenant_timeouts_total",
+			Help: "Total number of tenants skipped by the blocks cleanup because their cleanup took longer than the per-tenant timeout.",
+		}),
+		deletionRetries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_deletion_retries_total",
+			Help: "Total number of retries of failed blocks deletions.",
+		}),
+		bucketIndexWriteFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_bucket_index_write_failures_total",
+			Help: "Total number of tenants bucket index failed to be written by the blocks cleaner.",
+		}),
+		blocksCleanedDryRun: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_cleaned_dryrun_total",
+			Help: "Total number of blocks which would have been deleted, if the blocks cleaner was not running in dry-run mode.",
+		}),
+		blocksExcluded: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_excluded_total",
+			Help: "Total number of blocks excluded from the loaded blocks while fetching the tenants blocks during the blocks cleanup, by reason.",
+		}, []string{"reason"}),
+		inconsistentScans: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_inconsistent_users_scans_total",
+			Help: "Total number of tenants discoveries finding no active tenant but some tenants marked for deletion, by the policy applied.",
+		}, []string{"policy"}),
+		activeUsersSeen: atomic.NewBool(false),
+		deletionsSkippedNoActive: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_deletions_skipped_no_active_tenants_total",
+			Help: "Total number of tenants marked for deletion whose deletion has been skipped because no active tenant has been found since the compactor started.",
+		}),
+		maxBlocksMarked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_max_blocks_per_tenant_blocks_marked_for_deletion_total",
+			Help: "Total number of blocks marked for deletion because exceeding the max number of blocks per tenant.",
+		}),
+		tenantRetentionMarked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_retention_blocks_marked_for_deletion_total",
+			Help: "Total number of blocks marked for deletion because exceeding the tenant retention period.",
+		}),
+		maxBlocksProtected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_max_blocks_per_tenant_blocks_protected_total",
+			Help: "Total number of blocks exceeding the max number of blocks per tenant but not marked for deletion because containing data more recent than the min retention.",
+		}),
+		runsDeletionBudgetHit: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_cleanup_max_blocks_deleted_reached_total",
+			Help: "Total number of blocks cleanup runs which reached the max number of blocks deleted per run.",
+		}),
+		runSuccessRatio: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_success_ratio",
+			Help: "Ratio of blocks successfully deleted to blocks attempted to be deleted by the last blocks cleanup run.",
+		}),
+		convergenceFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_convergence_failures_total",
+			Help: "Total number of tenants whose bucket state didn't match the expected one after having been cleaned up.",
+		}),
+		reconciliation: newReconciliation(reg),
+		tenantBlocksStaged: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_blocks_staged_for_deletion_total",
+			Help: "Total number of blocks of tenants marked for deletion which have been marked for deletion, and will be deleted once the tenant deletion delay has elapsed.",
+		}),
+		runsDisabledByKillSwitch: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_cleanup_disabled_by_flag_total",
+			Help: "Total number of blocks cleanup runs skipped because the kill switch object exists in the bucket.",
+		}),
+		tenantDeletions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_deletions_total",
+			Help: "Total number of cleanups of tenants to delete, by the reason why the tenant is deleted.",
+		}, []string{"reason"}),
+		tenantDeletionsDeferred: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_deletions_deferred_total",
+			Help: "Total number of times the deletion of a tenant marked for deletion has been deferred because not authorized by a valid tenant deletion token, or because the max tenants deleted per run has been reached.",
+		}),
+		completedTenantDeletions: newCompletedTenantDeletions(),
+		tenantDeletionsDenied: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_deletions_denied_total",
+			Help: "Total number of times the deletion of a tenant marked for deletion has been skipped because not approved by the deletion approver.",
+		}),
+		tenantDeletionMarksDeleted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_deletion_marks_deleted_total",
+			Help: "Total number of tenant deletion marks deleted, once all the blocks of the tenant have been deleted and the tenant deletion mark delay has elapsed.",
+		}),
+		orphanPrefixesCleaned: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_orphan_block_prefixes_cleaned_total",
+			Help: "Total number of block prefixes containing only markers, and no block data, cleaned up.",
+		}),
+		orphanObjectsDeleted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_orphan_objects_deleted_total",
+			Help: "Total number of objects stored in a tenant location, outside of any block, deleted because older than the configured min age.",
+		}),
+		queryActivityDeferred: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_deferred_query_activity_total",
+			Help: "Total number of times the deletion or marking for deletion of a block has been deferred because the block has been recently queried.",
+		}),
+		markingFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_marking_failures_total",
+			Help: "Total number of blocks failed to be marked for deletion by the blocks cleaner, after retries.",
+		}),
+		role: atomic.NewString(BlocksCleanerRoleActive),
+		roleStandby: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_standby",
+			Help: "Whether the blocks cleaner is standby (1) or active (0).",
+		}),
+		paused: atomic.NewBool(false),
+		pausedGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_block_cleanup_paused",
+			Help: "Whether the blocks cleanup is paused (1) or not (0).",
+		}),
+		malformedBlockDirs: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_malformed_block_dirs",
+			Help: "Number of directories looking like blocks, but failing to be parsed as block, found across all tenants by the current or last blocks cleanup run. Tracked only if enabled.",
+		}),
+		classifier:  newTenantClassifier(cfg.DeletionClassificationStabilization, reg),
+		transitions: newTenantTransitions(),
+		tenantTransitionsToDeleted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_transition_to_deleted_total",
+			Help: "Total number of tenants processed as deleted by a blocks cleanup run, which were processed as active by the previous run.",
+		}),
+		fetchGuard: newFetchGuard(cfg.SuspiciousEmptyFetchMinBlocks),
+		suspiciousEmptyFetches: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_suspicious_empty_fetch_total",
+			Help: "Total number of times no block has been found for a tenant which had blocks in the previous cleanup run, and the tenant cleanup has been skipped.",
+		}),
+		metaCacheCorruptionRecovered: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_meta_cache_corruption_recovered_total",
+			Help: "Total number of times the blocks fetch of a tenant failed because of the local metas cache, which has been wiped before retrying the fetch.",
+		}),
+		emptyTenants: newEmptyTenants(promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_empty_tenants",
+			Help: "Number of tenants not marked for deletion for which no block has been found by their last cleanup.",
+		})),
+		blocksDeletionFiltered: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_deletion_filtered_total",
+			Help: "Total number of times the deletion of a block marked for deletion has been skipped because excluded by the block delete filter.",
+		}),
+		deletionsAbortedMarkChanged: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_deletions_aborted_mark_changed_total",
+			Help: "Total number of blocks deletions aborted because the block deletion mark was gone or had been replaced when verified right before the deletion.",
+		}),
+		tenantsCleanupStats:      newTenantsCleanupStats(),
+		tenantsStatus:            newTenantsStatus(),
+		tenantCleanedHookTimeout: tenantCleanedHookTimeout,
+		tenantCleanedHookFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_cleaned_hook_failures_total",
+			Help: "Total number of times the tenant cleaned hook panicked or didn't return in time.",
+		}),
+		tenantEventHookFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_event_hook_failures_total",
+			Help: "Total number of times the tenant event hook panicked or didn't return in time.",
+		}),
+		blockMetasArchived: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_block_metas_archived_total",
+			Help: "Total number of meta.json of blocks of tenants marked for deletion archived before deleting the blocks.",
+		}),
+	}
+
+	// Initialize the phase series, so that they're exported before any deletion.
+	for _, phase := range cleanupPhases {
+		c.blocksCleanedByPhase.WithLabelValues(phase)
+		c.blocksFailedByPhase.WithLabelValues(phase)
+	}
+
+	if cfg.Role != "" {
+		if err := c.SetRole(cfg.Role); err != nil {
+			level.Warn(c.logger).Log("msg", "invalid blocks cleaner role, falling back to active", "err", err)
+		}
+	}
+
+	if c.cfg.DeletionAuditor == nil {
+		c.cfg.DeletionAuditor = noopDeletionAuditor{}
+	}
+
+	if c.cfg.DeletionApprover == nil {
+		c.cfg.DeletionApprover = alwaysApproveDeletionApprover{}
+	}
+
+	if cfg.MaxConcurrentDeletes > 0 {
+		c.deletionsGate = make(chan struct{}, cfg.MaxConcurrentDeletes)
+	}
+
+	if cfg.DeleteRateLimit > 0 {
+		c.deletionsLimiter = rate.NewLimiter(rate.Limit(cfg.DeleteRateLimit), 1)
 	}
 
-	c.Service = services.NewTimerService(cfg.CleanupInterval, c.starting, c.ticker, nil)
+	if cfg.CorruptBlocksCheckEnabled {
+		c.corruptBlocks = newCorruptBlocks(reg)
+	}
+
+	if cfg.GovernanceFile != "" {
+		c.governance = newGovernance(cfg, bucketClient, c.logger, reg)
+	}
+
+	if cfg.SkipUnchangedTenants {
+		c.unchangedTenants = newUnchangedTenants()
+	}
+
+	if cfg.MetaCacheSize > 0 {
+		c.metaCache = newMetaCache(cfg.MetaCacheSize, cfg.MetaCacheTTL, reg)
+	}
+
+	if len(cfg.EnabledTenants) > 0 {
+		c.enabledUsers = map[string]struct{}{}
+		for _, u := range cfg.EnabledTenants {
+			c.enabledUsers[u] = struct{}{}
+		}
+	}
+
+	if len(cfg.DisabledTenants) > 0 {
+		c.disabledUsers = map[string]struct{}{}
+		for _, u := range cfg.DisabledTenants {
+			c.disabledUsers[u] = struct{}{}
+		}
+	}
+
+	if cfg.RetentionLabel != "" {
+		c.labelRetention = newLabelRetention(cfg, c.logger, reg)
+	}
+
+	if cfg.DeletionPlanPath != "" {
+		c.deletionPlan = newDeletionPlan(cfg, bucketClient, c.logger, reg)
+	}
+
+	if cfg.ExportDeletionMarks || cfg.ExportDeletionMarksDetails {
+		c.deletionMarksExporter = newDeletionMarksExporter(cfg.ExportDeletionMarksDetails, reg)
+	}
+
+	c.triggeredRunsCtx, c.cancelTriggeredRuns = context.WithCancel(context.Background())
+	c.tenantsInFlightCtx, c.cancelTenantsInFlight = context.WithCancel(context.Background())
+	c.Service = services.NewBasicService(c.starting, c.running, c.stopping)
 
 	return c
 }
@@ -88,38 +693,109 @@ func NewBlocksCleaner(cfg BlocksCleanerConfig, bucketClient objstore.Bucket, use
 func (c *BlocksCleaner) starting(ctx context.Context) error {
 	// Run a cleanup so that any other service depending on this service
 	// is guaranteed to start once the initial cleanup has been done.
-	c.runCleanup(ctx)
+	if err := c.awaitRun(ctx, c.runCleanup); err != nil && c.cfg.FailStartOnInitialCleanupError {
+		return errors.Wrap(err, "initial blocks cleanup failed")
+	}
 
 	return nil
 }
 
 func (c *BlocksCleaner) ticker(ctx context.Context) error {
-	c.runCleanup(ctx)
+	if c.paused.Load() {
+		level.Debug(c.logger).Log("msg", "skipped the scheduled blocks cleanup run because the blocks cleanup is paused")
+		return nil
+	}
+
+	// Errors are already logged and tracked by metrics. We don't want to stop
+	// the service because of a failed run, so we just move on.
+	if ran, _ := c.runCleanupExclusive(ctx); !ran {
+		c.runsOverlappingSkipped.Inc()
+		level.Warn(c.logger).Log("msg", "skipped the scheduled blocks cleanup run because another run is already in progress")
+	}
 
 	return nil
 }
 
-func (c *BlocksCleaner) runCleanup(ctx context.Context) {
+func (c *BlocksCleaner) runCleanup(ctx context.Context) error {
+	if disabled, err := c.disabledByKillSwitch(ctx); err != nil || disabled {
+		return err
+	}
+
 	level.Info(c.logger).Log("msg", "started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion")
 	c.runsStarted.Inc()
+	c.runBlocksDeleted.Store(0)
+	c.runBlocksFailed.Store(0)
+	c.runDeletionBudgetExhausted.Store(false)
+	c.runBlocksDeletedGauge.Set(0)
+	c.runBlocksCleaned.Store(0)
+	c.runBytesCleaned.Store(0)
+	c.malformedBlockDirs.Set(0)
+	c.runSummary.reset()
+
+	// The plan cycle doesn't run when the cleaner is read-only for other reasons.
+	if c.deletionPlan != nil {
+		c.deletionPlan.begin(ctx, !c.readOnly())
+	}
+
+	readOnly := c.readOnly()
+	if readOnly {
+		c.reconciliation.start()
+	}
+
+	if c.deletionMarksExporter != nil {
+		c.deletionMarksExporter.start()
+	}
+
+	if c.governance != nil {
+		c.governance.load(ctx)
+	}
+
+	start := time.Now()
+	err := c.cleanUsers(ctx)
+	duration := time.Since(start)
+	c.runsDuration.Observe(duration.Seconds())
+	c.updateRunThroughput(duration)
+	c.runSuccessRatio.Set(c.runDeletionsSuccessRatio())
+	if !c.runSummary.empty() {
+		level.Info(c.logger).Log(append([]interface{}{"msg", "blocks cleanup run summary"}, c.runSummary.keyvals()...)...)
+	}
+
+	if readOnly {
+		c.reconciliation.complete(c.logger)
+	}
+
+	if c.deletionPlan != nil {
+		c.deletionPlan.end(ctx, err, c.reconciliation.lastReport())
+	}
+
+	if c.governance != nil && !readOnly {
+		if recordErr := c.governance.record(ctx); recordErr != nil {
+			level.Warn(c.logger).Log("msg", "failed to record the applied blocks cleanup governance rows", "err", recordErr)
+		}
+	}
 
-	if err := c.cleanUsers(ctx); err == nil {
+	if err == nil {
 		level.Info(c.logger).Log("msg", "successfully completed hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion")
+		if c.deletionMarksExporter != nil {
+			c.deletionMarksExporter.publish()
+		}
 		c.runsCompleted.Inc()
 		c.runsLastSuccess.SetToCurrentTime()
 	} else if errors.Is(err, context.Canceled) {
 		level.Info(c.logger).Log("msg", "canceled hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion", "err", err)
-		return
 	} else {
 		level.Error(c.logger).Log("msg", "failed to hard delete blocks marked for deletion, and blocks for tenants marked for deletion", "err", err.Error())
 		c.runsFailed.Inc()
 	}
+
+	c.trackRunResult(err)
+	return err
 }
 
 func (c *BlocksCleaner) cleanUsers(ctx context.Context) error {
-	users, deleted, err := c.usersScanner.ScanUsers(ctx)
-	if err != nil {
-		return errors.Wrap(err, "failed to discover users from bucket")
+	users, deleted, proceed, err := c.selectUsers(ctx)
+	if !proceed {
+		return err
 	}
 
 	isDeleted := map[string]bool{}
@@ -128,136 +804,78 @@ func (c *BlocksCleaner) cleanUsers(ctx context.Context) error {
 	}
 
 	allUsers := append(users, deleted...)
-	return concurrency.ForEachUser(ctx, allUsers, c.cfg.CleanupConcurrency, func(ctx context.Context, userID string) error {
-		if isDeleted[userID] {
-			return errors.Wrapf(c.deleteUser(ctx, userID), "failed to delete blocks for user marked for deletion: %s", userID)
-		}
-		return errors.Wrapf(c.cleanUser(ctx, userID), "failed to delete blocks for user: %s", userID)
-	})
-}
-
-// Remove all blocks for user marked for deletion.
-func (c *BlocksCleaner) deleteUser(ctx context.Context, userID string) error {
-	userLogger := util.WithUserID(userID, c.logger)
-	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
-
-	level.Info(userLogger).Log("msg", "deleting blocks for user marked for deletion")
+	c.orderUsers(allUsers)
 
-	var deleted, failed int
-	err := userBucket.Iter(ctx, "", func(name string) error {
-		if err := ctx.Err(); err != nil {
-			return err
-		}
+	// Workers in excess of the number of tenants would be idle.
+	effectiveConcurrency := c.capBucketOpsConcurrency(c.cfg.CleanupConcurrency)
+	if len(allUsers) < effectiveConcurrency {
+		effectiveConcurrency = len(allUsers)
+	}
+	c.effectiveConcurrency.Set(float64(effectiveConcurrency))
+	level.Debug(c.logger).Log("msg", "cleaning up tenants", "tenants", len(allUsers), "configured_concurrency", c.cfg.CleanupConcurrency, "effective_concurrency", effectiveConcurrency)
 
-		id, ok := block.IsBlockDir(name)
-		if !ok {
-			return nil
-		}
+	// A failed tenant doesn't stop the cleanup of the other ones: all errors are returned once done.
+	failed := atomic.NewInt64(0)
 
-		err := block.Delete(ctx, userLogger, userBucket, id)
-		if err != nil {
-			failed++
-			c.blocksFailedTotal.Inc()
-			level.Warn(userLogger).Log("msg", "failed to delete block", "block", id, "err", err)
-			return nil // Continue with other blocks.
-		}
+	// No tenant is started once the run is canceled, but the in-flight ones are allowed to
+	// finish within the shutdown grace period.
+	tenantsCtx := c.tenantsContext(ctx)
 
-		deleted++
-		c.blocksCleanedTotal.Inc()
-		level.Info(userLogger).Log("msg", "deleted block", "block", id)
-		return nil
+	err = concurrency.ForEachUser(ctx, allUsers, effectiveConcurrency, func(_ context.Context, userID string) error {
+		return c.cleanUpUser(tenantsCtx, userID, isDeleted[userID], failed)
 	})
 
-	if err != nil {
-		return err
-	}
-
-	if failed > 0 {
-		return errors.Errorf("failed to delete %d blocks", failed)
-	}
-
-	level.Info(userLogger).Log("msg", "finished deleting blocks for user marked for deletion", "deletedBlocks", deleted)
-	return nil
+	c.tenantsFailed.Set(float64(failed.Load()))
+	return err
 }
 
-func (c *BlocksCleaner) cleanUser(ctx context.Context, userID string) error {
-	userLogger := util.WithUserID(userID, c.logger)
-	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
-
-	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(userLogger, userBucket, c.cfg.DeletionDelay, c.cfg.MetaSyncConcurrency)
-
-	fetcher, err := block.NewMetaFetcher(
-		userLogger,
-		c.cfg.MetaSyncConcurrency,
-		userBucket,
-		// The fetcher stores cached metas in the "meta-syncer/" sub directory,
-		// but we prefix it in order to guarantee no clashing with the compactor.
-		path.Join(c.cfg.DataDir, "blocks-cleaner-meta-"+userID),
-		// No metrics.
-		nil,
-		[]block.MetadataFilter{ignoreDeletionMarkFilter},
-		nil,
-	)
-	if err != nil {
-		return errors.Wrap(err, "error creating metadata fetcher")
+// cleanUpUser deletes the blocks of a tenant marked for deletion, or cleans up the blocks of an active
+// tenant, and tracks the outcome. The failures are counted in the input counter, except the timeouts
+// which skip the tenant without failing the run.
+func (c *BlocksCleaner) cleanUpUser(ctx context.Context, userID string, deleted bool, failed *atomic.Int64) error {
+	if c.paused.Load() {
+		level.Debug(c.logger).Log("msg", "skipping blocks cleanup for user because the blocks cleanup is paused", "user", userID)
+		return nil
 	}
 
-	// Runs a bucket scan to get a fresh list of all blocks and populate
-	// the list of deleted blocks in filter.
-	_, partials, err := fetcher.Fetch(ctx)
-	if err != nil {
-		return errors.Wrap(err, "error fetching metadata")
+	if !c.cfgProvider.CompactorBlocksCleanupEnabled(userID) {
+		level.Debug(c.logger).Log("msg", "skipping blocks cleanup for user because disabled in the per-tenant config", "user", userID)
+		return nil
 	}
 
-	cleaner := compact.NewBlocksCleaner(
-		userLogger,
-		userBucket,
-		ignoreDeletionMarkFilter,
-		c.cfg.DeletionDelay,
-		c.blocksCleanedTotal,
-		c.blocksFailedTotal)
-
-	if err := cleaner.DeleteMarkedBlocks(ctx); err != nil {
-		return errors.Wrap(err, "error cleaning blocks")
+	var err error
+	if deleted {
+		err = c.withTenantTimeout(ctx, userID, func(ctx context.Context) error {
+			return errors.Wrapf(c.deleteUser(ctx, userID, tenantDeletionReasonMark, nil), "failed to delete blocks for user marked for deletion: %s", userID)
+		})
+	} else {
+		start := time.Now()
+		err = c.withTenantTimeout(ctx, userID, func(ctx context.Context) error {
+			return errors.Wrapf(c.cleanUser(ctx, userID, nil), "failed to delete blocks for user: %s", userID)
+		})
+		c.tenantCleanupDuration.WithLabelValues(userID).Set(time.Since(start).Seconds())
 	}
 
-	// Partial blocks with a deletion mark can be cleaned up. This is a best effort, so we don't return
-	// error if the cleanup of partial blocks fail.
-	if len(partials) > 0 {
-		level.Info(userLogger).Log("msg", "started cleaning of partial blocks marked for deletion")
-		c.cleanUserPartialBlocks(ctx, partials, userBucket, userLogger)
-		level.Info(userLogger).Log("msg", "cleaning of partial blocks marked for deletion done")
+	switch {
+	case err == nil:
+		c.tenantsSucceededTotal.Inc()
+	case errors.Is(err, errTenantTimedOut):
+		// The tenant has been skipped, without failing the run.
+		c.tenantsFailedTotal.Inc()
+		return nil
+	case !errors.Is(err, context.Canceled):
+		failed.Inc()
+		c.tenantsFailedTotal.Inc()
+		level.Warn(c.logger).Log("msg", "failed to clean up blocks for user", "user", userID, "err", err)
 	}
-
-	return nil
+	return err
 }
 
-func (c *BlocksCleaner) cleanUserPartialBlocks(ctx context.Context, partials map[ulid.ULID]error, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
-	for blockID, blockErr := range partials {
-		// We can safely delete only blocks which are partial because the meta.json is missing.
-		if blockErr != block.ErrorSyncMetaNotFound {
-			continue
-		}
-
-		// We can safely delete only partial blocks with a deletion mark.
-		err := metadata.ReadMarker(ctx, userLogger, userBucket, blockID.String(), &metadata.DeletionMark{})
-		if err == metadata.ErrorMarkerNotFound {
-			continue
-		}
-		if err != nil {
-			level.Warn(userLogger).Log("msg", "error reading partial block deletion mark", "block", blockID, "err", err)
-			continue
-		}
-
-		// Hard-delete partial blocks having a deletion mark, even if the deletion threshold has not
-		// been reached yet.
-		if err := block.Delete(ctx, userLogger, userBucket, blockID); err != nil {
-			c.blocksFailedTotal.Inc()
-			level.Warn(userLogger).Log("msg", "error deleting partial block marked for deletion", "block", blockID, "err", err)
-			continue
-		}
-
-		c.blocksCleanedTotal.Inc()
-		level.Info(userLogger).Log("msg", "deleted partial block marked for deletion", "block", blockID)
+// now returns the current time according to the configured clock, used by the age and delay
+// comparisons of the cleaner.
+func (c *BlocksCleaner) now() time.Time {
+	if c.cfg.Now != nil {
+		return c.cfg.Now()
 	}
+	return time.Now()
 }
@@ -0,0 +1,44 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// errTenantLocationNotEmpty is used to stop listing the tenant location once an object is found.
+var errTenantLocationNotEmpty = errors.New("the tenant location is not empty")
+
+// tenantAlreadyGone returns whether the input error, returned by the cleanup or the deletion of the
+// tenant, is caused by the tenant location having been removed in the meanwhile (eg. by another tool).
+// The tenant is considered gone only if the error is an object not found error, and no object is left
+// in the tenant location, so that a single object removed in the meanwhile is still a failure.
+func (c *BlocksCleaner) tenantAlreadyGone(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger, err error) bool {
+	if err == nil || !isObjNotFoundErr(userBucket, err) {
+		return false
+	}
+
+	listErr := userBucket.Iter(ctx, "", func(string) error {
+		return errTenantLocationNotEmpty
+	})
+	if listErr != nil {
+		return false
+	}
+
+	c.tenantsAlreadyGone.Inc()
+	level.Info(userLogger).Log("msg", "skipped blocks cleanup for user because its location has been removed in the meanwhile", "err", err)
+	return true
+}
+
+// isObjNotFoundErr returns whether the input error, or any error it wraps, is an object not found error.
+func isObjNotFoundErr(bkt objstore.BucketReader, err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if bkt.IsObjNotFoundErr(err) {
+			return true
+		}
+	}
+	return false
+}
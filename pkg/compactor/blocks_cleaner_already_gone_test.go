@@ -0,0 +1,101 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldNotFailTenantsWhoseLocationIsAlreadyGone(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-3"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The locations of user-1 and user-3 are removed while being cleaned up, while user-2 fails
+	// with a not found error even if its location still exists.
+	bkt := &vanishingTenantBucket{
+		Bucket:     bucketClient,
+		storageDir: storageDir,
+		vanishing:  map[string]*atomic.Bool{"user-1": atomic.NewBool(true), "user-2": atomic.NewBool(false), "user-3": atomic.NewBool(true)},
+	}
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, newMockConfigProvider(), logger, nil)
+	require.Error(t, cleaner.runCleanup(ctx))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantsAlreadyGone))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailed))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailedTotal))
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.tenantsSucceededTotal))
+}
+
+// vanishingTenantBucket is a bucket whose first listing in the location of the configured tenants
+// fails with a not found error, optionally removing the tenant location.
+type vanishingTenantBucket struct {
+	objstore.Bucket
+	storageDir string
+	vanishing  map[string]*atomic.Bool
+	failed     sync.Map
+}
+
+func (b *vanishingTenantBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	userID := strings.SplitN(dir, "/", 2)[0]
+	remove, ok := b.vanishing[userID]
+	if !ok {
+		return b.Bucket.Iter(ctx, dir, f)
+	}
+	if _, alreadyFailed := b.failed.LoadOrStore(userID, true); alreadyFailed {
+		return b.Bucket.Iter(ctx, dir, f)
+	}
+
+	if remove.Load() {
+		if err := os.RemoveAll(filepath.Join(b.storageDir, userID)); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(os.ErrNotExist, "mocked iter failure of %s", dir)
+}
@@ -0,0 +1,109 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/runutil"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+const (
+	// BlockPolicyAnnotationFilename is the name of the object, stored in the block
+	// location, annotating a block retained by the blocks cleaner.
+	BlockPolicyAnnotationFilename = "cleanup-policy.json"
+
+	// Policies which can retain a block.
+	policyDeletionDelay = "deletion-delay"
+)
+
+// BlockPolicyAnnotation describes why a block has been retained by the blocks cleaner
+// and when it will become eligible for deletion.
+type BlockPolicyAnnotation struct {
+	// EvaluatedBy is the policy which retained the block.
+	EvaluatedBy string `json:"evaluated_by"`
+
+	// NextEligible is the unix timestamp (seconds precision) since when the block
+	// will be eligible for deletion.
+	NextEligible int64 `json:"next_eligible"`
+}
+
+func (a BlockPolicyAnnotation) GetNextEligible() time.Time {
+	return time.Unix(a.NextEligible, 0)
+}
+
+// annotateRetainedBlocks writes a policy annotation to each block marked for deletion which
+// hasn't reached the deletion delay yet.
+func (c *BlocksCleaner) annotateRetainedBlocks(ctx context.Context, userID string, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	deletionDelay := c.deletionDelay(userID)
+
+	for id, mark := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		eligibleAt := time.Unix(mark.DeletionTime, 0).Add(deletionDelay)
+		if !eligibleAt.After(c.now()) {
+			continue
+		}
+
+		annotation := BlockPolicyAnnotation{
+			EvaluatedBy:  policyDeletionDelay,
+			NextEligible: eligibleAt.Unix(),
+		}
+
+		if err := writeBlockPolicyAnnotation(ctx, userBucket, userLogger, id, annotation); err != nil {
+			level.Warn(userLogger).Log("msg", "failed to write retained block policy annotation", "block", id, "err", err)
+		}
+	}
+}
+
+// writeBlockPolicyAnnotation uploads the annotation for the input block, unless the
+// same annotation is already stored.
+func writeBlockPolicyAnnotation(ctx context.Context, userBucket *bucket.UserBucketClient, userLogger log.Logger, id ulid.ULID, annotation BlockPolicyAnnotation) error {
+	annotationPath := path.Join(id.String(), BlockPolicyAnnotationFilename)
+
+	existing, err := readBlockPolicyAnnotation(ctx, userBucket, userLogger, annotationPath)
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to read retained block policy annotation, overwriting it", "block", id, "err", err)
+	} else if existing != nil && *existing == annotation {
+		return nil
+	}
+
+	data, err := json.Marshal(annotation)
+	if err != nil {
+		return errors.Wrap(err, "serialize block policy annotation")
+	}
+
+	return errors.Wrap(userBucket.Upload(ctx, annotationPath, bytes.NewReader(data)), "upload block policy annotation")
+}
+
+// readBlockPolicyAnnotation returns the annotation stored at the input path, or nil if it doesn't exist.
+func readBlockPolicyAnnotation(ctx context.Context, userBucket *bucket.UserBucketClient, userLogger log.Logger, annotationPath string) (*BlockPolicyAnnotation, error) {
+	r, err := userBucket.Get(ctx, annotationPath)
+	if userBucket.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(userLogger, r, "close block policy annotation reader")
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	annotation := &BlockPolicyAnnotation{}
+	if err := json.Unmarshal(data, annotation); err != nil {
+		return nil, err
+	}
+
+	return annotation, nil
+}
@@ -0,0 +1,42 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// DeletionApprover approves the hard deletion of tenants, eg. by consulting an external compliance system.
+type DeletionApprover interface {
+	// ApproveTenantDeletion returns whether the blocks of the tenant can be deleted. It's consulted
+	// each time the deletion of the tenant is about to start, so a denied tenant is retried by the next runs.
+	ApproveTenantDeletion(ctx context.Context, userID string) (bool, error)
+}
+
+type alwaysApproveDeletionApprover struct{}
+
+func (alwaysApproveDeletionApprover) ApproveTenantDeletion(context.Context, string) (bool, error) {
+	return true, nil
+}
+
+// approveTenantDeletion returns whether the deletion of the tenant has been approved by the deletion approver.
+// The deletion of tenants doesn't delete anything when read-only, so it doesn't need to be approved.
+func (c *BlocksCleaner) approveTenantDeletion(ctx context.Context, userID string) (bool, error) {
+	if c.readOnly() {
+		return true, nil
+	}
+
+	approved, err := c.cfg.DeletionApprover.ApproveTenantDeletion(ctx, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get the approval of the deletion of user")
+	}
+
+	if !approved {
+		c.tenantDeletionsDenied.Inc()
+		level.Info(util.WithUserID(userID, c.logger)).Log("msg", "skipped the deletion of user marked for deletion because not approved by the deletion approver")
+	}
+	return approved, nil
+}
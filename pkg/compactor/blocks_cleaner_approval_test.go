@@ -0,0 +1,104 @@
+package compactor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldDeleteTenantsOnlyIfApproved(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+
+	// user-1, user-2 and user-3 are marked for deletion, while user-4 is active.
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+	for _, userID := range []string{"user-1", "user-2", "user-3"} {
+		require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, userID))
+	}
+
+	approver := &mockDeletionApprover{
+		approved: map[string]bool{"user-1": true, "user-2": false},
+		err:      errors.New("mocked approval failure"),
+	}
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeletionApprover:    approver,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.Error(t, cleaner.runCleanup(ctx))
+
+	// Only the blocks of the approved tenant have been deleted.
+	for _, tc := range []struct {
+		userID   string
+		blockID  ulid.ULID
+		expected bool
+	}{
+		{userID: "user-1", blockID: block1, expected: false},
+		{userID: "user-2", blockID: block2, expected: true},
+		{userID: "user-3", blockID: block3, expected: true},
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join(tc.userID, tc.blockID.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, exists, tc.userID)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletionsDenied))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletions.WithLabelValues(tenantDeletionReasonMark)))
+	assert.ElementsMatch(t, []string{"user-1", "user-2", "user-3"}, approver.consulted)
+}
+
+// mockDeletionApprover approves the deletion of the tenants as configured, failing for the other ones.
+type mockDeletionApprover struct {
+	approved  map[string]bool
+	err       error
+	consulted []string
+}
+
+func (m *mockDeletionApprover) ApproveTenantDeletion(_ context.Context, userID string) (bool, error) {
+	m.consulted = append(m.consulted, userID)
+
+	approved, ok := m.approved[userID]
+	if !ok {
+		return false, m.err
+	}
+	return approved, nil
+}
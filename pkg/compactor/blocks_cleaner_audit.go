@@ -0,0 +1,56 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// DeletionAuditor records the blocks permanently deleted by the blocks cleaner.
+type DeletionAuditor interface {
+	// RecordBlockDeleted records the block of the tenant has been deleted at the given time. The reason
+	// is the deletion of the tenant, the block deletion mark or the cleanup of a partial block.
+	RecordBlockDeleted(userID string, id ulid.ULID, reason string, t time.Time)
+}
+
+type noopDeletionAuditor struct{}
+
+func (noopDeletionAuditor) RecordBlockDeleted(string, ulid.ULID, string, time.Time) {}
+
+// DeletionAuditEntry is the record of a block deletion written by the bucket deletion auditor.
+type DeletionAuditEntry struct {
+	UserID    string    `json:"user_id"`
+	BlockID   ulid.ULID `json:"block_id"`
+	Reason    string    `json:"reason"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type bucketDeletionAuditor struct {
+	bkt    objstore.Bucket
+	dir    string
+	logger log.Logger
+}
+
+// NewBucketDeletionAuditor returns an auditor writing each block deletion as a JSON DeletionAuditEntry
+// to the bucket, at <dir>/<user>/<block>.json. Failed writes are logged.
+func NewBucketDeletionAuditor(bkt objstore.Bucket, dir string, logger log.Logger) DeletionAuditor {
+	return &bucketDeletionAuditor{bkt: bkt, dir: dir, logger: logger}
+}
+
+func (a *bucketDeletionAuditor) RecordBlockDeleted(userID string, id ulid.ULID, reason string, t time.Time) {
+	data, err := json.Marshal(DeletionAuditEntry{UserID: userID, BlockID: id, Reason: reason, DeletedAt: t})
+	if err == nil {
+		err = a.bkt.Upload(context.Background(), path.Join(a.dir, userID, id.String()+".json"), bytes.NewReader(data))
+	}
+
+	if err != nil {
+		level.Error(a.logger).Log("msg", "failed to record the block deletion audit entry", "user", userID, "block", id, "reason", reason, "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldRecordDeletionsToTheAuditor(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-time.Minute))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block2.String(), metadata.MetaFilename)))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeletionAuditor:     NewBucketDeletionAuditor(bucketClient, "audit", log.NewNopLogger()),
+		DeletionAuditPath:   "audit",
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		userID         string
+		blockID        ulid.ULID
+		expectedReason string
+	}{
+		{userID: "user-1", blockID: block1, expectedReason: deletionReasonDeletionMark},
+		{userID: "user-1", blockID: block2, expectedReason: deletionReasonPartialBlock},
+		{userID: "user-2", blockID: block3, expectedReason: deletionReasonTenantDeleted},
+	} {
+		reader, err := bucketClient.Get(ctx, path.Join("audit", tc.userID, tc.blockID.String()+".json"))
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+
+		entry := DeletionAuditEntry{}
+		require.NoError(t, json.Unmarshal(data, &entry))
+		assert.Equal(t, tc.userID, entry.UserID)
+		assert.Equal(t, tc.blockID, entry.BlockID)
+		assert.Equal(t, tc.expectedReason, entry.Reason)
+		assert.WithinDuration(t, time.Now(), entry.DeletedAt, time.Minute)
+	}
+
+	// The audit records are not handled as a tenant.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+}
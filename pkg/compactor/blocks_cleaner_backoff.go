@@ -0,0 +1,48 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// trackRunResult tracks the consecutive failed runs, by which the next scheduled runs are backed off.
+// A successful run resets the backoff, while a canceled run doesn't change it.
+func (c *BlocksCleaner) trackRunResult(err error) {
+	switch {
+	case err == nil:
+		c.consecutiveFailedRuns.Store(0)
+	case errors.Is(err, context.Canceled):
+		return
+	default:
+		c.consecutiveFailedRuns.Inc()
+	}
+
+	backoff := c.failedRunsBackoff()
+	c.backoffSeconds.Set(backoff.Seconds())
+	if backoff > 0 {
+		level.Warn(c.logger).Log("msg", "backing off the next blocks cleanup run after consecutive failed runs", "failedRuns", c.consecutiveFailedRuns.Load(), "backoff", backoff)
+	}
+}
+
+// failedRunsBackoff returns the time by which the next scheduled run is delayed, on top of the cleanup
+// interval. The backoff starts from the cleanup interval after the first failed run, and doubles on each
+// consecutive failed run, up to the configured max. 0 if the last run succeeded or the backoff is disabled.
+func (c *BlocksCleaner) failedRunsBackoff() time.Duration {
+	failed := c.consecutiveFailedRuns.Load()
+	if c.cfg.FailedRunsMaxBackoff <= 0 || failed == 0 {
+		return 0
+	}
+
+	backoff := c.cfg.CleanupInterval
+	for i := int64(1); i < failed && backoff < c.cfg.FailedRunsMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > c.cfg.FailedRunsMaxBackoff {
+		backoff = c.cfg.FailedRunsMaxBackoff
+	}
+	return backoff
+}
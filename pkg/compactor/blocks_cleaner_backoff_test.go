@@ -0,0 +1,87 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldBackOffAfterConsecutiveFailedRuns(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:              dataDir,
+		MetaSyncConcurrency:  10,
+		DeletionDelay:        time.Hour,
+		CleanupInterval:      time.Minute,
+		CleanupConcurrency:   1,
+		FailedRunsMaxBackoff: 5 * time.Minute,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// The users scan fails, so that the whole run fails.
+	failingScanner := tsdb.NewUsersScanner(&failingIterBucket{Bucket: bucketClient, dir: ""}, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, failingScanner, newMockConfigProvider(), logger, nil)
+
+	now := time.Now()
+	assert.Equal(t, time.Minute, cleaner.scheduleNextRun(now))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.backoffSeconds))
+
+	// The backoff doubles on each consecutive failed run, up to the max.
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		require.Error(t, cleaner.runCleanup(ctx))
+		assert.Equal(t, expected, cleaner.failedRunsBackoff())
+		assert.Equal(t, expected.Seconds(), testutil.ToFloat64(cleaner.backoffSeconds))
+		assert.Equal(t, time.Minute+expected, cleaner.scheduleNextRun(now))
+		assert.True(t, now.Add(time.Minute+expected).Equal(cleaner.NextCleanup()))
+	}
+
+	// A canceled run doesn't change the backoff.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	cleaner.trackRunResult(canceledCtx.Err())
+	assert.Equal(t, 5*time.Minute, cleaner.failedRunsBackoff())
+
+	// The first successful run resets the backoff.
+	cleaner.usersScanner = tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, time.Duration(0), cleaner.failedRunsBackoff())
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.backoffSeconds))
+	assert.Equal(t, time.Minute, cleaner.scheduleNextRun(now))
+}
+
+func TestBlocksCleaner_ShouldNotBackOffIfDisabled(t *testing.T) {
+	cleaner := NewBlocksCleaner(BlocksCleanerConfig{CleanupInterval: time.Minute}, nil, nil, newMockConfigProvider(), log.NewNopLogger(), nil)
+
+	cleaner.trackRunResult(assert.AnError)
+	cleaner.trackRunResult(assert.AnError)
+	assert.Equal(t, time.Duration(0), cleaner.failedRunsBackoff())
+	assert.Equal(t, time.Minute, cleaner.scheduleNextRun(time.Now()))
+}
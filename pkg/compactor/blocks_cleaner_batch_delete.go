@@ -0,0 +1,107 @@
+package compactor
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// deleteBlockObjects deletes the block from the storage, in batches of the configured size if
+// the bucket supports batch deletion, or with block.Delete otherwise. On failure, a blockDeletionError
+// locating the object failed to be deleted is returned.
+func (c *BlocksCleaner) deleteBlockObjects(ctx context.Context, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID) error {
+	recorder := &failedOpRecorderBucket{Bucket: userBucket}
+
+	if c.cfg.DeleteBatchSize <= 0 {
+		return recorder.wrap(id, block.Delete(ctx, userLogger, recorder, id))
+	}
+	if _, ok := userBucket.(bucket.BatchDeleter); !ok {
+		return recorder.wrap(id, block.Delete(ctx, userLogger, recorder, id))
+	}
+
+	return recorder.wrap(id, deleteBlockInBatches(ctx, userLogger, recorder, id, c.cfg.DeleteBatchSize))
+}
+
+// deleteBlockInBatches is like block.Delete, but deletes the block objects in batches. Like block.Delete,
+// the meta.json is deleted first, so that an interrupted deletion leaves a partial block, while the deletion
+// mark is deleted last.
+func deleteBlockInBatches(ctx context.Context, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID, batchSize int) error {
+	metaFile := path.Join(id.String(), block.MetaFilename)
+	ok, err := userBucket.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", metaFile)
+	}
+
+	if ok {
+		if err := userBucket.Delete(ctx, metaFile); err != nil {
+			return errors.Wrapf(err, "delete %s", metaFile)
+		}
+	}
+
+	objects, err := listBlockObjects(ctx, userBucket, id.String()+objstore.DirDelim)
+	if err != nil {
+		return errors.Wrapf(err, "list objects of block %s", id)
+	}
+
+	// Move the deletion mark to the end.
+	markFile := path.Join(id.String(), metadata.DeletionMarkFilename)
+	ordered := make([]string, 0, len(objects))
+	hasMark := false
+	for _, name := range objects {
+		switch name {
+		case metaFile:
+		case markFile:
+			hasMark = true
+		default:
+			ordered = append(ordered, name)
+		}
+	}
+	if hasMark {
+		ordered = append(ordered, markFile)
+	}
+
+	for start := 0; start < len(ordered); start += batchSize {
+		end := start + batchSize
+		if end > len(ordered) {
+			end = len(ordered)
+		}
+
+		if err := bucket.DeleteBatch(ctx, userBucket, ordered[start:end]); err != nil {
+			return errors.Wrapf(err, "delete objects of block %s", id)
+		}
+		level.Debug(userLogger).Log("msg", "deleted batch of block objects", "block", id, "objects", end-start)
+	}
+
+	return nil
+}
+
+// listBlockObjects returns all the objects stored in the input location, recursively.
+func listBlockObjects(ctx context.Context, userBucket objstore.Bucket, dir string) ([]string, error) {
+	var objects []string
+
+	err := userBucket.Iter(ctx, dir, func(name string) error {
+		if !strings.HasSuffix(name, objstore.DirDelim) {
+			objects = append(objects, name)
+			return nil
+		}
+
+		nested, err := listBlockObjects(ctx, userBucket, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, nested...)
+		return nil
+	})
+
+	return objects, err
+}
@@ -0,0 +1,162 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldDeleteBlocksInBatchesIfSupportedByTheBucket(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	fsBucket, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	batchBucket := &batchDeleteBucket{Bucket: fsBucket}
+	bucketClient := bucketindex.BucketWithGlobalMarkers(batchBucket)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeleteBatchSize:     2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Greater(t, batchBucket.batches.Load(), int64(0))
+
+	for _, name := range []string{
+		path.Join("user-1", block1.String(), metadata.MetaFilename),
+		path.Join("user-1", block1.String(), metadata.DeletionMarkFilename),
+		path.Join("user-1", block1.String(), "index"),
+		path.Join("user-1", bucketindex.BlockDeletionMarkFilepath(block1)),
+		path.Join("user-2", block2.String(), metadata.MetaFilename),
+		path.Join("user-2", block2.String(), "index"),
+	} {
+		exists, err := fsBucket.Exists(ctx, name)
+		require.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+}
+
+func TestBlocksCleaner_ShouldDeleteBlockObjectsOneByOneIfBatchDeletionIsNotSupportedByTheBucket(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	fsBucket, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	trackingBucket := &deleteTrackingBucket{Bucket: fsBucket}
+	bucketClient := bucketindex.BucketWithGlobalMarkers(trackingBucket)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeleteBatchSize:     2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Greater(t, trackingBucket.deletes.Load(), int64(0))
+
+	for _, name := range []string{
+		path.Join("user-1", block1.String(), metadata.MetaFilename),
+		path.Join("user-1", block1.String(), metadata.DeletionMarkFilename),
+		path.Join("user-1", block1.String(), "index"),
+		path.Join("user-1", bucketindex.BlockDeletionMarkFilepath(block1)),
+		path.Join("user-2", block2.String(), metadata.MetaFilename),
+		path.Join("user-2", block2.String(), "index"),
+	} {
+		exists, err := fsBucket.Exists(ctx, name)
+		require.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+}
+
+// batchDeleteBucket is a bucket supporting batch deletion, which tracks the number of batches.
+type batchDeleteBucket struct {
+	objstore.Bucket
+	batches atomic.Int64
+}
+
+func (b *batchDeleteBucket) DeleteBatch(ctx context.Context, names []string) error {
+	b.batches.Inc()
+
+	for _, name := range names {
+		if err := b.Bucket.Delete(ctx, name); err != nil && !b.Bucket.IsObjNotFoundErr(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTrackingBucket is a bucket not supporting batch deletion, which tracks the number of deleted objects.
+type deleteTrackingBucket struct {
+	objstore.Bucket
+	deletes atomic.Int64
+}
+
+func (b *deleteTrackingBucket) Delete(ctx context.Context, name string) error {
+	b.deletes.Inc()
+	return b.Bucket.Delete(ctx, name)
+}
@@ -0,0 +1,266 @@
+package compactor
+
+import (
+	"context"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+var (
+	errDeletionBudgetExhausted = errors.New("max number of blocks deleted per run reached")
+	errDeletionDryRun          = errors.New("block not deleted because running in dry-run mode")
+)
+
+// blockCleaned tracks a block of the tenant successfully deleted in the input phase.
+func (c *BlocksCleaner) blockCleaned(userID, phase string) {
+	c.blocksCleanedTotal.Inc()
+	c.blocksCleanedByPhase.WithLabelValues(phase).Inc()
+	c.runSummary.blockCleaned(phase)
+	c.tenantBlocksCleaned.WithLabelValues(userID).Inc()
+	c.tenantsCleanupStats.blockCleaned(userID)
+}
+
+// blockCleanupFailed tracks a block of the tenant failed to be deleted in the input phase.
+func (c *BlocksCleaner) blockCleanupFailed(userID, phase string) {
+	c.blocksFailedTotal.Inc()
+	c.blocksFailedByPhase.WithLabelValues(phase).Inc()
+	c.runSummary.blockCleanupFailed(phase)
+	c.tenantBlocksFailed.WithLabelValues(userID).Inc()
+	c.tenantsCleanupStats.blockCleanupFailed(userID)
+}
+
+func (c *BlocksCleaner) deleteConcurrency() int {
+	if c.cfg.DeleteConcurrency > 0 {
+		return c.cfg.DeleteConcurrency
+	}
+	return 1
+}
+
+// deleteBlock hard-deletes a block from the storage. All blocks deletions done by the cleaner
+// are expected to go through this function, in order to honor the per-run deletion budget and
+// the dry-run mode. A failed deletion returns a blockDeletionError locating the object failed
+// to be deleted, whenever an object store operation failed.
+func (c *BlocksCleaner) deleteBlock(ctx context.Context, userID string, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID) error {
+	if !c.acquireDeletionBudget() {
+		return errDeletionBudgetExhausted
+	}
+
+	// The budget is consumed anyway, so that the dry-run previews the same deletions of a real run.
+	if c.cfg.DryRun {
+		c.blocksCleanedDryRun.Inc()
+		level.Info(userLogger).Log("msg", "would delete block", "block", id, "dryRun", true)
+		return errDeletionDryRun
+	}
+
+	if c.deletionsGate != nil {
+		select {
+		case c.deletionsGate <- struct{}{}:
+			defer func() { <-c.deletionsGate }()
+		case <-ctx.Done():
+			c.runBlocksDeleted.Dec()
+			return ctx.Err()
+		}
+	}
+
+	// The size is read before deleting the block, given its meta.json is deleted as well.
+	size := c.blockSize(ctx, userLogger, userBucket, id)
+
+	if err := c.deleteBlockWithRetries(ctx, userLogger, userBucket, id); err != nil {
+		// The block has not been deleted, so it doesn't consume the budget.
+		c.runBlocksDeleted.Dec()
+		c.runBlocksFailed.Inc()
+
+		var deletionErr *blockDeletionError
+		if errors.As(err, &deletionErr) {
+			deletionErr.UserID = userID
+		}
+		return err
+	}
+
+	c.runBlocksDeletedGauge.Inc()
+	c.blocksCleanedBytes.Add(float64(size))
+	c.runBlocksCleaned.Inc()
+	c.runBytesCleaned.Add(size)
+	return nil
+}
+
+// blockSize returns the size in bytes of the block, as tracked by the files listed in its meta.json or,
+// if not tracked and enabled, summing the size of the block objects. Returns 0 if unknown.
+func (c *BlocksCleaner) blockSize(ctx context.Context, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID) int64 {
+	size := int64(0)
+
+	if reader, err := userBucket.Get(ctx, path.Join(id.String(), metadata.MetaFilename)); err == nil {
+		if meta, err := metadata.Read(reader); err == nil {
+			for _, f := range meta.Thanos.Files {
+				size += f.SizeBytes
+			}
+		}
+	}
+
+	if size > 0 || !c.cfg.DeletedBytesFromObjects {
+		return size
+	}
+
+	size, err := objectsSize(ctx, userBucket, id.String())
+	if err != nil {
+		level.Debug(userLogger).Log("msg", "failed to compute the size of the block objects", "block", id, "err", err)
+		return 0
+	}
+	return size
+}
+
+// deleteBlockWithRetries runs deleteBlockWithTimeout(), retrying it with backoff on failure
+// if configured.
+func (c *BlocksCleaner) deleteBlockWithRetries(ctx context.Context, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID) error {
+	if c.cfg.DeleteRetries <= 0 {
+		return c.deleteBlockWithTimeout(ctx, userLogger, userBucket, id)
+	}
+
+	var err error
+
+	retries := util.NewBackoff(ctx, util.BackoffConfig{
+		MinBackoff: c.cfg.DeleteRetryMinBackoff,
+		MaxBackoff: c.cfg.DeleteRetryMaxBackoff,
+		MaxRetries: c.cfg.DeleteRetries + 1,
+	})
+	for retries.Ongoing() {
+		if err = c.deleteBlockWithTimeout(ctx, userLogger, userBucket, id); err == nil {
+			return nil
+		}
+
+		retries.Wait()
+		if retries.Ongoing() {
+			c.deletionRetries.Inc()
+			level.Warn(userLogger).Log("msg", "failed to delete block, retrying", "block", id, "retry", retries.NumRetries(), "err", err)
+		}
+	}
+
+	if err == nil {
+		err = retries.Err()
+	}
+	return err
+}
+
+// deleteBlockWithTimeout runs block.Delete(), honoring the deletion rate limit and the per deletion
+// timeout if configured. The time spent waiting for the rate limiter doesn't count towards the timeout.
+func (c *BlocksCleaner) deleteBlockWithTimeout(ctx context.Context, userLogger log.Logger, userBucket objstore.Bucket, id ulid.ULID) error {
+	if c.deletionsLimiter != nil {
+		if err := c.deletionsLimiter.Wait(ctx); err != nil {
+			return errors.Wrap(err, "wait for the deletion rate limiter")
+		}
+	}
+
+	if c.cfg.PerDeletionTimeout <= 0 {
+		return c.deleteBlockObjects(ctx, userLogger, userBucket, id)
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctx, c.cfg.PerDeletionTimeout)
+	defer cancel()
+
+	err := c.deleteBlockObjects(deleteCtx, userLogger, userBucket, id)
+	if err != nil && ctx.Err() == nil && errors.Is(deleteCtx.Err(), context.DeadlineExceeded) {
+		c.deletionTimeouts.Inc()
+		return errors.Wrapf(err, "block deletion timed out after %s", c.cfg.PerDeletionTimeout)
+	}
+
+	return err
+}
+
+// runDeletionsSuccessRatio returns the ratio of blocks successfully deleted to blocks
+// attempted to be deleted by the current run. The blocks which would have been deleted by
+// a dry-run consume the deletion budget, but are not counted as deleted.
+func (c *BlocksCleaner) runDeletionsSuccessRatio() float64 {
+	deleted := float64(c.runBlocksCleaned.Load())
+	failed := float64(c.runBlocksFailed.Load())
+
+	if deleted+failed == 0 {
+		if c.cfg.SuccessRatioNaNWithoutDeletions {
+			return math.NaN()
+		}
+		return 1
+	}
+
+	return deleted / (deleted + failed)
+}
+
+// acquireDeletionBudget reserves the deletion of a block within the per-run deletion
+// budget. Returns false if the budget has been exhausted.
+func (c *BlocksCleaner) acquireDeletionBudget() bool {
+	max := int64(c.cfg.MaxTotalBlocksDeletedPerRun)
+	if c.runBlocksDeleted.Inc() <= max || max <= 0 {
+		return true
+	}
+
+	c.runBlocksDeleted.Dec()
+
+	// Log it only once per run.
+	if c.runDeletionBudgetExhausted.CAS(false, true) {
+		c.runsDeletionBudgetHit.Inc()
+		level.Warn(c.logger).Log("msg", "reached the max number of blocks deleted per run, remaining blocks will be deleted in the next runs", "max", max)
+	}
+
+	return false
+}
+
+// objectsSize returns the total size of all objects, recursively, in the input dir.
+func objectsSize(ctx context.Context, bkt objstore.Bucket, dir string) (int64, error) {
+	var size int64
+
+	err := bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			nested, err := objectsSize(ctx, bkt, name)
+			size += nested
+			return err
+		}
+
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return err
+		}
+		size += attrs.Size
+		return nil
+	})
+
+	return size, err
+}
+
+// oldestObjectTime returns the oldest last modified time of all objects, recursively, in the input dir.
+func oldestObjectTime(ctx context.Context, bkt objstore.Bucket, dir string) (time.Time, error) {
+	var oldest time.Time
+
+	err := bkt.Iter(ctx, dir, func(name string) error {
+		var (
+			t   time.Time
+			err error
+		)
+
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			t, err = oldestObjectTime(ctx, bkt, name)
+		} else {
+			var attrs objstore.ObjectAttributes
+			attrs, err = bkt.Attributes(ctx, name)
+			t = attrs.LastModified
+		}
+
+		if err != nil {
+			return err
+		}
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+		return nil
+	})
+
+	return oldest, err
+}
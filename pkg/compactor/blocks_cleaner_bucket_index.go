@@ -0,0 +1,71 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+// writeUserBucketIndex writes the bucket index of the tenant, built from the blocks fetched by the
+// cleanup. The blocks deleted by the cleanup are expected to have been removed from the input metas,
+// while the blocks marked for deletion by the cleanup itself are listed as not marked until the next run.
+func (c *BlocksCleaner) writeUserBucketIndex(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, marks map[ulid.ULID]*metadata.DeletionMark, userLogger log.Logger) {
+	// The old index is read only to preserve when blocks have been first seen.
+	old, err := bucketindex.ReadIndex(ctx, c.bucketClient, userID, userLogger)
+	if err != nil && !errors.Is(err, bucketindex.ErrIndexNotFound) {
+		level.Warn(userLogger).Log("msg", "failed to read the bucket index, rebuilding it from scratch", "err", err)
+	}
+
+	idx := buildBucketIndex(old, metas, marks, time.Now())
+
+	if err := bucketindex.WriteIndex(ctx, c.bucketClient, userID, idx); err != nil {
+		c.bucketIndexWriteFailures.Inc()
+		level.Warn(userLogger).Log("msg", "failed to write the bucket index", "err", err)
+		return
+	}
+
+	level.Debug(userLogger).Log("msg", "written the bucket index", "blocks", len(idx.Blocks), "deletionMarks", len(idx.BlockDeletionMarks))
+}
+
+// buildBucketIndex returns the bucket index listing the input blocks, and the deletion marks of
+// such blocks. The upload time of the blocks not in the old index is approximated with now, given
+// fetched metas don't carry it.
+func buildBucketIndex(old *bucketindex.Index, metas map[ulid.ULID]*metadata.Meta, marks map[ulid.ULID]*metadata.DeletionMark, now time.Time) *bucketindex.Index {
+	uploadedAt := map[ulid.ULID]int64{}
+	if old != nil {
+		for _, b := range old.Blocks {
+			uploadedAt[b.ID] = b.UploadedAt
+		}
+	}
+
+	idx := &bucketindex.Index{
+		Version:            bucketindex.IndexVersion1,
+		Blocks:             make([]*bucketindex.Block, 0, len(metas)),
+		BlockDeletionMarks: make([]*bucketindex.BlockDeletionMark, 0, len(marks)),
+		UpdatedAt:          now.Unix(),
+	}
+
+	for id, meta := range metas {
+		b := bucketindex.BlockFromThanosMeta(*meta)
+		if ts, ok := uploadedAt[id]; ok {
+			b.UploadedAt = ts
+		} else {
+			b.UploadedAt = now.Unix()
+		}
+
+		idx.Blocks = append(idx.Blocks, b)
+
+		if mark, ok := marks[id]; ok {
+			idx.BlockDeletionMarks = append(idx.BlockDeletionMarks, bucketindex.BlockDeletionMarkFromThanosMarker(mark))
+		}
+	}
+
+	return idx
+}
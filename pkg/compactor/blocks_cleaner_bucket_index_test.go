@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldWriteTheBucketIndex(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-time.Minute))
+
+	// The bucket index of a tenant marked for deletion is deleted along with its blocks.
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+	require.NoError(t, bucketindex.WriteIndex(ctx, bucketClient, "user-2", &bucketindex.Index{Version: bucketindex.IndexVersion1}))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		WriteBucketIndex:    true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	idx, err := bucketindex.ReadIndex(ctx, bucketClient, "user-1", logger)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{block2.String(), block3.String()}, blockIDs(idx.Blocks))
+	require.Len(t, idx.BlockDeletionMarks, 1)
+	assert.Equal(t, block2, idx.BlockDeletionMarks[0].ID)
+
+	_, err = bucketindex.ReadIndex(ctx, bucketClient, "user-2", logger)
+	assert.Equal(t, bucketindex.ErrIndexNotFound, err)
+
+	// The time blocks have been first seen is preserved across runs.
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	updated, err := bucketindex.ReadIndex(ctx, bucketClient, "user-1", logger)
+	require.NoError(t, err)
+	for _, b := range updated.Blocks {
+		for _, prev := range idx.Blocks {
+			if prev.ID == b.ID {
+				assert.Equal(t, prev.UploadedAt, b.UploadedAt)
+			}
+		}
+	}
+}
+
+func blockIDs(blocks []*bucketindex.Block) []string {
+	ids := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		ids = append(ids, b.ID.String())
+	}
+	return ids
+}
@@ -0,0 +1,136 @@
+package compactor
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// Operations tracked by the cleanup bucket metrics. They match the Thanos objstore operations.
+const (
+	cleanupBucketOpIter        = "iter"
+	cleanupBucketOpGet         = "get"
+	cleanupBucketOpGetRange    = "get_range"
+	cleanupBucketOpExists      = "exists"
+	cleanupBucketOpAttributes  = "attributes"
+	cleanupBucketOpUpload      = "upload"
+	cleanupBucketOpDelete      = "delete"
+	cleanupBucketOpDeleteBatch = "delete_batch"
+)
+
+var cleanupBucketOps = []string{
+	cleanupBucketOpIter,
+	cleanupBucketOpGet,
+	cleanupBucketOpGetRange,
+	cleanupBucketOpExists,
+	cleanupBucketOpAttributes,
+	cleanupBucketOpUpload,
+	cleanupBucketOpDelete,
+	cleanupBucketOpDeleteBatch,
+}
+
+// cleanupMetricsBucket is a bucket tracking the operations done by the blocks cleaner, so that they can be
+// attributed to the cleanup. It forwards the batch deletion and the expected errors to the wrapped bucket.
+type cleanupMetricsBucket struct {
+	bucket objstore.Bucket
+	ops    *prometheus.CounterVec
+}
+
+func newCleanupMetricsBucket(bkt objstore.Bucket, reg prometheus.Registerer) *cleanupMetricsBucket {
+	b := &cleanupMetricsBucket{
+		bucket: bkt,
+		ops: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_cleanup_bucket_operations_total",
+			Help: "Total number of object storage operations done by the blocks cleaner, by operation.",
+		}, []string{"operation"}),
+	}
+
+	for _, op := range cleanupBucketOps {
+		b.ops.WithLabelValues(op)
+	}
+
+	return b
+}
+
+func (b *cleanupMetricsBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	b.ops.WithLabelValues(cleanupBucketOpIter).Inc()
+	return b.bucket.Iter(ctx, dir, f)
+}
+
+func (b *cleanupMetricsBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.ops.WithLabelValues(cleanupBucketOpGet).Inc()
+	return b.bucket.Get(ctx, name)
+}
+
+func (b *cleanupMetricsBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.ops.WithLabelValues(cleanupBucketOpGetRange).Inc()
+	return b.bucket.GetRange(ctx, name, off, length)
+}
+
+func (b *cleanupMetricsBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.ops.WithLabelValues(cleanupBucketOpExists).Inc()
+	return b.bucket.Exists(ctx, name)
+}
+
+func (b *cleanupMetricsBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.ops.WithLabelValues(cleanupBucketOpAttributes).Inc()
+	return b.bucket.Attributes(ctx, name)
+}
+
+func (b *cleanupMetricsBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.ops.WithLabelValues(cleanupBucketOpUpload).Inc()
+	return b.bucket.Upload(ctx, name, r)
+}
+
+func (b *cleanupMetricsBucket) Delete(ctx context.Context, name string) error {
+	b.ops.WithLabelValues(cleanupBucketOpDelete).Inc()
+	return b.bucket.Delete(ctx, name)
+}
+
+// DeleteBatch implements bucket.BatchDeleter. If the wrapped bucket doesn't support batch deletion,
+// the objects are deleted one by one, each tracked as a single deletion.
+func (b *cleanupMetricsBucket) DeleteBatch(ctx context.Context, names []string) error {
+	if deleter, ok := b.bucket.(bucket.BatchDeleter); ok {
+		b.ops.WithLabelValues(cleanupBucketOpDeleteBatch).Inc()
+		return deleter.DeleteBatch(ctx, names)
+	}
+
+	for _, name := range names {
+		if err := b.Delete(ctx, name); err != nil && !b.IsObjNotFoundErr(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *cleanupMetricsBucket) IsObjNotFoundErr(err error) bool {
+	return b.bucket.IsObjNotFoundErr(err)
+}
+
+func (b *cleanupMetricsBucket) Name() string {
+	return b.bucket.Name()
+}
+
+func (b *cleanupMetricsBucket) Close() error {
+	return b.bucket.Close()
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (b *cleanupMetricsBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.bucket.(objstore.InstrumentedBucket); ok {
+		return &cleanupMetricsBucket{bucket: ib.WithExpectedErrs(fn), ops: b.ops}
+	}
+
+	return b
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucketReader.
+func (b *cleanupMetricsBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(fn)
+}
@@ -0,0 +1,98 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldTrackBucketOperations(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, reg)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	ops := cleaner.bucketClient.(*cleanupMetricsBucket).ops
+	assert.Greater(t, testutil.ToFloat64(ops.WithLabelValues(cleanupBucketOpIter)), float64(0))
+	assert.Greater(t, testutil.ToFloat64(ops.WithLabelValues(cleanupBucketOpGet)), float64(0))
+	assert.Greater(t, testutil.ToFloat64(ops.WithLabelValues(cleanupBucketOpDelete)), float64(0))
+	assert.Equal(t, float64(0), testutil.ToFloat64(ops.WithLabelValues(cleanupBucketOpDeleteBatch)))
+
+	// All operations are exported, even if never done.
+	assert.Equal(t, len(cleanupBucketOps), testutil.CollectAndCount(ops))
+}
+
+func TestCleanupMetricsBucket_DeleteBatch(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	fsBucket, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, fsBucket.Upload(ctx, name, strings.NewReader(name)))
+	}
+
+	// The filesystem bucket doesn't support batch deletion, so the objects are deleted one by one.
+	bkt := newCleanupMetricsBucket(fsBucket, nil)
+	require.NoError(t, bucket.DeleteBatch(ctx, bkt, []string{"a", "b", "missing"}))
+	assert.Equal(t, float64(3), testutil.ToFloat64(bkt.ops.WithLabelValues(cleanupBucketOpDelete)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(bkt.ops.WithLabelValues(cleanupBucketOpDeleteBatch)))
+
+	// The markers bucket supports batch deletion.
+	require.NoError(t, fsBucket.Upload(ctx, "c", strings.NewReader("c")))
+	bkt = newCleanupMetricsBucket(bucketindex.BucketWithGlobalMarkers(fsBucket), nil)
+	require.NoError(t, bucket.DeleteBatch(ctx, bkt, []string{"c"}))
+	assert.Equal(t, float64(0), testutil.ToFloat64(bkt.ops.WithLabelValues(cleanupBucketOpDelete)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(bkt.ops.WithLabelValues(cleanupBucketOpDeleteBatch)))
+
+	exists, err := fsBucket.Exists(ctx, "c")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,177 @@
+package compactor
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// concurrencyLimitBucket is a bucket bounding the number of object storage operations run concurrently,
+// shared by all the tenants being cleaned up, so that the cleanup concurrency and the meta sync concurrency
+// don't multiply the requests to the storage. An operation waits for a free slot, unless its context is
+// canceled. The slot is held until the operation returns: the content of the objects read by Get and GetRange
+// is streamed without holding it.
+type concurrencyLimitBucket struct {
+	bucket objstore.Bucket
+	slots  chan struct{}
+
+	// Operations currently running, and waiting for a free slot.
+	inflight prometheus.Gauge
+	waiting  prometheus.Gauge
+}
+
+func newConcurrencyLimitBucket(bkt objstore.Bucket, limit int, inflight, waiting prometheus.Gauge) *concurrencyLimitBucket {
+	return &concurrencyLimitBucket{
+		bucket:   bkt,
+		slots:    make(chan struct{}, limit),
+		inflight: inflight,
+		waiting:  waiting,
+	}
+}
+
+func (b *concurrencyLimitBucket) acquire(ctx context.Context) error {
+	b.waiting.Inc()
+	defer b.waiting.Dec()
+
+	select {
+	case b.slots <- struct{}{}:
+		b.inflight.Inc()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *concurrencyLimitBucket) release() {
+	b.inflight.Dec()
+	<-b.slots
+}
+
+// Iter lists the entries while holding a slot, and calls the function once the slot is released,
+// because the function could run other operations, waiting for a slot held by the listing itself.
+func (b *concurrencyLimitBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+
+	var names []string
+	err := b.bucket.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	b.release()
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *concurrencyLimitBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	return b.bucket.Get(ctx, name)
+}
+
+func (b *concurrencyLimitBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	return b.bucket.GetRange(ctx, name, off, length)
+}
+
+func (b *concurrencyLimitBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer b.release()
+
+	return b.bucket.Exists(ctx, name)
+}
+
+func (b *concurrencyLimitBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.acquire(ctx); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	defer b.release()
+
+	return b.bucket.Attributes(ctx, name)
+}
+
+func (b *concurrencyLimitBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bucket.Upload(ctx, name, r)
+}
+
+func (b *concurrencyLimitBucket) Delete(ctx context.Context, name string) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bucket.Delete(ctx, name)
+}
+
+// DeleteBatch implements bucket.BatchDeleter. The batch deletion holds a single slot.
+func (b *concurrencyLimitBucket) DeleteBatch(ctx context.Context, names []string) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return bucket.DeleteBatch(ctx, b.bucket, names)
+}
+
+func (b *concurrencyLimitBucket) IsObjNotFoundErr(err error) bool {
+	return b.bucket.IsObjNotFoundErr(err)
+}
+
+func (b *concurrencyLimitBucket) Name() string {
+	return b.bucket.Name()
+}
+
+func (b *concurrencyLimitBucket) Close() error {
+	return b.bucket.Close()
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket. The returned bucket shares the slots.
+func (b *concurrencyLimitBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.bucket.(objstore.InstrumentedBucket); ok {
+		return &concurrencyLimitBucket{bucket: ib.WithExpectedErrs(fn), slots: b.slots, inflight: b.inflight, waiting: b.waiting}
+	}
+
+	return b
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucketReader.
+func (b *concurrencyLimitBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(fn)
+}
+
+// capBucketOpsConcurrency returns the input concurrency, capped to the max concurrent object storage
+// operations if configured, given workers in excess would just wait for a free slot.
+func (c *BlocksCleaner) capBucketOpsConcurrency(concurrency int) int {
+	if c.cfg.MaxConcurrentBucketOps > 0 && concurrency > c.cfg.MaxConcurrentBucketOps {
+		return c.cfg.MaxConcurrentBucketOps
+	}
+	return concurrency
+}
@@ -0,0 +1,174 @@
+package compactor
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldBoundTheConcurrentBucketOperations(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	var deletable []string
+	for _, userID := range []string{"user-1", "user-2", "user-3", "user-4"} {
+		for i := 0; i < 3; i++ {
+			id := createTSDBBlock(t, bucketClient, userID, int64(10*i), int64(10*(i+1)), nil)
+			createDeletionMark(t, bucketClient, userID, id, time.Now().Add(-2*time.Hour))
+			deletable = append(deletable, path.Join(userID, id.String()))
+		}
+	}
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-4"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                dataDir,
+		MetaSyncConcurrency:    10,
+		DeletionDelay:          time.Hour,
+		CleanupInterval:        time.Minute,
+		CleanupConcurrency:     4,
+		DeleteConcurrency:      4,
+		MaxConcurrentBucketOps: 2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	bkt := &bucketOpsTrackingBucket{Bucket: bucketClient}
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	for _, blockDir := range deletable {
+		exists, err := bucketClient.Exists(ctx, path.Join(blockDir, metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.False(t, exists, blockDir)
+	}
+
+	assert.Greater(t, bkt.maxInflight.Load(), int64(0))
+	assert.LessOrEqual(t, bkt.maxInflight.Load(), int64(2))
+}
+
+func TestConcurrencyLimitBucket_ShouldNotHoldTheSlotWhileIterating(t *testing.T) {
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cleaner := NewBlocksCleaner(BlocksCleanerConfig{MaxConcurrentBucketOps: 1}, bucketClient, nil, newMockConfigProvider(), log.NewNopLogger(), nil)
+
+	// The callback runs an operation itself, which would wait forever if the listing held the only slot.
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var found []ulid.ULID
+	require.NoError(t, cleaner.bucketClient.Iter(ctx, "user-1/", func(name string) error {
+		exists, err := cleaner.bucketClient.Exists(ctx, path.Join(name, metadata.MetaFilename))
+		if err != nil {
+			return err
+		}
+		if exists {
+			found = append(found, block1)
+		}
+		return nil
+	}))
+	assert.Equal(t, []ulid.ULID{block1}, found)
+}
+
+// bucketOpsTrackingBucket tracks the max number of concurrent operations of any kind.
+type bucketOpsTrackingBucket struct {
+	objstore.Bucket
+
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+}
+
+func (b *bucketOpsTrackingBucket) track() func() {
+	inflight := b.inflight.Inc()
+	for {
+		max := b.maxInflight.Load()
+		if inflight <= max || b.maxInflight.CAS(max, inflight) {
+			break
+		}
+	}
+
+	// Give other operations the chance to run concurrently.
+	time.Sleep(time.Millisecond)
+	return func() { b.inflight.Dec() }
+}
+
+func (b *bucketOpsTrackingBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	done := b.track()
+	var names []string
+	err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	done()
+
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bucketOpsTrackingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	defer b.track()()
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *bucketOpsTrackingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	defer b.track()()
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *bucketOpsTrackingBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	defer b.track()()
+	return b.Bucket.Attributes(ctx, name)
+}
+
+func (b *bucketOpsTrackingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	defer b.track()()
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *bucketOpsTrackingBucket) Delete(ctx context.Context, name string) error {
+	defer b.track()()
+	return b.Bucket.Delete(ctx, name)
+}
@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	tenantClassificationActive  = "active"
+	tenantClassificationDeleted = "deleted"
+)
+
+type tenantClassification struct {
+	deleted bool
+	since   time.Time
+}
+
+// tenantClassifier keeps track of the classification (active or marked for deletion) of each
+// tenant across cleanup runs, so that a newly deleted classification is acted upon only once
+// it has been stable for the configured period. It's not safe for concurrent use.
+type tenantClassifier struct {
+	stabilization time.Duration
+	states        map[string]tenantClassification
+
+	changes *prometheus.CounterVec
+}
+
+func newTenantClassifier(stabilization time.Duration, reg prometheus.Registerer) *tenantClassifier {
+	return &tenantClassifier{
+		stabilization: stabilization,
+		states:        map[string]tenantClassification{},
+		changes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_tenant_classification_changes_total",
+			Help: "Total number of times a tenant classification, as active or marked for deletion, changed between blocks cleanup runs.",
+		}, []string{"classification"}),
+	}
+}
+
+// classify takes in input the active and deleted tenants discovered in the bucket and returns the
+// tenants to be cleaned up as active and the ones to be deleted. A tenant marked for deletion is
+// returned as active until it has been continuously seen as deleted for the stabilization period.
+func (t *tenantClassifier) classify(logger log.Logger, users, deleted []string, now time.Time) (active, committed []string) {
+	states := make(map[string]tenantClassification, len(users)+len(deleted))
+
+	observe := func(userID string, isDeleted bool) tenantClassification {
+		prev, ok := t.states[userID]
+		if ok && prev.deleted == isDeleted {
+			states[userID] = prev
+			return prev
+		}
+
+		if ok {
+			classification := tenantClassificationActive
+			if isDeleted {
+				classification = tenantClassificationDeleted
+			}
+
+			t.changes.WithLabelValues(classification).Inc()
+			level.Info(logger).Log("msg", "user classification changed since the previous blocks cleanup run", "user", userID, "classification", classification)
+		}
+
+		curr := tenantClassification{deleted: isDeleted, since: now}
+		states[userID] = curr
+		return curr
+	}
+
+	for _, userID := range users {
+		observe(userID, false)
+		active = append(active, userID)
+	}
+
+	for _, userID := range deleted {
+		state := observe(userID, true)
+
+		if t.stabilization > 0 && now.Sub(state.since) < t.stabilization {
+			level.Debug(logger).Log("msg", "user marked for deletion recently, cleaning it up as an active user until the classification is stable", "user", userID, "since", state.since)
+			active = append(active, userID)
+			continue
+		}
+
+		committed = append(committed, userID)
+	}
+
+	// Tenants not discovered anymore are forgotten.
+	t.states = states
+
+	return active, committed
+}
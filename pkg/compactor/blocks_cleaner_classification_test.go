@@ -0,0 +1,48 @@
+package compactor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantClassifier(t *testing.T) {
+	classifier := newTenantClassifier(time.Hour, prometheus.NewPedanticRegistry())
+	logger := log.NewNopLogger()
+	now := time.Now()
+
+	// Tenants marked for deletion when first discovered are cleaned up as active until stable.
+	active, deleted := classifier.classify(logger, []string{"user-1", "user-2"}, []string{"user-3"}, now)
+	assert.Equal(t, []string{"user-1", "user-2", "user-3"}, active)
+	assert.Empty(t, deleted)
+
+	// A tenant newly marked for deletion is cleaned up as active until stable.
+	active, deleted = classifier.classify(logger, []string{"user-1"}, []string{"user-2", "user-3"}, now.Add(30*time.Minute))
+	assert.Equal(t, []string{"user-1", "user-2", "user-3"}, active)
+	assert.Empty(t, deleted)
+	assert.Equal(t, float64(1), testutil.ToFloat64(classifier.changes.WithLabelValues(tenantClassificationDeleted)))
+
+	active, deleted = classifier.classify(logger, []string{"user-1"}, []string{"user-2", "user-3"}, now.Add(time.Hour))
+	assert.Equal(t, []string{"user-1", "user-2"}, active)
+	assert.Equal(t, []string{"user-3"}, deleted)
+
+	// A tenant flipping back and forth restarts the stabilization period.
+	classifier.classify(logger, []string{"user-1", "user-2"}, []string{"user-3"}, now.Add(90*time.Minute))
+	active, deleted = classifier.classify(logger, []string{"user-1"}, []string{"user-2", "user-3"}, now.Add(2*time.Hour))
+	assert.Equal(t, []string{"user-1", "user-2"}, active)
+	assert.Equal(t, []string{"user-3"}, deleted)
+	assert.Equal(t, float64(2), testutil.ToFloat64(classifier.changes.WithLabelValues(tenantClassificationDeleted)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(classifier.changes.WithLabelValues(tenantClassificationActive)))
+}
+
+func TestTenantClassifier_ShouldCommitDeletedTenantsImmediatelyIfStabilizationIsDisabled(t *testing.T) {
+	classifier := newTenantClassifier(0, prometheus.NewPedanticRegistry())
+
+	active, deleted := classifier.classify(log.NewNopLogger(), []string{"user-1"}, []string{"user-2"}, time.Now())
+	assert.Equal(t, []string{"user-1"}, active)
+	assert.Equal(t, []string{"user-2"}, deleted)
+}
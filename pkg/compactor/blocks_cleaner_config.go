@@ -0,0 +1,343 @@
+package compactor
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+var (
+	errInvalidCleanerDataDir             = errors.New("the blocks cleaner data directory must be set")
+	errInvalidCleanerInterval            = errors.New("the blocks cleanup interval must be greater than 0")
+	errInvalidCleanerConcurrency         = errors.New("the blocks cleanup concurrency must be greater than 0")
+	errInvalidCleanerMetaSyncConcurrency = errors.New("the blocks cleaner meta sync concurrency must be greater than 0")
+	errInvalidCleanerDeletionDelay       = errors.New("the blocks cleaner deletion delays must be greater than or equal to 0")
+	errInvalidCleanerMaxBucketOps        = errors.New("the blocks cleaner max concurrent bucket operations must be greater than or equal to 0")
+	errInvalidCleanerMaxTenantsDeleted   = errors.New("the blocks cleaner max tenants deleted per run must be greater than or equal to 0")
+	errInvalidCleanerMaxBackoff          = errors.New("the blocks cleaner failed runs max backoff must be greater than or equal to 0")
+)
+
+type BlocksCleanerConfig struct {
+	DataDir             string
+	MetaSyncConcurrency int
+	DeletionDelay       time.Duration
+	CleanupInterval     time.Duration
+	CleanupConcurrency  int
+
+	// ReconciliationMode compares the bucket state against the configured policies
+	// and reports discrepancies, without mutating the bucket.
+	ReconciliationMode bool
+
+	// ReadOnly makes the cleaner treat the bucket as immutable (eg. a read-only bucket in validation
+	// environments): the bucket is evaluated like in reconciliation mode, but no write or delete is
+	// ever issued, so that no failure is tracked.
+	ReadOnly bool
+
+	// FailStartOnInitialCleanupError makes the service fail to start if the
+	// initial cleanup, run while starting, fails.
+	FailStartOnInitialCleanupError bool
+
+	// AnnotateRetainedBlocks writes a policy annotation to each evaluated block which
+	// has been retained, exposing when it will become eligible for deletion.
+	AnnotateRetainedBlocks bool
+
+	// MaxTotalBlocksDeletedPerRun is the max number of blocks deleted across all
+	// tenants in a single cleanup run. 0 means unlimited.
+	MaxTotalBlocksDeletedPerRun int
+
+	// VerifyConvergence re-scans each tenant once cleaned up, in order to verify
+	// the bucket has converged to the expected state.
+	VerifyConvergence bool
+
+	// DeleteConcurrency is the number of workers concurrently deleting the blocks of a single
+	// tenant marked for deletion, while its blocks are being listed. Defaults to 1 if not positive.
+	DeleteConcurrency int
+
+	// ExportDeletionMarks exposes the number of blocks marked for deletion, by the time
+	// left before they become eligible for deletion. ExportDeletionMarksDetails additionally
+	// exposes a per-block metric, for a bounded number of blocks.
+	ExportDeletionMarks        bool
+	ExportDeletionMarksDetails bool
+
+	// MinPartialBlockLifetime is the min time since the oldest object of a partial block
+	// has been uploaded, before the partial block can be deleted. 0 to disable.
+	MinPartialBlockLifetime time.Duration
+
+	// MaxConcurrentDeletes is the max number of blocks concurrently deleted across
+	// all tenants. 0 means unlimited.
+	MaxConcurrentDeletes int
+
+	// SuspiciousEmptyFetchMinBlocks is the min number of blocks a tenant must have had in the
+	// previous cleanup run for an empty blocks listing to be considered suspicious, in which
+	// case the tenant cleanup is skipped. 0 to disable.
+	SuspiciousEmptyFetchMinBlocks int
+
+	// DeletionClassificationStabilization is the min time a tenant must have been continuously
+	// seen as marked for deletion before its blocks are deleted. Until then, the tenant is cleaned
+	// up as an active one. 0 to disable.
+	DeletionClassificationStabilization time.Duration
+
+	// GovernanceFile is the path, in the bucket, of a CSV file listing (tenant, cutoff) rows. The
+	// blocks of a listed tenant containing only data older than the cutoff are marked for deletion.
+	// Empty to disable. GovernanceFileSeparator and GovernanceFileHasHeader configure the parsing.
+	GovernanceFile          string
+	GovernanceFileSeparator string
+	GovernanceFileHasHeader bool
+
+	// TenantDeletionTokenPath is the path, in the bucket, of the token authorizing the deletion
+	// of tenants marked for deletion. If set, tenants are deleted only while a valid token exists.
+	// The token is validated by TenantDeletionTokenValidator.
+	TenantDeletionTokenPath      string
+	TenantDeletionTokenValidator TenantDeletionTokenValidator
+
+	// OrphanBlockPrefixPolicy is how a block prefix containing only markers, and no block data,
+	// is handled. Supported values are defined by the orphanBlockPrefixPolicy* constants.
+	OrphanBlockPrefixPolicy string
+
+	// Role is the initial role of the cleaner. A standby cleaner runs the read-only evaluation of
+	// the bucket, like in reconciliation mode, but doesn't mutate it until promoted to active.
+	Role string
+
+	// MarkingConcurrency is the max number of deletion marks concurrently written for a single
+	// tenant when marking blocks for deletion. Defaults to 1 if not set.
+	MarkingConcurrency int
+
+	// SuccessRatioNaNWithoutDeletions reports the run success ratio as NaN, instead of 1, when
+	// no block deletion has been attempted.
+	SuccessRatioNaNWithoutDeletions bool
+
+	// CorruptBlocksCheckEnabled checks whether the files referenced by the meta.json of each block
+	// exist. CorruptBlocksMarkingGracePeriod is how long a block must have been continuously detected
+	// as corrupted before being marked for deletion. 0 to not mark corrupted blocks.
+	CorruptBlocksCheckEnabled       bool
+	CorruptBlocksMarkingGracePeriod time.Duration
+
+	// QueryActivityProvider, if set, is consulted before marking or deleting a block of a tenant
+	// not marked for deletion, in order to defer the operation on recently queried blocks.
+	QueryActivityProvider QueryActivityProvider
+
+	// DeletionPlanPath is the path, in the bucket, of the deletion plan. If set, a run either
+	// plans the deletions, evaluating the bucket read-only and writing the plan, or applies the
+	// previously written plan if approved by an object at DeletionPlanApprovalPath containing the
+	// plan digest. DeletionPlanFormat is the plan format.
+	DeletionPlanPath         string
+	DeletionPlanApprovalPath string
+	DeletionPlanFormat       string
+
+	// PerDeletionTimeout is the max time a single block deletion can take. A deletion timing out
+	// is a failure for that block. 0 means no timeout.
+	PerDeletionTimeout time.Duration
+
+	// PerTenantTimeout is the max time the cleanup of a single tenant can take within a run. A tenant
+	// timing out is skipped, without failing the run. 0 means no timeout.
+	PerTenantTimeout time.Duration
+
+	// RetentionLabel is the block external label whose value selects the retention of the block
+	// among RetentionByLabel, whose keys are anchored regular expressions matched against the label
+	// value. If multiple keys match, the longest retention wins. The selected retention takes
+	// precedence over the tenant retention period, which applies to the blocks not matching any key,
+	// or without the label. A retention of 0 means unlimited.
+	RetentionLabel   string
+	RetentionByLabel map[string]time.Duration
+
+	// InconsistentScanPolicy is how a tenants scan finding no active tenant but some tenants
+	// marked for deletion is handled.
+	InconsistentScanPolicy string
+
+	// MetaCacheSize is the max number of tenants whose last fetched blocks are cached in memory
+	// for MetaCacheTTL, so that read-only runs can reuse them instead of fetching them again. Runs
+	// deleting blocks always fetch them. 0 disables the cache.
+	MetaCacheSize int
+	MetaCacheTTL  time.Duration
+
+	// MetaCacheDir is the local directory where the metas of the tenant blocks are cached by the meta
+	// syncer, so that it can be placed on a different storage than DataDir. Defaults to DataDir if empty.
+	MetaCacheDir string
+
+	// MaxBlocksPerTenant is the max number of blocks a tenant can retain, overridable per tenant.
+	// The oldest blocks exceeding it are marked for deletion, except the ones containing data more
+	// recent than MaxBlocksMinRetention. 0 means unlimited.
+	MaxBlocksPerTenant    int
+	MaxBlocksMinRetention time.Duration
+
+	// DeleteRetries is the number of times a failed block deletion is retried, with an exponential
+	// backoff between DeleteRetryMinBackoff and DeleteRetryMaxBackoff, before being accounted as a
+	// failure. 0 disables retries.
+	DeleteRetries         int
+	DeleteRetryMinBackoff time.Duration
+	DeleteRetryMaxBackoff time.Duration
+
+	// DryRun makes the cleaner log, instead of running, the blocks deletions and the deletion marks writes,
+	// so that the effect of a configuration change can be previewed.
+	DryRun bool
+
+	// EnabledTenants, if not empty, is the list of the only tenants cleaned up. DisabledTenants is the list
+	// of tenants never cleaned up. Skipped tenants are neither cleaned up nor deleted.
+	EnabledTenants  []string
+	DisabledTenants []string
+
+	// WriteBucketIndex writes, at the end of the cleanup of each tenant, a bucket index listing the tenant blocks
+	// and deletion marks, built from the blocks fetched by the cleanup itself. The bucket index is deleted once the
+	// tenant marked for deletion has been fully deleted.
+	WriteBucketIndex bool
+
+	// PartialBlockDeletionDelay is the min time since a partial block has been marked for deletion, before
+	// the partial block can be deleted. 0 to disable.
+	PartialBlockDeletionDelay time.Duration
+
+	// DeletionAuditor records each block deleted. Defaults to a no-op. DeletionAuditPath is the path, in
+	// the bucket, where the bucket deletion auditor writes its records, excluded from the tenants.
+	DeletionAuditor   DeletionAuditor
+	DeletionAuditPath string
+
+	// DeletionApprover is consulted before deleting a tenant marked for deletion, which is skipped
+	// if not approved. Defaults to approving all deletions.
+	DeletionApprover DeletionApprover
+
+	// SkipUnchangedTenants skips the cleanup of the tenants found with nothing to clean up by the previous
+	// run, until the objects at their root or their deletion marks change.
+	SkipUnchangedTenants bool
+
+	// OrphanObjectsMinAge is the min age of the objects stored in the tenant location, outside of any block and
+	// markers location, before they're deleted as orphaned objects. 0 to disable.
+	OrphanObjectsMinAge time.Duration
+
+	// DeleteRateLimit is the max number of blocks deleted per second across all tenants, including
+	// the retries of failed deletions. 0 means unlimited.
+	DeleteRateLimit float64
+
+	// TenantDeletionDelay is the grace period before the blocks of a tenant marked for deletion are
+	// hard-deleted. If set, each block is marked for deletion first, and deleted by a subsequent run once
+	// the grace period since its deletion mark has elapsed. 0 to delete the blocks immediately.
+	TenantDeletionDelay time.Duration
+
+	// TenantDeletionMarkDelay is how long the deletion mark of a tenant is kept, since the tenant has been
+	// marked for deletion. Once elapsed, the mark is deleted as soon as all the blocks of the tenant have
+	// been deleted and the mark is the last object left, so that the tenant isn't found by the next runs.
+	// 0 to never delete the tenant deletion mark.
+	TenantDeletionMarkDelay time.Duration
+
+	// TenantDeletionProgressInterval is how frequently the progress of the deletion of a tenant marked
+	// for deletion is logged. 0 to disable.
+	TenantDeletionProgressInterval time.Duration
+
+	// CleanupOrder is the order in which tenants are cleaned up within a run. Supported values are
+	// defined by the CleanupOrder* constants. Defaults to the users scan order if empty.
+	CleanupOrder string
+
+	// KillSwitchPath is the path, in the bucket, of the object disabling the cleanup while it exists.
+	// Checked at the beginning of each run. Empty to disable.
+	KillSwitchPath string
+
+	// DeletedBytesFromObjects sums the size of the objects of a deleted block, listing them before
+	// the deletion, when the size is not tracked by the block meta.json. This issues extra requests
+	// to the storage.
+	DeletedBytesFromObjects bool
+
+	// CleanupIntervalJitter is the max fraction of CleanupInterval by which each interval between
+	// two scheduled runs is randomly increased or decreased. 0 to disable.
+	CleanupIntervalJitter float64
+
+	// FailedRunsMaxBackoff enables the backoff of the scheduled runs after consecutive failed runs: the
+	// interval until the next run is increased by the cleanup interval after the first failed run, doubling
+	// on each consecutive failed run up to this max. A successful run resets the interval. 0 to disable.
+	FailedRunsMaxBackoff time.Duration
+
+	// ShutdownGracePeriod is the max time the tenants being cleaned up when the cleaner is stopped are
+	// allowed to finish, while no other tenant is started. 0 to cancel them immediately.
+	ShutdownGracePeriod time.Duration
+
+	// OnTenantCleaned, if set, is invoked at the end of the cleanup, or the deletion, of each tenant with its stats.
+	// A panic of the hook is recovered, and a hook not returning in time is left running in background.
+	OnTenantCleaned func(userID string, stats CleanupStats)
+
+	// OnTenantEvent, if set, is invoked for each event of the lifecycle of a tenant, like the transition from
+	// active to deleted. It's protected like OnTenantCleaned.
+	OnTenantEvent func(userID string, event TenantEvent)
+
+	// DeleteEmptyTenants deletes the residual objects, like the bucket index and the markers, left in the location
+	// of a tenant not marked for deletion once no block is found for it.
+	DeleteEmptyTenants bool
+
+	// DeleteBatchSize is the max number of objects of a block deleted with a single request, when the bucket
+	// supports batch deletion (see bucket.BatchDeleter). 0 to delete the objects one by one.
+	DeleteBatchSize int
+
+	// AllowDeletionOnEmptyActiveUsers allows the deletion of the tenants marked for deletion even if no tenants scan since
+	// the cleaner started has found an active tenant, which may be caused by pointing to the wrong bucket.
+	AllowDeletionOnEmptyActiveUsers bool
+
+	// BlockDeleteFilter, if set, is consulted before deleting a block marked for deletion of a tenant not marked
+	// for deletion. The block is not deleted if it returns false.
+	BlockDeleteFilter func(userID string, meta *metadata.Meta) bool
+
+	// TenantShardFunc, if set, returns whether the tenant is owned by this cleaner, so that the tenants
+	// can be sharded across multiple cleaners. Tenants not owned are neither cleaned up nor deleted.
+	TenantShardFunc func(userID string) bool
+
+	// VerifyMarkBeforeDelete re-reads the deletion mark of a block marked for deletion, or of a partial block,
+	// right before deleting it, and doesn't delete the block if the mark is gone or has been replaced.
+	VerifyMarkBeforeDelete bool
+
+	// DisablePartialBlocksCleanup disables the deletion of the partial blocks, which are still tracked,
+	// so that they can be investigated manually.
+	DisablePartialBlocksCleanup bool
+
+	// ReportMalformedBlockDirs logs the directories in the tenant location which look like blocks, but fail
+	// to be parsed as block, and tracks them by a metric. Meant for debugging, given they're otherwise ignored.
+	ReportMalformedBlockDirs bool
+
+	// ArchiveDeletedMeta appends the meta.json of each block deleted because its tenant is marked for
+	// deletion to a compressed archive in the tenant location, before deleting the block.
+	ArchiveDeletedMeta bool
+
+	// MaxConcurrentBucketOps bounds the object storage operations run concurrently by the cleaner across
+	// all tenants, including the meta sync of each tenant. 0 means no limit, in which case up to
+	// CleanupConcurrency multiplied by MetaSyncConcurrency operations may be run concurrently.
+	MaxConcurrentBucketOps int
+
+	// PerTenantMetaFilesMetrics tracks the block metas synced, and the ones read from the local metas cache,
+	// by tenant. Disabled by default to keep the metrics cardinality bounded.
+	PerTenantMetaFilesMetrics bool
+
+	// MaxTenantsDeletedPerRun is the max number of tenants marked for deletion whose blocks are deleted
+	// by a single run, the ones marked the earliest first. The remaining ones are deferred to the next
+	// runs, so that a mass deletion is spread out. 0 means unlimited.
+	MaxTenantsDeletedPerRun int
+
+	// Now returns the current time, used by the age and delay comparisons of the cleaner (eg. to make
+	// them deterministic in tests). Defaults to time.Now if nil. The blocks marked for deletion are
+	// still excluded from the fetched blocks according to the real time.
+	Now func() time.Time
+}
+
+// Validate the config, returning an error if it would make the cleaner misbehave.
+func (cfg *BlocksCleanerConfig) Validate() error {
+	if cfg.DataDir == "" {
+		return errInvalidCleanerDataDir
+	}
+	if cfg.CleanupInterval <= 0 {
+		return errInvalidCleanerInterval
+	}
+	if cfg.CleanupConcurrency <= 0 {
+		return errInvalidCleanerConcurrency
+	}
+	if cfg.MetaSyncConcurrency <= 0 {
+		return errInvalidCleanerMetaSyncConcurrency
+	}
+	if cfg.DeletionDelay < 0 || cfg.TenantDeletionDelay < 0 || cfg.TenantDeletionMarkDelay < 0 || cfg.PartialBlockDeletionDelay < 0 {
+		return errInvalidCleanerDeletionDelay
+	}
+	if cfg.MaxConcurrentBucketOps < 0 {
+		return errInvalidCleanerMaxBucketOps
+	}
+	if cfg.MaxTenantsDeletedPerRun < 0 {
+		return errInvalidCleanerMaxTenantsDeleted
+	}
+	if cfg.FailedRunsMaxBackoff < 0 {
+		return errInvalidCleanerMaxBackoff
+	}
+
+	return nil
+}
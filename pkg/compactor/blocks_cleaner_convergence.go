@@ -0,0 +1,81 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/thanos-io/thanos/pkg/block"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// verifyUserConvergence re-fetches the blocks of a tenant not marked for deletion and checks
+// that no block marked for deletion beyond the deletion delay is left in the storage.
+func (c *BlocksCleaner) verifyUserConvergence(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	if c.skipConvergenceVerification(userLogger) {
+		return
+	}
+
+	ignoreDeletionMarkFilter, _, _, err := c.fetchUserBlocks(ctx, userID, userBucket, userLogger)
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to verify convergence of blocks cleanup", "err", err)
+		return
+	}
+
+	remaining := 0
+	deletionDelay := c.deletionDelay(userID)
+	for id, mark := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		if deletionDelayReached(mark, deletionDelay, c.now()) {
+			remaining++
+			level.Warn(userLogger).Log("msg", "block marked for deletion still exists after cleanup", "block", id)
+		}
+	}
+
+	if remaining > 0 {
+		c.convergenceFailures.Inc()
+		level.Warn(userLogger).Log("msg", "blocks cleanup didn't converge", "remainingMarkedBlocks", remaining)
+	}
+}
+
+// verifyDeletedUserConvergence re-lists the blocks of a tenant marked for deletion
+// and checks that no block is left in the storage.
+func (c *BlocksCleaner) verifyDeletedUserConvergence(ctx context.Context, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	if c.skipConvergenceVerification(userLogger) {
+		return
+	}
+
+	remaining := 0
+	err := userBucket.Iter(ctx, "", func(name string) error {
+		if id, ok := block.IsBlockDir(name); ok {
+			remaining++
+			level.Warn(userLogger).Log("msg", "block of user marked for deletion still exists after cleanup", "block", id)
+		}
+		return nil
+	})
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to verify convergence of blocks cleanup", "err", err)
+		return
+	}
+
+	if remaining > 0 {
+		c.convergenceFailures.Inc()
+		level.Warn(userLogger).Log("msg", "blocks cleanup of user marked for deletion didn't converge", "remainingBlocks", remaining)
+	}
+}
+
+// skipConvergenceVerification returns whether some blocks were expected to be left
+// in the storage by the current run, so that the verification would be meaningless.
+func (c *BlocksCleaner) skipConvergenceVerification(userLogger log.Logger) bool {
+	if c.runDeletionBudgetExhausted.Load() {
+		level.Debug(userLogger).Log("msg", "skipped verification of blocks cleanup convergence because the max number of blocks deleted per run has been reached")
+		return true
+	}
+
+	if c.cfg.DryRun {
+		level.Debug(userLogger).Log("msg", "skipped verification of blocks cleanup convergence because running in dry-run mode")
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,153 @@
+package compactor
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// corruptBlocks detects blocks whose meta.json exists but some of the files it references
+// don't, and keeps track of since when each corrupted block has been detected.
+type corruptBlocks struct {
+	mtx   sync.Mutex
+	since map[string]map[ulid.ULID]time.Time
+
+	detected          prometheus.Counter
+	markedForDeletion prometheus.Counter
+}
+
+func newCorruptBlocks(reg prometheus.Registerer) *corruptBlocks {
+	return &corruptBlocks{
+		since: map[string]map[ulid.ULID]time.Time{},
+		detected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_corrupt_blocks_detected_total",
+			Help: "Total number of times a block whose meta.json exists but some of the referenced files don't has been detected.",
+		}),
+		markedForDeletion: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_corrupt_blocks_marked_for_deletion_total",
+			Help: "Total number of corrupted blocks marked for deletion by the blocks cleaner.",
+		}),
+	}
+}
+
+// observe records the corrupted blocks of a tenant found by the current run, forgetting the ones
+// not corrupted anymore, and returns the ones continuously detected for at least the grace period.
+func (b *corruptBlocks) observe(userID string, corrupted []ulid.ULID, gracePeriod time.Duration, now time.Time) []ulid.ULID {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	prev := b.since[userID]
+	curr := make(map[ulid.ULID]time.Time, len(corrupted))
+
+	var expired []ulid.ULID
+	for _, id := range corrupted {
+		since, ok := prev[id]
+		if !ok {
+			since = now
+		}
+		curr[id] = since
+
+		if now.Sub(since) >= gracePeriod {
+			expired = append(expired, id)
+		}
+	}
+
+	if len(curr) == 0 {
+		delete(b.since, userID)
+	} else {
+		b.since[userID] = curr
+	}
+
+	return expired
+}
+
+// findCorruptBlocks returns the blocks not marked for deletion whose meta.json references files not
+// existing in the storage.
+func findCorruptBlocks(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, marks map[ulid.ULID]*metadata.DeletionMark, userBucket objstore.Bucket, userLogger log.Logger) ([]ulid.ULID, error) {
+	var corrupted []ulid.ULID
+
+	for id, meta := range metas {
+		if _, ok := marks[id]; ok {
+			continue
+		}
+
+		missing, err := findMissingBlockFile(ctx, id, meta, userBucket)
+		if err != nil {
+			return nil, err
+		}
+		if missing != "" {
+			level.Warn(userLogger).Log("msg", "found block referencing a file missing in the storage", "block", id, "file", missing)
+			corrupted = append(corrupted, id)
+		}
+	}
+
+	return corrupted, nil
+}
+
+// findMissingBlockFile returns the first file referenced by the meta.json which doesn't exist in the
+// storage or an empty string if all files exist.
+func findMissingBlockFile(ctx context.Context, id ulid.ULID, meta *metadata.Meta, userBucket objstore.Bucket) (string, error) {
+	for _, file := range blockReferencedFiles(meta) {
+		exists, err := userBucket.Exists(ctx, path.Join(id.String(), file))
+		if err != nil {
+			return "", errors.Wrapf(err, "check %s of block %s", file, id)
+		}
+		if !exists {
+			return file, nil
+		}
+	}
+
+	return "", nil
+}
+
+// blockReferencedFiles returns the files, excluding meta.json, referenced by the block meta.json.
+// Older blocks don't list their files, so we fallback to the index and the segment files.
+func blockReferencedFiles(meta *metadata.Meta) []string {
+	var files []string
+
+	for _, f := range meta.Thanos.Files {
+		if f.RelPath != metadata.MetaFilename {
+			files = append(files, f.RelPath)
+		}
+	}
+	if len(files) > 0 {
+		return files
+	}
+
+	files = append(files, block.IndexFilename)
+	for _, segment := range meta.Thanos.SegmentFiles {
+		files = append(files, path.Join(block.ChunksDirname, segment))
+	}
+	return files
+}
+
+// checkCorruptBlocks detects the corrupted blocks of a tenant and, if enabled, marks for deletion
+// the ones which have been detected as corrupted for at least the grace period.
+func (c *BlocksCleaner) checkCorruptBlocks(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, marks map[ulid.ULID]*metadata.DeletionMark, userBucket objstore.Bucket, userLogger log.Logger) {
+	corrupted, err := findCorruptBlocks(ctx, metas, marks, userBucket, userLogger)
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to check blocks for missing files", "err", err)
+		return
+	}
+
+	c.corruptBlocks.detected.Add(float64(len(corrupted)))
+	expired := c.corruptBlocks.observe(userID, corrupted, c.cfg.CorruptBlocksMarkingGracePeriod, c.now())
+
+	if c.cfg.CorruptBlocksMarkingGracePeriod <= 0 || len(expired) == 0 {
+		return
+	}
+
+	marked, failed := c.markBlocksForDeletion(ctx, userID, expired, "block files referenced by meta.json are missing", c.corruptBlocks.markedForDeletion, userBucket, userLogger)
+	level.Info(userLogger).Log("msg", "marked corrupted blocks for deletion", "markedBlocks", marked, "failedBlocks", failed)
+}
@@ -0,0 +1,95 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldMarkCorruptBlocksAfterGracePeriod(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block2.String(), block.IndexFilename)))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+		CorruptBlocksCheckEnabled:       true,
+		CorruptBlocksMarkingGracePeriod: time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	markExists := func(id string) bool {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", id, metadata.DeletionMarkFilename))
+		require.NoError(t, err)
+		return exists
+	}
+
+	// The corrupted block is detected but not marked until the grace period has elapsed.
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.corruptBlocks.detected))
+	assert.False(t, markExists(block2.String()))
+
+	// Move back in time the detection.
+	cleaner.corruptBlocks.since["user-1"][block2] = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.corruptBlocks.detected))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.corruptBlocks.markedForDeletion))
+	assert.False(t, markExists(block1.String()))
+	assert.True(t, markExists(block2.String()))
+
+	// Once marked for deletion, the block is not checked anymore.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.corruptBlocks.detected))
+	assert.NotContains(t, cleaner.corruptBlocks.since, "user-1")
+}
+
+func TestBlockReferencedFiles(t *testing.T) {
+	meta := &metadata.Meta{}
+	assert.Equal(t, []string{"index"}, blockReferencedFiles(meta))
+
+	meta.Thanos.SegmentFiles = []string{"000001", "000002"}
+	assert.Equal(t, []string{"index", "chunks/000001", "chunks/000002"}, blockReferencedFiles(meta))
+
+	meta.Thanos.Files = []metadata.File{{RelPath: "chunks/000001"}, {RelPath: "index"}, {RelPath: "meta.json"}}
+	assert.Equal(t, []string{"chunks/000001", "index"}, blockReferencedFiles(meta))
+}
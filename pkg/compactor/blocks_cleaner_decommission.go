@@ -0,0 +1,137 @@
+package compactor
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/util/concurrency"
+)
+
+var (
+	errDecommissionReadOnly      = errors.New("the blocks cleaner is read-only")
+	errDecommissionNotAuthorized = errors.New("the deletion of tenants is not authorized")
+)
+
+// DecommissionOptions configures a decommission of the bucket.
+type DecommissionOptions struct {
+	// Tenants to decommission. If empty, all tenants found in the bucket are decommissioned.
+	Tenants []string
+}
+
+// DecommissionFailure is a tenant whose blocks failed to be deleted.
+type DecommissionFailure struct {
+	UserID string `json:"user_id"`
+	Error  string `json:"error"`
+}
+
+// DecommissionReport describes what remains in the bucket after a decommission.
+type DecommissionReport struct {
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	// Tenants whose blocks deletion has been attempted.
+	Tenants []string `json:"tenants"`
+
+	// Tenants whose blocks failed to be deleted.
+	Failures []DecommissionFailure `json:"failures,omitempty"`
+
+	// Number of blocks still existing in the bucket.
+	RemainingBlocks int `json:"remaining_blocks"`
+
+	// Objects still existing in the bucket, including the ones belonging to the remaining blocks.
+	RemainingObjects []string `json:"remaining_objects,omitempty"`
+}
+
+// Empty returns whether the bucket was empty at the end of the decommission.
+func (r DecommissionReport) Empty() bool {
+	return len(r.RemainingObjects) == 0
+}
+
+// Decommission deletes the blocks of all tenants, regardless of whether they're marked for
+// deletion, and reports what remains in the bucket. The deletion goes through the same path
+// of the tenants marked for deletion, honoring the same interlocks: it's refused if the cleaner
+// is read-only or the deletion of tenants isn't authorized, while blocks left because of the
+// deletion budget or per-tenant config are reported as remaining, and the decommission can be
+// invoked again. An error is returned only if the decommission couldn't run or the bucket couldn't
+// be listed; per-tenant failures are listed in the report.
+func (c *BlocksCleaner) Decommission(ctx context.Context, opts DecommissionOptions) (DecommissionReport, error) {
+	report := DecommissionReport{StartedAt: time.Now()}
+
+	if c.readOnly() {
+		return report, errDecommissionReadOnly
+	}
+	if !c.authorizeTenantDeletion(ctx) {
+		return report, errDecommissionNotAuthorized
+	}
+
+	tenants := opts.Tenants
+	if len(tenants) == 0 {
+		users, deleted, err := c.usersScanner.ScanUsers(ctx)
+		if err != nil {
+			return report, errors.Wrap(err, "failed to discover users from bucket")
+		}
+		tenants = c.excludeReservedEntries(append(users, deleted...))
+	}
+	report.Tenants = tenants
+
+	level.Info(c.logger).Log("msg", "started decommissioning the bucket", "tenants", len(tenants))
+
+	mtx := sync.Mutex{}
+	err := concurrency.ForEachUser(ctx, tenants, c.cfg.CleanupConcurrency, func(ctx context.Context, userID string) error {
+		if !c.cfgProvider.CompactorBlocksCleanupEnabled(userID) {
+			level.Info(c.logger).Log("msg", "skipping decommission of user because blocks cleanup is disabled in the per-tenant config", "user", userID)
+			return nil
+		}
+
+		if err := c.deleteUser(ctx, userID, tenantDeletionReasonDecommission, nil); err != nil {
+			mtx.Lock()
+			report.Failures = append(report.Failures, DecommissionFailure{UserID: userID, Error: err.Error()})
+			mtx.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// List what remains in the whole bucket, and not only in the decommissioned tenants,
+	// so that the report can be used as a confirmation the bucket is empty.
+	blocks := map[string]struct{}{}
+	err = iterRecursive(ctx, c.bucketClient, "", func(name string) {
+		report.RemainingObjects = append(report.RemainingObjects, name)
+
+		if parts := strings.SplitN(name, objstore.DirDelim, 3); len(parts) == 3 {
+			if _, ok := block.IsBlockDir(parts[1]); ok {
+				blocks[parts[0]+objstore.DirDelim+parts[1]] = struct{}{}
+			}
+		}
+	})
+	if err != nil {
+		return report, errors.Wrap(err, "failed to list the remaining objects")
+	}
+
+	report.RemainingBlocks = len(blocks)
+	report.CompletedAt = time.Now()
+
+	level.Info(c.logger).Log("msg", "completed decommissioning the bucket", "failures", len(report.Failures), "remainingBlocks", report.RemainingBlocks, "remainingObjects", len(report.RemainingObjects))
+	return report, nil
+}
+
+// iterRecursive calls f for each object under dir, recursively.
+func iterRecursive(ctx context.Context, bkt objstore.Bucket, dir string, f func(name string)) error {
+	return bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return iterRecursive(ctx, bkt, name, f)
+		}
+
+		f(name)
+		return nil
+	})
+}
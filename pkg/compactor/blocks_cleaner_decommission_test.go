@@ -0,0 +1,116 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_Decommission(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	// The decommission is refused while standby.
+	cleaner.SetRole(BlocksCleanerRoleStandby)
+	_, err = cleaner.Decommission(ctx, DecommissionOptions{})
+	assert.Equal(t, errDecommissionReadOnly, err)
+
+	// Blocks of all tenants are deleted, regardless of whether they're marked for deletion,
+	// while the other objects are reported as remaining.
+	cleaner.SetRole(BlocksCleanerRoleActive)
+	report, err := cleaner.Decommission(ctx, DecommissionOptions{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user-1", "user-2"}, report.Tenants)
+	assert.Empty(t, report.Failures)
+	assert.Equal(t, 0, report.RemainingBlocks)
+	assert.Equal(t, []string{path.Join("user-2", tsdb.TenantDeletionMarkPath)}, report.RemainingObjects)
+	assert.False(t, report.Empty())
+
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-2", tsdb.TenantDeletionMarkPath)))
+	report, err = cleaner.Decommission(ctx, DecommissionOptions{Tenants: []string{"user-1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user-1"}, report.Tenants)
+	assert.True(t, report.Empty())
+}
+
+func TestBlocksCleaner_DecommissionShouldReportRemainingBlocks(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The deletion of the user-2 blocks fails.
+	cleaner := NewBlocksCleaner(cfg, &failingDeleteBucket{Bucket: bucketClient, prefix: "user-2/"}, scanner, newMockConfigProvider(), logger, nil)
+
+	report, err := cleaner.Decommission(ctx, DecommissionOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.Failures, 1)
+	assert.Equal(t, "user-2", report.Failures[0].UserID)
+	assert.Equal(t, 1, report.RemainingBlocks)
+	assert.NotEmpty(t, report.RemainingObjects)
+	assert.False(t, report.Empty())
+}
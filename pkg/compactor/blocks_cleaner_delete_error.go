@@ -0,0 +1,110 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// blockDeletionError is the error returned when a block deletion fails, carrying enough
+// context to locate the object which failed to be deleted in the object store.
+type blockDeletionError struct {
+	UserID string
+	Block  ulid.ULID
+
+	// The object store operation failed, and the object it was run on, relative to the tenant location.
+	Op     string
+	Object string
+
+	Err error
+}
+
+// Path returns the full object store path of the object the operation failed on.
+func (e *blockDeletionError) Path() string {
+	return path.Join(e.UserID, e.Object)
+}
+
+func (e *blockDeletionError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path(), e.Err)
+}
+
+func (e *blockDeletionError) Unwrap() error {
+	return e.Err
+}
+
+// blockDeletionErrorFields returns the log fields locating the object which failed to be deleted,
+// if the input error is a block deletion error.
+func blockDeletionErrorFields(err error) []interface{} {
+	var deletionErr *blockDeletionError
+	if !errors.As(err, &deletionErr) {
+		return nil
+	}
+	return []interface{}{"op", deletionErr.Op, "path", deletionErr.Path()}
+}
+
+// failedOpRecorderBucket is a bucket recording the last operation failed, and the object it was run on.
+type failedOpRecorderBucket struct {
+	objstore.Bucket
+
+	op     string
+	object string
+}
+
+func (b *failedOpRecorderBucket) record(op, object string, err error) error {
+	if err != nil {
+		b.op = op
+		b.object = object
+	}
+	return err
+}
+
+func (b *failedOpRecorderBucket) Exists(ctx context.Context, name string) (bool, error) {
+	ok, err := b.Bucket.Exists(ctx, name)
+	return ok, b.record("stat", name, err)
+}
+
+func (b *failedOpRecorderBucket) Delete(ctx context.Context, name string) error {
+	return b.record("delete", name, b.Bucket.Delete(ctx, name))
+}
+
+func (b *failedOpRecorderBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	// Errors returned by the callback are recorded by the operation run by the callback itself.
+	var callbackErr error
+	err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		callbackErr = f(name)
+		return callbackErr
+	})
+	if err == nil || (callbackErr != nil && errors.Is(err, callbackErr)) {
+		return err
+	}
+	return b.record("list", dir, err)
+}
+
+// DeleteBatch implements bucket.BatchDeleter. The batch deletion is run by the wrapped bucket
+// if supported, otherwise the objects are deleted one by one.
+func (b *failedOpRecorderBucket) DeleteBatch(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return b.record("delete batch", names[0], bucket.DeleteBatch(ctx, b.Bucket, names))
+}
+
+// wrap returns the input error as a block deletion error, locating the last operation failed.
+// The block location is reported if no operation failed.
+func (b *failedOpRecorderBucket) wrap(id ulid.ULID, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	op, object := b.op, b.object
+	if op == "" {
+		op, object = "delete", id.String()+objstore.DirDelim
+	}
+	return &blockDeletionError{Block: id, Op: op, Object: object, Err: err}
+}
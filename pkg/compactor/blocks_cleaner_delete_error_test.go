@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_DeleteBlockShouldReturnTheFailedObjectPath(t *testing.T) {
+	tests := map[string]struct {
+		failingBucket  func(bkt objstore.Bucket, blockDir string) objstore.Bucket
+		expectedOp     string
+		expectedObject string
+	}{
+		"failed object deletion": {
+			failingBucket: func(bkt objstore.Bucket, blockDir string) objstore.Bucket {
+				return &failingDeleteBucket{Bucket: bkt, prefix: path.Join(blockDir, "index")}
+			},
+			expectedOp:     "delete",
+			expectedObject: "index",
+		},
+		"failed listing": {
+			failingBucket: func(bkt objstore.Bucket, blockDir string) objstore.Bucket {
+				return &failingIterBucket{Bucket: bkt, dir: blockDir}
+			},
+			expectedOp:     "list",
+			expectedObject: "",
+		},
+	}
+
+	for testName, testData := range tests {
+		testData := testData
+
+		t.Run(testName, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			blockDir := path.Join("user-1", block1.String())
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+			userBucket := bucket.NewUserBucketClient("user-1", testData.failingBucket(bucketClient, blockDir))
+			err = cleaner.deleteBlock(context.Background(), "user-1", logger, userBucket, block1)
+			require.Error(t, err)
+
+			var deletionErr *blockDeletionError
+			require.True(t, errors.As(err, &deletionErr))
+			assert.Equal(t, "user-1", deletionErr.UserID)
+			assert.Equal(t, block1, deletionErr.Block)
+			assert.Equal(t, testData.expectedOp, deletionErr.Op)
+			assert.Equal(t, path.Join(blockDir, testData.expectedObject), deletionErr.Path())
+			assert.Contains(t, err.Error(), deletionErr.Path())
+			assert.Equal(t, []interface{}{"op", testData.expectedOp, "path", deletionErr.Path()}, blockDeletionErrorFields(err))
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package compactor
+
+import (
+	"context"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// excludedByDeleteFilter returns whether the deletion of the block marked for deletion is excluded by the
+// configured block delete filter. The block is excluded if its meta.json can't be read, given the filter
+// can't be evaluated.
+func (c *BlocksCleaner) excludedByDeleteFilter(ctx context.Context, userID string, id ulid.ULID, userBucket objstore.Bucket, userLogger log.Logger) bool {
+	if c.cfg.BlockDeleteFilter == nil {
+		return false
+	}
+
+	meta, err := readBlockMeta(ctx, userBucket, id)
+	if err != nil {
+		c.blocksDeletionFiltered.Inc()
+		level.Warn(userLogger).Log("msg", "skipped the deletion of a block because its meta.json can't be read to evaluate the block delete filter", "block", id, "err", err)
+		return true
+	}
+
+	if c.cfg.BlockDeleteFilter(userID, meta) {
+		return false
+	}
+
+	c.blocksDeletionFiltered.Inc()
+	level.Info(userLogger).Log("msg", "skipped the deletion of a block excluded by the block delete filter", "block", id)
+	return true
+}
+
+// readBlockMeta reads the meta.json of the block from the storage.
+func readBlockMeta(ctx context.Context, userBucket objstore.Bucket, id ulid.ULID) (*metadata.Meta, error) {
+	reader, err := userBucket.Get(ctx, path.Join(id.String(), metadata.MetaFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata.Read(reader)
+}
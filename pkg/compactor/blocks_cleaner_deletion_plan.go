@@ -0,0 +1,336 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// Supported deletion plan formats.
+	DeletionPlanFormatJSON = "json"
+	DeletionPlanFormatCSV  = "csv"
+
+	// deletionPlanApprovalSuffix is the suffix of the default approval object, stored next
+	// to the deletion plan.
+	deletionPlanApprovalSuffix = ".approved"
+
+	// Reasons why a block is deleted, as listed in the deletion plan and recorded by the deletion auditor.
+	deletionReasonTenantDeleted = "tenant-deleted"
+	deletionReasonDeletionMark  = "deletion-mark"
+	deletionReasonPartialBlock  = "partial-block"
+)
+
+var (
+	deletionPlanFormats = []string{DeletionPlanFormatJSON, DeletionPlanFormatCSV}
+
+	deletionPlanCSVHeader = []string{"user_id", "block_id", "reason"}
+
+	// deletionPlanReasons maps the read-only evaluation discrepancies to the reason
+	// a block is listed in the deletion plan.
+	deletionPlanReasons = map[string]string{
+		discrepancyTenantBlockNotDeleted:  deletionReasonTenantDeleted,
+		discrepancyMarkedBlockNotDeleted:  deletionReasonDeletionMark,
+		discrepancyPartialBlockNotDeleted: deletionReasonPartialBlock,
+	}
+)
+
+// DeletionPlan lists the blocks the blocks cleaner will delete once the plan is approved.
+type DeletionPlan struct {
+	CreatedAt int64               `json:"created_at"`
+	Blocks    []DeletionPlanEntry `json:"blocks"`
+}
+
+// DeletionPlanEntry is a block listed in the deletion plan.
+type DeletionPlanEntry struct {
+	UserID  string    `json:"user_id"`
+	BlockID ulid.ULID `json:"block_id"`
+	Reason  string    `json:"reason"`
+}
+
+// DeletionPlanDigest returns the digest an approval object must contain to approve
+// the input serialized deletion plan.
+func DeletionPlanDigest(plan []byte) string {
+	sum := sha256.Sum256(plan)
+	return hex.EncodeToString(sum[:])
+}
+
+type deletionPlanMode int
+
+const (
+	// No plan cycle is running (eg. the cleaner is read-only for other reasons).
+	deletionPlanIdle deletionPlanMode = iota
+
+	// The run evaluates the bucket read-only and writes the plan.
+	deletionPlanPlanning
+
+	// The run deletes only the blocks listed in the approved plan.
+	deletionPlanApplying
+)
+
+// deletionPlan runs the plan, approve and apply cycle of the blocks cleaner deletions.
+type deletionPlan struct {
+	path         string
+	approvalPath string
+	format       string
+	bkt          objstore.Bucket
+	logger       log.Logger
+
+	mtx     sync.Mutex
+	mode    deletionPlanMode
+	planned map[string]map[ulid.ULID]struct{}
+
+	plansWritten  prometheus.Counter
+	plansApplied  prometheus.Counter
+	plannedBlocks prometheus.Gauge
+	blocksSkipped prometheus.Counter
+}
+
+func newDeletionPlan(cfg BlocksCleanerConfig, bkt objstore.Bucket, logger log.Logger, reg prometheus.Registerer) *deletionPlan {
+	approvalPath := cfg.DeletionPlanApprovalPath
+	if approvalPath == "" {
+		approvalPath = cfg.DeletionPlanPath + deletionPlanApprovalSuffix
+	}
+
+	format := cfg.DeletionPlanFormat
+	if format == "" {
+		format = DeletionPlanFormatJSON
+	}
+
+	return &deletionPlan{
+		path:         cfg.DeletionPlanPath,
+		approvalPath: approvalPath,
+		format:       format,
+		bkt:          bkt,
+		logger:       logger,
+		plansWritten: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_deletion_plans_written_total",
+			Help: "Total number of blocks cleanup deletion plans written.",
+		}),
+		plansApplied: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_deletion_plans_applied_total",
+			Help: "Total number of approved blocks cleanup deletion plans applied.",
+		}),
+		plannedBlocks: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_compactor_deletion_plan_blocks",
+			Help: "Number of blocks listed in the last blocks cleanup deletion plan written or applied.",
+		}),
+		blocksSkipped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_deletion_plan_blocks_skipped_total",
+			Help: "Total number of blocks eligible for deletion but not deleted because not listed in the approved blocks cleanup deletion plan.",
+		}),
+	}
+}
+
+// begin switches to applying if an approved plan exists, otherwise to planning. When
+// active is false, no plan cycle is run.
+func (p *deletionPlan) begin(ctx context.Context, active bool) {
+	mode, planned := deletionPlanIdle, map[string]map[ulid.ULID]struct{}(nil)
+
+	if active {
+		mode = deletionPlanPlanning
+
+		plan, err := p.readApproved(ctx)
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to read the approved blocks cleanup deletion plan, planning again", "plan", p.path, "err", err)
+		} else if plan != nil {
+			mode, planned = deletionPlanApplying, map[string]map[ulid.ULID]struct{}{}
+			for _, entry := range plan.Blocks {
+				if planned[entry.UserID] == nil {
+					planned[entry.UserID] = map[ulid.ULID]struct{}{}
+				}
+				planned[entry.UserID][entry.BlockID] = struct{}{}
+			}
+
+			p.plannedBlocks.Set(float64(len(plan.Blocks)))
+			level.Info(p.logger).Log("msg", "applying the approved blocks cleanup deletion plan", "plan", p.path, "blocks", len(plan.Blocks))
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.mode = mode
+	p.planned = planned
+}
+
+// end completes the current plan cycle: a successful planning run writes the plan based on
+// the read-only evaluation report, while a successful applying run consumes the plan.
+func (p *deletionPlan) end(ctx context.Context, runErr error, report *ReconciliationReport) {
+	p.mtx.Lock()
+	mode := p.mode
+	p.mode = deletionPlanIdle
+	p.planned = nil
+	p.mtx.Unlock()
+
+	if runErr != nil {
+		return
+	}
+
+	switch mode {
+	case deletionPlanPlanning:
+		plan := DeletionPlan{CreatedAt: time.Now().Unix()}
+		if report != nil {
+			for _, d := range report.Discrepancies {
+				plan.Blocks = append(plan.Blocks, DeletionPlanEntry{UserID: d.UserID, BlockID: d.BlockID, Reason: deletionPlanReasons[d.Type]})
+			}
+		}
+
+		data, err := p.encode(plan)
+		if err == nil {
+			err = p.bkt.Upload(ctx, p.path, bytes.NewReader(data))
+		}
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to write the blocks cleanup deletion plan", "plan", p.path, "err", err)
+			return
+		}
+
+		p.plansWritten.Inc()
+		p.plannedBlocks.Set(float64(len(plan.Blocks)))
+		level.Info(p.logger).Log("msg", "written the blocks cleanup deletion plan, waiting for approval", "plan", p.path, "approval", p.approvalPath, "digest", DeletionPlanDigest(data), "blocks", len(plan.Blocks))
+
+	case deletionPlanApplying:
+		// The approval is deleted first, so that a plan is never applied twice.
+		for _, name := range []string{p.approvalPath, p.path} {
+			if err := p.bkt.Delete(ctx, name); err != nil && !p.bkt.IsObjNotFoundErr(err) {
+				level.Warn(p.logger).Log("msg", "failed to delete the applied blocks cleanup deletion plan", "object", name, "err", err)
+				return
+			}
+		}
+
+		p.plansApplied.Inc()
+		level.Info(p.logger).Log("msg", "applied the blocks cleanup deletion plan", "plan", p.path)
+	}
+}
+
+func (p *deletionPlan) planning() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.mode == deletionPlanPlanning
+}
+
+// allows returns whether the input block can be deleted by the current run.
+func (p *deletionPlan) allows(userID string, id ulid.ULID) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.mode != deletionPlanApplying {
+		return true
+	}
+
+	_, ok := p.planned[userID][id]
+	return ok
+}
+
+// readApproved returns the plan stored in the bucket if approved, or nil if there's
+// no plan or it hasn't been approved.
+func (p *deletionPlan) readApproved(ctx context.Context) (*DeletionPlan, error) {
+	data, err := p.readObject(ctx, p.path)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	approval, err := p.readObject(ctx, p.approvalPath)
+	if err != nil || approval == nil {
+		return nil, err
+	}
+
+	if digest := DeletionPlanDigest(data); strings.TrimSpace(string(approval)) != digest {
+		level.Warn(p.logger).Log("msg", "the blocks cleanup deletion plan approval doesn't match the plan, planning again", "approval", p.approvalPath, "expected", digest)
+		return nil, nil
+	}
+
+	return p.decode(data)
+}
+
+// readObject returns the content of the input object, or nil if it doesn't exist.
+func (p *deletionPlan) readObject(ctx context.Context, name string) ([]byte, error) {
+	r, err := p.bkt.Get(ctx, name)
+	if p.bkt.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(p.logger, r, "close deletion plan reader")
+
+	return ioutil.ReadAll(r)
+}
+
+func (p *deletionPlan) encode(plan DeletionPlan) ([]byte, error) {
+	if p.format != DeletionPlanFormatCSV {
+		data, err := json.Marshal(plan)
+		return data, errors.Wrap(err, "serialize deletion plan")
+	}
+
+	buf := bytes.Buffer{}
+	w := csv.NewWriter(&buf)
+	_ = w.Write(deletionPlanCSVHeader)
+	for _, entry := range plan.Blocks {
+		_ = w.Write([]string{entry.UserID, entry.BlockID.String(), entry.Reason})
+	}
+	w.Flush()
+
+	return buf.Bytes(), errors.Wrap(w.Error(), "serialize deletion plan")
+}
+
+func (p *deletionPlan) decode(data []byte) (*DeletionPlan, error) {
+	plan := &DeletionPlan{}
+
+	if p.format != DeletionPlanFormatCSV {
+		return plan, errors.Wrap(json.Unmarshal(data, plan), "deserialize deletion plan")
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = len(deletionPlanCSVHeader)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "deserialize deletion plan")
+		}
+		if line == 1 {
+			continue
+		}
+
+		id, err := ulid.Parse(record[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "deserialize deletion plan line %d", line)
+		}
+		plan.Blocks = append(plan.Blocks, DeletionPlanEntry{UserID: record[0], BlockID: id, Reason: record[2]})
+	}
+
+	return plan, nil
+}
+
+// plannedForDeletion returns whether the input block can be deleted by the current run,
+// according to the deletion plan. Always true if the deletion plan is disabled.
+func (c *BlocksCleaner) plannedForDeletion(userID string, id ulid.ULID, userLogger log.Logger) bool {
+	if c.deletionPlan == nil || c.deletionPlan.allows(userID, id) {
+		return true
+	}
+
+	c.deletionPlan.blocksSkipped.Inc()
+	level.Debug(userLogger).Log("msg", "skipped the deletion of a block not listed in the approved deletion plan", "block", id)
+	return false
+}
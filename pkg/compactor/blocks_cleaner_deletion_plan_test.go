@@ -0,0 +1,134 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldDeleteOnlyBlocksListedInTheApprovedDeletionPlan(t *testing.T) {
+	for _, format := range deletionPlanFormats {
+		t.Run(format, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+			createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+				DeletionPlanPath:    "plans/deletion-plan",
+				DeletionPlanFormat:  format,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			blockExists := func(id ulid.ULID) bool {
+				exists, err := bucketClient.Exists(ctx, path.Join("user-1", id.String(), metadata.MetaFilename))
+				require.NoError(t, err)
+				return exists
+			}
+
+			// The initial run plans the deletion without deleting anything.
+			assert.True(t, blockExists(block1))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionPlan.plansWritten))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionPlan.plannedBlocks))
+
+			reader, err := bucketClient.Get(ctx, cfg.DeletionPlanPath)
+			require.NoError(t, err)
+			plan, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+
+			decoded, err := cleaner.deletionPlan.decode(plan)
+			require.NoError(t, err)
+			require.Len(t, decoded.Blocks, 1)
+			assert.Equal(t, DeletionPlanEntry{UserID: "user-1", BlockID: block1, Reason: deletionReasonDeletionMark}, decoded.Blocks[0])
+
+			// A run without approval plans again.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assert.True(t, blockExists(block1))
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.deletionPlan.plansWritten))
+
+			// A plan whose approval doesn't match is not applied.
+			createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-2*time.Hour))
+			require.NoError(t, bucketClient.Upload(ctx, cfg.DeletionPlanPath+deletionPlanApprovalSuffix, bytes.NewReader([]byte("invalid"))))
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assert.True(t, blockExists(block1))
+			assert.True(t, blockExists(block2))
+
+			// The plan has been written again, so the approval must match the latest one.
+			reader, err = bucketClient.Get(ctx, cfg.DeletionPlanPath)
+			require.NoError(t, err)
+			plan, err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+
+			decoded, err = cleaner.deletionPlan.decode(plan)
+			require.NoError(t, err)
+			require.Len(t, decoded.Blocks, 2)
+
+			// Approve a plan only listing block1: block2, eligible too, is not deleted.
+			plan, err = cleaner.deletionPlan.encode(DeletionPlan{Blocks: []DeletionPlanEntry{{UserID: "user-1", BlockID: block1, Reason: deletionReasonDeletionMark}}})
+			require.NoError(t, err)
+			require.NoError(t, bucketClient.Upload(ctx, cfg.DeletionPlanPath, bytes.NewReader(plan)))
+			require.NoError(t, bucketClient.Upload(ctx, cfg.DeletionPlanPath+deletionPlanApprovalSuffix, bytes.NewReader([]byte(DeletionPlanDigest(plan)+"\n"))))
+
+			// The approved plan is applied and consumed.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assert.False(t, blockExists(block1))
+			assert.True(t, blockExists(block2))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionPlan.plansApplied))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionPlan.blocksSkipped))
+
+			for _, name := range []string{cfg.DeletionPlanPath, cfg.DeletionPlanPath + deletionPlanApprovalSuffix} {
+				exists, err := bucketClient.Exists(ctx, name)
+				require.NoError(t, err)
+				assert.False(t, exists, name)
+			}
+
+			// The next run plans the deletion of the remaining block.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assert.True(t, blockExists(block2))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionPlan.plannedBlocks))
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package compactor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+var (
+	errTenantDeletionTokenNotFound = errors.New("tenant deletion token not found")
+	errTenantDeletionTokenExpired  = errors.New("tenant deletion token expired")
+	errTenantDeletionTokenInvalid  = errors.New("tenant deletion token signature is invalid")
+)
+
+// TenantDeletionTokenValidator validates the content of the token authorizing the
+// deletion of tenants marked for deletion.
+type TenantDeletionTokenValidator interface {
+	// Validate returns an error if the token doesn't authorize the deletion of tenants at the given time.
+	Validate(ctx context.Context, token []byte, now time.Time) error
+}
+
+// TenantDeletionToken is the content of the token validated by the HMAC validator.
+type TenantDeletionToken struct {
+	// ExpiresAt is the unix timestamp (seconds precision) after which the token is not valid anymore.
+	ExpiresAt int64 `json:"expires_at"`
+
+	// Signature is the hex encoded HMAC-SHA256 of ExpiresAt (formatted in base 10).
+	Signature string `json:"signature"`
+}
+
+type hmacTenantDeletionTokenValidator struct {
+	secret []byte
+}
+
+// NewHMACTenantDeletionTokenValidator returns a validator of a TenantDeletionToken signed with the input secret.
+func NewHMACTenantDeletionTokenValidator(secret string) TenantDeletionTokenValidator {
+	return &hmacTenantDeletionTokenValidator{secret: []byte(secret)}
+}
+
+func (v *hmacTenantDeletionTokenValidator) Validate(_ context.Context, data []byte, now time.Time) error {
+	token := TenantDeletionToken{}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return errors.Wrap(err, "decode tenant deletion token")
+	}
+
+	signature, err := hex.DecodeString(token.Signature)
+	if err != nil || !hmac.Equal(signature, SignTenantDeletionToken(v.secret, token.ExpiresAt)) {
+		return errTenantDeletionTokenInvalid
+	}
+
+	if !now.Before(time.Unix(token.ExpiresAt, 0)) {
+		return errTenantDeletionTokenExpired
+	}
+
+	return nil
+}
+
+// SignTenantDeletionToken returns the HMAC-SHA256 signature of a token expiring at the input unix timestamp.
+func SignTenantDeletionToken(secret []byte, expiresAt int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(strconv.FormatInt(expiresAt, 10)))
+	return mac.Sum(nil)
+}
+
+// authorizeTenantDeletion returns whether the deletion of tenants marked for deletion is authorized.
+func (c *BlocksCleaner) authorizeTenantDeletion(ctx context.Context) bool {
+	if c.cfg.TenantDeletionTokenPath == "" {
+		return true
+	}
+
+	if err := c.validateTenantDeletionToken(ctx); err != nil {
+		level.Warn(c.logger).Log("msg", "deletion of tenants marked for deletion is not authorized, deferring it to the next runs", "token", c.cfg.TenantDeletionTokenPath, "err", err)
+		return false
+	}
+
+	return true
+}
+
+func (c *BlocksCleaner) validateTenantDeletionToken(ctx context.Context) error {
+	if c.cfg.TenantDeletionTokenValidator == nil {
+		return errors.New("no tenant deletion token validator configured")
+	}
+
+	r, err := c.bucketClient.Get(ctx, c.cfg.TenantDeletionTokenPath)
+	if c.bucketClient.IsObjNotFoundErr(err) {
+		return errTenantDeletionTokenNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "read tenant deletion token")
+	}
+	defer runutil.CloseWithLogOnErr(c.logger, r, "close tenant deletion token reader")
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read tenant deletion token")
+	}
+
+	return c.cfg.TenantDeletionTokenValidator.Validate(ctx, data, time.Now())
+}
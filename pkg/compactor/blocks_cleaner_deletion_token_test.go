@@ -0,0 +1,143 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestHMACTenantDeletionTokenValidator(t *testing.T) {
+	now := time.Now()
+	validator := NewHMACTenantDeletionTokenValidator("secret")
+
+	tests := map[string]struct {
+		token    []byte
+		expected error
+	}{
+		"valid token": {
+			token: mockTenantDeletionToken(t, "secret", now.Add(time.Hour)),
+		},
+		"expired token": {
+			token:    mockTenantDeletionToken(t, "secret", now.Add(-time.Second)),
+			expected: errTenantDeletionTokenExpired,
+		},
+		"token signed with another secret": {
+			token:    mockTenantDeletionToken(t, "another", now.Add(time.Hour)),
+			expected: errTenantDeletionTokenInvalid,
+		},
+		"token with a tampered expiration": {
+			token: func() []byte {
+				token := TenantDeletionToken{}
+				require.NoError(t, json.Unmarshal(mockTenantDeletionToken(t, "secret", now.Add(time.Hour)), &token))
+				token.ExpiresAt += 3600
+				data, err := json.Marshal(token)
+				require.NoError(t, err)
+				return data
+			}(),
+			expected: errTenantDeletionTokenInvalid,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, validator.Validate(context.Background(), testData.token, now))
+		})
+	}
+
+	assert.Error(t, validator.Validate(context.Background(), []byte("{"), now))
+}
+
+func TestBlocksCleaner_ShouldDeferTenantDeletionWithoutValidToken(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	tokenPath := "tenant-deletion-token.json"
+	cfg := BlocksCleanerConfig{
+		AllowDeletionOnEmptyActiveUsers: true,
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+		TenantDeletionTokenPath:         tokenPath,
+		TenantDeletionTokenValidator:    NewHMACTenantDeletionTokenValidator("secret"),
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	blockExists := func() bool {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		return exists
+	}
+
+	// No token.
+	assert.True(t, blockExists())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletionsDeferred))
+
+	// Expired token.
+	uploadTenantDeletionToken(t, bucketClient, tokenPath, mockTenantDeletionToken(t, "secret", time.Now().Add(-time.Minute)))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.True(t, blockExists())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantDeletionsDeferred))
+
+	// Valid token.
+	uploadTenantDeletionToken(t, bucketClient, tokenPath, mockTenantDeletionToken(t, "secret", time.Now().Add(time.Minute)))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.False(t, blockExists())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantDeletionsDeferred))
+
+	// The token has not been considered a tenant.
+	assert.NotContains(t, cleaner.classifier.states, tokenPath)
+}
+
+func mockTenantDeletionToken(t *testing.T, secret string, expiresAt time.Time) []byte {
+	data, err := json.Marshal(TenantDeletionToken{
+		ExpiresAt: expiresAt.Unix(),
+		Signature: hex.EncodeToString(SignTenantDeletionToken([]byte(secret), expiresAt.Unix())),
+	})
+	require.NoError(t, err)
+	return data
+}
+
+func uploadTenantDeletionToken(t *testing.T, bkt objstore.Bucket, tokenPath string, token []byte) {
+	require.NoError(t, bkt.Upload(context.Background(), tokenPath, bytes.NewReader(token)))
+}
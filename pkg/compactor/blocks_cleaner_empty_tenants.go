@@ -0,0 +1,110 @@
+package compactor
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+var errEmptyTenantHasBlocks = errors.New("a block has been found in the location of the empty tenant")
+
+// emptyTenants tracks the tenants not marked for deletion for which the last cleanup has found no block.
+type emptyTenants struct {
+	gauge prometheus.Gauge
+
+	mtx   sync.Mutex
+	users map[string]struct{}
+}
+
+func newEmptyTenants(gauge prometheus.Gauge) *emptyTenants {
+	return &emptyTenants{gauge: gauge, users: map[string]struct{}{}}
+}
+
+// observe records whether the tenant has been found empty by its last cleanup.
+func (e *emptyTenants) observe(userID string, empty bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if empty {
+		e.users[userID] = struct{}{}
+	} else {
+		delete(e.users, userID)
+	}
+	e.gauge.Set(float64(len(e.users)))
+}
+
+// retain removes the tracked tenants which are not in the input list.
+func (e *emptyTenants) retain(userIDs []string) {
+	keep := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		keep[userID] = struct{}{}
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for userID := range e.users {
+		if _, ok := keep[userID]; !ok {
+			delete(e.users, userID)
+		}
+	}
+	e.gauge.Set(float64(len(e.users)))
+}
+
+// deleteEmptyTenant deletes the residual objects (eg. the bucket index and the markers) left in the
+// location of a tenant with no block. Nothing is deleted if a block is found while listing them.
+func (c *BlocksCleaner) deleteEmptyTenant(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger) error {
+	objects, err := listEmptyTenantObjects(ctx, userBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range objects {
+		if c.cfg.DryRun {
+			level.Info(userLogger).Log("msg", "would delete residual object of empty user", "object", name, "dryRun", true)
+			continue
+		}
+
+		if err := userBucket.Delete(ctx, name); err != nil && !userBucket.IsObjNotFoundErr(err) {
+			return errors.Wrapf(err, "delete residual object %s", name)
+		}
+	}
+
+	if !c.cfg.DryRun {
+		level.Info(userLogger).Log("msg", "deleted residual objects of empty user", "objects", len(objects))
+	}
+	return nil
+}
+
+// listEmptyTenantObjects returns all the objects stored in the tenant location, or errEmptyTenantHasBlocks
+// if a location which could be a block one is found.
+func listEmptyTenantObjects(ctx context.Context, userBucket objstore.Bucket) ([]string, error) {
+	var objects []string
+
+	err := userBucket.Iter(ctx, "", func(name string) error {
+		// Be conservative with any entry which could be a temporary location of a block.
+		if hasULIDPrefix(name) {
+			return errEmptyTenantHasBlocks
+		}
+
+		if !strings.HasSuffix(name, objstore.DirDelim) {
+			objects = append(objects, name)
+			return nil
+		}
+
+		nested, err := listOrphanObjects(ctx, userBucket, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, nested...)
+		return nil
+	})
+
+	return objects, err
+}
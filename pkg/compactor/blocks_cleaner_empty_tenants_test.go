@@ -0,0 +1,118 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldTrackAndOptionallyDeleteEmptyTenants(t *testing.T) {
+	for name, deleteEmptyTenants := range map[string]bool{
+		"empty tenants deletion disabled": false,
+		"empty tenants deletion enabled":  true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			// The user-1 has no block left, but some residual objects.
+			ctx := context.Background()
+			residuals := []string{
+				path.Join("user-1", bucketindex.IndexCompressedFilename),
+				path.Join("user-1", "debug", "metas.json"),
+			}
+			for _, name := range residuals {
+				require.NoError(t, bucketClient.Upload(ctx, name, bytes.NewReader([]byte("residual"))))
+			}
+			block1 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+				DeleteEmptyTenants:  deleteEmptyTenants,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.emptyTenants.gauge))
+			assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+
+			for _, name := range residuals {
+				exists, err := bucketClient.Exists(ctx, name)
+				require.NoError(t, err)
+				assert.Equal(t, !deleteEmptyTenants, exists, name)
+			}
+
+			// The blocks of other tenants are left untouched.
+			exists, err := bucketClient.Exists(ctx, path.Join("user-2", block1.String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			assert.True(t, exists)
+
+			// Once deleted, the empty tenant is not tracked anymore.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			if deleteEmptyTenants {
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.emptyTenants.gauge))
+			} else {
+				assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.emptyTenants.gauge))
+			}
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldNotDeleteEmptyTenantResidualsIfBlockFound(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+
+	// A block whose upload is in progress.
+	ctx := context.Background()
+	require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", bucketindex.IndexCompressedFilename), bytes.NewReader([]byte("residual"))))
+	require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", "01EQK4QKFHVSZYVJ908Y7HH9E0", "index"), bytes.NewReader([]byte("index"))))
+
+	cleaner := &BlocksCleaner{}
+	err = cleaner.deleteEmptyTenant(ctx, bucket.NewUserBucketClient("user-1", bucketClient), log.NewNopLogger())
+	assert.Equal(t, errEmptyTenantHasBlocks, err)
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", bucketindex.IndexCompressedFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
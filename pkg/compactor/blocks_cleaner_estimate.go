@@ -0,0 +1,179 @@
+package compactor
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/cortexproject/cortex/pkg/util/concurrency"
+)
+
+// CleanupEstimate describes the cleanup work the blocks cleaner would do if run now.
+type CleanupEstimate struct {
+	EstimatedAt time.Time `json:"estimated_at"`
+
+	Tenants []TenantCleanupEstimate `json:"tenants"`
+}
+
+// TenantCleanupEstimate describes the cleanup work of a single tenant.
+type TenantCleanupEstimate struct {
+	UserID string `json:"user_id"`
+
+	// Whether the tenant is marked for deletion, in which case all its blocks are deletable.
+	MarkedForDeletion bool `json:"marked_for_deletion"`
+
+	// Blocks marked for deletion which haven't reached the deletion delay yet.
+	PendingBlocks int   `json:"pending_blocks"`
+	PendingBytes  int64 `json:"pending_bytes"`
+
+	// Blocks which would be deleted.
+	DeletableBlocks int   `json:"deletable_blocks"`
+	DeletableBytes  int64 `json:"deletable_bytes"`
+
+	// Partial blocks found, and the ones which would be deleted.
+	PartialBlocks          int `json:"partial_blocks"`
+	DeletablePartialBlocks int `json:"deletable_partial_blocks"`
+
+	// Set if the tenant blocks couldn't be fetched.
+	Error string `json:"error,omitempty"`
+}
+
+// DeletableBlocks returns the total number of blocks which would be deleted, including the partial ones.
+func (e CleanupEstimate) DeletableBlocks() int {
+	total := 0
+	for _, t := range e.Tenants {
+		total += t.DeletableBlocks + t.DeletablePartialBlocks
+	}
+	return total
+}
+
+// DeletableBytes returns the total size of the blocks which would be deleted, as tracked by their meta.json.
+func (e CleanupEstimate) DeletableBytes() int64 {
+	total := int64(0)
+	for _, t := range e.Tenants {
+		total += t.DeletableBytes
+	}
+	return total
+}
+
+// EstimateCleanup returns the cleanup work the blocks cleaner would do if run now, without deleting
+// or marking any block. The tenants are discovered and filtered like in a cleanup run, and their blocks
+// fetched from the storage. The estimate ignores the deletion budget and the blocks which would be
+// marked for deletion by the run itself (eg. by the retention). An error is returned only if the
+// tenants couldn't be discovered; per-tenant failures are reported in the estimate.
+func (c *BlocksCleaner) EstimateCleanup(ctx context.Context) (CleanupEstimate, error) {
+	estimate := CleanupEstimate{EstimatedAt: time.Now()}
+
+	users, deleted, err := c.usersScanner.ScanUsers(ctx)
+	if err != nil {
+		return estimate, errors.Wrap(err, "failed to discover users from bucket")
+	}
+
+	users = c.filterOwnedUsers(c.filterAllowedUsers(c.excludeReservedEntries(users)))
+	deleted = c.filterOwnedUsers(c.filterAllowedUsers(c.excludeReservedEntries(deleted)))
+
+	isDeleted := map[string]bool{}
+	for _, userID := range deleted {
+		isDeleted[userID] = true
+	}
+
+	mtx := sync.Mutex{}
+	err = concurrency.ForEachUser(ctx, append(users, deleted...), c.cfg.CleanupConcurrency, func(ctx context.Context, userID string) error {
+		if !c.cfgProvider.CompactorBlocksCleanupEnabled(userID) {
+			return nil
+		}
+
+		var tenant TenantCleanupEstimate
+		if isDeleted[userID] {
+			tenant = c.estimateUserDeletion(ctx, userID)
+		} else {
+			tenant = c.estimateUserCleanup(ctx, userID)
+		}
+
+		mtx.Lock()
+		estimate.Tenants = append(estimate.Tenants, tenant)
+		mtx.Unlock()
+		return nil
+	})
+	if err != nil {
+		return estimate, err
+	}
+
+	sort.Slice(estimate.Tenants, func(i, j int) bool {
+		return estimate.Tenants[i].UserID < estimate.Tenants[j].UserID
+	})
+
+	return estimate, nil
+}
+
+// estimateUserDeletion estimates the cleanup work of a tenant marked for deletion.
+func (c *BlocksCleaner) estimateUserDeletion(ctx context.Context, userID string) TenantCleanupEstimate {
+	estimate := TenantCleanupEstimate{UserID: userID, MarkedForDeletion: true}
+	userLogger := util.WithUserID(userID, c.logger)
+	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
+
+	var blocks []ulid.ULID
+	err := userBucket.Iter(ctx, "", func(name string) error {
+		if id, ok := block.IsBlockDir(name); ok {
+			blocks = append(blocks, id)
+		}
+		return nil
+	})
+	if err != nil {
+		estimate.Error = err.Error()
+		return estimate
+	}
+
+	estimate.DeletableBlocks = len(blocks)
+	estimate.DeletableBytes = c.blocksSize(ctx, userLogger, userBucket, blocks)
+	return estimate
+}
+
+// estimateUserCleanup estimates the cleanup work of a tenant not marked for deletion.
+func (c *BlocksCleaner) estimateUserCleanup(ctx context.Context, userID string) TenantCleanupEstimate {
+	estimate := TenantCleanupEstimate{UserID: userID}
+	userLogger := util.WithUserID(userID, c.logger)
+	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
+
+	ignoreDeletionMarkFilter, metas, partials, err := c.fetchUserBlocks(ctx, userID, userBucket, userLogger)
+	if err != nil {
+		estimate.Error = err.Error()
+		return estimate
+	}
+
+	marks := ignoreDeletionMarkFilter.DeletionMarkBlocks()
+	estimate.PendingBlocks, estimate.PendingBytes = pendingDeletionBlocks(marks, metas, c.deletionDelay(userID), c.now())
+
+	var deletable []ulid.ULID
+	for id, mark := range marks {
+		if deletionDelayReached(mark, c.deletionDelay(userID), c.now()) {
+			deletable = append(deletable, id)
+		}
+	}
+	estimate.DeletableBlocks = len(deletable)
+	estimate.DeletableBytes = c.blocksSize(ctx, userLogger, userBucket, deletable)
+
+	estimate.PartialBlocks = len(partials)
+	if !c.cfg.DisablePartialBlocksCleanup {
+		estimate.DeletablePartialBlocks = len(c.findDeletablePartialBlocks(ctx, partials, userBucket, userLogger))
+	}
+
+	return estimate
+}
+
+// blocksSize returns the total size in bytes of the input blocks.
+func (c *BlocksCleaner) blocksSize(ctx context.Context, userLogger log.Logger, userBucket *bucket.UserBucketClient, blocks []ulid.ULID) int64 {
+	size := int64(0)
+	for _, id := range blocks {
+		size += c.blockSize(ctx, userLogger, userBucket, id)
+	}
+	return size
+}
@@ -0,0 +1,106 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_EstimateCleanup(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+
+	// user-1 has a block not marked, a block marked within the deletion delay, a block
+	// marked since longer than the deletion delay and a partial block marked for deletion.
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-1", 40, 50, nil)
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block3, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block4, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block4.String(), metadata.MetaFilename)))
+
+	// user-2 is marked for deletion.
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 20, 30, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+
+		// The test blocks don't track the size of their files in the meta.json.
+		DeletedBytesFromObjects: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	estimate, err := cleaner.EstimateCleanup(ctx)
+	require.NoError(t, err)
+	require.Len(t, estimate.Tenants, 2)
+
+	user1 := estimate.Tenants[0]
+	assert.Equal(t, "user-1", user1.UserID)
+	assert.False(t, user1.MarkedForDeletion)
+	assert.Equal(t, 1, user1.PendingBlocks)
+	assert.Equal(t, 1, user1.DeletableBlocks)
+	assert.Greater(t, user1.DeletableBytes, int64(0))
+	assert.Equal(t, 1, user1.PartialBlocks)
+	assert.Equal(t, 1, user1.DeletablePartialBlocks)
+	assert.Empty(t, user1.Error)
+
+	user2 := estimate.Tenants[1]
+	assert.Equal(t, "user-2", user2.UserID)
+	assert.True(t, user2.MarkedForDeletion)
+	assert.Equal(t, 2, user2.DeletableBlocks)
+	assert.Greater(t, user2.DeletableBytes, int64(0))
+
+	assert.Equal(t, 4, estimate.DeletableBlocks())
+	assert.Equal(t, user1.DeletableBytes+user2.DeletableBytes, estimate.DeletableBytes())
+
+	// Nothing has been deleted.
+	for _, id := range []string{block3.String(), block4.String()} {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", id, metadata.DeletionMarkFilename))
+		require.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	users, deleted, err := scanner.ScanUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user-1"}, users)
+	assert.Equal(t, []string{"user-2"}, deleted)
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.bucketClient.(*cleanupMetricsBucket).ops.WithLabelValues("delete")))
+}
@@ -0,0 +1,156 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// Reasons why a block is excluded while fetching the blocks. They match the metadata
+// fetcher synced states.
+const (
+	exclusionReasonMarkedForDeletion = "marked-for-deletion"
+	exclusionReasonNoMeta            = "no-meta-json"
+	exclusionReasonCorruptedMeta     = "corrupted-meta-json"
+	exclusionReasonFailedMeta        = "failed"
+)
+
+// fetchUserBlocks runs a bucket scan to get a fresh list of all blocks of a tenant. Returns the
+// filter populated with the blocks marked for deletion, the blocks metas and the partial blocks.
+func (c *BlocksCleaner) fetchUserBlocks(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) (*block.IgnoreDeletionMarkFilter, map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	ignoreDeletionMarkFilter, metas, partials, err := c.fetchUserBlocksWithRecovery(ctx, userID, userBucket, userLogger)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		c.metaSyncFailures.WithLabelValues(userID).Inc()
+	}
+
+	return ignoreDeletionMarkFilter, metas, partials, err
+}
+
+// fetchUserBlocksWithRecovery fetches the blocks of the tenant, retrying once if the fetch failed
+// because of the local metas cache.
+func (c *BlocksCleaner) fetchUserBlocksWithRecovery(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) (*block.IgnoreDeletionMarkFilter, map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	ignoreDeletionMarkFilter, metas, partials, err := c.fetchUserBlocksOnce(ctx, userID, userBucket, userLogger)
+	if err == nil || !isLocalDirError(err, c.metaSyncDirForUser(userID)) {
+		return ignoreDeletionMarkFilter, metas, partials, err
+	}
+
+	// The local metas cache is likely corrupted (eg. partially written before a crash), so
+	// it's wiped and the blocks are fetched once again.
+	level.Warn(userLogger).Log("msg", "failed to fetch blocks because of the local metas cache, wiping it and retrying", "dir", c.metaSyncDirForUser(userID), "err", err)
+	if removeErr := os.RemoveAll(c.metaSyncDirForUser(userID)); removeErr != nil {
+		level.Warn(userLogger).Log("msg", "failed to wipe the local metas cache", "dir", c.metaSyncDirForUser(userID), "err", removeErr)
+		return nil, nil, nil, err
+	}
+
+	ignoreDeletionMarkFilter, metas, partials, err = c.fetchUserBlocksOnce(ctx, userID, userBucket, userLogger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c.metaCacheCorruptionRecovered.Inc()
+	level.Warn(userLogger).Log("msg", "recovered from a corrupted local metas cache")
+	return ignoreDeletionMarkFilter, metas, partials, nil
+}
+
+// fetchUserBlocksOnce fetches the blocks of the tenant from the storage, without retrying on error.
+func (c *BlocksCleaner) fetchUserBlocksOnce(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) (*block.IgnoreDeletionMarkFilter, map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	metaSyncConcurrency := c.capBucketOpsConcurrency(c.cfg.MetaSyncConcurrency)
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(userLogger, userBucket, c.deletionDelay(userID), metaSyncConcurrency)
+
+	fetcher, err := block.NewMetaFetcher(
+		userLogger,
+		metaSyncConcurrency,
+		userBucket,
+		// The fetcher stores cached metas in the "meta-syncer/" sub directory,
+		// but we prefix it in order to guarantee no clashing with the compactor.
+		c.metaSyncDirForUser(userID),
+		// No metrics.
+		nil,
+		[]block.MetadataFilter{ignoreDeletionMarkFilter},
+		nil,
+	)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error creating metadata fetcher")
+	}
+
+	cached := c.locallyCachedMetas(userID)
+	metas, partials, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error fetching metadata")
+	}
+
+	c.trackMetaFilesSynced(userID, metas, cached)
+	return ignoreDeletionMarkFilter, metas, partials, nil
+}
+
+// isLocalDirError returns whether the error has been caused by an operation on the local
+// filesystem, within the input directory.
+func isLocalDirError(err error, dir string) bool {
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		return false
+	}
+
+	rel, relErr := filepath.Rel(dir, pathErr.Path)
+	return relErr == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// metaSyncDirForUser returns the local directory where the metas of the tenant blocks are cached.
+func (c *BlocksCleaner) metaSyncDirForUser(userID string) string {
+	dir := c.cfg.MetaCacheDir
+	if dir == "" {
+		dir = c.cfg.DataDir
+	}
+	return path.Join(dir, "blocks-cleaner-meta-"+userID)
+}
+
+// countFetchedBlocks returns the number of blocks found by fetchUserBlocks(), including
+// the blocks filtered out because marked for deletion.
+func countFetchedBlocks(ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, metas map[ulid.ULID]*metadata.Meta, partials map[ulid.ULID]error) int {
+	count := len(metas) + len(partials)
+	for id := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		_, isMeta := metas[id]
+		_, isPartial := partials[id]
+		if !isMeta && !isPartial {
+			count++
+		}
+	}
+	return count
+}
+
+// trackExcludedBlocks accounts the blocks excluded by fetchUserBlocks(), by the reason
+// they've been excluded.
+func (c *BlocksCleaner) trackExcludedBlocks(ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, partials map[ulid.ULID]error, userLogger log.Logger) {
+	for id := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		if _, isPartial := partials[id]; isPartial {
+			continue
+		}
+
+		c.blocksExcluded.WithLabelValues(exclusionReasonMarkedForDeletion).Inc()
+		level.Debug(userLogger).Log("msg", "block excluded while fetching blocks", "block", id, "reason", exclusionReasonMarkedForDeletion)
+	}
+
+	for id, err := range partials {
+		reason := exclusionReasonFailedMeta
+		switch errors.Cause(err) {
+		case block.ErrorSyncMetaNotFound:
+			reason = exclusionReasonNoMeta
+		case block.ErrorSyncMetaCorrupted:
+			reason = exclusionReasonCorruptedMeta
+		}
+
+		c.blocksExcluded.WithLabelValues(reason).Inc()
+		level.Debug(userLogger).Log("msg", "block excluded while fetching blocks", "block", id, "reason", reason, "err", err)
+	}
+}
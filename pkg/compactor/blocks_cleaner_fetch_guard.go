@@ -0,0 +1,67 @@
+package compactor
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// fetchGuard tracks the number of blocks found for each tenant by the last cleanup run, in
+// order to detect a listing unexpectedly returning no blocks (eg. a transient storage glitch).
+type fetchGuard struct {
+	minBlocks int
+
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+func newFetchGuard(minBlocks int) *fetchGuard {
+	return &fetchGuard{
+		minBlocks: minBlocks,
+		counts:    map[string]int{},
+	}
+}
+
+// observe records the number of blocks found for the tenant and returns whether the
+// listing is suspicious, because no block has been found while the previous run found
+// at least the configured min number of blocks.
+func (g *fetchGuard) observe(logger log.Logger, userID string, count int) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	previous := g.counts[userID]
+	g.counts[userID] = count
+
+	if g.minBlocks <= 0 || count > 0 || previous < g.minBlocks {
+		return false
+	}
+
+	level.Warn(logger).Log("msg", "no block found for user while the previous cleanup found some, skipping the user cleanup for this run", "previousBlocks", previous)
+	return true
+}
+
+// previous returns the number of blocks found for the tenant by the last cleanup run, or 0 if unknown.
+func (g *fetchGuard) previous(userID string) int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	return g.counts[userID]
+}
+
+// retain removes the tracked tenants which are not in the input list.
+func (g *fetchGuard) retain(userIDs []string) {
+	keep := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		keep[userID] = struct{}{}
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for userID := range g.counts {
+		if _, ok := keep[userID]; !ok {
+			delete(g.counts, userID)
+		}
+	}
+}
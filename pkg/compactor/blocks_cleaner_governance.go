@@ -0,0 +1,229 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+const (
+	// governanceAppliedSuffix is the suffix of the object, stored next to the governance
+	// file, recording the governance rows applied by the last cleanup run.
+	governanceAppliedSuffix = ".applied.json"
+)
+
+// GovernanceAppliedRow is a governance file row applied by the blocks cleaner.
+type GovernanceAppliedRow struct {
+	UserID       string `json:"user_id"`
+	Cutoff       int64  `json:"cutoff"`
+	AppliedAt    int64  `json:"applied_at"`
+	BlocksMarked int    `json:"blocks_marked"`
+	BlocksFailed int    `json:"blocks_failed,omitempty"`
+}
+
+// governance applies the per-tenant cutoffs listed in a CSV file uploaded to the bucket.
+type governance struct {
+	file      string
+	separator rune
+	hasHeader bool
+	bkt       objstore.Bucket
+	logger    log.Logger
+
+	mtx     sync.Mutex
+	cutoffs map[string]time.Time
+	applied []GovernanceAppliedRow
+
+	malformedRows prometheus.Counter
+	rowsApplied   prometheus.Counter
+	blocksMarked  prometheus.Counter
+}
+
+func newGovernance(cfg BlocksCleanerConfig, bkt objstore.Bucket, logger log.Logger, reg prometheus.Registerer) *governance {
+	separator := ','
+	if cfg.GovernanceFileSeparator != "" {
+		separator = []rune(cfg.GovernanceFileSeparator)[0]
+	}
+
+	return &governance{
+		file:      cfg.GovernanceFile,
+		separator: separator,
+		hasHeader: cfg.GovernanceFileHasHeader,
+		bkt:       bkt,
+		logger:    logger,
+		malformedRows: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_governance_malformed_rows_total",
+			Help: "Total number of malformed rows skipped while reading the blocks cleanup governance file.",
+		}),
+		rowsApplied: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_governance_rows_applied_total",
+			Help: "Total number of blocks cleanup governance file rows applied.",
+		}),
+		blocksMarked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_governance_blocks_marked_for_deletion_total",
+			Help: "Total number of blocks marked for deletion because older than the cutoff listed in the blocks cleanup governance file.",
+		}),
+	}
+}
+
+// load reads the governance file from the bucket. If the file can't be read, no cutoff
+// is applied during the current run.
+func (g *governance) load(ctx context.Context) {
+	cutoffs, err := g.read(ctx)
+	if err != nil {
+		level.Warn(g.logger).Log("msg", "failed to read the blocks cleanup governance file, no cutoff will be applied", "file", g.file, "err", err)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.cutoffs = cutoffs
+	g.applied = nil
+}
+
+func (g *governance) read(ctx context.Context) (map[string]time.Time, error) {
+	r, err := g.bkt.Get(ctx, g.file)
+	if g.bkt.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(g.logger, r, "close governance file reader")
+
+	reader := csv.NewReader(r)
+	reader.Comma = g.separator
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	cutoffs := map[string]time.Time{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				g.malformedRows.Inc()
+				level.Warn(g.logger).Log("msg", "skipped malformed row in the blocks cleanup governance file", "file", g.file, "err", err)
+				continue
+			}
+			return nil, err
+		}
+
+		if line == 1 && g.hasHeader {
+			continue
+		}
+
+		userID, cutoff, err := parseGovernanceRow(record)
+		if err != nil {
+			g.malformedRows.Inc()
+			level.Warn(g.logger).Log("msg", "skipped malformed row in the blocks cleanup governance file", "file", g.file, "line", line, "err", err)
+			continue
+		}
+
+		// If a tenant is listed multiple times, the most recent cutoff wins.
+		if prev, ok := cutoffs[userID]; !ok || cutoff.After(prev) {
+			cutoffs[userID] = cutoff
+		}
+	}
+
+	return cutoffs, nil
+}
+
+func parseGovernanceRow(record []string) (string, time.Time, error) {
+	if len(record) != 2 {
+		return "", time.Time{}, fmt.Errorf("expected 2 fields but got %d", len(record))
+	}
+
+	userID := strings.TrimSpace(record[0])
+	if userID == "" {
+		return "", time.Time{}, errors.New("empty tenant ID")
+	}
+
+	value := strings.TrimSpace(record[1])
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return userID, time.Unix(secs, 0), nil
+	}
+
+	cutoff, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid cutoff %q", value)
+	}
+
+	return userID, cutoff, nil
+}
+
+func (g *governance) cutoff(userID string) (time.Time, bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	cutoff, ok := g.cutoffs[userID]
+	return cutoff, ok
+}
+
+// applyGovernance marks for deletion the blocks of the tenant containing only data older
+// than the tenant governance cutoff, if any.
+func (c *BlocksCleaner) applyGovernance(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	g := c.governance
+
+	cutoff, ok := g.cutoff(userID)
+	if !ok {
+		return
+	}
+
+	var ids []ulid.ULID
+	for id, meta := range metas {
+		if meta.MaxTime <= cutoff.Unix()*1000 {
+			ids = append(ids, id)
+		}
+	}
+
+	marked, failed := c.markBlocksForDeletion(ctx, userID, ids, "older than the governance cutoff", g.blocksMarked, userBucket, userLogger)
+	level.Info(userLogger).Log("msg", "applied the blocks cleanup governance cutoff", "cutoff", cutoff, "markedBlocks", marked, "failedBlocks", failed)
+	g.rowsApplied.Inc()
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.applied = append(g.applied, GovernanceAppliedRow{
+		UserID:       userID,
+		Cutoff:       cutoff.Unix(),
+		AppliedAt:    time.Now().Unix(),
+		BlocksMarked: marked,
+		BlocksFailed: failed,
+	})
+}
+
+// record uploads the rows applied since the last load() next to the governance file.
+func (g *governance) record(ctx context.Context) error {
+	g.mtx.Lock()
+	applied := append([]GovernanceAppliedRow{}, g.applied...)
+	g.mtx.Unlock()
+
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return errors.Wrap(err, "serialize governance applied rows")
+	}
+
+	return errors.Wrap(g.bkt.Upload(ctx, g.file+governanceAppliedSuffix, bytes.NewReader(data)), "upload governance applied rows")
+}
@@ -0,0 +1,154 @@
+package compactor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldApplyGovernanceFileCutoffs(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 10000000, 10001000, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	governanceFile := "expired-tenants.csv"
+	require.NoError(t, bucketClient.Upload(ctx, governanceFile, strings.NewReader(strings.Join([]string{
+		"tenant;cutoff",
+		"user-1;1000",
+		"user-3;1970-01-01T00:16:40Z",
+		"user-4",
+		";1000",
+		"user-5;yesterday",
+	}, "\n"))))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                 dataDir,
+		MetaSyncConcurrency:     10,
+		DeletionDelay:           time.Hour,
+		CleanupInterval:         time.Minute,
+		CleanupConcurrency:      1,
+		GovernanceFile:          governanceFile,
+		GovernanceFileSeparator: ";",
+		GovernanceFileHasHeader: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		// Only the blocks older than the cutoff are marked for deletion.
+		{path: path.Join("user-1", block1.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-1", block2.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		// Tenants not listed in the governance file are not affected.
+		{path: path.Join("user-2", block3.String(), metadata.DeletionMarkFilename), expectedExists: false},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.governance.malformedRows))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.governance.rowsApplied))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.governance.blocksMarked))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsCompleted))
+
+	// The governance file has not been considered a tenant.
+	assert.NotContains(t, cleaner.classifier.states, governanceFile)
+	assert.NotContains(t, cleaner.classifier.states, governanceFile+governanceAppliedSuffix)
+
+	// The applied rows have been recorded next to the governance file.
+	reader, err := bucketClient.Get(ctx, governanceFile+governanceAppliedSuffix)
+	require.NoError(t, err)
+	defer reader.Close() //nolint:errcheck
+
+	var applied []GovernanceAppliedRow
+	require.NoError(t, json.NewDecoder(reader).Decode(&applied))
+	require.Len(t, applied, 1)
+	assert.Equal(t, "user-1", applied[0].UserID)
+	assert.Equal(t, int64(1000), applied[0].Cutoff)
+	assert.Equal(t, 1, applied[0].BlocksMarked)
+}
+
+func TestParseGovernanceRow(t *testing.T) {
+	tests := map[string]struct {
+		record         []string
+		expectedUserID string
+		expectedCutoff time.Time
+		expectedErr    bool
+	}{
+		"unix timestamp": {
+			record:         []string{"user-1", "1000"},
+			expectedUserID: "user-1",
+			expectedCutoff: time.Unix(1000, 0),
+		},
+		"RFC3339 timestamp": {
+			record:         []string{" user-1 ", "2020-12-01T00:00:00Z"},
+			expectedUserID: "user-1",
+			expectedCutoff: time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"missing field": {
+			record:      []string{"user-1"},
+			expectedErr: true,
+		},
+		"empty tenant": {
+			record:      []string{"", "1000"},
+			expectedErr: true,
+		},
+		"invalid cutoff": {
+			record:      []string{"user-1", "yesterday"},
+			expectedErr: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			userID, cutoff, err := parseGovernanceRow(testData.record)
+			if testData.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedUserID, userID)
+			assert.True(t, testData.expectedCutoff.Equal(cutoff))
+		})
+	}
+}
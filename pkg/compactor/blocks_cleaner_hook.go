@@ -0,0 +1,144 @@
+package compactor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+)
+
+// tenantCleanedHookTimeout is the default max time the cleaner waits for the tenant cleaned hook to return,
+// before moving on. The hook is not canceled, and keeps running in background.
+const tenantCleanedHookTimeout = 10 * time.Second
+
+// CleanupStats are the stats of the cleanup, or the deletion, of a single tenant.
+type CleanupStats struct {
+	BlocksDeleted int
+	BlocksFailed  int
+	Duration      time.Duration
+
+	// PendingDeletionBlocks is the number of blocks left to delete by the next cleanups, because they
+	// haven't reached the deletion delay yet.
+	PendingDeletionBlocks int
+
+	// Err is the error the cleanup failed with, if any.
+	Err error
+}
+
+// tenantCleanupStats tracks the blocks deleted and failed by the cleanup of a single tenant.
+type tenantCleanupStats struct {
+	start   time.Time
+	deleted atomic.Int64
+	failed  atomic.Int64
+	pending atomic.Int64
+}
+
+// tenantsCleanupStats tracks the stats of the tenants being cleaned up.
+type tenantsCleanupStats struct {
+	mtx   sync.Mutex
+	stats map[string]*tenantCleanupStats
+}
+
+func newTenantsCleanupStats() *tenantsCleanupStats {
+	return &tenantsCleanupStats{stats: map[string]*tenantCleanupStats{}}
+}
+
+// begin starts tracking the stats of the cleanup of the tenant.
+func (s *tenantsCleanupStats) begin(userID string) *tenantCleanupStats {
+	stats := &tenantCleanupStats{start: time.Now()}
+
+	s.mtx.Lock()
+	s.stats[userID] = stats
+	s.mtx.Unlock()
+
+	return stats
+}
+
+// end stops tracking the stats of the cleanup of the tenant, and returns them.
+func (s *tenantsCleanupStats) end(userID string, stats *tenantCleanupStats, err error) CleanupStats {
+	s.mtx.Lock()
+	if s.stats[userID] == stats {
+		delete(s.stats, userID)
+	}
+	s.mtx.Unlock()
+
+	return CleanupStats{
+		BlocksDeleted:         int(stats.deleted.Load()),
+		BlocksFailed:          int(stats.failed.Load()),
+		Duration:              time.Since(stats.start),
+		PendingDeletionBlocks: int(stats.pending.Load()),
+		Err:                   err,
+	}
+}
+
+// blockCleaned tracks a block deleted by the cleanup of the tenant, if in progress.
+func (s *tenantsCleanupStats) blockCleaned(userID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if stats, ok := s.stats[userID]; ok {
+		stats.deleted.Inc()
+	}
+}
+
+// blockCleanupFailed tracks a block failed to be deleted by the cleanup of the tenant, if in progress.
+func (s *tenantsCleanupStats) blockCleanupFailed(userID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if stats, ok := s.stats[userID]; ok {
+		stats.failed.Inc()
+	}
+}
+
+// pendingDeletion tracks the blocks left to delete by the cleanup of the tenant, if in progress.
+func (s *tenantsCleanupStats) pendingDeletion(userID string, blocks int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if stats, ok := s.stats[userID]; ok {
+		stats.pending.Store(int64(blocks))
+	}
+}
+
+// tenantCleaned invokes the tenant cleaned hook, if configured. A panic of the hook is recovered,
+// and a hook not returning in time is left running in background.
+func (c *BlocksCleaner) tenantCleaned(userID string, userLogger log.Logger, stats CleanupStats) {
+	if c.cfg.OnTenantCleaned == nil {
+		return
+	}
+
+	c.invokeTenantHook("tenant cleaned", userLogger, c.tenantCleanedHookFailures, func() {
+		c.cfg.OnTenantCleaned(userID, stats)
+	})
+}
+
+// invokeTenantHook invokes the input hook, recovering from its panic and moving on if it doesn't
+// return in time. The failures of the hook are tracked by the input counter.
+func (c *BlocksCleaner) invokeTenantHook(name string, userLogger log.Logger, failures prometheus.Counter, hook func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				failures.Inc()
+				level.Error(userLogger).Log("msg", "recovered from a panic of the "+name+" hook", "panic", r)
+			}
+		}()
+
+		hook()
+	}()
+
+	t := time.NewTimer(c.tenantCleanedHookTimeout)
+	defer t.Stop()
+
+	select {
+	case <-done:
+	case <-t.C:
+		failures.Inc()
+		level.Warn(userLogger).Log("msg", "the "+name+" hook didn't return in time, moving on", "timeout", c.tenantCleanedHookTimeout)
+	}
+}
@@ -0,0 +1,135 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldInvokeTheTenantCleanedHook(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	var (
+		statsMx sync.Mutex
+		stats   = map[string]CleanupStats{}
+	)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		OnTenantCleaned: func(userID string, s CleanupStats) {
+			statsMx.Lock()
+			defer statsMx.Unlock()
+			stats[userID] = s
+		},
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	statsMx.Lock()
+	defer statsMx.Unlock()
+
+	require.Len(t, stats, 2)
+	assert.Equal(t, 1, stats["user-1"].BlocksDeleted)
+	assert.Equal(t, 0, stats["user-1"].BlocksFailed)
+	assert.NoError(t, stats["user-1"].Err)
+	assert.Equal(t, 1, stats["user-2"].BlocksDeleted)
+	assert.Equal(t, 0, stats["user-2"].BlocksFailed)
+	assert.NoError(t, stats["user-2"].Err)
+}
+
+func TestBlocksCleaner_ShouldGuardAgainstFaultyTenantCleanedHook(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	for name, hook := range map[string]func(string, CleanupStats){
+		"panicking hook": func(string, CleanupStats) {
+			panic("hook failure")
+		},
+		"slow hook": func(string, CleanupStats) {
+			<-release
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+				OnTenantCleaned:     hook,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			cleaner.tenantCleanedHookTimeout = 100 * time.Millisecond
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			// All tenants have been cleaned up anyway.
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantCleanedHookFailures))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsCompleted))
+			assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package compactor
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// Supported policies for a tenants scan finding no active tenant but some tenants marked for deletion.
+const (
+	// The run proceeds as usual.
+	InconsistentScanPolicyProceed = "proceed"
+
+	// The run is skipped, without cleaning up any tenant.
+	InconsistentScanPolicySkip = "skip"
+
+	// The run fails, without cleaning up any tenant.
+	InconsistentScanPolicyFail = "fail"
+)
+
+var inconsistentScanPolicies = []string{InconsistentScanPolicyProceed, InconsistentScanPolicySkip, InconsistentScanPolicyFail}
+
+var errInconsistentUsersScan = errors.New("the tenants discovery found no active tenant but some tenants marked for deletion")
+
+// checkUsersScan detects a tenants scan finding no active tenant but some tenants marked for
+// deletion, and handles it according to the configured policy. Returns whether the run should
+// proceed and the error failing the run, if any.
+func (c *BlocksCleaner) checkUsersScan(users, deleted []string) (bool, error) {
+	if len(users) > 0 || len(deleted) == 0 {
+		return true, nil
+	}
+
+	policy := c.cfg.InconsistentScanPolicy
+	if policy == "" {
+		policy = InconsistentScanPolicyProceed
+	}
+	c.inconsistentScans.WithLabelValues(policy).Inc()
+
+	switch policy {
+	case InconsistentScanPolicySkip:
+		level.Warn(c.logger).Log("msg", "skipping blocks cleanup because the tenants discovery found no active tenant but some tenants marked for deletion", "deleted", len(deleted))
+		return false, nil
+	case InconsistentScanPolicyFail:
+		level.Error(c.logger).Log("msg", "failing blocks cleanup because the tenants discovery found no active tenant but some tenants marked for deletion", "deleted", len(deleted))
+		return false, errInconsistentUsersScan
+	default:
+		level.Warn(c.logger).Log("msg", "proceeding with blocks cleanup even if the tenants discovery found no active tenant but some tenants marked for deletion", "deleted", len(deleted))
+		return true, nil
+	}
+}
+
+// guardDeletionOnEmptyActiveUsers returns the tenants marked for deletion which can be deleted. Until
+// a tenants scan since the cleaner started has found an active tenant, no tenant is deleted unless
+// explicitly allowed, given a bucket with only tenants marked for deletion is more likely the wrong one.
+func (c *BlocksCleaner) guardDeletionOnEmptyActiveUsers(users, deleted []string) []string {
+	if len(users) > 0 {
+		c.activeUsersSeen.Store(true)
+	}
+
+	if len(deleted) == 0 || c.activeUsersSeen.Load() || c.cfg.AllowDeletionOnEmptyActiveUsers {
+		return deleted
+	}
+
+	c.deletionsSkippedNoActive.Add(float64(len(deleted)))
+	level.Error(c.logger).Log("msg", "skipping the deletion of tenants marked for deletion because no active tenant has been found since the compactor started, which may be caused by pointing to the wrong bucket: set -compactor.cleanup-allow-deletion-on-empty-active-users to allow it", "deleted", len(deleted))
+	return nil
+}
@@ -0,0 +1,34 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// defaultKillSwitchPath is the default path, in the bucket, of the object disabling the cleanup.
+const defaultKillSwitchPath = "__cortex_cleanup_disabled__"
+
+// disabledByKillSwitch returns whether the run should be skipped because the kill switch object
+// exists in the bucket. The run fails if it can't be checked, so that the cleanup never runs
+// while it's supposed to be disabled.
+func (c *BlocksCleaner) disabledByKillSwitch(ctx context.Context) (bool, error) {
+	if c.cfg.KillSwitchPath == "" {
+		return false, nil
+	}
+
+	exists, err := c.bucketClient.Exists(ctx, c.cfg.KillSwitchPath)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "failed to check the blocks cleanup kill switch, skipping the run", "path", c.cfg.KillSwitchPath, "err", err)
+		c.runsFailed.Inc()
+		return true, errors.Wrap(err, "check the blocks cleanup kill switch")
+	}
+	if !exists {
+		return false, nil
+	}
+
+	c.runsDisabledByKillSwitch.Inc()
+	level.Warn(c.logger).Log("msg", "skipped blocks cleanup run because the kill switch object exists in the bucket", "path", c.cfg.KillSwitchPath)
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package compactor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldSkipRunsWhileKillSwitchExists(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, bucketClient.Upload(ctx, defaultKillSwitchPath, strings.NewReader("")))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		KillSwitchPath:      defaultKillSwitchPath,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists := func() bool {
+		ok, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		return ok
+	}
+
+	// The runs are skipped while the kill switch exists.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.True(t, exists())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.runsDisabledByKillSwitch))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsStarted))
+
+	// The cleanup is re-enabled once the kill switch is removed.
+	require.NoError(t, bucketClient.Delete(ctx, defaultKillSwitchPath))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.False(t, exists())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.runsDisabledByKillSwitch))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsCompleted))
+}
+
+func TestBlocksCleaner_ShouldFailRunIfKillSwitchCantBeChecked(t *testing.T) {
+	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, errors.New("mocked error"))
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:      time.Hour,
+		CleanupInterval:    time.Minute,
+		CleanupConcurrency: 1,
+		KillSwitchPath:     defaultKillSwitchPath,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The bucket is not scanned if the kill switch can't be checked.
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.Error(t, cleaner.runCleanup(context.Background()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsFailed))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsStarted))
+}
@@ -0,0 +1,57 @@
+package compactor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// findMalformedBlockDirs lists the tenant location, looking for malformed block directories.
+// This is a best effort, so a failed listing is just logged.
+func (c *BlocksCleaner) findMalformedBlockDirs(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger) {
+	err := userBucket.Iter(ctx, "", func(name string) error {
+		if _, ok := block.IsBlockDir(name); !ok {
+			c.checkMalformedBlockDir(name, userLogger)
+		}
+		return nil
+	})
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to look for malformed block directories", "err", err)
+	}
+}
+
+// checkMalformedBlockDir logs and tracks the input entry of the tenant location, which is not a block
+// directory, if reporting malformed block directories is enabled and it looks like a block directory.
+func (c *BlocksCleaner) checkMalformedBlockDir(name string, userLogger log.Logger) {
+	if !c.cfg.ReportMalformedBlockDirs || !isMalformedBlockDir(name) {
+		return
+	}
+
+	c.malformedBlockDirs.Inc()
+	level.Warn(userLogger).Log("msg", "found directory looking like a block, but failing to be parsed as block", "dir", name)
+}
+
+// isMalformedBlockDir returns whether the input entry, which is not a block directory, is a directory
+// shaped as a block one: its name has the length of a ULID and is made of alphanumeric characters.
+func isMalformedBlockDir(name string) bool {
+	if !strings.HasSuffix(name, objstore.DirDelim) {
+		return false
+	}
+
+	dir := strings.TrimSuffix(name, objstore.DirDelim)
+	if len(dir) != ulid.EncodedSize {
+		return false
+	}
+
+	for _, r := range dir {
+		if !('0' <= r && r <= '9') && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldReportMalformedBlockDirs(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		enabled := enabled
+
+		t.Run(map[bool]string{false: "disabled", true: "enabled"}[enabled], func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+
+			// The ULID-shaped directories overflow the ULID range, so they fail to be parsed.
+			createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", "ZZZZZZZZZZZZZZZZZZZZZZZZZZ", "meta.json"), bytes.NewReader([]byte("{}"))))
+			require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", "debug", "file"), bytes.NewReader([]byte("data"))))
+
+			createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+			require.NoError(t, bucketClient.Upload(ctx, path.Join("user-2", "YYYYYYYYYYYYYYYYYYYYYYYYYY", "index"), bytes.NewReader([]byte("data"))))
+			require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+			cfg := BlocksCleanerConfig{
+				DataDir:                  dataDir,
+				MetaSyncConcurrency:      10,
+				DeletionDelay:            time.Hour,
+				CleanupInterval:          time.Minute,
+				CleanupConcurrency:       1,
+				ReportMalformedBlockDirs: enabled,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, cleaner.runCleanup(ctx))
+
+			if enabled {
+				assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.malformedBlockDirs))
+			} else {
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.malformedBlockDirs))
+			}
+
+			// The malformed block directories are never deleted.
+			exists, err := bucketClient.Exists(ctx, path.Join("user-2", "YYYYYYYYYYYYYYYYYYYYYYYYYY", "index"))
+			require.NoError(t, err)
+			assert.True(t, exists)
+		})
+	}
+}
+
+func TestIsMalformedBlockDir(t *testing.T) {
+	tests := map[string]bool{
+		"ZZZZZZZZZZZZZZZZZZZZZZZZZZ/":  true,
+		"zzzzzzzzzzzzzzzzzzzzzzzzzz/":  true,
+		"ZZZZZZZZZZZZZZZZZZZZZZZZZZ":   false,
+		"ZZZZZZZZZZZZZZZZZZZZZZZZZ/":   false,
+		"ZZZZZZZZZZZZZZZZZZZZZZZZZZZ/": false,
+		"ZZZZZZZZZZZZZ-ZZZZZZZZZZZZ/":  false,
+		"debug/":                       false,
+		"bucket-index.json.gz":         false,
+	}
+
+	for name, expected := range tests {
+		assert.Equal(t, expected, isMalformedBlockDir(name), name)
+	}
+}
@@ -0,0 +1,50 @@
+package compactor
+
+import (
+	"sync"
+	"time"
+)
+
+// TenantsMarkedForDeletion is the list of tenants marked for deletion discovered by a cleanup run.
+type TenantsMarkedForDeletion struct {
+	Tenants []string `json:"tenants"`
+
+	// ScannedAt is the time of the users scan which discovered the tenants.
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// markedTenants holds the tenants marked for deletion discovered by the most recent cleanup run.
+type markedTenants struct {
+	mtx  sync.RWMutex
+	last *TenantsMarkedForDeletion
+}
+
+func (m *markedTenants) set(userIDs []string, scannedAt time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.last = &TenantsMarkedForDeletion{
+		Tenants:   append([]string{}, userIDs...),
+		ScannedAt: scannedAt,
+	}
+}
+
+func (m *markedTenants) get() (TenantsMarkedForDeletion, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.last == nil {
+		return TenantsMarkedForDeletion{}, false
+	}
+
+	return TenantsMarkedForDeletion{
+		Tenants:   append([]string{}, m.last.Tenants...),
+		ScannedAt: m.last.ScannedAt,
+	}, true
+}
+
+// TenantsMarkedForDeletion returns the tenants marked for deletion discovered by the most recent
+// cleanup run, and false if no run has scanned the users yet.
+func (c *BlocksCleaner) TenantsMarkedForDeletion() (TenantsMarkedForDeletion, bool) {
+	return c.markedTenants.get()
+}
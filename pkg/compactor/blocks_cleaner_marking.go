@@ -0,0 +1,104 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// markingBackoff is the backoff used to retry a failed deletion mark write. No need to
+// make it configurable, given the defaults should be fine.
+var markingBackoff = util.BackoffConfig{
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: time.Second,
+	MaxRetries: 3,
+}
+
+// markBlocksForDeletion writes the deletion mark of the input blocks, with up to MarkingConcurrency
+// concurrent writes. Blocks recently queried are skipped. A failed write is retried and, if it keeps failing, counted and skipped without
+// aborting the marking of the other blocks. In dry-run mode, blocks are only logged. Returns the number of blocks marked and
+// failed to be marked.
+func (c *BlocksCleaner) markBlocksForDeletion(ctx context.Context, userID string, ids []ulid.ULID, details string, markedForDeletion prometheus.Counter, userBucket objstore.Bucket, userLogger log.Logger) (int, int) {
+	var (
+		marked = atomic.NewInt64(0)
+		failed = atomic.NewInt64(0)
+		ch     = make(chan ulid.ULID)
+		wg     = sync.WaitGroup{}
+	)
+
+	for i := 0; i < c.markingConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range ch {
+				if err := markBlockForDeletionWithRetries(ctx, id, details, markedForDeletion, userBucket, userLogger); err != nil {
+					failed.Inc()
+					c.markingFailures.Inc()
+					level.Warn(userLogger).Log("msg", "failed to mark block for deletion", "block", id, "err", err)
+					continue
+				}
+
+				marked.Inc()
+			}
+		}()
+	}
+
+sendLoop:
+	for _, id := range ids {
+		if c.recentlyQueried(userID, id, userLogger) {
+			continue
+		}
+
+		if c.cfg.DryRun {
+			level.Info(userLogger).Log("msg", "would mark block for deletion", "block", id, "details", details, "dryRun", true)
+			continue
+		}
+
+		select {
+		case ch <- id:
+		case <-ctx.Done():
+			break sendLoop
+		}
+	}
+
+	close(ch)
+	wg.Wait()
+
+	return int(marked.Load()), int(failed.Load())
+}
+
+func markBlockForDeletionWithRetries(ctx context.Context, id ulid.ULID, details string, markedForDeletion prometheus.Counter, userBucket objstore.Bucket, userLogger log.Logger) error {
+	var err error
+
+	retries := util.NewBackoff(ctx, markingBackoff)
+	for retries.Ongoing() {
+		if err = block.MarkForDeletion(ctx, userLogger, userBucket, id, details, markedForDeletion); err == nil {
+			return nil
+		}
+
+		retries.Wait()
+	}
+
+	if err == nil {
+		err = retries.Err()
+	}
+	return err
+}
+
+func (c *BlocksCleaner) markingConcurrency() int {
+	if c.cfg.MarkingConcurrency > 0 {
+		return c.cfg.MarkingConcurrency
+	}
+	return 1
+}
@@ -0,0 +1,83 @@
+package compactor
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+)
+
+func TestBlocksCleaner_MarkBlocksForDeletionShouldRetryAndNotAbortOnFailures(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+
+	var ids []ulid.ULID
+	for i := 0; i < 10; i++ {
+		ids = append(ids, ulid.MustNew(ulid.Now(), rand.Reader))
+	}
+
+	// The 1st block mark upload fails once, while the 2nd block mark upload always fails.
+	failingBucket := &failingUploadBucket{Bucket: bucketClient, failures: map[string]int{
+		path.Join(ids[0].String(), metadata.DeletionMarkFilename): 1,
+		path.Join(ids[1].String(), metadata.DeletionMarkFilename): -1,
+	}}
+
+	cleaner := NewBlocksCleaner(BlocksCleanerConfig{MarkingConcurrency: 3}, bucketClient, nil, newMockConfigProvider(), log.NewNopLogger(), nil)
+	markedForDeletion := prometheus.NewCounter(prometheus.CounterOpts{})
+
+	marked, failed := cleaner.markBlocksForDeletion(context.Background(), "user-1", ids, "test", markedForDeletion, failingBucket, log.NewNopLogger())
+	assert.Equal(t, 9, marked)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, float64(9), testutil.ToFloat64(markedForDeletion))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.markingFailures))
+
+	for i, id := range ids {
+		exists, err := bucketClient.Exists(context.Background(), path.Join(id.String(), metadata.DeletionMarkFilename))
+		require.NoError(t, err)
+		assert.Equal(t, i != 1, exists, id.String())
+	}
+}
+
+// failingUploadBucket is a bucket whose upload of the configured objects fails the configured
+// number of times (or always, if negative).
+type failingUploadBucket struct {
+	objstore.Bucket
+
+	mtx      sync.Mutex
+	failures map[string]int
+}
+
+func (b *failingUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	remaining, ok := b.failures[name]
+	if ok && remaining > 0 {
+		b.failures[name] = remaining - 1
+	}
+	b.mtx.Unlock()
+
+	if ok && remaining != 0 {
+		return errors.New("mocked upload failure")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
@@ -0,0 +1,119 @@
+package compactor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+const (
+	// Max number of blocks for which the deletion mark details are exported, in order
+	// to keep the metrics cardinality bounded.
+	maxExportedDeletionMarkDetails = 1000
+)
+
+// deletionMarksEligibilityBuckets are the upper bounds of the time left before a block
+// marked for deletion becomes eligible for deletion.
+var deletionMarksEligibilityBuckets = []struct {
+	label string
+	upper time.Duration
+}{
+	{label: "0s", upper: 0},
+	{label: "1h", upper: time.Hour},
+	{label: "6h", upper: 6 * time.Hour},
+	{label: "24h", upper: 24 * time.Hour},
+}
+
+const deletionMarksEligibilityBucketInf = "+Inf"
+
+type exportedDeletionMark struct {
+	userID     string
+	blockID    ulid.ULID
+	eligibleAt time.Time
+}
+
+// deletionMarksExporter exposes the deletion intent, as seen by the last blocks cleanup run,
+// so that it can be consumed by external tools without having access to the bucket.
+type deletionMarksExporter struct {
+	withDetails bool
+
+	mtx     sync.Mutex
+	counts  map[string]int
+	details []exportedDeletionMark
+
+	marks       *prometheus.GaugeVec
+	markDetails *prometheus.GaugeVec
+}
+
+func newDeletionMarksExporter(withDetails bool, reg prometheus.Registerer) *deletionMarksExporter {
+	e := &deletionMarksExporter{
+		withDetails: withDetails,
+		marks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_deletion_marks",
+			Help: "Number of blocks marked for deletion found by the last blocks cleanup run, by the time left before they become eligible for deletion.",
+		}, []string{"eligible_within"}),
+	}
+
+	if withDetails {
+		e.markDetails = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_compactor_deletion_mark_eligible_timestamp_seconds",
+			Help: "Unix timestamp since when a block marked for deletion is eligible for deletion. Exported for a bounded number of blocks.",
+		}, []string{"user", "block"})
+	}
+
+	return e
+}
+
+func (e *deletionMarksExporter) start() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.counts = map[string]int{}
+	e.details = nil
+}
+
+func (e *deletionMarksExporter) observe(userID string, marks map[ulid.ULID]*metadata.DeletionMark, deletionDelay time.Duration, now time.Time) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for id, mark := range marks {
+		eligibleAt := time.Unix(mark.DeletionTime, 0).Add(deletionDelay)
+		e.counts[deletionMarksEligibilityBucket(eligibleAt.Sub(now))]++
+
+		if e.withDetails && len(e.details) < maxExportedDeletionMarkDetails {
+			e.details = append(e.details, exportedDeletionMark{userID: userID, blockID: id, eligibleAt: eligibleAt})
+		}
+	}
+}
+
+// publish exposes the deletion marks observed since the last start().
+func (e *deletionMarksExporter) publish() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for _, b := range deletionMarksEligibilityBuckets {
+		e.marks.WithLabelValues(b.label).Set(float64(e.counts[b.label]))
+	}
+	e.marks.WithLabelValues(deletionMarksEligibilityBucketInf).Set(float64(e.counts[deletionMarksEligibilityBucketInf]))
+
+	if e.withDetails {
+		e.markDetails.Reset()
+		for _, d := range e.details {
+			e.markDetails.WithLabelValues(d.userID, d.blockID.String()).Set(float64(d.eligibleAt.Unix()))
+		}
+	}
+}
+
+func deletionMarksEligibilityBucket(eligibleIn time.Duration) string {
+	for _, b := range deletionMarksEligibilityBuckets {
+		if eligibleIn <= b.upper {
+			return b.label
+		}
+	}
+
+	return deletionMarksEligibilityBucketInf
+}
@@ -0,0 +1,57 @@
+package compactor
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestDeletionMarksExporter(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	exporter := newDeletionMarksExporter(true, reg)
+
+	deletionDelay := 12 * time.Hour
+	now := time.Now()
+	block1 := ulid.MustNew(1, rand.Reader)
+	block2 := ulid.MustNew(2, rand.Reader)
+	block3 := ulid.MustNew(3, rand.Reader)
+
+	exporter.start()
+	exporter.observe("user-1", map[ulid.ULID]*metadata.DeletionMark{
+		block1: {ID: block1, DeletionTime: now.Add(-deletionDelay).Add(-time.Hour).Unix()},
+		block2: {ID: block2, DeletionTime: now.Add(-deletionDelay).Add(2 * time.Hour).Unix()},
+	}, deletionDelay, now)
+	exporter.observe("user-2", map[ulid.ULID]*metadata.DeletionMark{
+		block3: {ID: block3, DeletionTime: now.Unix()},
+	}, deletionDelay, now)
+	exporter.publish()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.marks.WithLabelValues("0s")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(exporter.marks.WithLabelValues("1h")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.marks.WithLabelValues("6h")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.marks.WithLabelValues("24h")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(exporter.marks.WithLabelValues(deletionMarksEligibilityBucketInf)))
+	assert.Equal(t, 3, testutil.CollectAndCount(exporter.markDetails))
+
+	// The next run should replace the previously exported details.
+	exporter.start()
+	exporter.publish()
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_compactor_deletion_marks Number of blocks marked for deletion found by the last blocks cleanup run, by the time left before they become eligible for deletion.
+		# TYPE cortex_compactor_deletion_marks gauge
+		cortex_compactor_deletion_marks{eligible_within="+Inf"} 0
+		cortex_compactor_deletion_marks{eligible_within="0s"} 0
+		cortex_compactor_deletion_marks{eligible_within="1h"} 0
+		cortex_compactor_deletion_marks{eligible_within="24h"} 0
+		cortex_compactor_deletion_marks{eligible_within="6h"} 0
+	`)))
+}
@@ -0,0 +1,64 @@
+package compactor
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// maxBlocksPerTenant returns the max number of blocks the input tenant can retain.
+func (c *BlocksCleaner) maxBlocksPerTenant(userID string) int {
+	if limit := c.cfgProvider.CompactorMaxBlocksPerTenant(userID); limit > 0 {
+		return limit
+	}
+	return c.cfg.MaxBlocksPerTenant
+}
+
+// applyMaxBlocksPerTenant marks for deletion the oldest blocks of the tenant exceeding the max
+// number of blocks, except the ones containing data more recent than the min retention.
+func (c *BlocksCleaner) applyMaxBlocksPerTenant(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	limit := c.maxBlocksPerTenant(userID)
+	if limit <= 0 || len(metas) <= limit {
+		return
+	}
+
+	sorted := make([]*metadata.Meta, 0, len(metas))
+	for _, meta := range metas {
+		sorted = append(sorted, meta)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MaxTime != sorted[j].MaxTime {
+			return sorted[i].MaxTime < sorted[j].MaxTime
+		}
+		return sorted[i].ULID.Compare(sorted[j].ULID) < 0
+	})
+
+	minRetentionCutoff := c.now().Add(-c.cfg.MaxBlocksMinRetention).Unix() * 1000
+
+	var ids []ulid.ULID
+	exceeding := sorted[:len(sorted)-limit]
+	for i, meta := range exceeding {
+		// Blocks are sorted by max time, so all the remaining ones are protected too.
+		if meta.MaxTime > minRetentionCutoff {
+			protected := len(exceeding) - i
+			c.maxBlocksProtected.Add(float64(protected))
+			level.Warn(userLogger).Log("msg", "blocks exceeding the max number of blocks per tenant not marked for deletion because containing data more recent than the min retention", "limit", limit, "protectedBlocks", protected)
+			break
+		}
+
+		ids = append(ids, meta.ULID)
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	marked, failed := c.markBlocksForDeletion(ctx, userID, ids, "exceeded the max number of blocks per tenant", c.maxBlocksMarked, userBucket, userLogger)
+	level.Info(userLogger).Log("msg", "applied the max number of blocks per tenant", "limit", limit, "blocks", len(metas), "markedBlocks", marked, "failedBlocks", failed)
+}
@@ -0,0 +1,87 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldMarkOldestBlocksExceedingMaxBlocksPerTenant(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	recent := time.Now().Add(-time.Minute).Unix() * 1000
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	block5 := createTSDBBlock(t, bucketClient, "user-2", recent-2000, recent-1000, nil)
+	block6 := createTSDBBlock(t, bucketClient, "user-2", recent-1000, recent, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:               dataDir,
+		MetaSyncConcurrency:   10,
+		DeletionDelay:         time.Hour,
+		CleanupInterval:       time.Minute,
+		CleanupConcurrency:    1,
+		MaxBlocksPerTenant:    2,
+		MaxBlocksMinRetention: time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cfgProvider := newMockConfigProvider()
+	cfgProvider.maxBlocks["user-2"] = 1
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, cfgProvider, logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		// The oldest block exceeding the limit is marked for deletion.
+		{path: path.Join("user-1", block1.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-1", block2.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		{path: path.Join("user-1", block3.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		// The per-tenant limit is honored, except for blocks more recent than the min retention.
+		{path: path.Join("user-2", block4.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-2", block5.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		{path: path.Join("user-2", block6.String(), metadata.DeletionMarkFilename), expectedExists: false},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.maxBlocksMarked))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.maxBlocksProtected))
+}
@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+
+	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
+)
+
+// completedTenantDeletions tracks the tenants marked for deletion for which the last deletion has left
+// no block, which are not accounted by the max tenants deleted per run, given they're cheap to process.
+type completedTenantDeletions struct {
+	mtx   sync.Mutex
+	users map[string]struct{}
+}
+
+func newCompletedTenantDeletions() *completedTenantDeletions {
+	return &completedTenantDeletions{users: map[string]struct{}{}}
+}
+
+// observe records whether the last deletion of the tenant has deleted all the blocks found.
+func (d *completedTenantDeletions) observe(userID string, completed bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if completed {
+		d.users[userID] = struct{}{}
+	} else {
+		delete(d.users, userID)
+	}
+}
+
+// split returns the input tenants whose deletion is completed, and the other ones. Tenants not in the
+// input are forgotten.
+func (d *completedTenantDeletions) split(userIDs []string) (completed, pending []string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	retained := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := d.users[userID]; ok {
+			retained[userID] = struct{}{}
+			completed = append(completed, userID)
+		} else {
+			pending = append(pending, userID)
+		}
+	}
+	d.users = retained
+
+	return completed, pending
+}
+
+// capTenantDeletions returns the tenants to delete in this run, and the ones whose deletion is deferred
+// to the next runs because the max number of tenants deleted per run has been reached. The tenants marked
+// for deletion the earliest are deleted first. Tenants whose deletion mark can't be read are deleted last.
+// Tenants whose blocks have all been deleted by a previous run are not accounted.
+func (c *BlocksCleaner) capTenantDeletions(ctx context.Context, deleted []string) (selected, deferred []string) {
+	completed, pending := c.completedTenantDeletions.split(deleted)
+	if c.cfg.MaxTenantsDeletedPerRun <= 0 || len(pending) <= c.cfg.MaxTenantsDeletedPerRun {
+		return deleted, nil
+	}
+
+	markedAt := make(map[string]int64, len(pending))
+	for _, userID := range pending {
+		markedAt[userID] = math.MaxInt64
+
+		mark, err := cortex_tsdb.ReadTenantDeletionMark(ctx, c.bucketClient, userID)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "failed to read the tenant deletion mark, deleting the tenant last", "user", userID, "err", err)
+			continue
+		}
+		if mark != nil {
+			markedAt[userID] = mark.DeletionTime
+		}
+	}
+
+	sorted := append([]string{}, pending...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if markedAt[sorted[i]] != markedAt[sorted[j]] {
+			return markedAt[sorted[i]] < markedAt[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	selected, deferred = append(completed, sorted[:c.cfg.MaxTenantsDeletedPerRun]...), sorted[c.cfg.MaxTenantsDeletedPerRun:]
+	level.Warn(c.logger).Log("msg", "the number of tenants marked for deletion exceeds the max tenants deleted per run, deferring the deletion of the remaining ones to the next runs", "marked", len(pending), "max", c.cfg.MaxTenantsDeletedPerRun, "deferred", len(deferred))
+	return selected, deferred
+}
@@ -0,0 +1,79 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldCapTheTenantsDeletedPerRun(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	now := time.Now()
+	createTSDBBlock(t, bucketClient, "user-active", 10, 20, nil)
+
+	// Tenants are marked for deletion in a different order than their name.
+	blocks := map[string]ulid.ULID{}
+	for userID, markedAgo := range map[string]time.Duration{"user-1": time.Hour, "user-2": 3 * time.Hour, "user-3": 2 * time.Hour} {
+		blocks[userID] = createTSDBBlock(t, bucketClient, userID, 10, 20, nil)
+		writeTenantDeletionMark(t, bucketClient, userID, now.Add(-markedAgo))
+	}
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                 dataDir,
+		MetaSyncConcurrency:     10,
+		DeletionDelay:           time.Hour,
+		CleanupInterval:         time.Minute,
+		CleanupConcurrency:      1,
+		MaxTenantsDeletedPerRun: 2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	assertBlocksExist := func(expected map[string]bool) {
+		for userID, exists := range expected {
+			ok, err := bucketClient.Exists(ctx, path.Join(userID, blocks[userID].String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			assert.Equal(t, exists, ok, userID)
+		}
+	}
+
+	// The tenants marked for deletion the earliest are deleted first.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assertBlocksExist(map[string]bool{"user-1": true, "user-2": false, "user-3": false})
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletionsDeferred))
+
+	// The deferred tenant is deleted by the next run.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assertBlocksExist(map[string]bool{"user-1": false, "user-2": false, "user-3": false})
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletionsDeferred))
+}
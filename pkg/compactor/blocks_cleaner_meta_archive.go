@@ -0,0 +1,289 @@
+package compactor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// DeletedBlocksMetaArchiveName is the name of the object, at the tenant root, where the meta.json
+	// of the blocks deleted because the tenant is marked for deletion are archived, one per line.
+	DeletedBlocksMetaArchiveName = "deleted-blocks-meta.jsonl.gz"
+)
+
+// deletedBlocksMetaArchiveChunkSize is the max number of meta.json appended to the deleted blocks meta
+// archive of a tenant before it's uploaded, while archiving the blocks of the tenant.
+const deletedBlocksMetaArchiveChunkSize = 1000
+
+// deletedBlocksMetaArchive is the deleted blocks meta archive of a tenant, loaded once per deletion of the
+// tenant and indexed by block ID. The archive is rewritten on each upload, given objects can't be appended
+// to, so the uploads of the archive of a tenant are serialized.
+type deletedBlocksMetaArchive struct {
+	userBucket objstore.Bucket
+	userLogger log.Logger
+	archived   prometheus.Counter
+
+	mtx   sync.Mutex
+	lines [][]byte
+	ids   map[ulid.ULID]struct{}
+}
+
+// archiveDeletedBlockMetas loads the deleted blocks meta archive of the tenant and appends to it the meta.json
+// of all the blocks of the tenant not archived yet, uploading it once every deletedBlocksMetaArchiveChunkSize
+// blocks. It returns nil if the archival is disabled. The meta.json of a block failed to be read is not
+// archived, so that it's retried by deleteUserBlock() before deleting the block.
+func (c *BlocksCleaner) archiveDeletedBlockMetas(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger) (*deletedBlocksMetaArchive, error) {
+	if !c.cfg.ArchiveDeletedMeta || c.cfg.DryRun || c.readOnly() {
+		return nil, nil
+	}
+
+	lines, err := readDeletedBlocksMetaArchive(ctx, userBucket, userLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &deletedBlocksMetaArchive{
+		userBucket: userBucket,
+		userLogger: userLogger,
+		archived:   c.blockMetasArchived,
+		lines:      lines,
+		ids:        archivedBlockIDs(lines),
+	}
+
+	var ids []ulid.ULID
+	err = userBucket.Iter(ctx, "", func(name string) error {
+		if id, ok := block.IsBlockDir(name); ok && !archive.contains(id) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list blocks to archive")
+	}
+
+	for start := 0; start < len(ids); start += deletedBlocksMetaArchiveChunkSize {
+		end := start + deletedBlocksMetaArchiveChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		metas := c.readBlockMetaJSONs(ctx, userBucket, userLogger, ids[start:end])
+		if err := archive.add(ctx, ids[start:end], metas); err != nil {
+			return nil, err
+		}
+	}
+
+	return archive, nil
+}
+
+// readBlockMetaJSONs concurrently reads the meta.json of the input blocks. The blocks without meta.json and
+// the ones failed to be read are not included in the returned map.
+func (c *BlocksCleaner) readBlockMetaJSONs(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger, ids []ulid.ULID) map[ulid.ULID][]byte {
+	var (
+		metas   = make(map[ulid.ULID][]byte, len(ids))
+		metasMx sync.Mutex
+		jobs    = make(chan ulid.ULID)
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < c.deleteConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range jobs {
+				meta, err := readBlockMetaJSON(ctx, userBucket, userLogger, id)
+				if err != nil {
+					level.Warn(userLogger).Log("msg", "failed to read the meta.json of block to archive", "block", id, "err", err)
+					continue
+				}
+				if meta == nil {
+					// Partial blocks have no meta.json to archive.
+					continue
+				}
+
+				metasMx.Lock()
+				metas[id] = meta
+				metasMx.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	return metas
+}
+
+// archiveDeletedBlockMeta appends the meta.json of the block, if any, to the deleted blocks meta archive
+// of the tenant, unless already archived. Given the blocks of the tenant are archived at the beginning of
+// its deletion, it's expected to upload the archive only for the blocks failed to be read back then.
+func (a *deletedBlocksMetaArchive) archiveDeletedBlockMeta(ctx context.Context, id ulid.ULID) error {
+	if a == nil || a.contains(id) {
+		return nil
+	}
+
+	meta, err := readBlockMetaJSON(ctx, a.userBucket, a.userLogger, id)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		// Partial blocks have no meta.json to archive.
+		return nil
+	}
+
+	return a.add(ctx, []ulid.ULID{id}, map[ulid.ULID][]byte{id: meta})
+}
+
+func (a *deletedBlocksMetaArchive) contains(id ulid.ULID) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	_, ok := a.ids[id]
+	return ok
+}
+
+// add appends the meta.json of the input blocks, in order, to the archive and uploads it. The blocks
+// already archived, or whose meta.json is missing from the input metas, are skipped.
+func (a *deletedBlocksMetaArchive) add(ctx context.Context, ids []ulid.ULID, metas map[ulid.ULID][]byte) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	lines := a.lines
+	added := make([]ulid.ULID, 0, len(metas))
+	for _, id := range ids {
+		meta, ok := metas[id]
+		if _, archived := a.ids[id]; !ok || archived {
+			continue
+		}
+
+		lines = append(lines, meta)
+		added = append(added, id)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := writeDeletedBlocksMetaArchive(ctx, a.userBucket, lines); err != nil {
+		return err
+	}
+
+	a.lines = lines
+	for _, id := range added {
+		a.ids[id] = struct{}{}
+	}
+
+	a.archived.Add(float64(len(added)))
+	level.Debug(a.userLogger).Log("msg", "archived the meta.json of blocks", "blocks", len(added))
+	return nil
+}
+
+// readBlockMetaJSON returns the meta.json of the block in its compact form, or nil if it doesn't exist.
+func readBlockMetaJSON(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger, id ulid.ULID) ([]byte, error) {
+	metaFile := path.Join(id.String(), metadata.MetaFilename)
+
+	reader, err := userBucket.Get(ctx, metaFile)
+	if userBucket.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", metaFile)
+	}
+	defer runutil.CloseWithLogOnErr(userLogger, reader, "close block meta reader")
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", metaFile)
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, content); err != nil {
+		return nil, errors.Wrapf(err, "compact %s", metaFile)
+	}
+	return compacted.Bytes(), nil
+}
+
+// readDeletedBlocksMetaArchive returns the lines of the deleted blocks meta archive of the tenant, if any.
+func readDeletedBlocksMetaArchive(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger) ([][]byte, error) {
+	reader, err := userBucket.Get(ctx, DeletedBlocksMetaArchiveName)
+	if userBucket.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read deleted blocks meta archive")
+	}
+	defer runutil.CloseWithLogOnErr(userLogger, reader, "close deleted blocks meta archive reader")
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress deleted blocks meta archive")
+	}
+	defer runutil.CloseWithLogOnErr(userLogger, gzipReader, "close deleted blocks meta archive gzip reader")
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(gzipReader)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "decompress deleted blocks meta archive")
+	}
+
+	return lines, nil
+}
+
+// writeDeletedBlocksMetaArchive uploads the deleted blocks meta archive of the tenant, made of the input lines.
+func writeDeletedBlocksMetaArchive(ctx context.Context, userBucket objstore.Bucket, lines [][]byte) error {
+	var content bytes.Buffer
+	gzipWriter := gzip.NewWriter(&content)
+
+	for _, line := range lines {
+		if _, err := gzipWriter.Write(append(line, '\n')); err != nil {
+			return errors.Wrap(err, "compress deleted blocks meta archive")
+		}
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return errors.Wrap(err, "compress deleted blocks meta archive")
+	}
+
+	if err := userBucket.Upload(ctx, DeletedBlocksMetaArchiveName, &content); err != nil {
+		return errors.Wrap(err, "upload deleted blocks meta archive")
+	}
+	return nil
+}
+
+// archivedBlockIDs returns the IDs of the blocks whose meta.json is in the archive lines.
+func archivedBlockIDs(lines [][]byte) map[ulid.ULID]struct{} {
+	ids := make(map[ulid.ULID]struct{}, len(lines))
+	for _, line := range lines {
+		var meta struct {
+			ULID ulid.ULID `json:"ulid"`
+		}
+		if err := json.Unmarshal(line, &meta); err == nil {
+			ids[meta.ULID] = struct{}{}
+		}
+	}
+	return ids
+}
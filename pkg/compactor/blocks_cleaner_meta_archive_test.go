@@ -0,0 +1,169 @@
+package compactor
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ArchiveDeletedMeta(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		enabled := enabled
+
+		t.Run(map[bool]string{true: "enabled", false: "disabled"}[enabled], func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+			createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+			require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+				ArchiveDeletedMeta:  enabled,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+			require.NoError(t, cleaner.runCleanup(ctx))
+
+			for _, id := range []ulid.ULID{block1, block2} {
+				exists, err := bucketClient.Exists(ctx, path.Join("user-1", id.String(), metadata.MetaFilename))
+				require.NoError(t, err)
+				assert.False(t, exists)
+			}
+
+			userBucket := bucket.NewUserBucketClient("user-1", bucketClient)
+			exists, err := userBucket.Exists(ctx, DeletedBlocksMetaArchiveName)
+			require.NoError(t, err)
+			assert.Equal(t, enabled, exists)
+
+			if !enabled {
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blockMetasArchived))
+				return
+			}
+
+			assertArchivedBlocks := func() {
+				lines, err := readDeletedBlocksMetaArchive(ctx, userBucket, logger)
+				require.NoError(t, err)
+				require.Len(t, lines, 2)
+
+				ids := archivedBlockIDs(lines)
+				for _, id := range []ulid.ULID{block1, block2} {
+					assert.Contains(t, ids, id)
+				}
+			}
+
+			assertArchivedBlocks()
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blockMetasArchived))
+
+			// Archiving the meta.json of a block again doesn't duplicate it.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assertArchivedBlocks()
+
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blockMetasArchived))
+		})
+	}
+}
+
+func TestBlocksCleaner_ArchiveDeletedMetaShouldUploadTheArchiveOncePerChunk(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	fsBucket, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient := bucketindex.BucketWithGlobalMarkers(fsBucket)
+
+	ctx := context.Background()
+	var blocks []ulid.ULID
+	for i := int64(0); i < 5; i++ {
+		blocks = append(blocks, createTSDBBlock(t, bucketClient, "user-1", i*10, (i+1)*10, nil))
+	}
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeleteConcurrency:   3,
+		ArchiveDeletedMeta:  true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	uploadsBucket := &uploadsCountingBucket{Bucket: bucketClient}
+	cleaner := NewBlocksCleaner(cfg, uploadsBucket, scanner, newMockConfigProvider(), logger, nil)
+
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(5), testutil.ToFloat64(cleaner.blockMetasArchived))
+	assert.Equal(t, int64(1), uploadsBucket.uploads.Load())
+
+	lines, err := readDeletedBlocksMetaArchive(ctx, bucket.NewUserBucketClient("user-1", bucketClient), logger)
+	require.NoError(t, err)
+	require.Len(t, lines, len(blocks))
+
+	ids := archivedBlockIDs(lines)
+	for _, id := range blocks {
+		assert.Contains(t, ids, id)
+	}
+}
+
+// uploadsCountingBucket counts the uploads of the deleted blocks meta archive.
+type uploadsCountingBucket struct {
+	objstore.Bucket
+	uploads atomic.Int64
+}
+
+func (b *uploadsCountingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if path.Base(name) == DeletedBlocksMetaArchiveName {
+		b.uploads.Inc()
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
@@ -0,0 +1,139 @@
+package compactor
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+type metaCacheEntry struct {
+	userID    string
+	fetchedAt time.Time
+
+	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	metas                    map[ulid.ULID]*metadata.Meta
+	partials                 map[ulid.ULID]error
+}
+
+// metaCache is a size bounded LRU of the last blocks fetched for each tenant.
+type metaCache struct {
+	size int
+	ttl  time.Duration
+
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+
+	requests prometheus.Counter
+	hits     prometheus.Counter
+}
+
+func newMetaCache(size int, ttl time.Duration, reg prometheus.Registerer) *metaCache {
+	return &metaCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_cleaner_meta_cache_requests_total",
+			Help: "Total number of lookups of the tenants blocks in the blocks cleaner in-memory cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_blocks_cleaner_meta_cache_hits_total",
+			Help: "Total number of lookups of the tenants blocks in the blocks cleaner in-memory cache, which have been served from the cache.",
+		}),
+	}
+}
+
+// get returns the blocks cached for the tenant, if not older than the TTL.
+func (m *metaCache) get(userID string) (*metaCacheEntry, bool) {
+	m.requests.Inc()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	element, ok := m.entries[userID]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*metaCacheEntry)
+	if time.Since(entry.fetchedAt) > m.ttl {
+		m.lru.Remove(element)
+		delete(m.entries, userID)
+		return nil, false
+	}
+
+	m.lru.MoveToFront(element)
+	m.hits.Inc()
+	return entry, true
+}
+
+func (m *metaCache) put(entry *metaCacheEntry) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if element, ok := m.entries[entry.userID]; ok {
+		element.Value = entry
+		m.lru.MoveToFront(element)
+		return
+	}
+
+	m.entries[entry.userID] = m.lru.PushFront(entry)
+
+	for m.lru.Len() > m.size {
+		evicted := m.lru.Remove(m.lru.Back()).(*metaCacheEntry)
+		delete(m.entries, evicted.userID)
+	}
+}
+
+// clear removes all the cached entries.
+func (m *metaCache) clear() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.lru.Init()
+	m.entries = map[string]*list.Element{}
+}
+
+// fetchUserBlocksCached is like fetchUserBlocks(), but reuses the blocks cached for the tenant
+// when the cleaner is read-only. Blocks are always fetched from the storage when deleting.
+func (c *BlocksCleaner) fetchUserBlocksCached(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) (*block.IgnoreDeletionMarkFilter, map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	if c.metaCache == nil {
+		return c.fetchUserBlocks(ctx, userID, userBucket, userLogger)
+	}
+
+	if c.readOnly() {
+		if entry, ok := c.metaCache.get(userID); ok {
+			level.Debug(userLogger).Log("msg", "reusing the cached tenant blocks", "fetchedAt", entry.fetchedAt)
+			return entry.ignoreDeletionMarkFilter, entry.metas, entry.partials, nil
+		}
+	}
+
+	fetchedAt := time.Now()
+	ignoreDeletionMarkFilter, metas, partials, err := c.fetchUserBlocks(ctx, userID, userBucket, userLogger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c.metaCache.put(&metaCacheEntry{
+		userID:                   userID,
+		fetchedAt:                fetchedAt,
+		ignoreDeletionMarkFilter: ignoreDeletionMarkFilter,
+		metas:                    metas,
+		partials:                 partials,
+	})
+
+	return ignoreDeletionMarkFilter, metas, partials, nil
+}
@@ -0,0 +1,99 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestMetaCache(t *testing.T) {
+	c := newMetaCache(2, time.Hour, nil)
+
+	c.put(&metaCacheEntry{userID: "user-1", fetchedAt: time.Now()})
+	c.put(&metaCacheEntry{userID: "user-2", fetchedAt: time.Now()})
+
+	// The least recently used tenant is evicted.
+	_, ok := c.get("user-1")
+	assert.True(t, ok)
+	c.put(&metaCacheEntry{userID: "user-3", fetchedAt: time.Now()})
+
+	_, ok = c.get("user-2")
+	assert.False(t, ok)
+	_, ok = c.get("user-1")
+	assert.True(t, ok)
+	_, ok = c.get("user-3")
+	assert.True(t, ok)
+
+	// Entries older than the TTL are not returned.
+	c.put(&metaCacheEntry{userID: "user-3", fetchedAt: time.Now().Add(-2 * time.Hour)})
+	_, ok = c.get("user-3")
+	assert.False(t, ok)
+
+	assert.Equal(t, float64(5), testutil.ToFloat64(c.requests))
+	assert.Equal(t, float64(3), testutil.ToFloat64(c.hits))
+}
+
+func TestBlocksCleaner_ShouldReuseCachedBlocksOnlyWhenReadOnly(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		MetaCacheSize:       10,
+		MetaCacheTTL:        time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	cleaner.SetRole(BlocksCleanerRoleStandby)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.metaCache.requests))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.metaCache.hits))
+
+	// A read-only run within the TTL reuses the cached blocks, so it doesn't see the block
+	// marked for deletion in the meanwhile.
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.metaCache.hits))
+	assert.Empty(t, cleaner.LastReconciliationReport().Discrepancies)
+
+	// A run deleting blocks always fetches them.
+	cleaner.SetRole(BlocksCleanerRoleActive)
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.metaCache.requests))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+}
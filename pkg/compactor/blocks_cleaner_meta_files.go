@@ -0,0 +1,62 @@
+package compactor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// metaSyncerCacheDirName is the sub directory where the metadata fetcher caches the metas of the blocks.
+const metaSyncerCacheDirName = "meta-syncer"
+
+// locallyCachedMetas returns the blocks whose meta.json is cached in the local metas cache of the tenant,
+// so that it's read from the local disk instead of the storage by the next fetch. Errors are ignored,
+// given the local cache is a best effort.
+func (c *BlocksCleaner) locallyCachedMetas(userID string) map[ulid.ULID]struct{} {
+	dir := filepath.Join(c.metaSyncDirForUser(userID), metaSyncerCacheDirName)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	cached := make(map[ulid.ULID]struct{}, len(entries))
+	for _, entry := range entries {
+		id, ok := block.IsBlockDir(entry.Name())
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), metadata.MetaFilename)); err == nil {
+			cached[id] = struct{}{}
+		}
+	}
+	return cached
+}
+
+// trackMetaFilesSynced accounts the block metas returned by a fetch of the tenant blocks, and the ones
+// read from the local metas cache, as found before the fetch.
+func (c *BlocksCleaner) trackMetaFilesSynced(userID string, metas map[ulid.ULID]*metadata.Meta, cached map[ulid.ULID]struct{}) {
+	hits := 0
+	for id := range metas {
+		if _, ok := cached[id]; ok {
+			hits++
+		}
+	}
+
+	label := c.metaFilesUserLabel(userID)
+	c.metaFilesSynced.WithLabelValues(label).Add(float64(len(metas)))
+	c.metaFilesCacheHits.WithLabelValues(label).Add(float64(hits))
+}
+
+// metaFilesUserLabel returns the user label of the meta files metrics, which is empty unless the
+// per-tenant meta files metrics are enabled, to keep their cardinality bounded.
+func (c *BlocksCleaner) metaFilesUserLabel(userID string) string {
+	if c.cfg.PerTenantMetaFilesMetrics {
+		return userID
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldTrackTheMetaFilesSynced(t *testing.T) {
+	for _, perTenant := range []bool{false, true} {
+		perTenant := perTenant
+
+		t.Run(map[bool]string{false: "aggregated", true: "per-tenant"}[perTenant], func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+			createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:                   dataDir,
+				MetaSyncConcurrency:       10,
+				DeletionDelay:             time.Hour,
+				CleanupInterval:           time.Minute,
+				CleanupConcurrency:        1,
+				PerTenantMetaFilesMetrics: perTenant,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+			// The first run reads all the metas from the storage.
+			require.NoError(t, cleaner.runCleanup(ctx))
+
+			// The second run reads the metas from the local metas cache, except the one of the new block.
+			createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+			require.NoError(t, cleaner.runCleanup(ctx))
+
+			if !perTenant {
+				assert.Equal(t, 1, testutil.CollectAndCount(cleaner.metaFilesSynced))
+				assert.Equal(t, float64(7), testutil.ToFloat64(cleaner.metaFilesSynced.WithLabelValues("")))
+				assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.metaFilesCacheHits.WithLabelValues("")))
+				return
+			}
+
+			assert.Equal(t, 2, testutil.CollectAndCount(cleaner.metaFilesSynced))
+			assert.Equal(t, float64(5), testutil.ToFloat64(cleaner.metaFilesSynced.WithLabelValues("user-1")))
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.metaFilesSynced.WithLabelValues("user-2")))
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.metaFilesCacheHits.WithLabelValues("user-1")))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.metaFilesCacheHits.WithLabelValues("user-2")))
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package compactor
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Supported orders in which tenants are cleaned up within a run.
+const (
+	// Tenants are cleaned up in the users scan order.
+	CleanupOrderScan = "scan"
+
+	// Tenants are shuffled on each run.
+	CleanupOrderRandom = "random"
+
+	// Tenants with the fewest blocks found by the previous run are cleaned up first. Tenants
+	// not cleaned up by the previous run come first.
+	CleanupOrderSmallestFirst = "smallest-first"
+)
+
+var cleanupOrders = []string{CleanupOrderScan, CleanupOrderRandom, CleanupOrderSmallestFirst}
+
+// orderUsers sorts in place the tenants to clean up according to the configured order.
+func (c *BlocksCleaner) orderUsers(userIDs []string) {
+	switch c.cfg.CleanupOrder {
+	case CleanupOrderRandom:
+		rand.Shuffle(len(userIDs), func(i, j int) {
+			userIDs[i], userIDs[j] = userIDs[j], userIDs[i]
+		})
+	case CleanupOrderSmallestFirst:
+		blocks := make(map[string]int, len(userIDs))
+		for _, userID := range userIDs {
+			blocks[userID] = c.fetchGuard.previous(userID)
+		}
+
+		sort.SliceStable(userIDs, func(i, j int) bool {
+			return blocks[userIDs[i]] < blocks[userIDs[j]]
+		})
+	}
+}
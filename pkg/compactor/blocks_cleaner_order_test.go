@@ -0,0 +1,35 @@
+package compactor
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocksCleaner_OrderUsers(t *testing.T) {
+	for _, order := range cleanupOrders {
+		order := order
+
+		t.Run(order, func(t *testing.T) {
+			cleaner := NewBlocksCleaner(BlocksCleanerConfig{CleanupOrder: order}, nil, nil, newMockConfigProvider(), log.NewNopLogger(), nil)
+
+			// Blocks found by the previous run. The user-4 has not been cleaned up by the previous run.
+			cleaner.fetchGuard.observe(log.NewNopLogger(), "user-1", 30)
+			cleaner.fetchGuard.observe(log.NewNopLogger(), "user-2", 10)
+			cleaner.fetchGuard.observe(log.NewNopLogger(), "user-3", 20)
+
+			users := []string{"user-1", "user-2", "user-3", "user-4"}
+			cleaner.orderUsers(users)
+
+			switch order {
+			case CleanupOrderScan:
+				assert.Equal(t, []string{"user-1", "user-2", "user-3", "user-4"}, users)
+			case CleanupOrderRandom:
+				assert.ElementsMatch(t, []string{"user-1", "user-2", "user-3", "user-4"}, users)
+			case CleanupOrderSmallestFirst:
+				assert.Equal(t, []string{"user-4", "user-2", "user-3", "user-1"}, users)
+			}
+		})
+	}
+}
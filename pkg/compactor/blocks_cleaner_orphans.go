@@ -0,0 +1,199 @@
+package compactor
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+// Supported policies for block prefixes containing only markers and no block data.
+const (
+	// The prefix is handled as any other block.
+	OrphanBlockPrefixPolicyBlock = "block"
+
+	// The markers are deleted and tracked as an orphan prefix cleanup, not as a block deletion.
+	OrphanBlockPrefixPolicyCleanup = "cleanup"
+
+	// The prefix is left untouched.
+	OrphanBlockPrefixPolicySkip = "skip"
+)
+
+var errStopIter = errors.New("stop iteration")
+
+var orphanBlockPrefixPolicies = []string{OrphanBlockPrefixPolicyBlock, OrphanBlockPrefixPolicyCleanup, OrphanBlockPrefixPolicySkip}
+
+// blockMarkerFilenames are the objects which can be stored in a block location without being block data.
+var blockMarkerFilenames = map[string]struct{}{
+	metadata.DeletionMarkFilename:  {},
+	metadata.NoCompactMarkFilename: {},
+	BlockPolicyAnnotationFilename:  {},
+}
+
+// listOrphanBlockPrefix returns the markers stored in the block location if the block location
+// contains only markers, or nil if it contains any block data.
+func listOrphanBlockPrefix(ctx context.Context, userBucket objstore.Bucket, id ulid.ULID) ([]string, error) {
+	var markers []string
+	hasData := false
+
+	err := userBucket.Iter(ctx, id.String(), func(name string) error {
+		if _, ok := blockMarkerFilenames[path.Base(name)]; !ok || strings.HasSuffix(name, objstore.DirDelim) {
+			hasData = true
+			return errStopIter
+		}
+
+		markers = append(markers, name)
+		return nil
+	})
+
+	if errors.Is(err, errStopIter) || hasData {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return markers, nil
+}
+
+// handleOrphanBlockPrefix applies the configured policy to the block location if it contains only
+// markers. Returns false if the block location should be handled as any other block.
+func (c *BlocksCleaner) handleOrphanBlockPrefix(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger, id ulid.ULID) (bool, error) {
+	if c.cfg.OrphanBlockPrefixPolicy == "" || c.cfg.OrphanBlockPrefixPolicy == OrphanBlockPrefixPolicyBlock {
+		return false, nil
+	}
+
+	markers, err := listOrphanBlockPrefix(ctx, userBucket, id)
+	if err != nil {
+		return false, errors.Wrap(err, "list block prefix")
+	}
+	if len(markers) == 0 {
+		return false, nil
+	}
+
+	if c.cfg.OrphanBlockPrefixPolicy == OrphanBlockPrefixPolicySkip {
+		level.Debug(userLogger).Log("msg", "skipped block prefix containing only markers", "block", id)
+		return true, nil
+	}
+
+	if c.cfg.DryRun {
+		level.Info(userLogger).Log("msg", "would clean up block prefix containing only markers", "block", id, "dryRun", true)
+		return true, nil
+	}
+
+	// The deletion mark is deleted last, so that an interrupted cleanup is retried.
+	sort.SliceStable(markers, func(i, j int) bool {
+		return path.Base(markers[j]) == metadata.DeletionMarkFilename && path.Base(markers[i]) != metadata.DeletionMarkFilename
+	})
+
+	for _, name := range markers {
+		if err := userBucket.Delete(ctx, name); err != nil && !userBucket.IsObjNotFoundErr(err) {
+			return true, errors.Wrapf(err, "delete %s", name)
+		}
+	}
+
+	c.orphanPrefixesCleaned.Inc()
+	level.Info(userLogger).Log("msg", "cleaned up block prefix containing only markers", "block", id)
+	return true, nil
+}
+
+// isOrphanObjectCandidate returns whether the top-level entry of the tenant location could be an
+// orphaned object. Block locations, including the ones of blocks whose upload is in progress, the
+// markers location, the bucket index and the deleted blocks meta archive are never deleted.
+func isOrphanObjectCandidate(name string) bool {
+	if _, ok := block.IsBlockDir(name); ok {
+		return false
+	}
+
+	switch strings.TrimSuffix(name, objstore.DirDelim) {
+	case bucketindex.MarkersPathname, bucketindex.IndexFilename, bucketindex.IndexCompressedFilename, DeletedBlocksMetaArchiveName:
+		return false
+	}
+
+	// Be conservative with any entry which could be a temporary location of a block.
+	return !hasULIDPrefix(name)
+}
+
+// hasULIDPrefix returns whether the entry name starts with a ULID, like the blocks locations.
+func hasULIDPrefix(name string) bool {
+	if len(name) < ulid.EncodedSize {
+		return false
+	}
+
+	_, err := ulid.Parse(name[:ulid.EncodedSize])
+	return err == nil
+}
+
+// listOrphanObjects returns the objects stored in the tenant location, outside of any block and
+// markers location.
+func listOrphanObjects(ctx context.Context, userBucket objstore.Bucket, dir string) ([]string, error) {
+	var objects []string
+
+	err := userBucket.Iter(ctx, dir, func(name string) error {
+		if dir == "" && !isOrphanObjectCandidate(name) {
+			return nil
+		}
+
+		if !strings.HasSuffix(name, objstore.DirDelim) {
+			objects = append(objects, name)
+			return nil
+		}
+
+		nested, err := listOrphanObjects(ctx, userBucket, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, nested...)
+		return nil
+	})
+
+	return objects, err
+}
+
+// deleteOrphanObjects deletes the orphaned objects of the tenant older than the configured min age.
+// This is a best effort, so errors are logged and not returned.
+func (c *BlocksCleaner) deleteOrphanObjects(ctx context.Context, userBucket objstore.Bucket, userLogger log.Logger) {
+	objects, err := listOrphanObjects(ctx, userBucket, "")
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to list orphaned objects", "err", err)
+		return
+	}
+
+	for _, name := range objects {
+		attrs, err := userBucket.Attributes(ctx, name)
+		if userBucket.IsObjNotFoundErr(err) {
+			continue
+		}
+		if err != nil {
+			level.Warn(userLogger).Log("msg", "failed to get the attributes of an orphaned object", "object", name, "err", err)
+			continue
+		}
+
+		if c.now().Sub(attrs.LastModified) <= c.cfg.OrphanObjectsMinAge {
+			continue
+		}
+
+		if c.cfg.DryRun {
+			level.Info(userLogger).Log("msg", "would delete orphaned object", "object", name, "dryRun", true)
+			continue
+		}
+
+		if err := userBucket.Delete(ctx, name); err != nil && !userBucket.IsObjNotFoundErr(err) {
+			level.Warn(userLogger).Log("msg", "failed to delete orphaned object", "object", name, "err", err)
+			continue
+		}
+
+		c.orphanObjectsDeleted.Inc()
+		level.Info(userLogger).Log("msg", "deleted orphaned object", "object", name, "lastModified", attrs.LastModified)
+	}
+}
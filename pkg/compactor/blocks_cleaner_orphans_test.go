@@ -0,0 +1,237 @@
+package compactor
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldHonorOrphanBlockPrefixPolicy(t *testing.T) {
+	for _, policy := range orphanBlockPrefixPolicies {
+		policy := policy
+
+		t.Run(policy, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			deletionDelay := 12 * time.Hour
+
+			// A tenant marked for deletion with a block and an orphan prefix.
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			orphan1 := ulid.MustNew(ulid.Now(), rand.Reader)
+			createDeletionMark(t, bucketClient, "user-1", orphan1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+			require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+			// An active tenant with an orphan prefix.
+			orphan2 := ulid.MustNew(ulid.Now(), rand.Reader)
+			createDeletionMark(t, bucketClient, "user-2", orphan2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+			cfg := BlocksCleanerConfig{
+				DataDir:                 dataDir,
+				MetaSyncConcurrency:     10,
+				DeletionDelay:           deletionDelay,
+				CleanupInterval:         time.Minute,
+				CleanupConcurrency:      1,
+				OrphanBlockPrefixPolicy: policy,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			exists := func(p string) bool {
+				ok, err := bucketClient.Exists(ctx, p)
+				require.NoError(t, err)
+				return ok
+			}
+
+			// The actual block is always deleted.
+			assert.False(t, exists(path.Join("user-1", block1.String(), metadata.MetaFilename)))
+
+			switch policy {
+			case OrphanBlockPrefixPolicyBlock:
+				assert.False(t, exists(path.Join("user-1", orphan1.String(), metadata.DeletionMarkFilename)))
+				assert.False(t, exists(path.Join("user-2", orphan2.String(), metadata.DeletionMarkFilename)))
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.orphanPrefixesCleaned))
+				assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+			case OrphanBlockPrefixPolicyCleanup:
+				assert.False(t, exists(path.Join("user-1", orphan1.String(), metadata.DeletionMarkFilename)))
+				assert.False(t, exists(path.Join("user-2", orphan2.String(), metadata.DeletionMarkFilename)))
+				assert.False(t, exists(path.Join("user-2", bucketindex.BlockDeletionMarkFilepath(orphan2))))
+				assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.orphanPrefixesCleaned))
+				assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+			case OrphanBlockPrefixPolicySkip:
+				assert.True(t, exists(path.Join("user-1", orphan1.String(), metadata.DeletionMarkFilename)))
+				assert.True(t, exists(path.Join("user-2", orphan2.String(), metadata.DeletionMarkFilename)))
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.orphanPrefixesCleaned))
+				assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+			}
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldDeleteOrphanObjectsOlderThanMinAge(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	partial := ulid.MustNew(ulid.Now(), rand.Reader)
+
+	// Objects created in the past, and an object created recently.
+	oldObjects := []string{
+		"index-cache.json",
+		"debug/metas/meta.json",
+		path.Join(partial.String(), "index"),
+		partial.String() + ".tmp/index",
+		bucketindex.IndexCompressedFilename,
+	}
+	for _, name := range append(oldObjects, "recent.json") {
+		require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", name), strings.NewReader("content")))
+	}
+	for _, name := range append(oldObjects, path.Join(block1.String(), metadata.MetaFilename)) {
+		past := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(path.Join(storageDir, "user-1", name), past, past))
+	}
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		OrphanObjectsMinAge: time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for name, expectedExists := range map[string]bool{
+		"index-cache.json":      false,
+		"debug/metas/meta.json": false,
+		"recent.json":           true,
+		path.Join(block1.String(), metadata.MetaFilename): true,
+		path.Join(partial.String(), "index"):              true,
+		partial.String() + ".tmp/index":                   true,
+		bucketindex.IndexCompressedFilename:               true,
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", name))
+		require.NoError(t, err)
+		assert.Equal(t, expectedExists, exists, name)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.orphanObjectsDeleted))
+}
+
+func TestBlocksCleaner_ShouldNotDeletePartialBlocksMarkedForNoCompaction(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	noCompactMark := `{"id":"%s","version":1,"details":"retained","no_compact_time":0,"reason":"manual"}`
+
+	// A partial block and a block prefix containing only markers, both marked for no-compaction.
+	partial := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", partial, time.Now().Add(-2*time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", partial.String(), metadata.MetaFilename)))
+	require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", partial.String(), metadata.NoCompactMarkFilename), strings.NewReader(fmt.Sprintf(noCompactMark, partial))))
+
+	orphan := ulid.MustNew(ulid.Now(), rand.Reader)
+	createDeletionMark(t, bucketClient, "user-1", orphan, time.Now().Add(-2*time.Hour))
+	require.NoError(t, bucketClient.Upload(ctx, path.Join("user-1", orphan.String(), metadata.NoCompactMarkFilename), strings.NewReader(fmt.Sprintf(noCompactMark, orphan))))
+
+	// A partial block not marked for no-compaction.
+	deletable := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", deletable, time.Now().Add(-2*time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", deletable.String(), metadata.MetaFilename)))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                 dataDir,
+		MetaSyncConcurrency:     10,
+		DeletionDelay:           time.Hour,
+		CleanupInterval:         time.Minute,
+		CleanupConcurrency:      1,
+		OrphanBlockPrefixPolicy: OrphanBlockPrefixPolicyCleanup,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for name, expectedExists := range map[string]bool{
+		path.Join(partial.String(), metadata.NoCompactMarkFilename):  true,
+		path.Join(partial.String(), metadata.DeletionMarkFilename):   true,
+		path.Join(orphan.String(), metadata.NoCompactMarkFilename):   true,
+		path.Join(orphan.String(), metadata.DeletionMarkFilename):    true,
+		path.Join(deletable.String(), metadata.DeletionMarkFilename): false,
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", name))
+		require.NoError(t, err)
+		assert.Equal(t, expectedExists, exists, name)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.partialBlocksDeleted))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.orphanPrefixesCleaned))
+}
@@ -0,0 +1,28 @@
+package compactor
+
+import (
+	"github.com/go-kit/kit/log/level"
+)
+
+// Pause pauses the cleanup, while keeping the service running. The scheduled runs are skipped, and
+// the run in progress, if any, doesn't start the cleanup of any other tenant, while the tenants
+// in-flight are finished. The runs triggered on-demand are refused.
+func (c *BlocksCleaner) Pause() {
+	if c.paused.CAS(false, true) {
+		level.Info(c.logger).Log("msg", "blocks cleanup paused")
+	}
+	c.pausedGauge.Set(1)
+}
+
+// Resume resumes the cleanup paused by Pause(). The cleanup is resumed by the next scheduled run.
+func (c *BlocksCleaner) Resume() {
+	if c.paused.CAS(true, false) {
+		level.Info(c.logger).Log("msg", "blocks cleanup resumed")
+	}
+	c.pausedGauge.Set(0)
+}
+
+// Paused returns whether the cleanup is paused.
+func (c *BlocksCleaner) Paused() bool {
+	return c.paused.Load()
+}
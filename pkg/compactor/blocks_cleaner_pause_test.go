@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_PauseAndResume(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Hour,
+		CleanupConcurrency:  1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+
+	cleaner.Pause()
+	assert.True(t, cleaner.Paused())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.pausedGauge))
+
+	// While paused, scheduled runs are skipped and triggered runs are refused.
+	runsStarted := testutil.ToFloat64(cleaner.runsStarted)
+	require.NoError(t, cleaner.ticker(ctx))
+	assert.Equal(t, errCleanupPaused, cleaner.TriggerCleanup())
+	assert.Equal(t, runsStarted, testutil.ToFloat64(cleaner.runsStarted))
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Once resumed, the next run cleans up the blocks.
+	cleaner.Resume()
+	assert.False(t, cleaner.Paused())
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.pausedGauge))
+
+	require.NoError(t, cleaner.ticker(ctx))
+	assert.Equal(t, runsStarted+1, testutil.ToFloat64(cleaner.runsStarted))
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
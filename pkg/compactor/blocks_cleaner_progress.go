@@ -0,0 +1,143 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.uber.org/atomic"
+)
+
+// Phases of a tenant cleanup reported through Progress.
+const (
+	ProgressPhaseFetchingBlocks        = "fetching-blocks"
+	ProgressPhaseDeletingMarkedBlocks  = "deleting-marked-blocks"
+	ProgressPhaseDeletingPartialBlocks = "deleting-partial-blocks"
+	ProgressPhaseDeletingTenantBlocks  = "deleting-tenant-blocks"
+	ProgressPhaseVerifyingConvergence  = "verifying-convergence"
+	ProgressPhaseDone                  = "done"
+)
+
+// Progress is an incremental update about an on-demand tenant cleanup.
+type Progress struct {
+	UserID string `json:"user_id"`
+	Phase  string `json:"phase"`
+
+	// BlocksProcessed is the number of blocks processed (either deleted or failed
+	// to be deleted) since the beginning of the cleanup.
+	BlocksProcessed int64 `json:"blocks_processed"`
+}
+
+// progressReporter sends progress updates to a channel, without blocking if the
+// receiver is not keeping up. A nil progressReporter is valid and reports nothing.
+type progressReporter struct {
+	userID    string
+	ch        chan<- Progress
+	phase     *atomic.String
+	processed *atomic.Int64
+}
+
+func newProgressReporter(userID string, ch chan<- Progress) *progressReporter {
+	if ch == nil {
+		return nil
+	}
+
+	return &progressReporter{
+		userID:    userID,
+		ch:        ch,
+		phase:     atomic.NewString(""),
+		processed: atomic.NewInt64(0),
+	}
+}
+
+func (r *progressReporter) setPhase(phase string) {
+	if r == nil {
+		return
+	}
+
+	r.phase.Store(phase)
+	r.send(r.processed.Load())
+}
+
+func (r *progressReporter) blockProcessed() {
+	if r == nil {
+		return
+	}
+
+	r.send(r.processed.Inc())
+}
+
+func (r *progressReporter) send(processed int64) {
+	select {
+	case r.ch <- Progress{UserID: r.userID, Phase: r.phase.Load(), BlocksProcessed: processed}:
+	default:
+	}
+}
+
+// CleanUser runs an on-demand cleanup of a tenant not marked for deletion. If progress is not nil,
+// incremental updates are sent to it without blocking, and the channel is closed once done.
+func (c *BlocksCleaner) CleanUser(ctx context.Context, userID string, progress chan<- Progress) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	reporter := newProgressReporter(userID, progress)
+	err := c.cleanUser(ctx, userID, reporter)
+	reporter.setPhase(ProgressPhaseDone)
+
+	return err
+}
+
+// DeleteUser runs an on-demand deletion of the blocks of a tenant marked for deletion. If progress
+// is not nil, incremental updates are sent to it without blocking, and the channel is closed once done.
+func (c *BlocksCleaner) DeleteUser(ctx context.Context, userID string, progress chan<- Progress) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	reporter := newProgressReporter(userID, progress)
+	err := c.deleteUser(ctx, userID, tenantDeletionReasonOnDemand, reporter)
+	reporter.setPhase(ProgressPhaseDone)
+
+	return err
+}
+
+// logTenantDeletionProgress periodically logs the progress of the deletion of a tenant marked for deletion,
+// until the returned function is called or the context is canceled. The remaining blocks are estimated from
+// the blocks listed so far.
+func (c *BlocksCleaner) logTenantDeletionProgress(ctx context.Context, userLogger log.Logger, listed, deleted, failed, staged *atomic.Int64) func() {
+	if c.cfg.TenantDeletionProgressInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(c.cfg.TenantDeletionProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				level.Info(userLogger).Log(
+					"msg", "deleting blocks for user marked for deletion in progress",
+					"deletedBlocks", deleted.Load(),
+					"failedBlocks", failed.Load(),
+					"estimatedRemainingBlocks", listed.Load()-deleted.Load()-failed.Load()-staged.Load())
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
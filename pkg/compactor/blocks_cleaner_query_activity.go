@@ -0,0 +1,25 @@
+package compactor
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+)
+
+// QueryActivityProvider provides the query activity on blocks (eg. collected from the store-gateways).
+type QueryActivityProvider interface {
+	// RecentlyQueried returns whether the block of the given user has been recently queried.
+	RecentlyQueried(userID string, id ulid.ULID) bool
+}
+
+// recentlyQueried returns whether the deletion or marking of the input block should be deferred
+// because recently queried. Always false if no provider is configured.
+func (c *BlocksCleaner) recentlyQueried(userID string, id ulid.ULID, userLogger log.Logger) bool {
+	if c.cfg.QueryActivityProvider == nil || !c.cfg.QueryActivityProvider.RecentlyQueried(userID, id) {
+		return false
+	}
+
+	c.queryActivityDeferred.Inc()
+	level.Info(userLogger).Log("msg", "deferred the deletion of a block because recently queried", "block", id)
+	return true
+}
@@ -0,0 +1,126 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// Discrepancy types reported by the blocks cleaner reconciliation mode.
+const (
+	// A block still exists for a tenant marked for deletion.
+	discrepancyTenantBlockNotDeleted = "tenant_block_not_deleted"
+
+	// A block deletion mark has reached the deletion delay but the block still exists.
+	discrepancyMarkedBlockNotDeleted = "marked_block_not_deleted"
+
+	// A partial block with a deletion mark still exists.
+	discrepancyPartialBlockNotDeleted = "partial_block_not_deleted"
+)
+
+// ReconciliationDiscrepancy is a single difference between the expected and the actual bucket state.
+type ReconciliationDiscrepancy struct {
+	UserID  string    `json:"user_id"`
+	BlockID ulid.ULID `json:"block_id"`
+	Type    string    `json:"type"`
+}
+
+// ReconciliationReport holds the discrepancies found by a reconciliation run.
+type ReconciliationReport struct {
+	StartedAt     time.Time                   `json:"started_at"`
+	CompletedAt   time.Time                   `json:"completed_at"`
+	Discrepancies []ReconciliationDiscrepancy `json:"discrepancies"`
+}
+
+type reconciliation struct {
+	mtx     sync.Mutex
+	current *ReconciliationReport
+	last    *ReconciliationReport
+
+	discrepancies *prometheus.CounterVec
+}
+
+func newReconciliation(reg prometheus.Registerer) *reconciliation {
+	return &reconciliation{
+		discrepancies: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_compactor_reconciliation_discrepancies_total",
+			Help: "Total number of discrepancies found between the expected and actual bucket state by the blocks cleaner reconciliation.",
+		}, []string{"type"}),
+	}
+}
+
+// start begins a new report. Discrepancies added until complete() is called belong to it.
+func (r *reconciliation) start() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.current = &ReconciliationReport{StartedAt: time.Now()}
+}
+
+func (r *reconciliation) add(logger log.Logger, userID string, blockID ulid.ULID, discrepancyType string) {
+	r.discrepancies.WithLabelValues(discrepancyType).Inc()
+	level.Warn(logger).Log("msg", "reconciliation discrepancy found", "type", discrepancyType, "block", blockID)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.current != nil {
+		r.current.Discrepancies = append(r.current.Discrepancies, ReconciliationDiscrepancy{
+			UserID:  userID,
+			BlockID: blockID,
+			Type:    discrepancyType,
+		})
+	}
+}
+
+func (r *reconciliation) complete(logger log.Logger) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.current == nil {
+		return
+	}
+
+	r.current.CompletedAt = time.Now()
+	r.last = r.current
+	r.current = nil
+
+	level.Info(logger).Log("msg", "completed blocks cleanup reconciliation", "discrepancies", len(r.last.Discrepancies))
+}
+
+func (r *reconciliation) lastReport() *ReconciliationReport {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.last
+}
+
+// LastReconciliationReport returns the report generated by the last completed
+// reconciliation run, or nil if no reconciliation run has completed yet.
+func (c *BlocksCleaner) LastReconciliationReport() *ReconciliationReport {
+	return c.reconciliation.lastReport()
+}
+
+// reconcileUser compares the blocks of a tenant not marked for deletion against the
+// expected state, without deleting anything.
+func (c *BlocksCleaner) reconcileUser(ctx context.Context, userID string, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, partials map[ulid.ULID]error, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	deletionDelay := c.deletionDelay(userID)
+	for id, mark := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		if deletionDelayReached(mark, deletionDelay, c.now()) {
+			c.reconciliation.add(userLogger, userID, id, discrepancyMarkedBlockNotDeleted)
+		}
+	}
+
+	for _, id := range c.findDeletablePartialBlocks(ctx, partials, userBucket, userLogger) {
+		c.reconciliation.add(userLogger, userID, id, discrepancyPartialBlockNotDeleted)
+	}
+}
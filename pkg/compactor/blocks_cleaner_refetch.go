@@ -0,0 +1,32 @@
+package compactor
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// clearMetaCaches removes the metas cached on disk by the meta syncer, and the blocks cached in memory,
+// for all tenants. It must not be called while a run is in progress.
+func (c *BlocksCleaner) clearMetaCaches() {
+	level.Warn(c.logger).Log("msg", "clearing the blocks cleaner metas caches of all tenants: the next run will fetch the metas of all blocks from the storage, which issues a request for each block and may take a long time")
+
+	if c.metaCache != nil {
+		c.metaCache.clear()
+	}
+
+	dirs, err := filepath.Glob(c.metaSyncDirForUser("*"))
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to list the local metas caches", "err", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to remove the local metas cache", "dir", dir, "err", err)
+		}
+	}
+
+	level.Info(c.logger).Log("msg", "cleared the blocks cleaner metas caches of all tenants", "dirs", len(dirs))
+}
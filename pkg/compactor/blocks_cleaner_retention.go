@@ -0,0 +1,117 @@
+package compactor
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+type labelRetentionRule struct {
+	matcher   *regexp.Regexp
+	retention time.Duration
+}
+
+// labelRetention selects the retention of each block based on the value of one of its external labels.
+type labelRetention struct {
+	label string
+	rules []labelRetentionRule
+
+	blocksMarked prometheus.Counter
+}
+
+func newLabelRetention(cfg BlocksCleanerConfig, logger log.Logger, reg prometheus.Registerer) *labelRetention {
+	r := &labelRetention{
+		label: cfg.RetentionLabel,
+		blocksMarked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_compactor_retention_blocks_marked_for_deletion_total",
+			Help: "Total number of blocks marked for deletion because exceeding the retention selected by the block label.",
+		}),
+	}
+
+	for expr, retention := range cfg.RetentionByLabel {
+		matcher, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			// Not expected to happen, given the expressions are validated with the config.
+			level.Warn(logger).Log("msg", "skipped invalid blocks cleanup retention by label expression", "expr", expr, "err", err)
+			continue
+		}
+
+		r.rules = append(r.rules, labelRetentionRule{matcher: matcher, retention: retention})
+	}
+
+	return r
+}
+
+// retention returns the retention of a block with the input external labels, and whether any rule
+// matched. When multiple rules match, the longest retention wins, 0 (unlimited) included.
+func (r *labelRetention) retention(lbls map[string]string) (time.Duration, bool) {
+	value, ok := lbls[r.label]
+	if !ok {
+		return 0, false
+	}
+
+	matched := false
+	longest := time.Duration(0)
+
+	for _, rule := range r.rules {
+		if !rule.matcher.MatchString(value) {
+			continue
+		}
+
+		if rule.retention <= 0 {
+			return 0, true
+		}
+		if rule.retention > longest {
+			longest = rule.retention
+		}
+		matched = true
+	}
+
+	return longest, matched
+}
+
+// matches returns whether the retention of a block with the input external labels is selected by its label.
+func (r *labelRetention) matches(lbls map[string]string) bool {
+	if r == nil {
+		return false
+	}
+
+	_, matched := r.retention(lbls)
+	return matched
+}
+
+// applyLabelRetention marks for deletion the blocks containing only data older than the
+// retention selected by their label. The blocks not matching any rule are left to the
+// tenant retention period.
+func (c *BlocksCleaner) applyLabelRetention(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	r := c.labelRetention
+	now := c.now()
+
+	var ids []ulid.ULID
+	for id, meta := range metas {
+		retention, matched := r.retention(meta.Thanos.Labels)
+		if !matched || retention <= 0 {
+			continue
+		}
+
+		if meta.MaxTime <= now.Add(-retention).Unix()*1000 {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	marked, failed := c.markBlocksForDeletion(ctx, userID, ids, "exceeded the retention selected by the block label", r.blocksMarked, userBucket, userLogger)
+	level.Info(userLogger).Log("msg", "applied the blocks cleanup retention by label", "label", r.label, "markedBlocks", marked, "failedBlocks", failed)
+}
@@ -0,0 +1,125 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestLabelRetention_Retention(t *testing.T) {
+	r := newLabelRetention(BlocksCleanerConfig{
+		RetentionLabel: "__stream__",
+		RetentionByLabel: map[string]time.Duration{
+			"audit":     0,
+			"team-.*":   24 * time.Hour,
+			"team-a.*":  72 * time.Hour,
+			"debug":     time.Hour,
+			"debug-.+":  2 * time.Hour,
+			"[invalid":  time.Minute,
+			"unmatched": time.Minute,
+		},
+	}, log.NewNopLogger(), nil)
+
+	for _, tc := range []struct {
+		labels          map[string]string
+		expected        time.Duration
+		expectedMatched bool
+	}{
+		{labels: map[string]string{"__stream__": "debug"}, expected: time.Hour, expectedMatched: true},
+		// The longest retention wins when multiple expressions match.
+		{labels: map[string]string{"__stream__": "team-a"}, expected: 72 * time.Hour, expectedMatched: true},
+		{labels: map[string]string{"__stream__": "team-b"}, expected: 24 * time.Hour, expectedMatched: true},
+		// Unlimited retention always wins.
+		{labels: map[string]string{"__stream__": "audit"}, expected: 0, expectedMatched: true},
+		// Expressions are anchored.
+		{labels: map[string]string{"__stream__": "my-debug"}, expectedMatched: false},
+		// Blocks not matching or without the label are left to the tenant retention period.
+		{labels: map[string]string{"__stream__": "other"}, expectedMatched: false},
+		{labels: map[string]string{"other": "debug"}, expectedMatched: false},
+		{labels: nil, expectedMatched: false},
+	} {
+		retention, matched := r.retention(tc.labels)
+		assert.Equal(t, tc.expected, retention, tc.labels)
+		assert.Equal(t, tc.expectedMatched, matched, tc.labels)
+		assert.Equal(t, tc.expectedMatched, r.matches(tc.labels), tc.labels)
+	}
+}
+
+func TestBlocksCleaner_ShouldMarkBlocksExceedingTheRetentionSelectedByLabel(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	now := time.Now()
+	fiveHoursAgo := now.Add(-5*time.Hour).Unix() * 1000
+	block1 := createTSDBBlock(t, bucketClient, "user-1", fiveHoursAgo-1000, fiveHoursAgo, map[string]string{"__stream__": "debug"})
+	block2 := createTSDBBlock(t, bucketClient, "user-1", fiveHoursAgo-1000, fiveHoursAgo, map[string]string{"__stream__": "audit"})
+	block3 := createTSDBBlock(t, bucketClient, "user-1", fiveHoursAgo-1000, fiveHoursAgo, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block5 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, map[string]string{"__stream__": "audit"})
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		RetentionLabel:      "__stream__",
+		RetentionByLabel:    map[string]time.Duration{"debug": time.Hour, "audit": 0},
+	}
+
+	// The tenant retention period applies to the blocks not matching any retention by label.
+	cfgProvider := newMockConfigProvider()
+	cfgProvider.retention["user-1"] = 24 * time.Hour
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, cfgProvider, logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		{path: path.Join("user-1", block1.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-1", block2.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		{path: path.Join("user-1", block3.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		{path: path.Join("user-1", block4.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		// The retention selected by the label takes precedence over the tenant retention period.
+		{path: path.Join("user-1", block5.String(), metadata.DeletionMarkFilename), expectedExists: false},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.labelRetention.blocksMarked))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantRetentionMarked))
+}
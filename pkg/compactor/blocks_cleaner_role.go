@@ -0,0 +1,52 @@
+package compactor
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// Supported blocks cleaner roles.
+const (
+	// An active cleaner deletes blocks and writes markers.
+	BlocksCleanerRoleActive = "active"
+
+	// A standby cleaner only runs the read-only evaluation of the bucket.
+	BlocksCleanerRoleStandby = "standby"
+)
+
+var blocksCleanerRoles = []string{BlocksCleanerRoleActive, BlocksCleanerRoleStandby}
+
+// Role returns the current role of the cleaner.
+func (c *BlocksCleaner) Role() string {
+	return c.role.Load()
+}
+
+// SetRole changes the role of the cleaner (eg. promoting a standby cleaner to active). The
+// new role is honored by the operations started after the change.
+func (c *BlocksCleaner) SetRole(role string) error {
+	if !util.StringsContain(blocksCleanerRoles, role) {
+		return fmt.Errorf("unsupported blocks cleaner role %q", role)
+	}
+
+	if prev := c.role.Load(); prev != role {
+		level.Info(c.logger).Log("msg", "blocks cleaner role changed", "previous", prev, "role", role)
+	}
+	c.role.Store(role)
+
+	if role == BlocksCleanerRoleStandby {
+		c.roleStandby.Set(1)
+	} else {
+		c.roleStandby.Set(0)
+	}
+
+	return nil
+}
+
+// readOnly returns whether the cleaner must not mutate the bucket, either because configured
+// read-only, running in reconciliation mode, because standby or because planning the deletions.
+func (c *BlocksCleaner) readOnly() bool {
+	return c.cfg.ReadOnly || c.cfg.ReconciliationMode || c.role.Load() == BlocksCleanerRoleStandby || (c.deletionPlan != nil && c.deletionPlan.planning())
+}
@@ -0,0 +1,71 @@
+package compactor
+
+import (
+	"go.uber.org/atomic"
+)
+
+// Phases of a cleanup run in which blocks are deleted. The set is fixed, in order to keep
+// the cardinality of the phase label bounded.
+const (
+	cleanupPhaseTenantDelete  = "tenant_delete"
+	cleanupPhaseMarkedDelete  = "marked_delete"
+	cleanupPhasePartialDelete = "partial_delete"
+)
+
+var cleanupPhases = []string{cleanupPhaseTenantDelete, cleanupPhaseMarkedDelete, cleanupPhasePartialDelete}
+
+// runSummary tracks the blocks deleted and failed to be deleted by a cleanup run, by phase.
+// The maps are populated once at creation, so the summary can be updated concurrently.
+type runSummary struct {
+	deleted map[string]*atomic.Int64
+	failed  map[string]*atomic.Int64
+}
+
+func newRunSummary() *runSummary {
+	s := &runSummary{
+		deleted: map[string]*atomic.Int64{},
+		failed:  map[string]*atomic.Int64{},
+	}
+
+	for _, phase := range cleanupPhases {
+		s.deleted[phase] = atomic.NewInt64(0)
+		s.failed[phase] = atomic.NewInt64(0)
+	}
+
+	return s
+}
+
+// reset clears the summary at the beginning of a run.
+func (s *runSummary) reset() {
+	for _, phase := range cleanupPhases {
+		s.deleted[phase].Store(0)
+		s.failed[phase].Store(0)
+	}
+}
+
+func (s *runSummary) blockCleaned(phase string) {
+	s.deleted[phase].Inc()
+}
+
+func (s *runSummary) blockCleanupFailed(phase string) {
+	s.failed[phase].Inc()
+}
+
+// empty returns whether no block deletion has been attempted.
+func (s *runSummary) empty() bool {
+	for _, phase := range cleanupPhases {
+		if s.deleted[phase].Load() > 0 || s.failed[phase].Load() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// keyvals returns the summary as log key-value pairs.
+func (s *runSummary) keyvals() []interface{} {
+	keyvals := make([]interface{}, 0, 4*len(cleanupPhases))
+	for _, phase := range cleanupPhases {
+		keyvals = append(keyvals, phase+"_deleted", s.deleted[phase].Load(), phase+"_failed", s.failed[phase].Load())
+	}
+	return keyvals
+}
@@ -0,0 +1,91 @@
+package compactor
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldTrackBlocksByPhase(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+
+	// The blocks of user-1 are deleted, while the ones of user-2 fail to be deleted.
+	for _, userID := range []string{"user-1", "user-2"} {
+		marked := createTSDBBlock(t, bucketClient, userID, 10, 20, nil)
+		createDeletionMark(t, bucketClient, userID, marked, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+		partial := ulid.MustNew(ulid.Now(), rand.Reader)
+		createDeletionMark(t, bucketClient, userID, partial, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	}
+
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-3"))
+	createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, &failingDeleteBucket{Bucket: bucketClient, prefix: "user-2/"}, scanner, newMockConfigProvider(), logger, nil)
+	require.Error(t, cleaner.runCleanup(ctx))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhaseTenantDelete)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhaseMarkedDelete)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhasePartialDelete)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedByPhase.WithLabelValues(cleanupPhaseTenantDelete)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksFailedByPhase.WithLabelValues(cleanupPhaseMarkedDelete)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedByPhase.WithLabelValues(cleanupPhasePartialDelete)))
+
+	// The failed marked block deletion stops the cleanup of user-2, so its partial block is not attempted.
+	assert.Equal(t, []interface{}{
+		"tenant_delete_deleted", int64(1), "tenant_delete_failed", int64(0),
+		"marked_delete_deleted", int64(1), "marked_delete_failed", int64(1),
+		"partial_delete_deleted", int64(1), "partial_delete_failed", int64(0),
+	}, cleaner.runSummary.keyvals())
+
+	// The summary is reset by each run, while the counters are not.
+	cleaner.bucketClient = bucketClient
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	assert.Equal(t, []interface{}{
+		"tenant_delete_deleted", int64(0), "tenant_delete_failed", int64(0),
+		"marked_delete_deleted", int64(1), "marked_delete_failed", int64(0),
+		"partial_delete_deleted", int64(1), "partial_delete_failed", int64(0),
+	}, cleaner.runSummary.keyvals())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhaseMarkedDelete)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhasePartialDelete)))
+}
@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// running is like the running function of a timer service, but the schedule is tracked so that
+// it can be exposed, each interval is randomized within the configured jitter, if any, backed off
+// after consecutive failed runs, and the schedule is shifted by the runs triggered on-demand.
+func (c *BlocksCleaner) running(ctx context.Context) error {
+	t := time.NewTimer(c.scheduleNextRun(time.Now()))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			// Like a timer service, the interval is measured between the start of two runs.
+			runStart := time.Now()
+			c.scheduleNextRun(runStart)
+			if err := c.awaitRun(ctx, c.ticker); err != nil {
+				return err
+			}
+
+			// The backoff depends on the outcome of the run, so the next run is scheduled once again.
+			if c.failedRunsBackoff() > 0 {
+				c.scheduleNextRun(runStart)
+			}
+			t.Reset(time.Until(c.NextCleanup()))
+
+		case <-c.scheduleShifted:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(time.Until(c.NextCleanup()))
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NextCleanup returns the time of the next scheduled cleanup run, or the zero time if no run
+// has been scheduled yet (ie. the cleaner is not running).
+func (c *BlocksCleaner) NextCleanup() time.Time {
+	next := c.nextRun.Load()
+	if next == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, next)
+}
+
+// scheduleNextRun schedules the next run one cleanup interval, randomized within the configured
+// jitter and increased by the failed runs backoff, after the input run start. Returns the interval
+// until the next run.
+func (c *BlocksCleaner) scheduleNextRun(runStart time.Time) time.Duration {
+	interval := c.cfg.CleanupInterval
+	if c.cfg.CleanupIntervalJitter > 0 {
+		interval = util.DurationWithJitter(interval, c.cfg.CleanupIntervalJitter)
+	}
+	interval += c.failedRunsBackoff()
+
+	next := runStart.Add(interval)
+	c.nextRun.Store(next.UnixNano())
+	c.nextRunTimestamp.Set(float64(next.UnixNano()) / float64(time.Second))
+
+	return interval
+}
+
+// shiftSchedule schedules the next run one cleanup interval after the input run start, which has
+// not been scheduled (eg. triggered on-demand), and notifies the running loop.
+func (c *BlocksCleaner) shiftSchedule(runStart time.Time) {
+	c.scheduleNextRun(runStart)
+
+	select {
+	case c.scheduleShifted <- struct{}{}:
+	default:
+		// A notification is already pending, and the loop will read the latest schedule.
+	}
+}
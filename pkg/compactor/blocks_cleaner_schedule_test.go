@@ -0,0 +1,119 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+	"github.com/cortexproject/cortex/pkg/util/test"
+)
+
+func TestBlocksCleaner_NextCleanup(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Hour,
+		CleanupConcurrency:  1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	assert.True(t, cleaner.NextCleanup().IsZero())
+
+	started := time.Now()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The first run is scheduled one interval after the cleaner is running.
+	test.Poll(t, time.Second, false, func() interface{} {
+		return cleaner.NextCleanup().IsZero()
+	})
+	scheduled := cleaner.NextCleanup()
+	assert.False(t, scheduled.Before(started.Add(time.Hour)))
+	assert.True(t, scheduled.Before(time.Now().Add(time.Hour).Add(time.Second)))
+	assert.Equal(t, float64(scheduled.UnixNano())/float64(time.Second), testutil.ToFloat64(cleaner.nextRunTimestamp))
+
+	// A triggered run shifts the schedule.
+	require.NoError(t, cleaner.TriggerCleanup())
+	assert.True(t, cleaner.NextCleanup().After(scheduled))
+	assert.Equal(t, float64(cleaner.NextCleanup().UnixNano())/float64(time.Second), testutil.ToFloat64(cleaner.nextRunTimestamp))
+
+	test.Poll(t, time.Second, float64(2), func() interface{} {
+		return testutil.ToFloat64(cleaner.runsCompleted)
+	})
+}
+
+func TestBlocksCleaner_ScheduleShouldFollowTriggeredRuns(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     200 * time.Millisecond,
+		CleanupConcurrency:  1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// Keep triggering runs before the scheduled one: no scheduled run should ever start.
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		test.Poll(t, time.Second, nil, func() interface{} {
+			return cleaner.TriggerCleanup()
+		})
+	}
+
+	test.Poll(t, time.Second, float64(6), func() interface{} {
+		return testutil.ToFloat64(cleaner.runsCompleted)
+	})
+	assert.Equal(t, float64(6), testutil.ToFloat64(cleaner.runsStarted))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsOverlappingSkipped))
+}
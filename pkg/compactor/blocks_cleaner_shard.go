@@ -0,0 +1,25 @@
+package compactor
+
+import (
+	"github.com/go-kit/kit/log/level"
+)
+
+// filterOwnedUsers removes from the input list the tenants not owned by this cleaner, according to
+// the configured tenant shard function. All tenants are owned if no function is configured.
+func (c *BlocksCleaner) filterOwnedUsers(userIDs []string) []string {
+	if c.cfg.TenantShardFunc == nil {
+		return userIDs
+	}
+
+	owned := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !c.cfg.TenantShardFunc(userID) {
+			level.Debug(c.logger).Log("msg", "skipping blocks cleanup for user because not owned by this shard", "user", userID)
+			continue
+		}
+
+		owned = append(owned, userID)
+	}
+
+	return owned
+}
@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldCleanUpOnlyOwnedTenants(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-3"))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-4"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		TenantShardFunc: func(userID string) bool {
+			return userID == "user-1" || userID == "user-3"
+		},
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		{path: path.Join("user-1", block1.String(), metadata.MetaFilename), expectedExists: false},
+		{path: path.Join("user-2", block2.String(), metadata.MetaFilename), expectedExists: true},
+		{path: path.Join("user-3", block3.String(), metadata.MetaFilename), expectedExists: false},
+		{path: path.Join("user-4", block4.String(), metadata.MetaFilename), expectedExists: true},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantsOwned))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantsActive))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantsMarkedForDeletion))
+}
@@ -0,0 +1,71 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// tenantsContext returns the context used to clean up the tenants of a run. Once the run context
+// is canceled (ie. the cleaner is stopping) no other tenant is started, while the tenants in-flight
+// are canceled by stopping() only once the shutdown grace period has elapsed, so that they can be
+// finished instead of being left half processed.
+func (c *BlocksCleaner) tenantsContext(runCtx context.Context) context.Context {
+	if c.cfg.ShutdownGracePeriod <= 0 {
+		return runCtx
+	}
+	return c.tenantsInFlightCtx
+}
+
+// awaitRun runs the input function in background, tracked among the runs in-flight, and waits until
+// it returns or the input context is canceled. On cancellation the run is left in-flight, so that
+// stopping() can let its tenants finish within the shutdown grace period.
+func (c *BlocksCleaner) awaitRun(ctx context.Context, run func(context.Context) error) error {
+	errCh := make(chan error, 1)
+
+	c.runsInFlight.Add(1)
+	go func() {
+		defer c.runsInFlight.Done()
+		errCh <- run(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// awaitRunsInFlight waits until the runs in-flight, whose context has already been canceled, have
+// finished the tenants in-flight. The tenants are canceled once the shutdown grace period has elapsed.
+func (c *BlocksCleaner) awaitRunsInFlight() {
+	done := make(chan struct{})
+	go func() {
+		c.runsInFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	default:
+		if c.cfg.ShutdownGracePeriod <= 0 {
+			break
+		}
+
+		level.Info(c.logger).Log("msg", "blocks cleanup canceled, waiting for the tenants in-flight to be cleaned up", "gracePeriod", c.cfg.ShutdownGracePeriod)
+
+		t := time.NewTimer(c.cfg.ShutdownGracePeriod)
+		defer t.Stop()
+
+		select {
+		case <-done:
+		case <-t.C:
+			level.Warn(c.logger).Log("msg", "shutdown grace period elapsed, canceling the cleanup of the tenants in-flight")
+		}
+	}
+
+	c.cancelTenantsInFlight()
+	<-done
+}
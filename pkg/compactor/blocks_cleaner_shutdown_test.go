@@ -0,0 +1,127 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldFinishInFlightTenantsWithinShutdownGracePeriod(t *testing.T) {
+	for name, tc := range map[string]struct {
+		gracePeriod          time.Duration
+		expectedUser1Deleted bool
+	}{
+		"without grace period": {
+			gracePeriod:          0,
+			expectedUser1Deleted: false,
+		},
+		"with grace period": {
+			gracePeriod:          time.Minute,
+			expectedUser1Deleted: true,
+		},
+		"with grace period elapsed": {
+			gracePeriod:          10 * time.Millisecond,
+			expectedUser1Deleted: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:             dataDir,
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Hour,
+				CleanupConcurrency:  1,
+				ShutdownGracePeriod: tc.gracePeriod,
+			}
+
+			ctx := context.Background()
+			logger := log.NewNopLogger()
+			bkt := &blockingDeleteBucket{Bucket: bucketClient, started: make(chan struct{}), release: make(chan struct{})}
+			scanner := tsdb.NewUsersScanner(bkt, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bkt, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+			createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+			createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-2*time.Hour))
+			bkt.blocking.Store(true)
+
+			require.NoError(t, cleaner.TriggerCleanup())
+
+			// Stop the cleaner while the first tenant is deleting its block.
+			<-bkt.started
+			stopErr := make(chan error, 1)
+			go func() {
+				stopErr <- services.StopAndAwaitTerminated(ctx, cleaner)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			close(bkt.release)
+
+			require.NoError(t, <-stopErr)
+
+			// The in-flight tenant has been finished only with a grace period, while no other tenant has been started.
+			exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			assert.Equal(t, !tc.expectedUser1Deleted, exists)
+
+			exists, err = bucketClient.Exists(ctx, path.Join("user-2", block2.String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			assert.True(t, exists)
+		})
+	}
+}
+
+// blockingDeleteBucket is a bucket whose deletions block, once enabled, until released. The
+// started channel is closed once the first deletion is blocked.
+type blockingDeleteBucket struct {
+	objstore.Bucket
+	blocking    atomic.Bool
+	started     chan struct{}
+	startedOnce sync.Once
+	release     chan struct{}
+}
+
+func (b *blockingDeleteBucket) Delete(ctx context.Context, name string) error {
+	if b.blocking.Load() {
+		b.startedOnce.Do(func() { close(b.started) })
+
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return b.Bucket.Delete(ctx, name)
+}
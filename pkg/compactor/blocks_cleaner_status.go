@@ -0,0 +1,154 @@
+package compactor
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// tenantStatusRetention is how long the status of a tenant not found by the users scans anymore
+// (eg. deleted or not owned anymore) is kept.
+const tenantStatusRetention = 24 * time.Hour
+
+const cleanerStatusTpl = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Cortex Compactor Blocks Cleaner Status</title>
+	</head>
+	<body>
+		<h1>Cortex Compactor Blocks Cleaner Status</h1>
+		<p>Current time: {{ .Now }}</p>
+		<table width="100%" border="1">
+			<thead>
+				<tr>
+					<th>User ID</th>
+					<th>Marked For Deletion</th>
+					<th>Last Cleanup</th>
+					<th>Blocks Deleted</th>
+					<th>Blocks Failed</th>
+					<th>Pending Deletion Blocks</th>
+					<th>Error</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range .Tenants }}
+				<tr>
+					<td>{{ .UserID }}</td>
+					<td>{{ .MarkedForDeletion }}</td>
+					<td>{{ .LastCleanup }}</td>
+					<td>{{ .BlocksDeleted }}</td>
+					<td>{{ .BlocksFailed }}</td>
+					<td>{{ .PendingDeletionBlocks }}</td>
+					<td>{{ .Error }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+	</body>
+</html>`
+
+var cleanerStatusTmpl = template.Must(template.New("cleaner-status").Parse(cleanerStatusTpl))
+
+// TenantStatus is the status of the last cleanup, or deletion, of a tenant.
+type TenantStatus struct {
+	UserID            string    `json:"user_id"`
+	MarkedForDeletion bool      `json:"marked_for_deletion"`
+	LastCleanup       time.Time `json:"last_cleanup"`
+
+	// Blocks deleted and failed to be deleted by the last cleanup.
+	BlocksDeleted int `json:"blocks_deleted"`
+	BlocksFailed  int `json:"blocks_failed"`
+
+	// Blocks left to delete by the next cleanups.
+	PendingDeletionBlocks int `json:"pending_deletion_blocks"`
+
+	// Set if the last cleanup failed.
+	Error string `json:"error,omitempty"`
+}
+
+// tenantsStatus holds the status of the last cleanup of the tenants found by the last users scan,
+// and of the ones recently found.
+type tenantsStatus struct {
+	mtx     sync.RWMutex
+	tenants map[string]TenantStatus
+}
+
+func newTenantsStatus() *tenantsStatus {
+	return &tenantsStatus{tenants: map[string]TenantStatus{}}
+}
+
+// update records the stats of the cleanup of the tenant, completed at the input time.
+func (s *tenantsStatus) update(userID string, markedForDeletion bool, stats CleanupStats, now time.Time) {
+	status := TenantStatus{
+		UserID:                userID,
+		MarkedForDeletion:     markedForDeletion,
+		LastCleanup:           now,
+		BlocksDeleted:         stats.BlocksDeleted,
+		BlocksFailed:          stats.BlocksFailed,
+		PendingDeletionBlocks: stats.PendingDeletionBlocks,
+	}
+	if stats.Err != nil {
+		status.Error = stats.Err.Error()
+	}
+
+	s.mtx.Lock()
+	s.tenants[userID] = status
+	s.mtx.Unlock()
+}
+
+// retain forgets the tenants not found by the users scan, unless cleaned up within the status retention.
+func (s *tenantsStatus) retain(now time.Time, found ...[]string) {
+	keep := map[string]struct{}{}
+	for _, userIDs := range found {
+		for _, userID := range userIDs {
+			keep[userID] = struct{}{}
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for userID, status := range s.tenants {
+		if _, ok := keep[userID]; !ok && now.Sub(status.LastCleanup) > tenantStatusRetention {
+			delete(s.tenants, userID)
+		}
+	}
+}
+
+// list returns the status of the tenants, sorted by user ID.
+func (s *tenantsStatus) list() []TenantStatus {
+	s.mtx.RLock()
+	tenants := make([]TenantStatus, 0, len(s.tenants))
+	for _, status := range s.tenants {
+		tenants = append(tenants, status)
+	}
+	s.mtx.RUnlock()
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].UserID < tenants[j].UserID
+	})
+	return tenants
+}
+
+// TenantsStatus returns the status of the last cleanup of each tenant, sorted by user ID.
+func (c *BlocksCleaner) TenantsStatus() []TenantStatus {
+	return c.tenantsStatus.list()
+}
+
+// StatusHandler serves the status of the last cleanup of each tenant, as JSON if requested by the
+// Accept header, otherwise as an HTML page.
+func (c *BlocksCleaner) StatusHandler(w http.ResponseWriter, req *http.Request) {
+	util.RenderHTTPResponse(w, struct {
+		Tenants []TenantStatus `json:"tenants"`
+		Now     time.Time      `json:"now"`
+	}{
+		Tenants: c.TenantsStatus(),
+		Now:     c.now(),
+	}, cleanerStatusTmpl, req)
+}
@@ -0,0 +1,109 @@
+package compactor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_StatusHandler(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now())
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	now := time.Now()
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		Now:                 func() time.Time { return now },
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	expected := []TenantStatus{
+		{UserID: "user-1", LastCleanup: now, BlocksDeleted: 1, PendingDeletionBlocks: 1},
+		{UserID: "user-2", MarkedForDeletion: true, LastCleanup: now, BlocksDeleted: 1},
+	}
+	assert.Equal(t, expected, cleaner.TenantsStatus())
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/compactor/cleaner_status", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		cleaner.StatusHandler(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var status struct {
+			Tenants []TenantStatus `json:"tenants"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		require.Len(t, status.Tenants, 2)
+		assert.Equal(t, "user-1", status.Tenants[0].UserID)
+		assert.Equal(t, 1, status.Tenants[0].PendingDeletionBlocks)
+		assert.True(t, status.Tenants[1].MarkedForDeletion)
+	})
+
+	t.Run("html", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/compactor/cleaner_status", nil)
+		rec := httptest.NewRecorder()
+		cleaner.StatusHandler(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "<td>user-1</td>")
+		assert.Contains(t, rec.Body.String(), "<td>user-2</td>")
+	})
+}
+
+func TestTenantsStatus_Retain(t *testing.T) {
+	now := time.Now()
+	s := newTenantsStatus()
+	s.update("user-1", false, CleanupStats{Err: errors.New("failed")}, now.Add(-2*tenantStatusRetention))
+	s.update("user-2", false, CleanupStats{BlocksDeleted: 1}, now.Add(-2*tenantStatusRetention))
+	s.update("user-3", true, CleanupStats{}, now.Add(-time.Hour))
+
+	// Tenants not found by the users scan are forgotten once the retention has elapsed.
+	s.retain(now, []string{"user-1"}, nil)
+
+	tenants := s.list()
+	require.Len(t, tenants, 2)
+	assert.Equal(t, "user-1", tenants[0].UserID)
+	assert.Equal(t, "failed", tenants[0].Error)
+	assert.Equal(t, "user-3", tenants[1].UserID)
+}
@@ -0,0 +1,393 @@
+package compactor
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+func (c *BlocksCleaner) cleanUser(ctx context.Context, userID string, progress *progressReporter) error {
+	userLogger := util.WithUserID(userID, c.logger)
+
+	stats := c.tenantsCleanupStats.begin(userID)
+	err := c.cleanUserBlocks(ctx, userID, progress)
+	if c.tenantAlreadyGone(ctx, bucket.NewUserBucketClient(userID, c.bucketClient), userLogger, err) {
+		err = nil
+	}
+	cleanupStats := c.tenantsCleanupStats.end(userID, stats, err)
+	c.tenantsStatus.update(userID, false, cleanupStats, c.now())
+	c.tenantCleaned(userID, userLogger, cleanupStats)
+
+	return err
+}
+
+func (c *BlocksCleaner) cleanUserBlocks(ctx context.Context, userID string, progress *progressReporter) error {
+	userLogger := util.WithUserID(userID, c.logger)
+	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
+
+	// The fingerprint is computed before fetching the blocks, so that any change
+	// done while cleaning up is detected by the next run.
+	fingerprint := ""
+	if c.canSkipUnchangedUser(userID) {
+		if fp, err := userBucketFingerprint(ctx, userBucket); err != nil {
+			level.Warn(userLogger).Log("msg", "failed to compute the user bucket fingerprint", "err", err)
+		} else if c.unchangedTenants.unchanged(userID, fp) {
+			c.tenantsSkippedUnchanged.Inc()
+			c.tenantLastSuccess.WithLabelValues(userID).SetToCurrentTime()
+			level.Debug(userLogger).Log("msg", "skipping blocks cleanup for user because the bucket is unchanged since the previous run")
+			return nil
+		} else {
+			fingerprint = fp
+		}
+	}
+	if c.unchangedTenants != nil {
+		c.unchangedTenants.forget(userID)
+	}
+
+	// Runs a bucket scan to get a fresh list of all blocks and populate
+	// the list of deleted blocks in filter.
+	progress.setPhase(ProgressPhaseFetchingBlocks)
+	ignoreDeletionMarkFilter, metas, partials, err := c.fetchUserBlocksCached(ctx, userID, userBucket, userLogger)
+	if err != nil {
+		return err
+	}
+
+	if c.fetchGuard.observe(userLogger, userID, countFetchedBlocks(ignoreDeletionMarkFilter, metas, partials)) {
+		c.suspiciousEmptyFetches.Inc()
+		return nil
+	}
+
+	empty := countFetchedBlocks(ignoreDeletionMarkFilter, metas, partials) == 0
+	c.emptyTenants.observe(userID, empty)
+	if empty {
+		level.Info(userLogger).Log("msg", "no block found for user not marked for deletion")
+
+		if c.cfg.DeleteEmptyTenants && !c.readOnly() {
+			err := c.deleteEmptyTenant(ctx, userBucket, userLogger)
+			if err == nil {
+				c.userCleanupSucceeded(userID, "")
+				return nil
+			}
+			if !errors.Is(err, errEmptyTenantHasBlocks) {
+				return errors.Wrap(err, "failed to delete the residual objects of empty user")
+			}
+
+			// A block has been uploaded in the meanwhile, so the user is cleaned up as usual.
+			level.Info(userLogger).Log("msg", "not deleting the residual objects of empty user because a block has been found")
+		}
+	}
+
+	// Blocks marked for deletion become deletable as time passes, even if the bucket is unchanged.
+	if fingerprint != "" && len(ignoreDeletionMarkFilter.DeletionMarkBlocks()) > 0 {
+		fingerprint = ""
+	}
+
+	c.trackExcludedBlocks(ignoreDeletionMarkFilter, partials, userLogger)
+
+	if c.cfg.ReportMalformedBlockDirs {
+		c.findMalformedBlockDirs(ctx, userBucket, userLogger)
+	}
+	c.tenantPartialBlocks.WithLabelValues(userID).Set(float64(len(partials)))
+
+	pendingBlocks, pendingBytes := pendingDeletionBlocks(ignoreDeletionMarkFilter.DeletionMarkBlocks(), metas, c.deletionDelay(userID), c.now())
+	c.tenantPendingDeletionBlocks.WithLabelValues(userID).Set(float64(pendingBlocks))
+	c.tenantsCleanupStats.pendingDeletion(userID, pendingBlocks)
+	c.tenantPendingDeletionBytes.WithLabelValues(userID).Set(float64(pendingBytes))
+	c.tenantOldestPendingDeletionAge.WithLabelValues(userID).Set(oldestDeletableBlockAge(ignoreDeletionMarkFilter.DeletionMarkBlocks(), c.deletionDelay(userID), nil, c.now()).Seconds())
+
+	if c.deletionMarksExporter != nil {
+		c.deletionMarksExporter.observe(userID, ignoreDeletionMarkFilter.DeletionMarkBlocks(), c.deletionDelay(userID), c.now())
+	}
+
+	if c.readOnly() {
+		c.reconcileUser(ctx, userID, ignoreDeletionMarkFilter, partials, userBucket, userLogger)
+		c.userCleanupSucceeded(userID, fingerprint)
+		return nil
+	}
+
+	// Blocks marked for deletion by the governance cutoff, the retentions or the max number of blocks follow the deletion delay,
+	// like any other block marked for deletion.
+	if c.governance != nil {
+		c.applyGovernance(ctx, userID, metas, userBucket, userLogger)
+	}
+
+	c.applyTenantRetention(ctx, userID, metas, userBucket, userLogger)
+
+	if c.labelRetention != nil {
+		c.applyLabelRetention(ctx, userID, metas, userBucket, userLogger)
+	}
+
+	c.applyMaxBlocksPerTenant(ctx, userID, metas, userBucket, userLogger)
+
+	if c.corruptBlocks != nil {
+		c.checkCorruptBlocks(ctx, userID, metas, ignoreDeletionMarkFilter.DeletionMarkBlocks(), userBucket, userLogger)
+	}
+
+	if c.cfg.AnnotateRetainedBlocks {
+		c.annotateRetainedBlocks(ctx, userID, ignoreDeletionMarkFilter, userBucket, userLogger)
+	}
+
+	if err := c.deleteMarkedBlocks(ctx, userID, ignoreDeletionMarkFilter, userBucket, userLogger, progress); err != nil {
+		return errors.Wrap(err, "error cleaning blocks")
+	}
+
+	// Partial blocks with a deletion mark can be cleaned up, unless disabled. This is a best effort, so we
+	// don't return error if the cleanup of partial blocks fail.
+	if len(partials) > 0 && c.cfg.DisablePartialBlocksCleanup {
+		level.Debug(userLogger).Log("msg", "skipped cleaning of partial blocks because disabled", "partialBlocks", len(partials))
+	} else if len(partials) > 0 {
+		level.Info(userLogger).Log("msg", "started cleaning of partial blocks marked for deletion")
+		c.cleanUserPartialBlocks(ctx, userID, partials, userBucket, userLogger, progress)
+		level.Info(userLogger).Log("msg", "cleaning of partial blocks marked for deletion done")
+	}
+
+	if c.cfg.OrphanObjectsMinAge > 0 {
+		c.deleteOrphanObjects(ctx, userBucket, userLogger)
+	}
+
+	if c.cfg.WriteBucketIndex {
+		c.writeUserBucketIndex(ctx, userID, metas, ignoreDeletionMarkFilter.DeletionMarkBlocks(), userLogger)
+	}
+
+	if c.cfg.VerifyConvergence {
+		progress.setPhase(ProgressPhaseVerifyingConvergence)
+		c.verifyUserConvergence(ctx, userID, userBucket, userLogger)
+	}
+
+	c.userCleanupSucceeded(userID, fingerprint)
+	return nil
+}
+
+// userCleanupSucceeded tracks the cleanup of a tenant not marked for deletion completed without error. The
+// fingerprint is empty unless the tenant had nothing to clean up and can be skipped while unchanged.
+func (c *BlocksCleaner) userCleanupSucceeded(userID, fingerprint string) {
+	c.tenantLastSuccess.WithLabelValues(userID).SetToCurrentTime()
+
+	if fingerprint != "" {
+		c.unchangedTenants.idle(userID, fingerprint)
+	}
+}
+
+// pendingDeletionBlocks returns the number of blocks marked for deletion which haven't reached the
+// deletion delay yet, and their size in bytes as tracked by the files listed in their meta.json.
+func pendingDeletionBlocks(marks map[ulid.ULID]*metadata.DeletionMark, metas map[ulid.ULID]*metadata.Meta, deletionDelay time.Duration, now time.Time) (int, int64) {
+	count := 0
+	size := int64(0)
+
+	for id, mark := range marks {
+		if deletionDelayReached(mark, deletionDelay, now) {
+			continue
+		}
+
+		count++
+		if meta, ok := metas[id]; ok {
+			for _, f := range meta.Thanos.Files {
+				size += f.SizeBytes
+			}
+		}
+	}
+
+	return count, size
+}
+
+// oldestDeletableBlockAge returns the age of the deletion mark of the oldest block which has reached
+// the deletion delay and is not in the input deleted blocks, or 0 if there's no such block.
+func oldestDeletableBlockAge(marks map[ulid.ULID]*metadata.DeletionMark, deletionDelay time.Duration, deleted map[ulid.ULID]struct{}, now time.Time) time.Duration {
+	oldest := time.Duration(0)
+
+	for id, mark := range marks {
+		if _, ok := deleted[id]; ok || !deletionDelayReached(mark, deletionDelay, now) {
+			continue
+		}
+
+		if age := now.Sub(time.Unix(mark.DeletionTime, 0)); age > oldest {
+			oldest = age
+		}
+	}
+
+	return oldest
+}
+
+// deletionDelay returns the deletion delay of the input tenant. A per-tenant delay not greater than zero
+// falls back to the configured deletion delay, so the per-tenant override can't disable the delay.
+func (c *BlocksCleaner) deletionDelay(userID string) time.Duration {
+	if delay := c.cfgProvider.CompactorBlocksDeletionDelay(userID); delay > 0 {
+		return delay
+	}
+	return c.cfg.DeletionDelay
+}
+
+// deletionDelayReached returns whether the block deletion mark is older than the deletion delay.
+func deletionDelayReached(mark *metadata.DeletionMark, deletionDelay time.Duration, now time.Time) bool {
+	return now.Sub(time.Unix(mark.DeletionTime, 0)).Seconds() > deletionDelay.Seconds()
+}
+
+// deleteMarkedBlocks hard-deletes the blocks marked for deletion which have reached the deletion delay.
+func (c *BlocksCleaner) deleteMarkedBlocks(ctx context.Context, userID string, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, userBucket *bucket.UserBucketClient, userLogger log.Logger, progress *progressReporter) error {
+	level.Info(userLogger).Log("msg", "started cleaning of blocks marked for deletion")
+	progress.setPhase(ProgressPhaseDeletingMarkedBlocks)
+
+	deletionDelay := c.deletionDelay(userID)
+
+	// The blocks which have reached the deletion delay but are not deleted by this run are a backlog.
+	deleted := map[ulid.ULID]struct{}{}
+	defer func() {
+		c.tenantOldestPendingDeletionAge.WithLabelValues(userID).Set(oldestDeletableBlockAge(ignoreDeletionMarkFilter.DeletionMarkBlocks(), deletionDelay, deleted, c.now()).Seconds())
+	}()
+
+	for _, mark := range ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		if !deletionDelayReached(mark, deletionDelay, c.now()) {
+			continue
+		}
+
+		if c.recentlyQueried(userID, mark.ID, userLogger) {
+			continue
+		}
+
+		if !c.plannedForDeletion(userID, mark.ID, userLogger) {
+			continue
+		}
+
+		if c.excludedByDeleteFilter(ctx, userID, mark.ID, userBucket, userLogger) {
+			continue
+		}
+
+		if !c.deletionMarkUnchanged(ctx, userBucket, userLogger, mark.ID, mark) {
+			continue
+		}
+
+		err := c.deleteBlock(ctx, userID, userLogger, userBucket, mark.ID)
+		if errors.Is(err, errDeletionBudgetExhausted) {
+			break
+		}
+		if errors.Is(err, errDeletionDryRun) {
+			continue
+		}
+
+		progress.blockProcessed()
+		if err != nil {
+			c.blockCleanupFailed(userID, cleanupPhaseMarkedDelete)
+			level.Warn(log.With(userLogger, blockDeletionErrorFields(err)...)).Log("msg", "failed to delete block marked for deletion", "block", mark.ID, "err", err)
+			return errors.Wrap(err, "delete block")
+		}
+
+		deleted[mark.ID] = struct{}{}
+		c.blockCleaned(userID, cleanupPhaseMarkedDelete)
+		c.deletionMarkAgeAtDelete.Observe(c.now().Sub(time.Unix(mark.DeletionTime, 0)).Seconds())
+		c.cfg.DeletionAuditor.RecordBlockDeleted(userID, mark.ID, deletionReasonDeletionMark, time.Now())
+		level.Info(userLogger).Log("msg", "deleted block marked for deletion", "block", mark.ID)
+	}
+
+	level.Info(userLogger).Log("msg", "cleaning of blocks marked for deletion done")
+	return nil
+}
+
+func (c *BlocksCleaner) cleanUserPartialBlocks(ctx context.Context, userID string, partials map[ulid.ULID]error, userBucket *bucket.UserBucketClient, userLogger log.Logger, progress *progressReporter) {
+	progress.setPhase(ProgressPhaseDeletingPartialBlocks)
+
+	for _, blockID := range c.findDeletablePartialBlocks(ctx, partials, userBucket, userLogger) {
+		if !c.plannedForDeletion(userID, blockID, userLogger) {
+			continue
+		}
+
+		if orphan, err := c.handleOrphanBlockPrefix(ctx, userBucket, userLogger, blockID); orphan || err != nil {
+			if err != nil {
+				level.Warn(userLogger).Log("msg", "error cleaning up block prefix containing only markers", "block", blockID, "err", err)
+			}
+			continue
+		}
+
+		if !c.deletionMarkUnchanged(ctx, userBucket, userLogger, blockID, nil) {
+			continue
+		}
+
+		// Hard-delete partial blocks having a deletion mark, even if the deletion threshold has not
+		// been reached yet, unless the partial blocks deletion delay is configured.
+		err := c.deleteBlock(ctx, userID, userLogger, userBucket, blockID)
+		if errors.Is(err, errDeletionBudgetExhausted) {
+			return
+		}
+		if errors.Is(err, errDeletionDryRun) {
+			continue
+		}
+
+		progress.blockProcessed()
+		if err != nil {
+			c.blockCleanupFailed(userID, cleanupPhasePartialDelete)
+			level.Warn(log.With(userLogger, blockDeletionErrorFields(err)...)).Log("msg", "error deleting partial block marked for deletion", "block", blockID, "err", err)
+			continue
+		}
+
+		c.blockCleaned(userID, cleanupPhasePartialDelete)
+		c.partialBlocksDeleted.Inc()
+		c.cfg.DeletionAuditor.RecordBlockDeleted(userID, blockID, deletionReasonPartialBlock, time.Now())
+		level.Info(userLogger).Log("msg", "deleted partial block marked for deletion", "block", blockID)
+	}
+}
+
+// findDeletablePartialBlocks returns the partial blocks which can be safely hard-deleted.
+func (c *BlocksCleaner) findDeletablePartialBlocks(ctx context.Context, partials map[ulid.ULID]error, userBucket *bucket.UserBucketClient, userLogger log.Logger) []ulid.ULID {
+	var deletable []ulid.ULID
+
+	for blockID, blockErr := range partials {
+		// We can safely delete only blocks which are partial because the meta.json is missing.
+		if blockErr != block.ErrorSyncMetaNotFound {
+			continue
+		}
+
+		// We can safely delete only partial blocks with a deletion mark.
+		mark := &metadata.DeletionMark{}
+		err := metadata.ReadMarker(ctx, userLogger, userBucket, blockID.String(), mark)
+		if err == metadata.ErrorMarkerNotFound {
+			continue
+		}
+		if err != nil {
+			level.Warn(userLogger).Log("msg", "error reading partial block deletion mark", "block", blockID, "err", err)
+			continue
+		}
+
+		// Blocks marked for no-compaction are intentionally retained, so they're never considered for
+		// deletion as partial blocks or block prefixes containing only markers.
+		if protected, err := userBucket.Exists(ctx, path.Join(blockID.String(), metadata.NoCompactMarkFilename)); err != nil {
+			level.Warn(userLogger).Log("msg", "error checking partial block no-compact mark", "block", blockID, "err", err)
+			continue
+		} else if protected {
+			level.Info(userLogger).Log("msg", "skipped deletion of partial block marked for deletion because marked for no-compaction", "block", blockID)
+			continue
+		}
+
+		if c.cfg.PartialBlockDeletionDelay > 0 && !deletionDelayReached(mark, c.cfg.PartialBlockDeletionDelay, c.now()) {
+			level.Info(userLogger).Log("msg", "skipped deletion of partial block marked for deletion because it has not reached the deletion delay yet", "block", blockID, "deletionTime", time.Unix(mark.DeletionTime, 0))
+			continue
+		}
+
+		// We can safely delete only partial blocks which exist since long enough, to not
+		// race with an upload which is still in progress.
+		if c.cfg.MinPartialBlockLifetime > 0 {
+			createdAt, err := oldestObjectTime(ctx, userBucket, blockID.String())
+			if err != nil {
+				level.Warn(userLogger).Log("msg", "error reading partial block objects attributes", "block", blockID, "err", err)
+				continue
+			}
+
+			if lifetime := c.now().Sub(createdAt); lifetime < c.cfg.MinPartialBlockLifetime {
+				level.Info(userLogger).Log("msg", "skipped deletion of partial block marked for deletion because it has not reached the min lifetime yet", "block", blockID, "lifetime", lifetime)
+				continue
+			}
+		}
+
+		deletable = append(deletable, blockID)
+	}
+
+	return deletable
+}
@@ -0,0 +1,255 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// Remove all blocks for user marked for deletion.
+func (c *BlocksCleaner) deleteUser(ctx context.Context, userID, reason string, progress *progressReporter) error {
+	if approved, err := c.approveTenantDeletion(ctx, userID); err != nil || !approved {
+		return err
+	}
+
+	userLogger := util.WithUserID(userID, c.logger)
+
+	stats := c.tenantsCleanupStats.begin(userID)
+	err := c.deleteUserBlocks(ctx, userID, reason, progress)
+	if c.tenantAlreadyGone(ctx, bucket.NewUserBucketClient(userID, c.bucketClient), userLogger, err) {
+		err = nil
+	}
+	cleanupStats := c.tenantsCleanupStats.end(userID, stats, err)
+	c.tenantsStatus.update(userID, true, cleanupStats, c.now())
+	c.tenantCleaned(userID, userLogger, cleanupStats)
+
+	return err
+}
+
+func (c *BlocksCleaner) deleteUserBlocks(ctx context.Context, userID, reason string, progress *progressReporter) error {
+	userLogger := util.WithUserID(userID, c.logger)
+	userBucket := bucket.NewUserBucketClient(userID, c.bucketClient)
+
+	c.tenantDeletions.WithLabelValues(reason).Inc()
+	level.Info(userLogger).Log("msg", "deleting blocks for user marked for deletion", "reason", reason)
+	progress.setPhase(ProgressPhaseDeletingTenantBlocks)
+
+	// Partial blocks are tracked only for tenants not marked for deletion.
+	c.tenantPartialBlocks.DeleteLabelValues(userID)
+	c.tenantPendingDeletionBlocks.DeleteLabelValues(userID)
+	c.tenantPendingDeletionBytes.DeleteLabelValues(userID)
+	c.tenantOldestPendingDeletionAge.DeleteLabelValues(userID)
+
+	// The meta.json of the blocks are archived upfront, so that the archive is uploaded once per chunk
+	// of blocks instead of once per block.
+	archive, err := c.archiveDeletedBlockMetas(ctx, userBucket, userLogger)
+	if err != nil {
+		return errors.Wrap(err, "archive the meta.json of the blocks")
+	}
+
+	// Blocks are listed and fed to a pool of workers deleting them, so that listing
+	// and deletion overlap.
+	var (
+		listed  = atomic.NewInt64(0)
+		deleted = atomic.NewInt64(0)
+		failed  = atomic.NewInt64(0)
+		staged  = atomic.NewInt64(0)
+		ids     = make(chan ulid.ULID, c.deleteConcurrency())
+		wg      = sync.WaitGroup{}
+	)
+
+	stopProgressLog := c.logTenantDeletionProgress(ctx, userLogger, listed, deleted, failed, staged)
+
+	for i := 0; i < c.deleteConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range ids {
+				switch c.deleteUserBlock(ctx, userID, id, userBucket, userLogger, archive, progress) {
+				case tenantBlockDeleted:
+					deleted.Inc()
+				case tenantBlockStaged:
+					staged.Inc()
+				case tenantBlockFailed:
+					failed.Inc()
+				}
+			}
+		}()
+	}
+
+	err = userBucket.Iter(ctx, "", func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Stop iterating, remaining blocks will be deleted in the next runs.
+		if c.runDeletionBudgetExhausted.Load() {
+			return errDeletionBudgetExhausted
+		}
+
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			c.checkMalformedBlockDir(name, userLogger)
+			return nil
+		}
+		listed.Inc()
+
+		// When read-only every block still existing for a tenant
+		// marked for deletion is a discrepancy.
+		if c.readOnly() {
+			c.reconciliation.add(userLogger, userID, id, discrepancyTenantBlockNotDeleted)
+			return nil
+		}
+
+		select {
+		case ids <- id:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	// Wait until all listed blocks have been processed.
+	close(ids)
+	wg.Wait()
+	stopProgressLog()
+
+	budgetExhausted := errors.Is(err, errDeletionBudgetExhausted) || (err == nil && c.runDeletionBudgetExhausted.Load())
+	if err != nil && !budgetExhausted {
+		return err
+	}
+
+	// Failures are reported even if the budget has been exhausted, in order to not hide them.
+	if failed.Load() > 0 {
+		return errors.Errorf("failed to delete %d blocks", failed.Load())
+	}
+
+	if budgetExhausted {
+		level.Info(userLogger).Log("msg", "stopped deleting blocks for user marked for deletion because the max number of blocks deleted per run has been reached", "deletedBlocks", deleted.Load())
+		return nil
+	}
+
+	if staged.Load() > 0 {
+		level.Info(userLogger).Log("msg", "blocks of user marked for deletion will be deleted once the tenant deletion delay has elapsed", "stagedBlocks", staged.Load(), "tenantDeletionDelay", c.cfg.TenantDeletionDelay)
+	}
+
+	// Staged blocks are expected to be left in the storage.
+	if c.cfg.VerifyConvergence && staged.Load() == 0 {
+		progress.setPhase(ProgressPhaseVerifyingConvergence)
+		c.verifyDeletedUserConvergence(ctx, userBucket, userLogger)
+	}
+
+	// Once no block is left, the tenant has been fully deleted in a previous run, so its
+	// series can be removed without losing the last deletions.
+	// The local metas cache is not used for tenants marked for deletion, so it can be removed
+	// once all blocks have been deleted.
+	if deleted.Load() == listed.Load() {
+		if err := os.RemoveAll(c.metaSyncDirForUser(userID)); err != nil {
+			level.Warn(userLogger).Log("msg", "failed to remove the local metas cache of user marked for deletion", "err", err)
+		}
+	}
+
+	// The bucket index is deleted once all blocks have been deleted, unless not mutating the bucket.
+	if c.cfg.WriteBucketIndex && !c.readOnly() && !c.cfg.DryRun && deleted.Load() == listed.Load() {
+		if err := bucketindex.DeleteIndex(ctx, c.bucketClient, userID); err != nil {
+			return err
+		}
+	}
+
+	c.completedTenantDeletions.observe(userID, deleted.Load() == listed.Load())
+	c.tenantsCleanupStats.pendingDeletion(userID, int(staged.Load()))
+
+	if listed.Load() == 0 {
+		// The deletion of the mark is a best effort, and is retried in the next runs.
+		if err := c.deleteExpiredTenantDeletionMark(ctx, userID, userBucket, userLogger); err != nil {
+			level.Warn(userLogger).Log("msg", "failed to delete the tenant deletion mark of user whose blocks have been deleted", "err", err)
+		}
+
+		c.tenantBlocksCleaned.DeleteLabelValues(userID)
+		c.tenantBlocksFailed.DeleteLabelValues(userID)
+		c.metaSyncFailures.DeleteLabelValues(userID)
+		if c.cfg.PerTenantMetaFilesMetrics {
+			c.metaFilesSynced.DeleteLabelValues(userID)
+			c.metaFilesCacheHits.DeleteLabelValues(userID)
+		}
+		c.tenantCleanupDuration.DeleteLabelValues(userID)
+		c.tenantLastSuccess.DeleteLabelValues(userID)
+	} else {
+		c.tenantLastSuccess.WithLabelValues(userID).SetToCurrentTime()
+	}
+
+	level.Info(userLogger).Log("msg", "finished deleting blocks for user marked for deletion", "deletedBlocks", deleted.Load())
+	return nil
+}
+
+// tenantBlockOutcome is the outcome of the deletion of a block of a tenant marked for deletion.
+type tenantBlockOutcome int
+
+const (
+	// tenantBlockSkipped means the block has been left in the storage, to be deleted in the next runs.
+	tenantBlockSkipped tenantBlockOutcome = iota
+	tenantBlockDeleted
+	tenantBlockStaged
+	tenantBlockFailed
+)
+
+// deleteUserBlock deletes a block of a tenant marked for deletion, once cleared by the deletion plan,
+// the orphan prefixes handling, the tenant deletion delay and the archival of its meta.json.
+func (c *BlocksCleaner) deleteUserBlock(ctx context.Context, userID string, id ulid.ULID, userBucket *bucket.UserBucketClient, userLogger log.Logger, archive *deletedBlocksMetaArchive, progress *progressReporter) tenantBlockOutcome {
+	if !c.plannedForDeletion(userID, id, userLogger) {
+		return tenantBlockSkipped
+	}
+
+	if orphan, err := c.handleOrphanBlockPrefix(ctx, userBucket, userLogger, id); orphan || err != nil {
+		if err != nil {
+			level.Warn(userLogger).Log("msg", "failed to clean up block prefix containing only markers", "block", id, "err", err)
+			return tenantBlockFailed
+		}
+		return tenantBlockSkipped
+	}
+
+	if deletable, err := c.stageTenantBlockDeletion(ctx, userBucket, userLogger, id); !deletable {
+		if err != nil {
+			level.Warn(userLogger).Log("msg", "failed to stage the deletion of block", "block", id, "err", err)
+			return tenantBlockFailed
+		}
+		return tenantBlockStaged
+	}
+
+	if err := archive.archiveDeletedBlockMeta(ctx, id); err != nil {
+		// The block is not deleted, so that its meta.json isn't lost.
+		level.Warn(userLogger).Log("msg", "failed to archive the meta.json of block, skipping its deletion", "block", id, "err", err)
+		return tenantBlockFailed
+	}
+
+	err := c.deleteBlock(ctx, userID, userLogger, userBucket, id)
+	if errors.Is(err, errDeletionBudgetExhausted) || errors.Is(err, errDeletionDryRun) {
+		// Remaining blocks will be deleted in the next runs.
+		return tenantBlockSkipped
+	}
+
+	progress.blockProcessed()
+	if err != nil {
+		c.blockCleanupFailed(userID, cleanupPhaseTenantDelete)
+		level.Warn(log.With(userLogger, blockDeletionErrorFields(err)...)).Log("msg", "failed to delete block", "block", id, "err", err)
+		return tenantBlockFailed
+	}
+
+	c.blockCleaned(userID, cleanupPhaseTenantDelete)
+	c.cfg.DeletionAuditor.RecordBlockDeleted(userID, id, deletionReasonTenantDeleted, time.Now())
+	level.Info(userLogger).Log("msg", "deleted block", "block", id)
+	return tenantBlockDeleted
+}
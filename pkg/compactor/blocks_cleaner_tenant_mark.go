@@ -0,0 +1,61 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
+)
+
+// deleteExpiredTenantDeletionMark deletes the deletion mark of a tenant whose blocks have all been deleted,
+// once the tenant deletion mark delay since the tenant has been marked for deletion has elapsed, so that
+// the tenant isn't found by the next users scans. The mark is deleted only if it's the last object left
+// in the tenant location, otherwise the tenant would be found as an active one.
+func (c *BlocksCleaner) deleteExpiredTenantDeletionMark(ctx context.Context, userID string, userBucket *bucket.UserBucketClient, userLogger log.Logger) error {
+	if c.cfg.TenantDeletionMarkDelay <= 0 || c.readOnly() {
+		return nil
+	}
+
+	mark, err := cortex_tsdb.ReadTenantDeletionMark(ctx, c.bucketClient, userID)
+	if err != nil {
+		return err
+	}
+	if mark == nil {
+		return nil
+	}
+
+	if markedAt := time.Unix(mark.DeletionTime, 0); c.now().Sub(markedAt) <= c.cfg.TenantDeletionMarkDelay {
+		level.Debug(userLogger).Log("msg", "not deleting the tenant deletion mark because it has not reached the tenant deletion mark delay yet", "deletionTime", markedAt)
+		return nil
+	}
+
+	objects, err := listEmptyTenantObjects(ctx, userBucket)
+	if errors.Is(err, errEmptyTenantHasBlocks) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "list the objects of user marked for deletion")
+	}
+	if len(objects) != 1 || objects[0] != cortex_tsdb.TenantDeletionMarkPath {
+		level.Info(userLogger).Log("msg", "not deleting the tenant deletion mark because other objects are left in the location of user marked for deletion", "objects", len(objects))
+		return nil
+	}
+
+	if c.cfg.DryRun {
+		level.Info(userLogger).Log("msg", "would delete the tenant deletion mark of user whose blocks have been deleted", "dryRun", true)
+		return nil
+	}
+
+	if err := userBucket.Delete(ctx, cortex_tsdb.TenantDeletionMarkPath); err != nil && !userBucket.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete tenant deletion mark")
+	}
+
+	c.tenantDeletionMarksDeleted.Inc()
+	level.Info(userLogger).Log("msg", "deleted the tenant deletion mark of user whose blocks have been deleted")
+	return nil
+}
@@ -0,0 +1,114 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldDeleteExpiredTenantDeletionMarks(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		dryRun := dryRun
+
+		t.Run(map[bool]string{false: "regular", true: "dry run"}[dryRun], func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			tenantDeletionMarkDelay := time.Hour
+
+			// user-1 has been marked for deletion since longer than the delay, and still has a block.
+			createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			writeTenantDeletionMark(t, bucketClient, "user-1", time.Now().Add(-2*tenantDeletionMarkDelay))
+
+			// user-2 has been marked for deletion recently.
+			createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+			writeTenantDeletionMark(t, bucketClient, "user-2", time.Now())
+
+			// user-3 has been marked for deletion since longer than the delay, and has other objects left.
+			createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+			writeTenantDeletionMark(t, bucketClient, "user-3", time.Now().Add(-2*tenantDeletionMarkDelay))
+			require.NoError(t, bucketClient.Upload(ctx, path.Join("user-3", "debug", "file"), bytes.NewReader([]byte("data"))))
+
+			// user-4 is active, so that the tenants marked for deletion are deleted.
+			createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:                 dataDir,
+				MetaSyncConcurrency:     10,
+				DeletionDelay:           time.Hour,
+				CleanupInterval:         time.Minute,
+				CleanupConcurrency:      1,
+				TenantDeletionMarkDelay: tenantDeletionMarkDelay,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+			// The first run deletes the blocks, so the tenant deletion marks are kept.
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assertTenantDeletionMarkExists(t, bucketClient, "user-1", true)
+			assertTenantDeletionMarkExists(t, bucketClient, "user-2", true)
+			assertTenantDeletionMarkExists(t, bucketClient, "user-3", true)
+			assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantDeletionMarksDeleted))
+
+			// The next run finds no block left, so the expired mark is deleted unless other objects are left.
+			cleaner.cfg.DryRun = dryRun
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assertTenantDeletionMarkExists(t, bucketClient, "user-1", dryRun)
+			assertTenantDeletionMarkExists(t, bucketClient, "user-2", true)
+			assertTenantDeletionMarkExists(t, bucketClient, "user-3", true)
+
+			if dryRun {
+				assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantDeletionMarksDeleted))
+				return
+			}
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletionMarksDeleted))
+
+			// The tenant is not found anymore.
+			users, deleted, err := scanner.ScanUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"user-4"}, users)
+			assert.Equal(t, []string{"user-2", "user-3"}, deleted)
+		})
+	}
+}
+
+func writeTenantDeletionMark(t *testing.T, bkt objstore.Bucket, userID string, deletionTime time.Time) {
+	data, err := json.Marshal(tsdb.TenantDeletionMark{DeletionTime: deletionTime.Unix()})
+	require.NoError(t, err)
+	require.NoError(t, bkt.Upload(context.Background(), path.Join(userID, tsdb.TenantDeletionMarkPath), bytes.NewReader(data)))
+}
+
+func assertTenantDeletionMarkExists(t *testing.T, bkt objstore.Bucket, userID string, expected bool) {
+	exists, err := tsdb.TenantDeletionMarkExists(context.Background(), bkt, userID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, exists, userID)
+}
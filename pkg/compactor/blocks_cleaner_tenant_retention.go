@@ -0,0 +1,38 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// applyTenantRetention marks for deletion the blocks of the tenant containing only data older than the
+// tenant retention period. Nothing is marked if the tenant retention is 0 (unlimited). The blocks whose
+// retention is selected by their label are skipped, given the label retention takes precedence.
+func (c *BlocksCleaner) applyTenantRetention(ctx context.Context, userID string, metas map[ulid.ULID]*metadata.Meta, userBucket *bucket.UserBucketClient, userLogger log.Logger) {
+	retention := c.cfgProvider.CompactorBlocksRetentionPeriod(userID)
+	if retention <= 0 {
+		return
+	}
+
+	cutoff := c.now().Add(-retention).Unix() * 1000
+
+	var ids []ulid.ULID
+	for id, meta := range metas {
+		if meta.MaxTime <= cutoff && !c.labelRetention.matches(meta.Thanos.Labels) {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	marked, failed := c.markBlocksForDeletion(ctx, userID, ids, "exceeded the tenant retention period", c.tenantRetentionMarked, userBucket, userLogger)
+	level.Info(userLogger).Log("msg", "applied the tenant blocks retention period", "retention", retention, "markedBlocks", marked, "failedBlocks", failed)
+}
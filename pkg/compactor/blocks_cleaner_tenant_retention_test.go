@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldMarkBlocksExceedingTenantRetention(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	ts := func(d time.Duration) int64 { return time.Now().Add(-d).Unix() * 1000 }
+	block1 := createTSDBBlock(t, bucketClient, "user-1", ts(4*time.Hour), ts(3*time.Hour), nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", ts(2*time.Hour), ts(90*time.Minute), nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", ts(90*time.Minute), ts(time.Minute), nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-2", ts(4*time.Hour), ts(3*time.Hour), nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The user-2 retention is unlimited.
+	cfgProvider := newMockConfigProvider()
+	cfgProvider.retention["user-1"] = time.Hour
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, cfgProvider, logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		// Only the blocks containing only data older than the retention are marked for deletion.
+		{path: path.Join("user-1", block1.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-1", block2.String(), metadata.DeletionMarkFilename), expectedExists: true},
+		{path: path.Join("user-1", block3.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		{path: path.Join("user-2", block4.String(), metadata.DeletionMarkFilename), expectedExists: false},
+		// Marked blocks are not deleted until the deletion delay has elapsed.
+		{path: path.Join("user-1", block1.String(), metadata.MetaFilename), expectedExists: true},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantRetentionMarked))
+}
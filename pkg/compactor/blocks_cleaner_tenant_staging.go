@@ -0,0 +1,52 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// tenantDeletionStagingDetails are the details of the deletion marks written for the blocks of a
+// tenant marked for deletion, when the tenant deletion delay is enabled.
+const tenantDeletionStagingDetails = "tenant marked for deletion"
+
+// stageTenantBlockDeletion returns whether the block of a tenant marked for deletion can be hard-deleted
+// according to the tenant deletion delay. A block not marked for deletion yet is marked, so that it's
+// deleted by a subsequent run once the delay since its deletion mark has elapsed.
+func (c *BlocksCleaner) stageTenantBlockDeletion(ctx context.Context, userBucket *bucket.UserBucketClient, userLogger log.Logger, id ulid.ULID) (bool, error) {
+	if c.cfg.TenantDeletionDelay <= 0 {
+		return true, nil
+	}
+
+	mark := &metadata.DeletionMark{}
+	err := metadata.ReadMarker(ctx, userLogger, userBucket, id.String(), mark)
+	if errors.Is(err, metadata.ErrorMarkerNotFound) {
+		if c.cfg.DryRun {
+			level.Info(userLogger).Log("msg", "would mark block of user marked for deletion for deletion", "block", id, "dryRun", true)
+			return false, nil
+		}
+
+		if err := block.MarkForDeletion(ctx, userLogger, userBucket, id, tenantDeletionStagingDetails, c.tenantBlocksStaged); err != nil {
+			return false, errors.Wrap(err, "mark block for deletion")
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "read block deletion mark")
+	}
+
+	if !deletionDelayReached(mark, c.cfg.TenantDeletionDelay, c.now()) {
+		level.Debug(userLogger).Log("msg", "skipped deletion of block of user marked for deletion because it has not reached the tenant deletion delay yet", "block", id, "deletionTime", time.Unix(mark.DeletionTime, 0))
+		return false, nil
+	}
+
+	return true, nil
+}
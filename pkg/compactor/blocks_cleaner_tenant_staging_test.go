@@ -0,0 +1,85 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldHonorTenantDeletionDelay(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		AllowDeletionOnEmptyActiveUsers: true,
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		TenantDeletionDelay:             12 * time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists := func(p string) bool {
+		ok, err := bucketClient.Exists(ctx, p)
+		require.NoError(t, err)
+		return ok
+	}
+
+	// The first run marks the blocks for deletion, without deleting them.
+	for _, id := range []string{block1.String(), block2.String()} {
+		assert.True(t, exists(path.Join("user-1", id, metadata.MetaFilename)))
+		assert.True(t, exists(path.Join("user-1", id, metadata.DeletionMarkFilename)))
+	}
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantBlocksStaged))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+
+	// The next run doesn't delete the blocks until the tenant deletion delay has elapsed.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.True(t, exists(path.Join("user-1", block1.String(), metadata.MetaFilename)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantBlocksStaged))
+
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-13*time.Hour))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.False(t, exists(path.Join("user-1", block1.String(), metadata.MetaFilename)))
+	assert.True(t, exists(path.Join("user-1", block2.String(), metadata.MetaFilename)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+}
@@ -0,0 +1,36 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// errTenantTimedOut is returned by withTenantTimeout when the tenant has been skipped because timed out.
+var errTenantTimedOut = errors.New("the blocks cleanup of the tenant took longer than the per-tenant timeout")
+
+// withTenantTimeout runs the input cleanup of a tenant, bounded by the per-tenant timeout if configured.
+// A tenant timing out is skipped: it's logged and tracked, and errTenantTimedOut is returned instead of
+// its error, which the caller shouldn't propagate, so that one pathological tenant doesn't fail the run.
+// The tenant is cleaned up again in the next runs.
+func (c *BlocksCleaner) withTenantTimeout(ctx context.Context, userID string, f func(ctx context.Context) error) error {
+	if c.cfg.PerTenantTimeout <= 0 {
+		return f(ctx)
+	}
+
+	tenantCtx, cancel := context.WithTimeout(ctx, c.cfg.PerTenantTimeout)
+	defer cancel()
+
+	err := f(tenantCtx)
+
+	// The cleanup of a tenant may not return an error even if timed out (eg. the cleanup
+	// of partial blocks is best effort), so the context is checked instead.
+	if ctx.Err() == nil && errors.Is(tenantCtx.Err(), context.DeadlineExceeded) {
+		c.tenantTimeouts.Inc()
+		level.Warn(c.logger).Log("msg", "skipped blocks cleanup for user because it took longer than the per-tenant timeout", "user", userID, "timeout", c.cfg.PerTenantTimeout, "err", err)
+		return errTenantTimedOut
+	}
+
+	return err
+}
@@ -0,0 +1,88 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldSkipTenantsTimingOut(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		PerTenantTimeout:    100 * time.Millisecond,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The listing of the user-1 blocks hangs.
+	cleaner := NewBlocksCleaner(cfg, &hangingIterBucket{Bucket: bucketClient, dir: "user-1/"}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	// The user-1 is skipped, while the user-2 is cleaned up and the run doesn't fail.
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-2", block2.String(), "index"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantTimeouts))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailedTotal))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSucceededTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantsFailed))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+}
+
+// hangingIterBucket is a bucket whose listing of the input directory hangs until the context is canceled.
+type hangingIterBucket struct {
+	objstore.Bucket
+	dir string
+}
+
+func (b *hangingIterBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if dir == b.dir {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.Bucket.Iter(ctx, dir, f)
+}
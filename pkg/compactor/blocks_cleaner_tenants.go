@@ -0,0 +1,153 @@
+package compactor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// selectUsers discovers the tenants from the bucket and returns the active tenants and the tenants marked
+// for deletion to be cleaned up by the run, once filtered by the config, the sharding and the safety checks.
+// Returns false if the run shouldn't proceed, along with the error failing the run, if any.
+func (c *BlocksCleaner) selectUsers(ctx context.Context) ([]string, []string, bool, error) {
+	scannedAt := time.Now()
+	users, deleted, err := c.usersScanner.ScanUsers(ctx)
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "failed to discover users from bucket")
+	}
+
+	users = c.excludeReservedEntries(users)
+	deleted = c.excludeReservedEntries(deleted)
+	users, deleted = c.dedupeUsers(users, deleted)
+	c.markedTenants.set(deleted, scannedAt)
+
+	// Tracked as discovered, before any check which could fail the run.
+	c.tenantsActive.Set(float64(len(users)))
+	c.tenantsMarkedForDeletion.Set(float64(len(deleted)))
+
+	if proceed, err := c.checkUsersScan(users, deleted); !proceed {
+		return nil, nil, false, err
+	}
+
+	deleted = c.guardDeletionOnEmptyActiveUsers(users, deleted)
+
+	users = c.filterAllowedUsers(users)
+	deleted = c.filterAllowedUsers(deleted)
+
+	users = c.filterOwnedUsers(users)
+	deleted = c.filterOwnedUsers(deleted)
+	c.tenantsOwned.Set(float64(len(users) + len(deleted)))
+
+	users, deleted = c.classifier.classify(c.logger, users, deleted, c.now())
+
+	// The deletion of tenants is not run when read-only, so it doesn't need to be authorized.
+	var deferred []string
+	if len(deleted) > 0 && !c.readOnly() && !c.authorizeTenantDeletion(ctx) {
+		c.tenantDeletionsDeferred.Add(float64(len(deleted)))
+		deferred, deleted = deleted, nil
+	}
+
+	if !c.readOnly() {
+		var capped []string
+		deleted, capped = c.capTenantDeletions(ctx, deleted)
+		c.tenantDeletionsDeferred.Add(float64(len(capped)))
+		deferred = append(deferred, capped...)
+	}
+
+	c.tenantsTransitioned(c.transitions.observe(users, deleted, deferred))
+
+	c.fetchGuard.retain(users)
+	c.tenantsStatus.retain(c.now(), users, deleted, deferred)
+	c.emptyTenants.retain(users)
+	if c.unchangedTenants != nil {
+		c.unchangedTenants.retain(users)
+	}
+
+	return users, deleted, true, nil
+}
+
+// filterAllowedUsers removes from the input list the tenants not enabled or disabled in the config.
+func (c *BlocksCleaner) filterAllowedUsers(userIDs []string) []string {
+	if len(c.enabledUsers) == 0 && len(c.disabledUsers) == 0 {
+		return userIDs
+	}
+
+	filtered := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !isAllowedUser(c.enabledUsers, c.disabledUsers, userID) {
+			c.tenantsSkipped.Inc()
+			level.Debug(c.logger).Log("msg", "skipping blocks cleanup for user because not enabled or disabled in the config", "user", userID)
+			continue
+		}
+
+		filtered = append(filtered, userID)
+	}
+
+	return filtered
+}
+
+// dedupeUsers removes the duplicated tenants from the input lists, so that each tenant is processed
+// once. A tenant found both active and marked for deletion (eg. because listed twice while being
+// marked) is kept only as marked for deletion.
+func (c *BlocksCleaner) dedupeUsers(users, deleted []string) ([]string, []string) {
+	seen := make(map[string]struct{}, len(users)+len(deleted))
+
+	dedupedDeleted := make([]string, 0, len(deleted))
+	for _, userID := range deleted {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+
+		seen[userID] = struct{}{}
+		dedupedDeleted = append(dedupedDeleted, userID)
+	}
+
+	dedupedUsers := make([]string, 0, len(users))
+	for _, userID := range users {
+		if _, ok := seen[userID]; ok {
+			level.Warn(c.logger).Log("msg", "user found more than once while discovering users from bucket, processing it once", "user", userID)
+			continue
+		}
+
+		seen[userID] = struct{}{}
+		dedupedUsers = append(dedupedUsers, userID)
+	}
+
+	return dedupedUsers, dedupedDeleted
+}
+
+// excludeReservedEntries removes from the input list the top-level bucket entries storing the
+// cleaner own objects (eg. the governance file), which are not tenants. A reserved path nested in
+// a directory reserves the whole top-level directory, given any object stored in a tenant location
+// is subject to be deleted by the cleanup.
+func (c *BlocksCleaner) excludeReservedEntries(userIDs []string) []string {
+	reserved := map[string]struct{}{}
+	reservedPaths := []string{c.cfg.TenantDeletionTokenPath, c.cfg.DeletionAuditPath, c.cfg.KillSwitchPath}
+	if c.cfg.GovernanceFile != "" {
+		reservedPaths = append(reservedPaths, c.cfg.GovernanceFile, c.cfg.GovernanceFile+governanceAppliedSuffix)
+	}
+	if c.deletionPlan != nil {
+		reservedPaths = append(reservedPaths, c.deletionPlan.path, c.deletionPlan.approvalPath)
+	}
+
+	for _, p := range reservedPaths {
+		if p = strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]; p != "" {
+			reserved[p] = struct{}{}
+		}
+	}
+
+	if len(reserved) == 0 {
+		return userIDs
+	}
+
+	filtered := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := reserved[userID]; !ok {
+			filtered = append(filtered, userID)
+		}
+	}
+	return filtered
+}
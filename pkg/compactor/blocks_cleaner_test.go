@@ -1,26 +1,41 @@
 package compactor
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
 
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
 	"github.com/cortexproject/cortex/pkg/storage/tsdb"
 	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/concurrency"
 	"github.com/cortexproject/cortex/pkg/util/services"
+	"github.com/cortexproject/cortex/pkg/util/test"
 )
 
 func TestBlocksCleaner(t *testing.T) {
@@ -86,7 +101,7 @@ func testBlocksCleanerWithConcurrency(t *testing.T, concurrency int) {
 	logger := log.NewNopLogger()
 	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
 
-	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, logger, nil)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
 	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
 	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
 
@@ -129,4 +144,2561 @@ func testBlocksCleanerWithConcurrency(t *testing.T, concurrency int) {
 	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
 	assert.Equal(t, float64(6), testutil.ToFloat64(cleaner.blocksCleanedTotal))
 	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+
+	// Blocks deleted, by phase.
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhaseTenantDelete)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhaseMarkedDelete)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedByPhase.WithLabelValues(cleanupPhasePartialDelete)))
+
+	// Blocks excluded while fetching the blocks, by reason.
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.blocksExcluded.WithLabelValues(exclusionReasonMarkedForDeletion)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.blocksExcluded.WithLabelValues(exclusionReasonNoMeta)))
+}
+
+func TestBlocksCleaner_ShouldHonorPerTenantConfig(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-3", block3, time.Now().Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-4", block4, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	cfgProvider := newMockConfigProvider()
+	cfgProvider.deletionDelays["user-2"] = 2 * deletionDelay
+	cfgProvider.deletionDelays["user-3"] = time.Minute
+	cfgProvider.cleanupDisabled["user-4"] = true
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, cfgProvider, logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		// The default deletion delay is used.
+		{path: path.Join("user-1", block1.String(), metadata.MetaFilename), expectedExists: false},
+		// The per-tenant deletion delay is longer than the default one.
+		{path: path.Join("user-2", block2.String(), metadata.MetaFilename), expectedExists: true},
+		// The per-tenant deletion delay is shorter than the default one.
+		{path: path.Join("user-3", block3.String(), metadata.MetaFilename), expectedExists: false},
+		// The blocks cleanup is disabled for the tenant.
+		{path: path.Join("user-4", block4.String(), metadata.MetaFilename), expectedExists: true},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+}
+
+func TestBlocksCleaner_ReconciliationModeShouldNotDeleteBlocks(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block3, time.Now().Add(-deletionDelay).Add(time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block3.String(), metadata.MetaFilename)))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		ReconciliationMode:  true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// No block should have been deleted.
+	for _, p := range []string{
+		path.Join("user-1", block1.String(), metadata.MetaFilename),
+		path.Join("user-1", block2.String(), metadata.MetaFilename),
+		path.Join("user-1", block3.String(), "index"),
+		path.Join("user-2", block4.String(), metadata.MetaFilename),
+	} {
+		exists, err := bucketClient.Exists(ctx, p)
+		require.NoError(t, err)
+		assert.True(t, exists, p)
+	}
+
+	report := cleaner.LastReconciliationReport()
+	require.NotNil(t, report)
+	assert.ElementsMatch(t, []ReconciliationDiscrepancy{
+		{UserID: "user-1", BlockID: block2, Type: discrepancyMarkedBlockNotDeleted},
+		{UserID: "user-1", BlockID: block3, Type: discrepancyPartialBlockNotDeleted},
+		{UserID: "user-2", BlockID: block4, Type: discrepancyTenantBlockNotDeleted},
+	}, report.Discrepancies)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.reconciliation.discrepancies.WithLabelValues(discrepancyMarkedBlockNotDeleted)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.reconciliation.discrepancies.WithLabelValues(discrepancyPartialBlockNotDeleted)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.reconciliation.discrepancies.WithLabelValues(discrepancyTenantBlockNotDeleted)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+}
+
+func TestBlocksCleaner_ReadOnlyShouldNotWriteToTheBucket(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	block4 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block3, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block3.String(), metadata.MetaFilename)))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		WriteBucketIndex:    true,
+		ReadOnly:            true,
+	}
+
+	logger := log.NewNopLogger()
+	readOnlyBucket := &readOnlyBucket{Bucket: bucketClient}
+	scanner := tsdb.NewUsersScanner(readOnlyBucket, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, readOnlyBucket, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	// No write has been attempted, and the blocks which would have been deleted are reported.
+	assert.Equal(t, int64(0), readOnlyBucket.writes.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+
+	report := cleaner.LastReconciliationReport()
+	require.NotNil(t, report)
+	assert.ElementsMatch(t, []ReconciliationDiscrepancy{
+		{UserID: "user-1", BlockID: block2, Type: discrepancyMarkedBlockNotDeleted},
+		{UserID: "user-1", BlockID: block3, Type: discrepancyPartialBlockNotDeleted},
+		{UserID: "user-2", BlockID: block4, Type: discrepancyTenantBlockNotDeleted},
+	}, report.Discrepancies)
+}
+
+// readOnlyBucket is a bucket failing any write, and counting the writes attempted.
+type readOnlyBucket struct {
+	objstore.Bucket
+	writes atomic.Int64
+}
+
+func (b *readOnlyBucket) Upload(_ context.Context, _ string, _ io.Reader) error {
+	b.writes.Inc()
+	return errors.New("mocked read-only bucket")
+}
+
+func (b *readOnlyBucket) Delete(_ context.Context, _ string) error {
+	b.writes.Inc()
+	return errors.New("mocked read-only bucket")
+}
+
+func TestBlocksCleaner_StandbyShouldNotMutateTheBucketUntilPromoted(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		Role:                BlocksCleanerRoleStandby,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	blocksExist := func() []bool {
+		var res []bool
+		for _, p := range []string{
+			path.Join("user-1", block1.String(), metadata.MetaFilename),
+			path.Join("user-2", block2.String(), metadata.MetaFilename),
+		} {
+			exists, err := bucketClient.Exists(ctx, p)
+			require.NoError(t, err)
+			res = append(res, exists)
+		}
+		return res
+	}
+
+	// The standby cleaner evaluates the bucket without deleting anything.
+	assert.Equal(t, []bool{true, true}, blocksExist())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.roleStandby))
+	require.NotNil(t, cleaner.LastReconciliationReport())
+	assert.ElementsMatch(t, []ReconciliationDiscrepancy{
+		{UserID: "user-1", BlockID: block1, Type: discrepancyMarkedBlockNotDeleted},
+		{UserID: "user-2", BlockID: block2, Type: discrepancyTenantBlockNotDeleted},
+	}, cleaner.LastReconciliationReport().Discrepancies)
+
+	// Once promoted, the cleaner deletes blocks.
+	require.Error(t, cleaner.SetRole("leader"))
+	require.NoError(t, cleaner.SetRole(BlocksCleanerRoleActive))
+	assert.Equal(t, BlocksCleanerRoleActive, cleaner.Role())
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.roleStandby))
+
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, []bool{false, false}, blocksExist())
+}
+
+func TestBlocksCleaner_ShouldFailStartOnInitialCleanupErrorIfEnabled(t *testing.T) {
+	for _, failStart := range []bool{false, true} {
+		failStart := failStart
+
+		t.Run(fmt.Sprintf("fail start=%t", failStart), func(t *testing.T) {
+			bucketClient := &bucket.ClientMock{}
+			bucketClient.MockIter("", nil, errors.New("failed to iterate the bucket"))
+
+			cfg := BlocksCleanerConfig{
+				DeletionDelay:                  time.Hour,
+				CleanupInterval:                time.Minute,
+				CleanupConcurrency:             1,
+				FailStartOnInitialCleanupError: failStart,
+			}
+
+			ctx := context.Background()
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			err := services.StartAndAwaitRunning(ctx, cleaner)
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			if failStart {
+				require.Error(t, err)
+				assert.Equal(t, services.Failed, cleaner.State())
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsFailed))
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldAnnotateRetainedBlocksIfEnabled(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	deletionTime := time.Now().Add(-deletionDelay).Add(time.Hour)
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block2, deletionTime)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                dataDir,
+		MetaSyncConcurrency:    10,
+		DeletionDelay:          deletionDelay,
+		CleanupInterval:        time.Minute,
+		CleanupConcurrency:     1,
+		AnnotateRetainedBlocks: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	userBucket := bucket.NewUserBucketClient("user-1", bucketClient)
+
+	// The block not marked for deletion should not be annotated.
+	annotation, err := readBlockPolicyAnnotation(ctx, userBucket, logger, path.Join(block1.String(), BlockPolicyAnnotationFilename))
+	require.NoError(t, err)
+	assert.Nil(t, annotation)
+
+	// The block marked for deletion should be annotated with the time it will become deletable.
+	annotation, err = readBlockPolicyAnnotation(ctx, userBucket, logger, path.Join(block2.String(), BlockPolicyAnnotationFilename))
+	require.NoError(t, err)
+	require.NotNil(t, annotation)
+	assert.Equal(t, policyDeletionDelay, annotation.EvaluatedBy)
+	assert.Equal(t, deletionTime.Add(deletionDelay).Unix(), annotation.NextEligible)
+}
+
+func TestBlocksCleaner_ShouldHonorMaxTotalBlocksDeletedPerRun(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	for _, userID := range []string{"user-1", "user-2"} {
+		for i := int64(0); i < 3; i++ {
+			id := createTSDBBlock(t, bucketClient, userID, i*10, (i+1)*10, nil)
+			createDeletionMark(t, bucketClient, userID, id, time.Now().Add(-deletionDelay).Add(-time.Hour))
+		}
+	}
+
+	// Blocks for user-3, marked for deletion.
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-3"))
+	createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-3", 20, 30, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                     dataDir,
+		MetaSyncConcurrency:         10,
+		DeletionDelay:               deletionDelay,
+		CleanupInterval:             time.Minute,
+		CleanupConcurrency:          3,
+		MaxTotalBlocksDeletedPerRun: 4,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsCompleted))
+	assert.Equal(t, float64(4), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(4), testutil.ToFloat64(cleaner.runBlocksDeletedGauge))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsDeletionBudgetHit))
+
+	// The next run should delete the remaining blocks.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(8), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(4), testutil.ToFloat64(cleaner.runBlocksDeletedGauge))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsDeletionBudgetHit))
+}
+
+func TestBlocksCleaner_ShouldReportFailedDeletionsOfTenantEvenIfMaxTotalBlocksDeletedPerRunIsReached(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	// Blocks for user-1, marked for deletion. The deletion of the first block listed fails,
+	// the second block is deleted and the third one exceeds the budget.
+	ctx := context.Background()
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	var ids []ulid.ULID
+	for i := int64(0); i < 3; i++ {
+		ids = append(ids, createTSDBBlock(t, bucketClient, "user-1", i*10, (i+1)*10, nil))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+
+	// Blocks for user-2, not marked for deletion.
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                     dataDir,
+		MetaSyncConcurrency:         10,
+		DeletionDelay:               time.Hour,
+		CleanupInterval:             time.Minute,
+		CleanupConcurrency:          1,
+		MaxTotalBlocksDeletedPerRun: 1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	failingBucket := &failingDeleteBucket{Bucket: bucketClient, prefix: path.Join("user-1", ids[0].String()) + "/"}
+	cleaner := NewBlocksCleaner(cfg, failingBucket, scanner, newMockConfigProvider(), logger, nil)
+	require.Error(t, cleaner.runCleanup(ctx))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsDeletionBudgetHit))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailedTotal))
+
+	for i, exists := range []bool{true, false, true} {
+		ok, err := bucketClient.Exists(ctx, path.Join("user-1", ids[i].String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.Equal(t, exists, ok, ids[i].String())
+	}
+}
+
+func TestBlocksCleaner_ShouldDetectNonConvergenceIfEnabled(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		VerifyConvergence:   true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// Deletions don't stick on the bucket used by the cleaner.
+	cleaner := NewBlocksCleaner(cfg, &nonDeletingBucket{bucketClient}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.convergenceFailures))
+
+	// Once deletions stick, the cleanup should converge.
+	cleaner.bucketClient = bucketClient
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.convergenceFailures))
+}
+
+// nonDeletingBucket is a bucket whose deletions are successful but have no effect.
+type nonDeletingBucket struct {
+	objstore.Bucket
+}
+
+func (b *nonDeletingBucket) Delete(_ context.Context, _ string) error {
+	return nil
+}
+
+func TestBlocksCleaner_ShouldHonorMinPartialBlockLifetime(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	for _, id := range []ulid.ULID{block1, block2} {
+		createDeletionMark(t, bucketClient, "user-1", id, time.Now().Add(-deletionDelay).Add(time.Hour))
+		require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", id.String(), metadata.MetaFilename)))
+	}
+
+	// Move back in time the objects of the 1st partial block.
+	oldTime := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, filepath.Walk(filepath.Join(storageDir, "user-1", block1.String()), func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, oldTime, oldTime)
+	}))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                 dataDir,
+		MetaSyncConcurrency:     10,
+		DeletionDelay:           deletionDelay,
+		CleanupInterval:         time.Minute,
+		CleanupConcurrency:      1,
+		MinPartialBlockLifetime: time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), "index"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-1", block2.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestBlocksCleaner_ShouldHonorPartialBlockDeletionDelay(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-time.Minute))
+	for _, id := range []ulid.ULID{block1, block2} {
+		require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", id.String(), metadata.MetaFilename)))
+	}
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                   dataDir,
+		MetaSyncConcurrency:       10,
+		DeletionDelay:             12 * time.Hour,
+		CleanupInterval:           time.Minute,
+		CleanupConcurrency:        1,
+		PartialBlockDeletionDelay: time.Hour,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), "index"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-1", block2.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantPartialBlocks.WithLabelValues("user-1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.partialBlocksDeleted))
+
+	// The partial blocks are tracked by the last run.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantPartialBlocks.WithLabelValues("user-1")))
+
+	// The tenant marked for deletion is not tracked anymore.
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, 0, testutil.CollectAndCount(cleaner.tenantPartialBlocks))
+}
+
+func TestBlocksCleaner_ShouldHonorMaxConcurrentDeletes(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	for _, userID := range []string{"user-1", "user-2", "user-3"} {
+		require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, userID))
+		for i := int64(0); i < 3; i++ {
+			createTSDBBlock(t, bucketClient, userID, i*10, (i+1)*10, nil)
+		}
+	}
+
+	cfg := BlocksCleanerConfig{
+		AllowDeletionOnEmptyActiveUsers: true,
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              3,
+		DeleteConcurrency:               3,
+		MaxConcurrentDeletes:            2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	trackingBucket := &concurrencyTrackingBucket{Bucket: bucketClient}
+
+	cleaner := NewBlocksCleaner(cfg, trackingBucket, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(9), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.LessOrEqual(t, trackingBucket.maxInflight.Load(), int64(2))
+}
+
+func TestBlocksCleaner_ShouldDeleteTheBlocksOfATenantConcurrently(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	for i := int64(0); i < 6; i++ {
+		createTSDBBlock(t, bucketClient, "user-1", i*10, (i+1)*10, nil)
+	}
+	block := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		DeleteConcurrency:   3,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	trackingBucket := &concurrencyTrackingBucket{Bucket: bucketClient}
+
+	cleaner := NewBlocksCleaner(cfg, trackingBucket, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(6), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Greater(t, trackingBucket.maxInflight.Load(), int64(1))
+	assert.LessOrEqual(t, trackingBucket.maxInflight.Load(), int64(3))
+
+	// The blocks of the tenant not marked for deletion are left untouched.
+	exists, err := bucketClient.Exists(ctx, path.Join("user-2", block.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// concurrencyTrackingBucket tracks the max number of concurrent Delete() calls.
+type concurrencyTrackingBucket struct {
+	objstore.Bucket
+
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+}
+
+func (b *concurrencyTrackingBucket) Delete(ctx context.Context, name string) error {
+	inflight := b.inflight.Inc()
+	defer b.inflight.Dec()
+
+	for {
+		max := b.maxInflight.Load()
+		if inflight <= max || b.maxInflight.CAS(max, inflight) {
+			break
+		}
+	}
+
+	// Give other deletions the chance to run concurrently.
+	time.Sleep(5 * time.Millisecond)
+
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestBlocksCleaner_ShouldSkipUserOnSuspiciousEmptyFetch(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                       dataDir,
+		MetaSyncConcurrency:           10,
+		DeletionDelay:                 time.Hour,
+		CleanupInterval:               time.Minute,
+		CleanupConcurrency:            1,
+		SuspiciousEmptyFetchMinBlocks: 2,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.suspiciousEmptyFetches))
+
+	// The listing of the user blocks unexpectedly returns no blocks.
+	cleaner.bucketClient = &emptyListingBucket{Bucket: bucketClient, prefix: "user-1/"}
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.suspiciousEmptyFetches))
+
+	// An empty listing following an empty listing is not suspicious.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.suspiciousEmptyFetches))
+}
+
+// emptyListingBucket is a bucket whose listing of the objects under the prefix returns nothing.
+type emptyListingBucket struct {
+	objstore.Bucket
+	prefix string
+}
+
+func (b *emptyListingBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if strings.HasPrefix(dir, b.prefix) {
+		return nil
+	}
+	return b.Bucket.Iter(ctx, dir, f)
+}
+
+func TestBlocksCleaner_OnDemandCleanupShouldReportProgress(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 30, 40, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	collect := func(progress chan Progress) []Progress {
+		var updates []Progress
+		for p := range progress {
+			updates = append(updates, p)
+		}
+		return updates
+	}
+
+	// The channel is large enough to not drop any update.
+	progress := make(chan Progress, 100)
+	require.NoError(t, cleaner.CleanUser(ctx, "user-1", progress))
+	updates := collect(progress)
+	require.NotEmpty(t, updates)
+	assert.Equal(t, Progress{UserID: "user-1", Phase: ProgressPhaseFetchingBlocks}, updates[0])
+	assert.Equal(t, Progress{UserID: "user-1", Phase: ProgressPhaseDone, BlocksProcessed: 2}, updates[len(updates)-1])
+
+	progress = make(chan Progress, 100)
+	require.NoError(t, cleaner.DeleteUser(ctx, "user-2", progress))
+	updates = collect(progress)
+	require.NotEmpty(t, updates)
+	assert.Equal(t, Progress{UserID: "user-2", Phase: ProgressPhaseDeletingTenantBlocks}, updates[0])
+	assert.Equal(t, Progress{UserID: "user-2", Phase: ProgressPhaseDone, BlocksProcessed: 3}, updates[len(updates)-1])
+
+	// Updates are dropped instead of blocking if the receiver doesn't keep up.
+	progress = make(chan Progress)
+	require.NoError(t, cleaner.CleanUser(ctx, "user-1", progress))
+	assert.Empty(t, collect(progress))
+
+	// A nil channel is allowed.
+	require.NoError(t, cleaner.CleanUser(ctx, "user-1", nil))
+}
+
+func TestBlocksCleaner_ShouldExportRunSuccessRatio(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   deletionDelay,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+		SuccessRatioNaNWithoutDeletions: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The deletion of the user-2 block fails.
+	cleaner := NewBlocksCleaner(cfg, &failingDeleteBucket{Bucket: bucketClient, prefix: "user-2/"}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, 0.5, testutil.ToFloat64(cleaner.runSuccessRatio))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailedTotal))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSucceededTotal))
+
+	// Once the deletion succeeds, no deletion is attempted anymore.
+	cleaner.bucketClient = bucketClient
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runSuccessRatio))
+
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.True(t, math.IsNaN(testutil.ToFloat64(cleaner.runSuccessRatio)))
+
+	// The blocks which would have been deleted by a dry-run are not counted as deleted.
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block3, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	cleaner.cfg.DryRun = true
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedDryRun))
+	assert.True(t, math.IsNaN(testutil.ToFloat64(cleaner.runSuccessRatio)))
+}
+
+// failingDeleteBucket is a bucket whose deletion of the objects under the prefix fails.
+type failingDeleteBucket struct {
+	objstore.Bucket
+	prefix string
+}
+
+func (b *failingDeleteBucket) Delete(ctx context.Context, name string) error {
+	if strings.HasPrefix(name, b.prefix) {
+		return errors.New("mocked delete failure")
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestBlocksCleaner_ShouldDeferDeletionOfRecentlyQueriedBlocks(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	activity := &mockQueryActivityProvider{queried: map[ulid.ULID]bool{block2: true}}
+	cfg := BlocksCleanerConfig{
+		DataDir:               dataDir,
+		MetaSyncConcurrency:   10,
+		DeletionDelay:         deletionDelay,
+		CleanupInterval:       time.Minute,
+		CleanupConcurrency:    1,
+		QueryActivityProvider: activity,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	blockExists := func(id ulid.ULID) bool {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", id.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		return exists
+	}
+
+	assert.False(t, blockExists(block1))
+	assert.True(t, blockExists(block2))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.queryActivityDeferred))
+
+	// Once not queried anymore, the block is deleted.
+	activity.queried = nil
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.False(t, blockExists(block2))
+}
+
+type mockQueryActivityProvider struct {
+	queried map[ulid.ULID]bool
+}
+
+func (m *mockQueryActivityProvider) RecentlyQueried(_ string, id ulid.ULID) bool {
+	return m.queried[id]
+}
+
+func TestBlocksCleaner_ShouldCapCleanupConcurrencyToTheNumberOfTenants(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  10,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.effectiveConcurrency))
+
+	// The configured concurrency is honored when lower than the number of tenants.
+	cleaner.cfg.CleanupConcurrency = 1
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.effectiveConcurrency))
+}
+
+func TestBlocksCleaner_ShouldFailBlockDeletionOnPerDeletionTimeout(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		PerDeletionTimeout:  100 * time.Millisecond,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, &hangingDeleteBucket{Bucket: bucketClient}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.deletionTimeouts))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsFailed))
+}
+
+// hangingDeleteBucket is a bucket whose deletions hang until the context is done.
+type hangingDeleteBucket struct {
+	objstore.Bucket
+}
+
+func (b *hangingDeleteBucket) Delete(ctx context.Context, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBlocksCleaner_ShouldHandleInconsistentUsersScanPerPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy            string
+		expectedDeleted   bool
+		expectedCompleted float64
+		expectedFailed    float64
+	}{
+		{policy: InconsistentScanPolicyProceed, expectedDeleted: true, expectedCompleted: 1},
+		{policy: InconsistentScanPolicySkip, expectedDeleted: false, expectedCompleted: 1},
+		{policy: InconsistentScanPolicyFail, expectedDeleted: false, expectedFailed: 1},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			// The only tenant is marked for deletion.
+			ctx := context.Background()
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+			cfg := BlocksCleanerConfig{
+				AllowDeletionOnEmptyActiveUsers: true,
+				DataDir:                         dataDir,
+				MetaSyncConcurrency:             10,
+				DeletionDelay:                   time.Hour,
+				CleanupInterval:                 time.Minute,
+				CleanupConcurrency:              1,
+				InconsistentScanPolicy:          tc.policy,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			assert.Equal(t, !tc.expectedDeleted, exists)
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.inconsistentScans.WithLabelValues(tc.policy)))
+			assert.Equal(t, tc.expectedCompleted, testutil.ToFloat64(cleaner.runsCompleted))
+			assert.Equal(t, tc.expectedFailed, testutil.ToFloat64(cleaner.runsFailed))
+
+			// The discovered tenants are tracked even if the run fails.
+			assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantsActive))
+			assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsMarkedForDeletion))
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldTrackPerTenantDeletions(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	block3 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-2", block3, time.Now().Add(-2*time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.tenantBlocksCleaned.WithLabelValues("user-1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantBlocksCleaned.WithLabelValues("user-2")))
+
+	// The cleanup duration is tracked only for the tenants not marked for deletion.
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.tenantCleanupDuration))
+	assert.Greater(t, testutil.ToFloat64(cleaner.tenantCleanupDuration.WithLabelValues("user-2")), float64(0))
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.runsDuration))
+	assert.Equal(t, 2, testutil.CollectAndCount(cleaner.tenantLastSuccess))
+
+	// Once the tenant marked for deletion has no blocks left, its series are removed.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.tenantBlocksCleaned))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantBlocksCleaned.WithLabelValues("user-2")))
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.tenantLastSuccess))
+	assert.Greater(t, testutil.ToFloat64(cleaner.tenantLastSuccess.WithLabelValues("user-2")), float64(0))
+}
+
+func TestBlocksCleaner_ShouldRetryFailedBlockDeletions(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-2*time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:               dataDir,
+		MetaSyncConcurrency:   10,
+		DeletionDelay:         time.Hour,
+		CleanupInterval:       time.Minute,
+		CleanupConcurrency:    1,
+		DeleteRetries:         2,
+		DeleteRetryMinBackoff: time.Millisecond,
+		DeleteRetryMaxBackoff: time.Millisecond,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The first deletion of the user-1 block fails, while the user-2 block deletions always fail.
+	bkt := &flakyDeleteBucket{Bucket: &failingDeleteBucket{Bucket: bucketClient, prefix: "user-2/"}, prefix: "user-1/", failures: 1}
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-2", block2.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.deletionRetries))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksFailedTotal))
+}
+
+// flakyDeleteBucket is a bucket whose first deletions of the objects under the prefix fail.
+type flakyDeleteBucket struct {
+	objstore.Bucket
+	prefix   string
+	failures int
+}
+
+func (b *flakyDeleteBucket) Delete(ctx context.Context, name string) error {
+	if strings.HasPrefix(name, b.prefix) && b.failures > 0 {
+		b.failures--
+		return errors.New("mocked transient delete failure")
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestBlocksCleaner_ShouldNotDeleteBlocksInDryRunMode(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-2"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		VerifyConvergence:   true,
+		DryRun:              true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		userID  string
+		blockID ulid.ULID
+	}{
+		{userID: "user-1", blockID: block1},
+		{userID: "user-1", blockID: block2},
+		{userID: "user-2", blockID: block3},
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join(tc.userID, tc.blockID.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.True(t, exists, tc.blockID.String())
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedDryRun))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.convergenceFailures))
+}
+
+func TestBlocksCleaner_ShouldSkipTenantsNotEnabledOrDisabled(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	blocks := map[string]ulid.ULID{}
+	for _, userID := range []string{"user-1", "user-2", "user-3"} {
+		blocks[userID] = createTSDBBlock(t, bucketClient, userID, 10, 20, nil)
+		createDeletionMark(t, bucketClient, userID, blocks[userID], time.Now().Add(-2*time.Hour))
+	}
+
+	// The tenant marked for deletion is not enabled.
+	block4 := createTSDBBlock(t, bucketClient, "user-4", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-4"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		EnabledTenants:      []string{"user-1", "user-2"},
+		DisabledTenants:     []string{"user-2"},
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	for _, tc := range []struct {
+		userID         string
+		blockID        ulid.ULID
+		expectedExists bool
+	}{
+		{userID: "user-1", blockID: blocks["user-1"], expectedExists: false},
+		{userID: "user-2", blockID: blocks["user-2"], expectedExists: true},
+		{userID: "user-3", blockID: blocks["user-3"], expectedExists: true},
+		{userID: "user-4", blockID: block4, expectedExists: true},
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join(tc.userID, tc.blockID.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.userID)
+	}
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.tenantsSkipped))
+}
+
+func TestBlocksCleaner_ShouldRemoveTheLocalMetasCacheOfDeletedTenants(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The cleanup of the tenant creates the local metas cache.
+	_, err = os.Stat(cleaner.metaSyncDirForUser("user-1"))
+	require.NoError(t, err)
+
+	// Once the tenant marked for deletion has been deleted, its local metas cache is removed.
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	_, err = os.Stat(cleaner.metaSyncDirForUser("user-1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The removal of a non existing local metas cache is not an error.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+}
+
+func TestBlocksCleaner_ShouldCacheTheMetasInTheConfiguredDir(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	// Create a temporary directory for the metas cache.
+	metaCacheDir, err := ioutil.TempDir(os.TempDir(), "meta-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(metaCacheDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaCacheDir:        metaCacheDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(context.Background()))
+
+	// The local metas cache is created in the configured dir, and not in the data dir.
+	_, err = os.Stat(filepath.Join(metaCacheDir, "blocks-cleaner-meta-user-1"))
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dataDir, "blocks-cleaner-meta-user-1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBlocksCleaner_ShouldCleanUpOtherTenantsOnTenantFailure(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	createDeletionMark(t, bucketClient, "user-2", block2, time.Now().Add(-2*time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The deletion of the user-1 blocks fails.
+	cleaner := NewBlocksCleaner(cfg, &failingDeleteBucket{Bucket: bucketClient, prefix: "user-1/"}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	err = cleaner.runCleanup(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "user-1")
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsFailed))
+
+	// The failure of user-1 doesn't prevent the cleanup of user-2.
+	for _, tc := range []struct {
+		userID         string
+		blockID        ulid.ULID
+		expectedExists bool
+	}{
+		{userID: "user-1", blockID: block1, expectedExists: true},
+		{userID: "user-2", blockID: block2, expectedExists: false},
+	} {
+		exists, err := bucketClient.Exists(ctx, path.Join(tc.userID, tc.blockID.String(), metadata.MetaFilename))
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.userID)
+	}
+
+	// Once the deletion succeeds, no tenant fails.
+	cleaner.bucketClient = bucketClient
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantsFailed))
+}
+
+func TestBlocksCleaner_ShouldHonorDeleteRateLimit(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		createTSDBBlock(t, bucketClient, "user-1", int64(i*10), int64((i+1)*10), nil)
+	}
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		AllowDeletionOnEmptyActiveUsers: true,
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+		DeleteRateLimit:                 10,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The first deletion doesn't wait, while the next ones are rate limited.
+	start := time.Now()
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+	assert.Equal(t, float64(4), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+
+	// The wait for the rate limiter honors the context cancellation.
+	cleaner.deletionsLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	require.True(t, cleaner.deletionsLimiter.Allow())
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err = cleaner.deleteBlockWithTimeout(canceledCtx, logger, bucket.NewUserBucketClient("user-1", bucketClient), ulid.MustNew(ulid.Now(), rand.Reader))
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestBlocksCleaner_ShouldRecoverFromCorruptedLocalMetasCache(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	// The local metas cache is corrupted, because a file is stored where a directory is expected.
+	require.NoError(t, os.MkdirAll(cleaner.metaSyncDirForUser("user-1"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cleaner.metaSyncDirForUser("user-1"), "meta-syncer"), []byte("corrupted"), os.ModePerm))
+
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.metaCacheCorruptionRecovered))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runsFailed))
+
+	// A storage error is not handled as a corrupted local metas cache.
+	assert.False(t, isLocalDirError(errors.New("mocked error"), cleaner.metaSyncDirForUser("user-1")))
+	assert.False(t, isLocalDirError(&os.PathError{Op: "open", Path: dataDir, Err: os.ErrNotExist}, cleaner.metaSyncDirForUser("user-1")))
+}
+
+func TestBlocksCleaner_ShouldLogTenantDeletionProgress(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		createTSDBBlock(t, bucketClient, "user-1", int64(i*10), int64((i+1)*10), nil)
+	}
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		AllowDeletionOnEmptyActiveUsers: true,
+		DataDir:                         dataDir,
+		MetaSyncConcurrency:             10,
+		DeletionDelay:                   time.Hour,
+		CleanupInterval:                 time.Minute,
+		CleanupConcurrency:              1,
+		TenantDeletionProgressInterval:  time.Millisecond,
+	}
+
+	logs := &concurrency.SyncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// Deletions are slowed down, so that the progress is logged.
+	cleaner := NewBlocksCleaner(cfg, &concurrencyTrackingBucket{Bucket: bucketClient}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+	assert.Contains(t, logs.String(), `msg="deleting blocks for user marked for deletion in progress"`)
+
+	// The progress logging stops once the context is canceled.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	stop := cleaner.logTenantDeletionProgress(canceledCtx, logger, atomic.NewInt64(0), atomic.NewInt64(0), atomic.NewInt64(0), atomic.NewInt64(0))
+	cancel()
+	stop()
+}
+
+func TestBlocksCleaner_ShouldTrackBlocksPendingDeletion(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-time.Minute))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// Only the block which hasn't reached the deletion delay is pending deletion.
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantPendingDeletionBlocks.WithLabelValues("user-1")))
+
+	// The block which has reached the deletion delay has been deleted, so there's no backlog.
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantOldestPendingDeletionAge.WithLabelValues("user-1")))
+
+	// Series are removed once the tenant is marked for deletion.
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, 0, testutil.CollectAndCount(cleaner.tenantPendingDeletionBlocks))
+	assert.Equal(t, 0, testutil.CollectAndCount(cleaner.tenantPendingDeletionBytes))
+	assert.Equal(t, 0, testutil.CollectAndCount(cleaner.tenantOldestPendingDeletionAge))
+}
+
+func TestPendingDeletionBlocks(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	marks := map[ulid.ULID]*metadata.DeletionMark{
+		block1: {ID: block1, DeletionTime: time.Now().Add(-2 * time.Hour).Unix()},
+		block2: {ID: block2, DeletionTime: time.Now().Unix()},
+		block3: {ID: block3, DeletionTime: time.Now().Unix()},
+	}
+
+	// The meta of block3 is not available, so its size is not accounted.
+	metas := map[ulid.ULID]*metadata.Meta{
+		block1: {Thanos: metadata.Thanos{Files: []metadata.File{{RelPath: "index", SizeBytes: 100}}}},
+		block2: {Thanos: metadata.Thanos{Files: []metadata.File{{RelPath: "index", SizeBytes: 10}, {RelPath: "chunks/000001", SizeBytes: 20}, {RelPath: "meta.json"}}}},
+	}
+
+	count, size := pendingDeletionBlocks(marks, metas, time.Hour, time.Now())
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(30), size)
+}
+
+func TestOldestDeletableBlockAge(t *testing.T) {
+	// Deletion marks have a seconds precision.
+	now := time.Unix(time.Now().Unix(), 0)
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	marks := map[ulid.ULID]*metadata.DeletionMark{
+		block1: {ID: block1, DeletionTime: now.Add(-3 * time.Hour).Unix()},
+		block2: {ID: block2, DeletionTime: now.Add(-2 * time.Hour).Unix()},
+		block3: {ID: block3, DeletionTime: now.Unix()},
+	}
+
+	assert.Equal(t, 3*time.Hour, oldestDeletableBlockAge(marks, time.Hour, nil, now))
+	assert.Equal(t, 2*time.Hour, oldestDeletableBlockAge(marks, time.Hour, map[ulid.ULID]struct{}{block1: {}}, now))
+	assert.Equal(t, time.Duration(0), oldestDeletableBlockAge(marks, time.Hour, map[ulid.ULID]struct{}{block1: {}, block2: {}}, now))
+	assert.Equal(t, time.Duration(0), oldestDeletableBlockAge(marks, 4*time.Hour, nil, now))
+}
+
+func TestBlocksCleaner_ShouldTrackBytesReclaimed(t *testing.T) {
+	for _, fromObjects := range []bool{false, true} {
+		fromObjects := fromObjects
+
+		t.Run(fmt.Sprintf("from objects=%t", fromObjects), func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			userBucket := bucket.NewUserBucketClient("user-1", bucketClient)
+
+			// A block whose size is tracked in the meta.json.
+			block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+			reader, err := userBucket.Get(ctx, path.Join(block1.String(), metadata.MetaFilename))
+			require.NoError(t, err)
+			meta, err := metadata.Read(reader)
+			require.NoError(t, err)
+			meta.Thanos.Files = []metadata.File{{RelPath: "index", SizeBytes: 100}, {RelPath: "chunks/000001", SizeBytes: 200}, {RelPath: metadata.MetaFilename}}
+			data, err := json.Marshal(meta)
+			require.NoError(t, err)
+			require.NoError(t, userBucket.Upload(ctx, path.Join(block1.String(), metadata.MetaFilename), bytes.NewReader(data)))
+			createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+
+			// A block whose size is not tracked in the meta.json.
+			block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+			createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-2*time.Hour))
+			block2Size, err := objectsSize(ctx, userBucket, block2.String())
+			require.NoError(t, err)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:                 dataDir,
+				MetaSyncConcurrency:     10,
+				DeletionDelay:           time.Hour,
+				CleanupInterval:         time.Minute,
+				CleanupConcurrency:      1,
+				DeletedBytesFromObjects: fromObjects,
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+			if fromObjects {
+				assert.Equal(t, float64(300+block2Size), testutil.ToFloat64(cleaner.blocksCleanedBytes))
+			} else {
+				assert.Equal(t, float64(300), testutil.ToFloat64(cleaner.blocksCleanedBytes))
+			}
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldRunPeriodicallyWithIntervalJitter(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:               dataDir,
+		MetaSyncConcurrency:   10,
+		DeletionDelay:         time.Hour,
+		CleanupInterval:       20 * time.Millisecond,
+		CleanupIntervalJitter: 0.5,
+		CleanupConcurrency:    1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+
+	// Wait until some scheduled runs have completed, other than the initial one.
+	test.Poll(t, time.Second, true, func() interface{} {
+		return testutil.ToFloat64(cleaner.runsCompleted) >= 3
+	})
+
+	require.NoError(t, services.StopAndAwaitTerminated(ctx, cleaner))
+}
+
+func TestBlocksCleaner_ShouldTrackTenantDeletionsByReason(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logs := &concurrency.SyncBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The tenant marked for deletion is deleted by the scheduled run.
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletions.WithLabelValues(tenantDeletionReasonMark)))
+	assert.Contains(t, logs.String(), `org_id=user-1 msg="deleting blocks for user marked for deletion" reason=tenant-deletion-mark`)
+
+	// The on-demand deletion is tracked with its own reason.
+	require.NoError(t, cleaner.DeleteUser(ctx, "user-2", nil))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletions.WithLabelValues(tenantDeletionReasonOnDemand)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantDeletions.WithLabelValues(tenantDeletionReasonDecommission)))
+}
+
+func TestBlocksCleanerConfig_Validate(t *testing.T) {
+	tests := map[string]struct {
+		setup    func(cfg *BlocksCleanerConfig)
+		expected error
+	}{
+		"should pass with a valid config": {
+			setup:    func(cfg *BlocksCleanerConfig) {},
+			expected: nil,
+		},
+		"should pass with 0 deletion delays": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.DeletionDelay = 0
+				cfg.TenantDeletionDelay = 0
+				cfg.PartialBlockDeletionDelay = 0
+			},
+			expected: nil,
+		},
+		"should fail with an empty data dir": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.DataDir = ""
+			},
+			expected: errInvalidCleanerDataDir,
+		},
+		"should fail with a 0 cleanup interval": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.CleanupInterval = 0
+			},
+			expected: errInvalidCleanerInterval,
+		},
+		"should fail with a negative cleanup interval": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.CleanupInterval = -time.Minute
+			},
+			expected: errInvalidCleanerInterval,
+		},
+		"should fail with a 0 cleanup concurrency": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.CleanupConcurrency = 0
+			},
+			expected: errInvalidCleanerConcurrency,
+		},
+		"should fail with a negative cleanup concurrency": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.CleanupConcurrency = -1
+			},
+			expected: errInvalidCleanerConcurrency,
+		},
+		"should fail with a 0 meta sync concurrency": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.MetaSyncConcurrency = 0
+			},
+			expected: errInvalidCleanerMetaSyncConcurrency,
+		},
+		"should fail with a negative deletion delay": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.DeletionDelay = -time.Hour
+			},
+			expected: errInvalidCleanerDeletionDelay,
+		},
+		"should fail with a negative tenant deletion delay": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.TenantDeletionDelay = -time.Hour
+			},
+			expected: errInvalidCleanerDeletionDelay,
+		},
+		"should fail with a negative tenant deletion mark delay": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.TenantDeletionMarkDelay = -time.Hour
+			},
+			expected: errInvalidCleanerDeletionDelay,
+		},
+		"should fail with a negative partial block deletion delay": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.PartialBlockDeletionDelay = -time.Hour
+			},
+			expected: errInvalidCleanerDeletionDelay,
+		},
+		"should fail with a negative max concurrent bucket operations": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.MaxConcurrentBucketOps = -1
+			},
+			expected: errInvalidCleanerMaxBucketOps,
+		},
+		"should fail with a negative max tenants deleted per run": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.MaxTenantsDeletedPerRun = -1
+			},
+			expected: errInvalidCleanerMaxTenantsDeleted,
+		},
+		"should fail with a negative failed runs max backoff": {
+			setup: func(cfg *BlocksCleanerConfig) {
+				cfg.FailedRunsMaxBackoff = -time.Hour
+			},
+			expected: errInvalidCleanerMaxBackoff,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			cfg := BlocksCleanerConfig{
+				DataDir:             "/data",
+				MetaSyncConcurrency: 10,
+				DeletionDelay:       time.Hour,
+				CleanupInterval:     time.Minute,
+				CleanupConcurrency:  1,
+			}
+			testData.setup(&cfg)
+
+			assert.Equal(t, testData.expected, cfg.Validate())
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldNotDeleteTenantsUntilAnActiveTenantIsFound(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The tenant is not deleted while no active tenant has been found, run after run.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.deletionsSkippedNoActive))
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Once an active tenant is found, the tenant is deleted.
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.deletionsSkippedNoActive))
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestBlocksCleaner_ShouldTrackMetaSyncFailuresByTenant(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	// The listing of the user-2 blocks fails.
+	cleaner := NewBlocksCleaner(cfg, &failingIterBucket{Bucket: bucketClient, dir: "user-2/"}, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsFailed))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.blocksFailedTotal))
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.metaSyncFailures))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.metaSyncFailures.WithLabelValues("user-2")))
+}
+
+// failingIterBucket is a bucket whose listing of the input directory fails.
+type failingIterBucket struct {
+	objstore.Bucket
+	dir string
+}
+
+func (b *failingIterBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if dir == b.dir {
+		return errors.New("mocked iter failure")
+	}
+	return b.Bucket.Iter(ctx, dir, f)
+}
+
+func TestBlocksCleaner_ShouldNotDeletePartialBlocksIfDisabled(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename)))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                     dataDir,
+		MetaSyncConcurrency:         10,
+		DeletionDelay:               deletionDelay,
+		CleanupInterval:             time.Minute,
+		CleanupConcurrency:          1,
+		DisablePartialBlocksCleanup: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The partial block is retained, but still tracked, while the block marked for deletion is deleted.
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), "index"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = bucketClient.Exists(ctx, path.Join("user-1", block2.String(), "index"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantPartialBlocks.WithLabelValues("user-1")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.partialBlocksDeleted))
+}
+
+func TestBlocksCleaner_ShouldProcessOnceTenantsFoundBothActiveAndMarkedForDeletion(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+
+	// The user-1 is listed twice and the first check of its deletion mark fails, so
+	// it's found both active and marked for deletion.
+	scannerBucket := &duplicatingIterBucket{
+		Bucket:     bucketClient,
+		entry:      "user-1/",
+		failExists: path.Join("user-1", tsdb.TenantDeletionMarkPath),
+	}
+	users, deleted, err := tsdb.NewUsersScanner(scannerBucket, tsdb.AllUsers, log.NewNopLogger()).ScanUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"user-1", "user-2"}, users)
+	require.Equal(t, []string{"user-1"}, deleted)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  2,
+	}
+
+	logger := log.NewNopLogger()
+	scannerBucket.existsFailed = false
+	scanner := tsdb.NewUsersScanner(scannerBucket, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	// The user-1 is processed only once, as marked for deletion.
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsActive))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsMarkedForDeletion))
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 1, testutil.CollectAndCount(cleaner.tenantCleanupDuration))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantDeletions.WithLabelValues(tenantDeletionReasonMark)))
+}
+
+// duplicatingIterBucket is a bucket whose listing of the root lists the input entry twice, and
+// whose first existence check of the input object fails.
+type duplicatingIterBucket struct {
+	objstore.Bucket
+	entry        string
+	failExists   string
+	existsFailed bool
+}
+
+func (b *duplicatingIterBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if dir != "" {
+		return b.Bucket.Iter(ctx, dir, f)
+	}
+
+	return b.Bucket.Iter(ctx, dir, func(name string) error {
+		if name == b.entry {
+			if err := f(name); err != nil {
+				return err
+			}
+		}
+		return f(name)
+	})
+}
+
+func (b *duplicatingIterBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if name == b.failExists && !b.existsFailed {
+		b.existsFailed = true
+		return false, errors.New("mocked exists failure")
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+func TestBlocksCleaner_DedupeUsers(t *testing.T) {
+	cleaner := &BlocksCleaner{logger: log.NewNopLogger()}
+
+	users, deleted := cleaner.dedupeUsers([]string{"user-1", "user-2", "user-3", "user-1"}, []string{"user-2", "user-4", "user-4"})
+	assert.Equal(t, []string{"user-1", "user-3"}, users)
+	assert.Equal(t, []string{"user-2", "user-4"}, deleted)
+}
+
+func TestBlocksCleaner_ExcludeReservedEntries(t *testing.T) {
+	cleaner := &BlocksCleaner{cfg: BlocksCleanerConfig{
+		GovernanceFile:          "governance.csv",
+		TenantDeletionTokenPath: "control-plane/tenant-deletion-token.json",
+		DeletionAuditPath:       "deletion-audit/",
+	}}
+
+	// The top-level directory of a nested reserved path is excluded as a whole.
+	users := cleaner.excludeReservedEntries([]string{"user-1", "governance.csv", "governance.csv" + governanceAppliedSuffix, "control-plane", "deletion-audit", "governance"})
+	assert.Equal(t, []string{"user-1", "governance"}, users)
+}
+
+func TestBlocksCleaner_ShouldNotCleanUpNestedReservedPathsAsTenants(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	governanceFile := "governance/expired-tenants.csv"
+	require.NoError(t, bucketClient.Upload(ctx, governanceFile, strings.NewReader("user-3,1000")))
+
+	auditPath := "audit/deletions"
+	logger := log.NewNopLogger()
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		GovernanceFile:      governanceFile,
+		DeletionAuditor:     NewBucketDeletionAuditor(bucketClient, auditPath, logger),
+		DeletionAuditPath:   auditPath,
+		OrphanObjectsMinAge: time.Nanosecond,
+		DeleteEmptyTenants:  true,
+	}
+
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// Run the cleanup again, now that the audit entry and the governance applied rows have been written.
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	for _, name := range []string{
+		governanceFile,
+		governanceFile + governanceAppliedSuffix,
+		path.Join(auditPath, "user-1", block1.String()+".json"),
+	} {
+		exists, err := bucketClient.Exists(ctx, name)
+		require.NoError(t, err)
+		assert.True(t, exists, name)
+	}
+
+	// The top-level directories of the reserved paths have not been considered tenants.
+	assert.NotContains(t, cleaner.classifier.states, "governance")
+	assert.NotContains(t, cleaner.classifier.states, "audit")
+}
+
+func TestBlocksCleaner_ShouldTrackDeletionMarkAgeAtDelete(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-3*deletionDelay))
+	createDeletionMark(t, bucketClient, "user-1", block3, time.Now().Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       deletionDelay,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	// Only the blocks deleted are tracked, by the age of their deletion mark.
+	metric := &dto.Metric{}
+	require.NoError(t, cleaner.deletionMarkAgeAtDelete.Write(metric))
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, (13*time.Hour).Seconds()+(36*time.Hour).Seconds(), metric.GetHistogram().GetSampleSum(), 60)
+
+	for _, b := range metric.GetHistogram().GetBucket() {
+		switch b.GetUpperBound() {
+		case (12 * time.Hour).Seconds():
+			assert.Equal(t, uint64(0), b.GetCumulativeCount())
+		case (24 * time.Hour).Seconds():
+			assert.Equal(t, uint64(1), b.GetCumulativeCount())
+		case (2 * 24 * time.Hour).Seconds():
+			assert.Equal(t, uint64(2), b.GetCumulativeCount())
+		}
+	}
+}
+
+func TestBlocksCleaner_ShouldUseTheConfiguredClock(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	// Both the marked block and the partial block have just been marked for deletion.
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now())
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now())
+	require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block2.String(), metadata.MetaFilename)))
+
+	now := atomic.NewInt64(time.Now().UnixNano())
+	cfg := BlocksCleanerConfig{
+		DataDir:                   dataDir,
+		MetaSyncConcurrency:       10,
+		DeletionDelay:             deletionDelay,
+		CleanupInterval:           time.Minute,
+		CleanupConcurrency:        1,
+		PartialBlockDeletionDelay: deletionDelay,
+		MinPartialBlockLifetime:   time.Hour,
+		Now:                       func() time.Time { return time.Unix(0, now.Load()) },
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	// No block is deleted until the delays have elapsed according to the clock.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	for _, id := range []ulid.ULID{block1, block2} {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", id.String(), "index"))
+		require.NoError(t, err)
+		assert.True(t, exists, id.String())
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantPendingDeletionBlocks.WithLabelValues("user-1")))
+
+	now.Add((deletionDelay + time.Hour).Nanoseconds())
+	require.NoError(t, cleaner.runCleanup(ctx))
+	for _, id := range []ulid.ULID{block1, block2} {
+		exists, err := bucketClient.Exists(ctx, path.Join("user-1", id.String(), "index"))
+		require.NoError(t, err)
+		assert.False(t, exists, id.String())
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.partialBlocksDeleted))
 }
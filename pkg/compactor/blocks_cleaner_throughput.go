@@ -0,0 +1,23 @@
+package compactor
+
+import (
+	"time"
+)
+
+// updateRunThroughput updates the throughput of the last run, given its duration. The throughput
+// of a run with no measurable duration is 0.
+func (c *BlocksCleaner) updateRunThroughput(duration time.Duration) {
+	blocksPerSecond, bytesPerSecond := runThroughput(c.runBlocksCleaned.Load(), c.runBytesCleaned.Load(), duration)
+	c.runBlocksPerSecond.Set(blocksPerSecond)
+	c.runBytesPerSecond.Set(bytesPerSecond)
+}
+
+// runThroughput returns the blocks and bytes deleted per second over the input duration.
+func runThroughput(blocks, bytes int64, duration time.Duration) (blocksPerSecond, bytesPerSecond float64) {
+	if duration <= 0 {
+		return 0, 0
+	}
+
+	seconds := duration.Seconds()
+	return float64(blocks) / seconds, float64(bytes) / seconds
+}
@@ -0,0 +1,76 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldExportTheRunThroughput(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-deletionDelay).Add(-time.Hour))
+	createDeletionMark(t, bucketClient, "user-1", block2, time.Now().Add(-deletionDelay).Add(-time.Hour))
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                 dataDir,
+		MetaSyncConcurrency:     10,
+		DeletionDelay:           deletionDelay,
+		CleanupInterval:         time.Minute,
+		CleanupConcurrency:      1,
+		DeletedBytesFromObjects: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, int64(2), cleaner.runBlocksCleaned.Load())
+	assert.Greater(t, testutil.ToFloat64(cleaner.runBlocksPerSecond), float64(0))
+	assert.Greater(t, testutil.ToFloat64(cleaner.runBytesPerSecond), float64(0))
+
+	// The next run has nothing to delete.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, int64(0), cleaner.runBlocksCleaned.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runBlocksPerSecond))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.runBytesPerSecond))
+}
+
+func TestRunThroughput(t *testing.T) {
+	blocksPerSecond, bytesPerSecond := runThroughput(10, 1000, 2*time.Second)
+	assert.Equal(t, float64(5), blocksPerSecond)
+	assert.Equal(t, float64(500), bytesPerSecond)
+
+	// A run with no measurable duration doesn't divide by zero.
+	blocksPerSecond, bytesPerSecond = runThroughput(10, 1000, 0)
+	assert.Equal(t, float64(0), blocksPerSecond)
+	assert.Equal(t, float64(0), bytesPerSecond)
+}
@@ -0,0 +1,71 @@
+package compactor
+
+import (
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// TenantEvent is an event of the lifecycle of a tenant, as observed by the blocks cleaner.
+type TenantEvent string
+
+const (
+	// TenantEventTransitionToDeleted is fired when a tenant processed as active by the previous
+	// run is processed as deleted for the first time.
+	TenantEventTransitionToDeleted TenantEvent = "transition-to-deleted"
+)
+
+// tenantTransitions keeps track of the tenants processed as active across cleanup runs, in order
+// to detect the ones transitioning to deleted. It's not safe for concurrent use.
+type tenantTransitions struct {
+	active map[string]struct{}
+}
+
+func newTenantTransitions() *tenantTransitions {
+	return &tenantTransitions{active: map[string]struct{}{}}
+}
+
+// observe takes in input the tenants processed by a run as active and as deleted, and the ones whose
+// deletion has been deferred, and returns the tenants processed as deleted which were processed as active
+// by the previous run. Tenants whose deletion has been deferred keep their previous state, so that the
+// transition is detected once their deletion is processed.
+func (t *tenantTransitions) observe(users, deleted, deferred []string) (transitioned []string) {
+	for _, userID := range deleted {
+		if _, ok := t.active[userID]; ok {
+			transitioned = append(transitioned, userID)
+		}
+	}
+
+	active := make(map[string]struct{}, len(users))
+	for _, userID := range users {
+		active[userID] = struct{}{}
+	}
+	for _, userID := range deferred {
+		if _, ok := t.active[userID]; ok {
+			active[userID] = struct{}{}
+		}
+	}
+
+	// Tenants not processed as active anymore are forgotten.
+	t.active = active
+
+	return transitioned
+}
+
+// tenantsTransitioned tracks the tenants transitioned from active to deleted, and invokes the
+// tenant event hook, if configured, for each of them.
+func (c *BlocksCleaner) tenantsTransitioned(transitioned []string) {
+	for _, userID := range transitioned {
+		userLogger := util.WithUserID(userID, c.logger)
+
+		c.tenantTransitionsToDeleted.Inc()
+		level.Info(userLogger).Log("msg", "user transitioned from active to deleted since the previous blocks cleanup run")
+
+		if c.cfg.OnTenantEvent != nil {
+			userID := userID
+			c.invokeTenantHook("tenant event", userLogger, c.tenantEventHookFailures, func() {
+				c.cfg.OnTenantEvent(userID, TenantEventTransitionToDeleted)
+			})
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldFireAnEventWhenTenantsTransitionToDeleted(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createTSDBBlock(t, bucketClient, "user-2", 10, 20, nil)
+
+	// user-3 is already marked for deletion when the cleaner starts.
+	createTSDBBlock(t, bucketClient, "user-3", 10, 20, nil)
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-3"))
+
+	var (
+		eventsMtx sync.Mutex
+		events    = map[string][]TenantEvent{}
+	)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Minute,
+		CleanupConcurrency:  1,
+		OnTenantEvent: func(userID string, event TenantEvent) {
+			eventsMtx.Lock()
+			defer eventsMtx.Unlock()
+			events[userID] = append(events[userID], event)
+		},
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantTransitionsToDeleted))
+
+	// Once user-1 is marked for deletion, the next run fires the event.
+	require.NoError(t, tsdb.WriteTenantDeletionMark(ctx, bucketClient, "user-1"))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantTransitionsToDeleted))
+
+	// The event is fired only once.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantTransitionsToDeleted))
+
+	eventsMtx.Lock()
+	defer eventsMtx.Unlock()
+	assert.Equal(t, map[string][]TenantEvent{"user-1": {TenantEventTransitionToDeleted}}, events)
+}
+
+func TestTenantTransitions_Observe(t *testing.T) {
+	transitions := newTenantTransitions()
+
+	assert.Empty(t, transitions.observe([]string{"user-1", "user-2", "user-3"}, nil, nil))
+
+	// The deletion of user-1 is deferred, so the transition is detected once processed.
+	assert.Empty(t, transitions.observe([]string{"user-2", "user-3"}, nil, []string{"user-1"}))
+	assert.Equal(t, []string{"user-1", "user-2"}, transitions.observe([]string{"user-3"}, []string{"user-1", "user-2"}, nil))
+
+	// Tenants not processed as active anymore are forgotten.
+	assert.Empty(t, transitions.observe([]string{"user-3"}, []string{"user-1", "user-2"}, nil))
+	assert.Empty(t, transitions.observe(nil, nil, nil))
+	assert.Empty(t, transitions.observe(nil, []string{"user-3"}, nil))
+}
@@ -0,0 +1,85 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+var (
+	errCleanupInProgress = errors.New("a blocks cleanup run is already in progress")
+	errCleanupNotRunning = errors.New("the blocks cleaner is not running")
+	errCleanupPaused     = errors.New("the blocks cleanup is paused")
+)
+
+// TriggerCleanup starts a cleanup run in background, without waiting for the next cleanup interval.
+// The run is bound to the lifecycle of the cleaner, and not to the caller. Returns errCleanupInProgress
+// if a run is already in progress, either triggered or scheduled, or errCleanupPaused if the cleanup
+// is paused. The schedule is shifted, so that the next scheduled run starts one cleanup interval after
+// the triggered one.
+func (c *BlocksCleaner) TriggerCleanup() error {
+	return c.triggerCleanup(false)
+}
+
+// TriggerRefetchCleanup is like TriggerCleanup, but the run clears the metas cached, on disk and in memory,
+// for all tenants before starting, so that the metas of all blocks are fetched from the storage. This is
+// meant to recover from a suspect cache, given the cold fetch is expensive.
+func (c *BlocksCleaner) TriggerRefetchCleanup() error {
+	return c.triggerCleanup(true)
+}
+
+func (c *BlocksCleaner) triggerCleanup(refetch bool) error {
+	if c.State() != services.Running {
+		return errCleanupNotRunning
+	}
+	if c.paused.Load() {
+		return errCleanupPaused
+	}
+	if !c.runInProgress.CAS(false, true) {
+		return errCleanupInProgress
+	}
+
+	level.Info(c.logger).Log("msg", "triggered an on-demand blocks cleanup run", "refetch", refetch)
+
+	// The next scheduled run is postponed by a full interval since this run.
+	c.shiftSchedule(time.Now())
+
+	c.runsInFlight.Add(1)
+	go func() {
+		defer c.runsInFlight.Done()
+		defer c.runInProgress.Store(false)
+
+		// The caches are cleared while the run is in progress, so no other run is using them.
+		if refetch {
+			c.clearMetaCaches()
+		}
+
+		_ = c.runCleanup(c.triggeredRunsCtx)
+	}()
+
+	return nil
+}
+
+// runCleanupExclusive runs a cleanup unless another one is already in progress. Returns
+// whether the cleanup has run.
+func (c *BlocksCleaner) runCleanupExclusive(ctx context.Context) (bool, error) {
+	if !c.runInProgress.CAS(false, true) {
+		return false, nil
+	}
+	defer c.runInProgress.Store(false)
+
+	return true, c.runCleanup(ctx)
+}
+
+func (c *BlocksCleaner) stopping(_ error) error {
+	// No tenant is started anymore by the runs in-flight, either scheduled or triggered, while the
+	// tenants in-flight are allowed to finish within the shutdown grace period.
+	c.cancelTriggeredRuns()
+	c.awaitRunsInFlight()
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+	"github.com/cortexproject/cortex/pkg/util/test"
+)
+
+func TestBlocksCleaner_TriggerCleanup(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Hour,
+		CleanupConcurrency:  1,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := &blockingIterBucket{Bucket: bucketClient, release: make(chan struct{})}
+	scanner := tsdb.NewUsersScanner(bkt, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, newMockConfigProvider(), logger, nil)
+	assert.Equal(t, errCleanupNotRunning, cleaner.TriggerCleanup())
+
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// Block the triggered run, so that it's still in progress while triggering another one.
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	bkt.blocking.Store(true)
+
+	require.NoError(t, cleaner.TriggerCleanup())
+	assert.Equal(t, errCleanupInProgress, cleaner.TriggerCleanup())
+
+	// A scheduled run is skipped too.
+	require.NoError(t, cleaner.ticker(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.runsOverlappingSkipped))
+
+	close(bkt.release)
+
+	test.Poll(t, time.Second, float64(2), func() interface{} {
+		return testutil.ToFloat64(cleaner.runsCompleted)
+	})
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Once completed, another run can be triggered.
+	require.NoError(t, cleaner.TriggerCleanup())
+}
+
+// blockingIterBucket is a bucket whose listings block, once enabled, until released.
+type blockingIterBucket struct {
+	objstore.Bucket
+	blocking atomic.Bool
+	release  chan struct{}
+}
+
+func (b *blockingIterBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if b.blocking.Load() {
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return b.Bucket.Iter(ctx, dir, f)
+}
+
+func TestBlocksCleaner_TriggerRefetchCleanup(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:             dataDir,
+		MetaSyncConcurrency: 10,
+		DeletionDelay:       time.Hour,
+		CleanupInterval:     time.Hour,
+		CleanupConcurrency:  1,
+		MetaCacheSize:       10,
+		MetaCacheTTL:        time.Hour,
+	}
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The first run has cached the metas, on disk and in memory.
+	_, cached := cleaner.metaCache.get("user-1")
+	require.True(t, cached)
+
+	staleFile := filepath.Join(cleaner.metaSyncDirForUser("user-1"), "stale")
+	require.NoError(t, ioutil.WriteFile(staleFile, []byte("stale"), os.ModePerm))
+
+	// The caches are cleared before the triggered run.
+	require.NoError(t, cleaner.TriggerRefetchCleanup())
+	test.Poll(t, time.Second, float64(2), func() interface{} {
+		return testutil.ToFloat64(cleaner.runsCompleted)
+	})
+
+	_, err = os.Stat(staleFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// The cleared caches are populated again by the run.
+	_, err = os.Stat(cleaner.metaSyncDirForUser("user-1"))
+	require.NoError(t, err)
+
+	_, cached = cleaner.metaCache.get("user-1")
+	assert.True(t, cached)
+}
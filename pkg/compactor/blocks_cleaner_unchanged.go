@@ -0,0 +1,100 @@
+package compactor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+// unchangedTenants tracks the fingerprint of the tenants found idle by the last cleanup run,
+// which can be skipped until their bucket changes.
+type unchangedTenants struct {
+	mtx          sync.Mutex
+	fingerprints map[string]string
+}
+
+func newUnchangedTenants() *unchangedTenants {
+	return &unchangedTenants{fingerprints: map[string]string{}}
+}
+
+// unchanged returns whether the tenant was idle in the last run and the fingerprint is the same.
+func (u *unchangedTenants) unchanged(userID, fingerprint string) bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	previous, ok := u.fingerprints[userID]
+	return ok && previous == fingerprint
+}
+
+// idle records the tenant has nothing left to clean up with the input fingerprint.
+func (u *unchangedTenants) idle(userID, fingerprint string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.fingerprints[userID] = fingerprint
+}
+
+// forget removes the tenant, so that it's not skipped by the next run.
+func (u *unchangedTenants) forget(userID string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	delete(u.fingerprints, userID)
+}
+
+// retain removes the tracked tenants which are not in the input list.
+func (u *unchangedTenants) retain(userIDs []string) {
+	keep := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		keep[userID] = struct{}{}
+	}
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	for userID := range u.fingerprints {
+		if _, ok := keep[userID]; !ok {
+			delete(u.fingerprints, userID)
+		}
+	}
+}
+
+// canSkipUnchangedUser returns whether the tenant can be skipped when its bucket hasn't changed.
+// A tenant is never skipped when the cleanup of an unchanged bucket could still mark blocks for
+// deletion, or delete orphaned objects, as time passes.
+func (c *BlocksCleaner) canSkipUnchangedUser(userID string) bool {
+	return c.unchangedTenants != nil && c.labelRetention == nil && c.governance == nil && c.corruptBlocks == nil && c.cfgProvider.CompactorBlocksRetentionPeriod(userID) <= 0 && c.maxBlocksPerTenant(userID) <= 0 && c.cfg.OrphanObjectsMinAge <= 0
+}
+
+// userBucketFingerprint returns a fingerprint of the objects in the tenant root and of the tenant
+// deletion marks. Changes within a block location are not detected, but a block is expected to be
+// marked for deletion in the markers location, so that its deletion changes the fingerprint.
+func userBucketFingerprint(ctx context.Context, userBucket objstore.Bucket) (string, error) {
+	var names []string
+	for _, dir := range []string{"", bucketindex.MarkersPathname} {
+		err := userBucket.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "list tenant objects")
+		}
+	}
+
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,130 @@
+package compactor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestBlocksCleaner_ShouldSkipUnchangedTenants(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DataDir:              dataDir,
+		MetaSyncConcurrency:  10,
+		DeletionDelay:        time.Hour,
+		CleanupInterval:      time.Minute,
+		CleanupConcurrency:   1,
+		SkipUnchangedTenants: true,
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+	defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+	// The tenant had nothing to clean up, and its bucket is unchanged.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSkippedUnchanged))
+
+	// A block marked for deletion changes the bucket.
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-time.Minute))
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSkippedUnchanged))
+
+	// The tenant is not skipped while having blocks marked for deletion, which become deletable as time passes.
+	require.NoError(t, cleaner.runCleanup(ctx))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSkippedUnchanged))
+
+	// Once the deletion delay is reached, the block is deleted.
+	createDeletionMark(t, bucketClient, "user-1", block1, time.Now().Add(-2*time.Hour))
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	exists, err := bucketClient.Exists(ctx, path.Join("user-1", block1.String(), metadata.MetaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.tenantsSkippedUnchanged))
+}
+
+func TestBlocksCleaner_ShouldNotSkipUnchangedTenantsWhileRetentionApplies(t *testing.T) {
+	for name, tenantRetention := range map[string]bool{"retention by label": false, "tenant retention period": true} {
+		tenantRetention := tenantRetention
+
+		t.Run(name, func(t *testing.T) {
+			// Create a temporary directory for local storage.
+			storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+			require.NoError(t, err)
+			defer os.RemoveAll(storageDir) //nolint:errcheck
+
+			// Create a temporary directory for cleaner.
+			dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir) //nolint:errcheck
+
+			bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+			require.NoError(t, err)
+			bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+			ctx := context.Background()
+			oneHourAgo := time.Now().Add(-time.Hour).Unix() * 1000
+			createTSDBBlock(t, bucketClient, "user-1", oneHourAgo-1000, oneHourAgo, nil)
+
+			cfg := BlocksCleanerConfig{
+				DataDir:              dataDir,
+				MetaSyncConcurrency:  10,
+				DeletionDelay:        time.Hour,
+				CleanupInterval:      time.Minute,
+				CleanupConcurrency:   1,
+				SkipUnchangedTenants: true,
+			}
+
+			cfgProvider := newMockConfigProvider()
+			if tenantRetention {
+				cfgProvider.retention["user-1"] = 24 * time.Hour
+			} else {
+				cfg.RetentionLabel = "tier"
+			}
+
+			logger := log.NewNopLogger()
+			scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+			cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, cfgProvider, logger, nil)
+			require.NoError(t, services.StartAndAwaitRunning(ctx, cleaner))
+			defer services.StopAndAwaitTerminated(ctx, cleaner) //nolint:errcheck
+
+			require.NoError(t, cleaner.runCleanup(ctx))
+			assert.Equal(t, float64(0), testutil.ToFloat64(cleaner.tenantsSkippedUnchanged))
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// deletionMarkUnchanged re-reads the block deletion mark right before the block deletion, returning whether
+// the block can still be deleted. The block can't be deleted if the mark is gone or can't be read or, when
+// the expected mark is given, if the mark has been replaced by another one with a different deletion time.
+// Always returns true if the verification is disabled.
+func (c *BlocksCleaner) deletionMarkUnchanged(ctx context.Context, userBucket *bucket.UserBucketClient, userLogger log.Logger, id ulid.ULID, expected *metadata.DeletionMark) bool {
+	if !c.cfg.VerifyMarkBeforeDelete {
+		return true
+	}
+
+	mark := &metadata.DeletionMark{}
+	err := metadata.ReadMarker(ctx, userLogger, userBucket, id.String(), mark)
+	if err == metadata.ErrorMarkerNotFound {
+		c.deletionsAbortedMarkChanged.Inc()
+		level.Warn(userLogger).Log("msg", "aborted the deletion of a block because its deletion mark is gone", "block", id)
+		return false
+	}
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "aborted the deletion of a block because its deletion mark can't be read", "block", id, "err", err)
+		return false
+	}
+
+	if expected != nil && mark.DeletionTime != expected.DeletionTime {
+		c.deletionsAbortedMarkChanged.Inc()
+		level.Warn(userLogger).Log("msg", "aborted the deletion of a block because its deletion mark has been replaced", "block", id, "expectedDeletionTime", expected.DeletionTime, "deletionTime", mark.DeletionTime)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,123 @@
+package compactor
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
+)
+
+func TestBlocksCleaner_ShouldVerifyMarkBeforeDeleteIfEnabled(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	// Create a temporary directory for cleaner.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ctx := context.Background()
+	deletionDelay := 12 * time.Hour
+	markedAt := time.Now().Add(-deletionDelay).Add(-time.Hour)
+
+	block1 := createTSDBBlock(t, bucketClient, "user-1", 10, 20, nil)
+	block2 := createTSDBBlock(t, bucketClient, "user-1", 20, 30, nil)
+	block3 := createTSDBBlock(t, bucketClient, "user-1", 30, 40, nil)
+	for _, id := range []ulid.ULID{block1, block2, block3} {
+		createDeletionMark(t, bucketClient, "user-1", id, markedAt)
+	}
+
+	cfg := BlocksCleanerConfig{
+		DataDir:                dataDir,
+		MetaSyncConcurrency:    10,
+		DeletionDelay:          deletionDelay,
+		CleanupInterval:        time.Minute,
+		CleanupConcurrency:     1,
+		VerifyMarkBeforeDelete: true,
+		// The filter is consulted between the blocks fetch and the deletion, so it's used to simulate
+		// the deletion marks changed in the meanwhile.
+		BlockDeleteFilter: func(_ string, meta *metadata.Meta) bool {
+			switch meta.ULID {
+			case block1:
+				require.NoError(t, bucketClient.Delete(ctx, path.Join("user-1", block1.String(), metadata.DeletionMarkFilename)))
+			case block2:
+				createDeletionMark(t, bucketClient, "user-1", block2, markedAt.Add(-time.Hour))
+			}
+			return true
+		},
+	}
+
+	logger := log.NewNopLogger()
+	scanner := tsdb.NewUsersScanner(bucketClient, tsdb.AllUsers, logger)
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, newMockConfigProvider(), logger, nil)
+	require.NoError(t, cleaner.runCleanup(ctx))
+
+	for _, tc := range []struct {
+		path           string
+		expectedExists bool
+	}{
+		{path: path.Join("user-1", block1.String(), metadata.MetaFilename), expectedExists: true},
+		{path: path.Join("user-1", block2.String(), metadata.MetaFilename), expectedExists: true},
+		{path: path.Join("user-1", block3.String(), metadata.MetaFilename), expectedExists: false},
+	} {
+		exists, err := bucketClient.Exists(ctx, tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedExists, exists, tc.path)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.deletionsAbortedMarkChanged))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cleaner.blocksCleanedTotal))
+}
+
+func TestBlocksCleaner_DeletionMarkUnchanged(t *testing.T) {
+	// Create a temporary directory for local storage.
+	storageDir, err := ioutil.TempDir(os.TempDir(), "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(storageDir) //nolint:errcheck
+
+	bucketClient, err := filesystem.NewBucketClient(filesystem.Config{Directory: storageDir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	userBucket := bucket.NewUserBucketClient("user-1", bucketClient)
+
+	marked := ulid.MustNew(1, rand.Reader)
+	notMarked := ulid.MustNew(2, rand.Reader)
+	markedAt := time.Now().Add(-time.Hour)
+	createDeletionMark(t, bucketClient, "user-1", marked, markedAt)
+
+	cleaner := NewBlocksCleaner(BlocksCleanerConfig{VerifyMarkBeforeDelete: true}, bucketClient, nil, newMockConfigProvider(), logger, nil)
+
+	assert.True(t, cleaner.deletionMarkUnchanged(ctx, userBucket, logger, marked, nil))
+	assert.True(t, cleaner.deletionMarkUnchanged(ctx, userBucket, logger, marked, &metadata.DeletionMark{DeletionTime: markedAt.Unix()}))
+	assert.False(t, cleaner.deletionMarkUnchanged(ctx, userBucket, logger, marked, &metadata.DeletionMark{DeletionTime: markedAt.Add(time.Minute).Unix()}))
+	assert.False(t, cleaner.deletionMarkUnchanged(ctx, userBucket, logger, notMarked, nil))
+	assert.Equal(t, float64(2), testutil.ToFloat64(cleaner.deletionsAbortedMarkChanged))
+
+	// Once disabled, the mark is not verified.
+	cleaner.cfg.VerifyMarkBeforeDelete = false
+	assert.True(t, cleaner.deletionMarkUnchanged(ctx, userBucket, logger, notMarked, nil))
+}
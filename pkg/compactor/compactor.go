@@ -7,8 +7,10 @@ import (
 	"hash/fnv"
 	"math/rand"
 	"path"
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -18,6 +20,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/objstore"
@@ -32,7 +35,16 @@ import (
 )
 
 var (
-	errInvalidBlockRanges = "compactor block range periods should be divisible by the previous one, but %s is not divisible by %s"
+	errInvalidBlockRanges         = "compactor block range periods should be divisible by the previous one, but %s is not divisible by %s"
+	errInvalidGovernanceFileSep   = errors.New("the compactor cleanup governance file separator must be a single character")
+	errInvalidOrphanPolicy        = errors.New("unsupported compactor cleanup orphan block prefix policy")
+	errInvalidCleanupRole         = errors.New("unsupported compactor cleanup role")
+	errInvalidCleanupOrder        = errors.New("unsupported compactor cleanup order")
+	errInvalidCleanupJitter       = errors.New("the compactor cleanup interval jitter must be greater than or equal to 0 and less than 1")
+	errInvalidDeletionPlanFormat  = errors.New("unsupported compactor cleanup deletion plan format")
+	errMissingRetentionLabel      = errors.New("the compactor cleanup retention by label requires the retention label to be set")
+	errInvalidInconsistentPolicy  = errors.New("unsupported compactor cleanup inconsistent scan policy")
+	errMissingDeletionTokenSecret = errors.New("the compactor cleanup tenant deletion token secret must be set when the tenant deletion token path is configured")
 )
 
 // Config holds the Compactor config.
@@ -48,6 +60,75 @@ type Config struct {
 	CleanupConcurrency    int                      `yaml:"cleanup_concurrency"`
 	DeletionDelay         time.Duration            `yaml:"deletion_delay"`
 
+	CleanupReconciliationMode                  bool                     `yaml:"cleanup_reconciliation_mode"`
+	CleanupReadOnly                            bool                     `yaml:"cleanup_read_only"`
+	CleanupFailStartOnInitialError             bool                     `yaml:"cleanup_fail_start_on_initial_error"`
+	CleanupAnnotateRetainedBlocks              bool                     `yaml:"cleanup_annotate_retained_blocks"`
+	CleanupMaxBlocksDeletedPerRun              int                      `yaml:"cleanup_max_blocks_deleted_per_run"`
+	CleanupVerifyConvergence                   bool                     `yaml:"cleanup_verify_convergence"`
+	CleanupTenantDeleteConcurrency             int                      `yaml:"cleanup_tenant_delete_concurrency"`
+	CleanupExportDeletionMarks                 bool                     `yaml:"cleanup_export_deletion_marks"`
+	CleanupExportDeletionMarksDetails          bool                     `yaml:"cleanup_export_deletion_marks_details"`
+	CleanupMinPartialBlockLifetime             time.Duration            `yaml:"cleanup_min_partial_block_lifetime"`
+	CleanupMaxConcurrentDeletes                int                      `yaml:"cleanup_max_concurrent_deletes"`
+	CleanupSuspiciousEmptyFetchMinBlocks       int                      `yaml:"cleanup_suspicious_empty_fetch_min_blocks"`
+	CleanupDeletionClassificationStabilization time.Duration            `yaml:"cleanup_deletion_classification_stabilization"`
+	CleanupGovernanceFile                      string                   `yaml:"cleanup_governance_file"`
+	CleanupGovernanceFileSeparator             string                   `yaml:"cleanup_governance_file_separator"`
+	CleanupGovernanceFileHasHeader             bool                     `yaml:"cleanup_governance_file_has_header"`
+	CleanupTenantDeletionTokenPath             string                   `yaml:"cleanup_tenant_deletion_token_path"`
+	CleanupTenantDeletionTokenSecret           flagext.Secret           `yaml:"cleanup_tenant_deletion_token_secret"`
+	CleanupOrphanBlockPrefixPolicy             string                   `yaml:"cleanup_orphan_block_prefix_policy"`
+	CleanupRole                                string                   `yaml:"cleanup_role"`
+	CleanupMarkingConcurrency                  int                      `yaml:"cleanup_marking_concurrency"`
+	CleanupSuccessRatioNaNWithoutDeletions     bool                     `yaml:"cleanup_success_ratio_nan_without_deletions"`
+	CleanupCorruptBlocksCheckEnabled           bool                     `yaml:"cleanup_corrupt_blocks_check_enabled"`
+	CleanupCorruptBlocksMarkingGracePeriod     time.Duration            `yaml:"cleanup_corrupt_blocks_marking_grace_period"`
+	CleanupDeletionPlanPath                    string                   `yaml:"cleanup_deletion_plan_path"`
+	CleanupDeletionPlanApprovalPath            string                   `yaml:"cleanup_deletion_plan_approval_path"`
+	CleanupDeletionPlanFormat                  string                   `yaml:"cleanup_deletion_plan_format"`
+	CleanupPerDeletionTimeout                  time.Duration            `yaml:"cleanup_per_deletion_timeout"`
+	CleanupPerTenantTimeout                    time.Duration            `yaml:"cleanup_per_tenant_timeout"`
+	CleanupRetentionLabel                      string                   `yaml:"cleanup_retention_label"`
+	CleanupRetentionByLabel                    map[string]time.Duration `yaml:"cleanup_retention_by_label" doc:"nocli|description=Retention of the blocks by the value of the label configured via -compactor.cleanup-retention-label. Keys are anchored regular expressions matched against the label value and, if multiple keys match, the longest retention wins. 0 means unlimited."`
+	CleanupInconsistentScanPolicy              string                   `yaml:"cleanup_inconsistent_scan_policy"`
+	CleanupMetaCacheSize                       int                      `yaml:"cleanup_meta_cache_size"`
+	CleanupMetaCacheTTL                        time.Duration            `yaml:"cleanup_meta_cache_ttl"`
+	CleanupMetaCacheDir                        string                   `yaml:"cleanup_meta_cache_dir"`
+	CleanupMaxBlocksPerTenant                  int                      `yaml:"cleanup_max_blocks_per_tenant"`
+	CleanupMaxBlocksMinRetention               time.Duration            `yaml:"cleanup_max_blocks_min_retention"`
+	CleanupDeleteRetries                       int                      `yaml:"cleanup_delete_retries"`
+	CleanupDeleteRetryMinBackoff               time.Duration            `yaml:"cleanup_delete_retry_min_backoff"`
+	CleanupDeleteRetryMaxBackoff               time.Duration            `yaml:"cleanup_delete_retry_max_backoff"`
+	CleanupDryRun                              bool                     `yaml:"cleanup_dry_run"`
+	CleanupEnabledTenants                      flagext.StringSliceCSV   `yaml:"cleanup_enabled_tenants"`
+	CleanupDisabledTenants                     flagext.StringSliceCSV   `yaml:"cleanup_disabled_tenants"`
+	CleanupWriteBucketIndex                    bool                     `yaml:"cleanup_write_bucket_index"`
+	CleanupPartialBlockDeletionDelay           time.Duration            `yaml:"cleanup_partial_block_deletion_delay"`
+	CleanupDeletionAuditPath                   string                   `yaml:"cleanup_deletion_audit_path"`
+	CleanupSkipUnchangedTenants                bool                     `yaml:"cleanup_skip_unchanged_tenants"`
+	CleanupOrphanObjectsMinAge                 time.Duration            `yaml:"cleanup_orphan_objects_min_age"`
+	CleanupDeleteRateLimit                     float64                  `yaml:"cleanup_delete_rate_limit"`
+	CleanupTenantDeletionDelay                 time.Duration            `yaml:"cleanup_tenant_deletion_delay"`
+	CleanupTenantDeletionMarkDelay             time.Duration            `yaml:"cleanup_tenant_deletion_mark_delay"`
+	CleanupTenantDeletionProgressInterval      time.Duration            `yaml:"cleanup_tenant_deletion_progress_interval"`
+	CleanupOrder                               string                   `yaml:"cleanup_order"`
+	CleanupKillSwitchPath                      string                   `yaml:"cleanup_kill_switch_path"`
+	CleanupDeletedBytesFromObjects             bool                     `yaml:"cleanup_deleted_bytes_from_objects"`
+	CleanupIntervalJitter                      float64                  `yaml:"cleanup_interval_jitter"`
+	CleanupFailedRunsMaxBackoff                time.Duration            `yaml:"cleanup_failed_runs_max_backoff"`
+	CleanupShutdownGracePeriod                 time.Duration            `yaml:"cleanup_shutdown_grace_period"`
+	CleanupDeleteEmptyTenants                  bool                     `yaml:"cleanup_delete_empty_tenants"`
+	CleanupDeleteBatchSize                     int                      `yaml:"cleanup_delete_batch_size"`
+	CleanupAllowDeletionOnEmptyActiveUsers     bool                     `yaml:"cleanup_allow_deletion_on_empty_active_users"`
+	CleanupVerifyMarkBeforeDelete              bool                     `yaml:"cleanup_verify_mark_before_delete"`
+	CleanupPartialBlocks                       bool                     `yaml:"cleanup_partial_blocks"`
+	CleanupReportMalformedBlockDirs            bool                     `yaml:"cleanup_report_malformed_block_dirs"`
+	CleanupArchiveDeletedMeta                  bool                     `yaml:"cleanup_archive_deleted_meta"`
+	CleanupMaxConcurrentBucketOps              int                      `yaml:"cleanup_max_concurrent_bucket_ops"`
+	CleanupPerTenantMetaFilesMetrics           bool                     `yaml:"cleanup_per_tenant_meta_files_metrics"`
+	CleanupMaxTenantsDeletedPerRun             int                      `yaml:"cleanup_max_tenants_deleted_per_run"`
+
 	EnabledTenants  flagext.StringSliceCSV `yaml:"enabled_tenants"`
 	DisabledTenants flagext.StringSliceCSV `yaml:"disabled_tenants"`
 
@@ -60,6 +141,26 @@ type Config struct {
 	// it in tests.
 	retryMinBackoff time.Duration `yaml:"-"`
 	retryMaxBackoff time.Duration `yaml:"-"`
+
+	// Allow to plug a custom validator of the tenant deletion token. If nil, the token
+	// is validated against the configured secret.
+	CleanupTenantDeletionTokenValidator TenantDeletionTokenValidator `yaml:"-"`
+
+	// Allow to plug a provider of the blocks recently queried, whose deletion should be deferred.
+	CleanupQueryActivityProvider QueryActivityProvider `yaml:"-"`
+
+	// Allow to plug a custom auditor of the blocks deletions. If nil, deletions are recorded in the
+	// bucket if the audit path is configured.
+	CleanupDeletionAuditor DeletionAuditor `yaml:"-"`
+
+	// Allow to plug a hook invoked at the end of the cleanup of each tenant.
+	CleanupOnTenantCleaned func(userID string, stats CleanupStats) `yaml:"-"`
+
+	// Allow to plug a filter of the blocks marked for deletion which can be deleted.
+	CleanupBlockDeleteFilter func(userID string, meta *metadata.Meta) bool `yaml:"-"`
+
+	// Allow to plug a function sharding the tenants cleaned up across multiple compactors.
+	CleanupTenantShardFunc func(userID string) bool `yaml:"-"`
 }
 
 // RegisterFlags registers the Compactor flags.
@@ -84,6 +185,73 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 		"If not 0, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
 		"If delete-delay is 0, blocks will be deleted straight away. Note that deleting blocks immediately can cause query failures, "+
 		"if store gateway still has the block loaded, or compactor is ignoring the deletion because it's compacting the block at the same time.")
+	f.BoolVar(&cfg.CleanupReconciliationMode, "compactor.cleanup-reconciliation-mode", false, "If enabled, the blocks cleaner doesn't delete any block but compares the bucket state against the configured policies and reports the discrepancies found (blocks which should have been deleted but still exist).")
+	f.BoolVar(&cfg.CleanupReadOnly, "compactor.cleanup-read-only", false, "If enabled, the blocks cleaner treats the bucket as read-only (eg. in staging or audit environments): it evaluates the bucket and reports what it would do, like in reconciliation mode, but never writes or deletes any object, so no failure is tracked because of the read-only bucket.")
+	f.BoolVar(&cfg.CleanupFailStartOnInitialError, "compactor.cleanup-fail-start-on-initial-error", false, "If enabled, the compactor fails to start when the initial blocks cleanup, run at startup, fails. If disabled, a failed initial cleanup is logged and the compactor starts anyway.")
+	f.BoolVar(&cfg.CleanupAnnotateRetainedBlocks, "compactor.cleanup-annotate-retained-blocks", false, "If enabled, the blocks cleaner writes a "+BlockPolicyAnnotationFilename+" object to each block marked for deletion which has not reached the deletion delay yet, annotating when the block will become eligible for deletion.")
+	f.IntVar(&cfg.CleanupMaxBlocksDeletedPerRun, "compactor.cleanup-max-blocks-deleted-per-run", 0, "Max number of blocks the blocks cleaner can hard delete across all tenants in a single cleanup run. Remaining blocks are deleted in the next runs. 0 means unlimited.")
+	f.BoolVar(&cfg.CleanupVerifyConvergence, "compactor.cleanup-verify-convergence", false, "If enabled, the blocks cleaner re-scans each tenant once cleaned up, to verify no block which should have been deleted is left in the storage. Enabling it increases the number of operations run against the storage.")
+	f.IntVar(&cfg.CleanupTenantDeleteConcurrency, "compactor.cleanup-tenant-delete-concurrency", 1, "Number of Go routines concurrently deleting the blocks of a single tenant marked for deletion, while its blocks are being listed.")
+	f.BoolVar(&cfg.CleanupExportDeletionMarks, "compactor.cleanup-export-deletion-marks", false, "If enabled, the blocks cleaner exposes the number of blocks marked for deletion found by the last cleanup run, by the time left before they become eligible for deletion.")
+	f.BoolVar(&cfg.CleanupExportDeletionMarksDetails, "compactor.cleanup-export-deletion-marks-details", false, fmt.Sprintf("If enabled, the blocks cleaner exposes the timestamp since when each block marked for deletion is eligible for deletion, for up to %d blocks. This is a debug option, which can significantly increase the metrics cardinality.", maxExportedDeletionMarkDetails))
+	f.DurationVar(&cfg.CleanupMinPartialBlockLifetime, "compactor.cleanup-min-partial-block-lifetime", 0, "Min time since the oldest object of a partial block marked for deletion has been uploaded, before the blocks cleaner deletes it. This protects from deleting blocks whose upload is still in progress. 0 to disable.")
+	f.IntVar(&cfg.CleanupMaxConcurrentDeletes, "compactor.cleanup-max-concurrent-deletes", 0, "Max number of blocks concurrently deleted by the blocks cleaner across all tenants, regardless of the tenants and per-tenant delete concurrency. 0 means unlimited.")
+	f.IntVar(&cfg.CleanupSuspiciousEmptyFetchMinBlocks, "compactor.cleanup-suspicious-empty-fetch-min-blocks", 0, "If a tenant had at least this number of blocks in the previous cleanup run and no block is found in the current run, the blocks cleaner considers the listing suspicious and skips the tenant cleanup for the current run. 0 to disable.")
+	f.DurationVar(&cfg.CleanupDeletionClassificationStabilization, "compactor.cleanup-deletion-classification-stabilization", 0, "Min time a tenant must have been continuously seen as marked for deletion by the blocks cleaner before its blocks are deleted. Until then, the tenant is cleaned up as an active tenant. This reduces the chances of different compactors concurrently cleaning up and deleting the same tenant while the tenant deletion mark is propagating. 0 to disable.")
+	f.StringVar(&cfg.CleanupGovernanceFile, "compactor.cleanup-governance-file", "", "Path, in the bucket, of a CSV file listing (tenant, cutoff) rows, where the cutoff is either a RFC3339 timestamp or a unix timestamp in seconds. The file is read at the beginning of each cleanup run and the blocks of each listed tenant containing only data older than the cutoff are marked for deletion. The rows applied are recorded in the bucket next to the file, with the "+governanceAppliedSuffix+" suffix. Empty to disable.")
+	f.StringVar(&cfg.CleanupGovernanceFileSeparator, "compactor.cleanup-governance-file-separator", ",", "Fields separator of the CSV file configured via -compactor.cleanup-governance-file. Must be a single character.")
+	f.BoolVar(&cfg.CleanupGovernanceFileHasHeader, "compactor.cleanup-governance-file-has-header", false, "Whether the first row of the CSV file configured via -compactor.cleanup-governance-file is a header, which should be skipped.")
+	f.StringVar(&cfg.CleanupTenantDeletionTokenPath, "compactor.cleanup-tenant-deletion-token-path", "", "Path, in the bucket, of the token authorizing the deletion of tenants marked for deletion. If set, the blocks cleaner deletes the tenants marked for deletion only while a valid and not expired token exists, otherwise the deletion is deferred to the next runs. The token is re-validated at each run. Empty to not require a token.")
+	f.Var(&cfg.CleanupTenantDeletionTokenSecret, "compactor.cleanup-tenant-deletion-token-secret", "Secret used to verify the signature of the tenant deletion token.")
+	f.StringVar(&cfg.CleanupOrphanBlockPrefixPolicy, "compactor.cleanup-orphan-block-prefix-policy", OrphanBlockPrefixPolicyBlock, fmt.Sprintf("How the blocks cleaner handles a block prefix containing only markers (eg. a deletion mark left behind after the block data has been deleted) and no block data. Supported values are: %s.", strings.Join(orphanBlockPrefixPolicies, ", ")))
+	f.StringVar(&cfg.CleanupRole, "compactor.cleanup-role", BlocksCleanerRoleActive, fmt.Sprintf("Role of the blocks cleaner. An active cleaner deletes blocks and writes markers, while a standby cleaner only runs the read-only evaluation of the bucket, populating metrics and reporting discrepancies like in reconciliation mode, so that it is ready to take over. Supported values are: %s.", strings.Join(blocksCleanerRoles, ", ")))
+	f.IntVar(&cfg.CleanupMarkingConcurrency, "compactor.cleanup-marking-concurrency", 1, "Max number of deletion marks concurrently written by the blocks cleaner for a single tenant, when marking blocks for deletion (eg. when applying the governance file cutoffs). A failed mark write is retried and does not abort the marking of the other blocks.")
+	f.BoolVar(&cfg.CleanupSuccessRatioNaNWithoutDeletions, "compactor.cleanup-success-ratio-nan-without-deletions", false, "If enabled, the cortex_compactor_block_cleanup_success_ratio metric is NaN when no block deletion has been attempted by a cleanup run. If disabled, it is 1.")
+	f.BoolVar(&cfg.CleanupCorruptBlocksCheckEnabled, "compactor.cleanup-corrupt-blocks-check-enabled", false, "If enabled, the blocks cleaner checks whether the index and chunks files referenced by the meta.json of each block exist in the storage. This significantly increases the number of operations run against the storage.")
+	f.DurationVar(&cfg.CleanupCorruptBlocksMarkingGracePeriod, "compactor.cleanup-corrupt-blocks-marking-grace-period", 0, "How long a block must have been continuously detected as corrupted, because of files referenced by its meta.json missing in the storage, before the blocks cleaner marks it for deletion. Requires -compactor.cleanup-corrupt-blocks-check-enabled. 0 to not mark corrupted blocks for deletion.")
+	f.StringVar(&cfg.CleanupDeletionPlanPath, "compactor.cleanup-deletion-plan-path", "", "Path, in the bucket, of the blocks cleanup deletion plan. If set, the blocks cleaner alternates between planning and applying: a run not finding an approved plan evaluates the bucket without deleting anything and writes the list of blocks to delete, with the reason, to the plan; the next run deletes only the blocks listed in the plan if the plan has been approved, otherwise it plans again. Empty to disable.")
+	f.StringVar(&cfg.CleanupDeletionPlanApprovalPath, "compactor.cleanup-deletion-plan-approval-path", "", "Path, in the bucket, of the object approving the blocks cleanup deletion plan. The plan is approved if the object content is the hex encoded SHA256 digest of the plan. Defaults to the plan path with the "+deletionPlanApprovalSuffix+" suffix.")
+	f.StringVar(&cfg.CleanupDeletionPlanFormat, "compactor.cleanup-deletion-plan-format", DeletionPlanFormatJSON, fmt.Sprintf("Format of the blocks cleanup deletion plan. Supported values are: %s.", strings.Join(deletionPlanFormats, ", ")))
+	f.DurationVar(&cfg.CleanupPerDeletionTimeout, "compactor.cleanup-per-deletion-timeout", 0, "Max time the blocks cleaner can take to delete a single block, including all its objects. A deletion timing out is accounted as a failure for that block, which is retried in the next runs. 0 means no timeout.")
+	f.DurationVar(&cfg.CleanupPerTenantTimeout, "compactor.cleanup-per-tenant-timeout", 0, "Max time the blocks cleaner can take to clean up a single tenant within a run. A tenant timing out is skipped, without failing the run, and cleaned up again in the next runs. 0 means no timeout.")
+	f.StringVar(&cfg.CleanupRetentionLabel, "compactor.cleanup-retention-label", "", "Block external label whose value selects the retention of the block among the ones configured via cleanup_retention_by_label. The blocks containing only data older than the retention are marked for deletion. The retention selected by the label takes precedence over -compactor.blocks-retention-period, which applies to the blocks not matching any of them.")
+	f.StringVar(&cfg.CleanupInconsistentScanPolicy, "compactor.cleanup-inconsistent-scan-policy", InconsistentScanPolicyProceed, fmt.Sprintf("How the blocks cleaner handles a tenants discovery finding no active tenant but some tenants marked for deletion, which may be caused by a partially broken discovery (eg. permission issues). proceed: the run proceeds as usual; skip: the run is skipped; fail: the run fails. Supported values are: %s.", strings.Join(inconsistentScanPolicies, ", ")))
+	f.IntVar(&cfg.CleanupMetaCacheSize, "compactor.cleanup-meta-cache-size", 0, "Max number of tenants whose blocks, as fetched by the last blocks cleanup, are cached in memory. The cached blocks are reused, until -compactor.cleanup-meta-cache-ttl is reached, by the runs not deleting blocks (eg. reconciliation or standby), while the runs deleting blocks always fetch them from the storage. 0 to disable.")
+	f.DurationVar(&cfg.CleanupMetaCacheTTL, "compactor.cleanup-meta-cache-ttl", time.Minute, "How long the blocks of a tenant cached via -compactor.cleanup-meta-cache-size can be reused.")
+	f.StringVar(&cfg.CleanupMetaCacheDir, "compactor.cleanup-meta-cache-dir", "", "Local directory where the blocks cleaner caches the metas of the tenant blocks, so that it can be placed on a different storage than -compactor.data-dir (eg. a faster ephemeral disk). Empty to use -compactor.data-dir.")
+	f.IntVar(&cfg.CleanupMaxBlocksPerTenant, "compactor.cleanup-max-blocks-per-tenant", 0, "Max number of blocks a tenant can retain. Once exceeded, the blocks cleaner marks for deletion the oldest blocks, down to the limit, except the ones containing data more recent than -compactor.cleanup-max-blocks-min-retention. Can be overridden on a per-tenant basis. 0 means unlimited.")
+	f.DurationVar(&cfg.CleanupMaxBlocksMinRetention, "compactor.cleanup-max-blocks-min-retention", 24*time.Hour, "Blocks containing data more recent than this are never marked for deletion because exceeding the max number of blocks per tenant.")
+	f.IntVar(&cfg.CleanupDeleteRetries, "compactor.cleanup-delete-retries", 0, "Number of times the blocks cleaner retries a failed block deletion, with an exponential backoff, before accounting it as a failure. 0 to disable retries.")
+	f.DurationVar(&cfg.CleanupDeleteRetryMinBackoff, "compactor.cleanup-delete-retry-min-backoff", time.Second, "Minimum backoff between the retries of a failed block deletion.")
+	f.DurationVar(&cfg.CleanupDeleteRetryMaxBackoff, "compactor.cleanup-delete-retry-max-backoff", 10*time.Second, "Maximum backoff between the retries of a failed block deletion.")
+	f.BoolVar(&cfg.CleanupDryRun, "compactor.cleanup-dry-run", false, "If enabled, the blocks cleaner logs the blocks it would delete or mark for deletion, without deleting or marking them. The blocks which would have been deleted are tracked by the cortex_compactor_blocks_cleaned_dryrun_total metric.")
+	f.Var(&cfg.CleanupEnabledTenants, "compactor.cleanup-enabled-tenants", "Comma separated list of tenants whose blocks can be cleaned up. If specified, only these tenants are cleaned up by the blocks cleaner, otherwise all tenants can be cleaned up.")
+	f.Var(&cfg.CleanupDisabledTenants, "compactor.cleanup-disabled-tenants", "Comma separated list of tenants whose blocks cannot be cleaned up. If specified, these tenants are skipped by the blocks cleaner, even if listed in -compactor.cleanup-enabled-tenants.")
+	f.BoolVar(&cfg.CleanupWriteBucketIndex, "compactor.cleanup-write-bucket-index", false, "If enabled, the blocks cleaner writes a bucket index for each tenant, listing the blocks and deletion marks found by the cleanup, at the root of the tenant in the storage.")
+	f.DurationVar(&cfg.CleanupPartialBlockDeletionDelay, "compactor.cleanup-partial-block-deletion-delay", 0, "Min time since a partial block has been marked for deletion, before the blocks cleaner deletes it. This protects from deleting blocks whose upload is still in progress. 0 to disable.")
+	f.StringVar(&cfg.CleanupDeletionAuditPath, "compactor.cleanup-deletion-audit-path", "", "Path, in the bucket, where the blocks cleaner writes an audit record, in JSON format, of each block permanently deleted. Empty to disable.")
+	f.BoolVar(&cfg.CleanupSkipUnchangedTenants, "compactor.cleanup-skip-unchanged-tenants", false, "If enabled, the blocks cleaner skips the tenants which had no block marked for deletion in the previous run, as long as the objects at their root and their deletion marks are unchanged. The skip is disabled while retention, governance, corrupted blocks or max blocks per tenant policies apply, given they can mark blocks for deletion even if the bucket is unchanged.")
+	f.DurationVar(&cfg.CleanupOrphanObjectsMinAge, "compactor.cleanup-orphan-objects-min-age", 0, "Min age of the objects stored in a tenant location which don't belong to any block (eg. leftover debug or index-cache files), before the blocks cleaner deletes them. Block locations, markers and the bucket index are never deleted. 0 to disable.")
+	f.Float64Var(&cfg.CleanupDeleteRateLimit, "compactor.cleanup-delete-rate-limit", 0, "Max number of blocks deleted per second by the blocks cleaner across all tenants, in order to protect the object storage from a flood of delete requests (eg. when a large tenant is deleted). 0 means unlimited.")
+	f.DurationVar(&cfg.CleanupTenantDeletionDelay, "compactor.cleanup-tenant-deletion-delay", 0, "Grace period before the blocks of a tenant marked for deletion are hard-deleted. If set, the blocks cleaner marks each block of the tenant for deletion first, and deletes it in a subsequent run once the grace period has elapsed. Within the grace period, the tenant can be recovered removing both the tenant deletion mark and the blocks deletion marks. 0 to delete the blocks immediately.")
+	f.DurationVar(&cfg.CleanupTenantDeletionMarkDelay, "compactor.cleanup-tenant-deletion-mark-delay", 0, "How long the deletion mark of a tenant is kept, since the tenant has been marked for deletion. Once elapsed, the blocks cleaner deletes the tenant deletion mark as soon as all the blocks of the tenant have been deleted and no other object is left in the tenant location, so that the tenant isn't scanned anymore. 0 to never delete the tenant deletion mark.")
+	f.DurationVar(&cfg.CleanupTenantDeletionProgressInterval, "compactor.cleanup-tenant-deletion-progress-interval", 30*time.Second, "How frequently the blocks cleaner logs the progress of the deletion of a tenant marked for deletion, including the number of deleted, failed and estimated remaining blocks. 0 to disable.")
+	f.StringVar(&cfg.CleanupOrder, "compactor.cleanup-order", CleanupOrderScan, fmt.Sprintf("Order in which the blocks cleaner processes tenants within a run. The %s order shuffles tenants on each run, while the %s order processes first the tenants with the fewest blocks found by the previous run, so that large tenants don't delay the cleanup of the other ones. Supported values are: %s.", CleanupOrderRandom, CleanupOrderSmallestFirst, strings.Join(cleanupOrders, ", ")))
+	f.StringVar(&cfg.CleanupKillSwitchPath, "compactor.cleanup-kill-switch-path", defaultKillSwitchPath, "Path, in the bucket, of the object disabling the blocks cleanup while it exists. The blocks cleaner checks for it at the beginning of each run, skipping the run if found. This is an emergency brake which doesn't require to change the configuration: the cleanup is re-enabled once the object is removed. Empty to disable.")
+	f.BoolVar(&cfg.CleanupDeletedBytesFromObjects, "compactor.cleanup-deleted-bytes-from-objects", false, "If enabled, the blocks cleaner accounts the bytes reclaimed by the deletion of a block whose size is not tracked by its meta.json (eg. partial blocks) listing its objects before the deletion. This issues extra requests to the object storage.")
+	f.Float64Var(&cfg.CleanupIntervalJitter, "compactor.cleanup-interval-jitter", 0, "Max fraction (between 0 and 1, exclusive) of -compactor.cleanup-interval by which each interval between two blocks cleanup runs is randomly increased or decreased, so that compactors started at the same time don't hit the object storage at once. 0 to disable.")
+	f.DurationVar(&cfg.CleanupFailedRunsMaxBackoff, "compactor.cleanup-failed-runs-max-backoff", 0, "If greater than 0, the scheduled blocks cleanup runs are backed off after consecutive failed runs: the interval until the next run is increased by -compactor.cleanup-interval after the first failed run, doubling on each consecutive failed run up to this max. A successful run resets the interval. 0 to disable.")
+	f.DurationVar(&cfg.CleanupShutdownGracePeriod, "compactor.cleanup-shutdown-grace-period", 0, "Max time the tenants being cleaned up by the blocks cleaner when the compactor shuts down are allowed to finish, while no other tenant is started. 0 to cancel them immediately.")
+	f.BoolVar(&cfg.CleanupDeleteEmptyTenants, "compactor.cleanup-delete-empty-tenants", false, "Delete the residual objects, like the bucket index and the markers, left in the storage for a tenant not marked for deletion once no block is found for it. Tenants with no block are tracked by cortex_compactor_empty_tenants anyway.")
+	f.IntVar(&cfg.CleanupDeleteBatchSize, "compactor.cleanup-delete-batch-size", 0, "Max number of objects of a block deleted by the blocks cleaner with a single request, when the object storage client supports batch deletion. Clients not supporting it delete the objects one by one. 0 to always delete the objects one by one.")
+	f.BoolVar(&cfg.CleanupAllowDeletionOnEmptyActiveUsers, "compactor.cleanup-allow-deletion-on-empty-active-users", false, "Allow the blocks cleaner to delete the tenants marked for deletion even if no tenants discovery since the compactor started has found an active tenant. By default, the deletion is skipped as a safety guard against pointing to the wrong bucket.")
+	f.BoolVar(&cfg.CleanupVerifyMarkBeforeDelete, "compactor.cleanup-verify-mark-before-delete", false, "Re-read the deletion mark of each block marked for deletion, and of each partial block, right before deleting it, and skip the deletion if the mark is gone or has been replaced. This issues an extra request to the object storage for each deleted block.")
+	f.BoolVar(&cfg.CleanupPartialBlocks, "compactor.cleanup-partial-blocks", true, "Delete the partial blocks marked for deletion. If disabled, the partial blocks are never deleted by the blocks cleaner, so that they can be investigated manually, but they're still tracked by cortex_compactor_partial_blocks.")
+	f.BoolVar(&cfg.CleanupReportMalformedBlockDirs, "compactor.cleanup-report-malformed-block-dirs", false, "Debug option to log the directories found in the tenant locations by the blocks cleaner which look like blocks (their name is shaped as a ULID) but fail to be parsed as block, and track them by cortex_compactor_malformed_block_dirs. Such directories are otherwise silently ignored. This issues an extra listing of the location of each tenant not marked for deletion.")
+	f.BoolVar(&cfg.CleanupArchiveDeletedMeta, "compactor.cleanup-archive-deleted-meta", false, "If enabled, the blocks cleaner appends the meta.json of each block deleted because its tenant is marked for deletion to a gzipped JSON lines archive (deleted-blocks-meta.jsonl.gz) in the tenant location, before deleting the block. The archive is kept in the tenant location, so the tenant deletion mark is not deleted.")
+	f.IntVar(&cfg.CleanupMaxConcurrentBucketOps, "compactor.cleanup-max-concurrent-bucket-ops", 0, "Max number of object storage operations run concurrently by the blocks cleaner across all tenants, including the blocks meta sync of each tenant. 0 means no limit, in which case up to -compactor.cleanup-concurrency multiplied by -compactor.meta-sync-concurrency operations may be run concurrently.")
+	f.BoolVar(&cfg.CleanupPerTenantMetaFilesMetrics, "compactor.cleanup-per-tenant-meta-files-metrics", false, "If enabled, the blocks cleaner tracks cortex_compactor_meta_files_synced_total and cortex_compactor_meta_files_cache_hits_total by tenant. This increases the metrics cardinality by the number of tenants.")
+	f.IntVar(&cfg.CleanupMaxTenantsDeletedPerRun, "compactor.cleanup-max-tenants-deleted-per-run", 0, "Max number of tenants marked for deletion whose blocks are deleted by a single blocks cleanup run, the ones marked for deletion the earliest first. The deletion of the remaining ones is deferred to the next runs. 0 means unlimited.")
 
 	f.Var(&cfg.EnabledTenants, "compactor.enabled-tenants", "Comma separated list of tenants that can be compacted. If specified, only these tenants will be compacted by compactor, otherwise all tenants can be compacted. Subject to sharding.")
 	f.Var(&cfg.DisabledTenants, "compactor.disabled-tenants", "Comma separated list of tenants that cannot be compacted by this compactor. If specified, and compactor would normally pick given tenant for compaction (via -compactor.enabled-tenants or sharding), it will be ignored instead.")
@@ -97,15 +265,76 @@ func (cfg *Config) Validate() error {
 		}
 	}
 
+	if cfg.CleanupGovernanceFile != "" && utf8.RuneCountInString(cfg.CleanupGovernanceFileSeparator) != 1 {
+		return errInvalidGovernanceFileSep
+	}
+
+	if !util.StringsContain(orphanBlockPrefixPolicies, cfg.CleanupOrphanBlockPrefixPolicy) {
+		return errInvalidOrphanPolicy
+	}
+
+	if !util.StringsContain(inconsistentScanPolicies, cfg.CleanupInconsistentScanPolicy) {
+		return errInvalidInconsistentPolicy
+	}
+
+	if !util.StringsContain(blocksCleanerRoles, cfg.CleanupRole) {
+		return errInvalidCleanupRole
+	}
+
+	if !util.StringsContain(cleanupOrders, cfg.CleanupOrder) {
+		return errInvalidCleanupOrder
+	}
+
+	if cfg.CleanupIntervalJitter < 0 || cfg.CleanupIntervalJitter >= 1 {
+		return errInvalidCleanupJitter
+	}
+
+	if len(cfg.CleanupRetentionByLabel) > 0 && cfg.CleanupRetentionLabel == "" {
+		return errMissingRetentionLabel
+	}
+
+	for expr := range cfg.CleanupRetentionByLabel {
+		if _, err := regexp.Compile("^(?:" + expr + ")$"); err != nil {
+			return errors.Wrapf(err, "invalid compactor cleanup retention by label expression %q", expr)
+		}
+	}
+
+	if !util.StringsContain(deletionPlanFormats, cfg.CleanupDeletionPlanFormat) {
+		return errInvalidDeletionPlanFormat
+	}
+
+	if cfg.CleanupTenantDeletionTokenPath != "" && cfg.CleanupTenantDeletionTokenSecret.Value == "" && cfg.CleanupTenantDeletionTokenValidator == nil {
+		return errMissingDeletionTokenSecret
+	}
+
 	return nil
 }
 
+// ConfigProvider defines the per-tenant config provider for the Compactor.
+type ConfigProvider interface {
+	// CompactorBlocksDeletionDelay returns the deletion delay of blocks marked for deletion
+	// for a given user. Zero, or a negative value, means the default deletion delay should be used.
+	CompactorBlocksDeletionDelay(userID string) time.Duration
+
+	// CompactorBlocksCleanupEnabled returns whether the blocks cleanup is enabled for a given user.
+	CompactorBlocksCleanupEnabled(userID string) bool
+
+	// CompactorMaxBlocksPerTenant returns the max number of blocks a given user can retain.
+	// Zero means the default max number of blocks should be used.
+	CompactorMaxBlocksPerTenant(userID string) int
+
+	// CompactorBlocksRetentionPeriod returns the retention period of the blocks of a given user.
+	// Zero means unlimited.
+	CompactorBlocksRetentionPeriod(userID string) time.Duration
+}
+
 // Compactor is a multi-tenant TSDB blocks compactor based on Thanos.
 type Compactor struct {
 	services.Service
 
 	compactorCfg Config
 	storageCfg   cortex_tsdb.BlocksStorageConfig
+	cfgProvider  ConfigProvider
 	logger       log.Logger
 	parentLogger log.Logger
 	registerer   prometheus.Registerer
@@ -156,7 +385,7 @@ type Compactor struct {
 }
 
 // NewCompactor makes a new Compactor.
-func NewCompactor(compactorCfg Config, storageCfg cortex_tsdb.BlocksStorageConfig, logger log.Logger, registerer prometheus.Registerer) (*Compactor, error) {
+func NewCompactor(compactorCfg Config, storageCfg cortex_tsdb.BlocksStorageConfig, cfgProvider ConfigProvider, logger log.Logger, registerer prometheus.Registerer) (*Compactor, error) {
 	createDependencies := func(ctx context.Context) (objstore.Bucket, tsdb.Compactor, compact.Planner, error) {
 		bucketClient, err := bucket.NewClient(ctx, storageCfg.Bucket, "compactor", logger, registerer)
 		if err != nil {
@@ -172,7 +401,7 @@ func NewCompactor(compactorCfg Config, storageCfg cortex_tsdb.BlocksStorageConfi
 		return bucketClient, compactor, planner, nil
 	}
 
-	cortexCompactor, err := newCompactor(compactorCfg, storageCfg, logger, registerer, createDependencies)
+	cortexCompactor, err := newCompactor(compactorCfg, storageCfg, cfgProvider, logger, registerer, createDependencies)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create Cortex blocks compactor")
 	}
@@ -183,6 +412,7 @@ func NewCompactor(compactorCfg Config, storageCfg cortex_tsdb.BlocksStorageConfi
 func newCompactor(
 	compactorCfg Config,
 	storageCfg cortex_tsdb.BlocksStorageConfig,
+	cfgProvider ConfigProvider,
 	logger log.Logger,
 	registerer prometheus.Registerer,
 	createDependencies func(ctx context.Context) (objstore.Bucket, tsdb.Compactor, compact.Planner, error),
@@ -190,6 +420,7 @@ func newCompactor(
 	c := &Compactor{
 		compactorCfg:       compactorCfg,
 		storageCfg:         storageCfg,
+		cfgProvider:        cfgProvider,
 		parentLogger:       logger,
 		logger:             log.With(logger, "component", "compactor"),
 		registerer:         registerer,
@@ -330,18 +561,110 @@ func (c *Compactor) starting(ctx context.Context) error {
 		}
 	}
 
+	tokenValidator := c.compactorCfg.CleanupTenantDeletionTokenValidator
+	if tokenValidator == nil {
+		tokenValidator = NewHMACTenantDeletionTokenValidator(c.compactorCfg.CleanupTenantDeletionTokenSecret.Value)
+	}
+
+	deletionAuditor := c.compactorCfg.CleanupDeletionAuditor
+	if deletionAuditor == nil && c.compactorCfg.CleanupDeletionAuditPath != "" {
+		deletionAuditor = NewBucketDeletionAuditor(c.bucketClient, c.compactorCfg.CleanupDeletionAuditPath, c.parentLogger)
+	}
+
 	// Create the blocks cleaner (service).
-	c.blocksCleaner = NewBlocksCleaner(BlocksCleanerConfig{
-		DataDir:             c.compactorCfg.DataDir,
-		MetaSyncConcurrency: c.compactorCfg.MetaSyncConcurrency,
-		DeletionDelay:       c.compactorCfg.DeletionDelay,
-		CleanupInterval:     util.DurationWithJitter(c.compactorCfg.CompactionInterval, 0.1),
-		CleanupConcurrency:  c.compactorCfg.CleanupConcurrency,
-	}, c.bucketClient, c.usersScanner, c.parentLogger, c.registerer)
+	cleanerCfg := BlocksCleanerConfig{
+		DataDir:                             c.compactorCfg.DataDir,
+		MetaSyncConcurrency:                 c.compactorCfg.MetaSyncConcurrency,
+		DeletionDelay:                       c.compactorCfg.DeletionDelay,
+		CleanupInterval:                     util.DurationWithJitter(c.compactorCfg.CompactionInterval, 0.1),
+		CleanupConcurrency:                  c.compactorCfg.CleanupConcurrency,
+		ReconciliationMode:                  c.compactorCfg.CleanupReconciliationMode,
+		ReadOnly:                            c.compactorCfg.CleanupReadOnly,
+		FailStartOnInitialCleanupError:      c.compactorCfg.CleanupFailStartOnInitialError,
+		AnnotateRetainedBlocks:              c.compactorCfg.CleanupAnnotateRetainedBlocks,
+		MaxTotalBlocksDeletedPerRun:         c.compactorCfg.CleanupMaxBlocksDeletedPerRun,
+		VerifyConvergence:                   c.compactorCfg.CleanupVerifyConvergence,
+		DeleteConcurrency:                   c.compactorCfg.CleanupTenantDeleteConcurrency,
+		ExportDeletionMarks:                 c.compactorCfg.CleanupExportDeletionMarks,
+		ExportDeletionMarksDetails:          c.compactorCfg.CleanupExportDeletionMarksDetails,
+		MinPartialBlockLifetime:             c.compactorCfg.CleanupMinPartialBlockLifetime,
+		MaxConcurrentDeletes:                c.compactorCfg.CleanupMaxConcurrentDeletes,
+		SuspiciousEmptyFetchMinBlocks:       c.compactorCfg.CleanupSuspiciousEmptyFetchMinBlocks,
+		DeletionClassificationStabilization: c.compactorCfg.CleanupDeletionClassificationStabilization,
+		GovernanceFile:                      c.compactorCfg.CleanupGovernanceFile,
+		GovernanceFileSeparator:             c.compactorCfg.CleanupGovernanceFileSeparator,
+		GovernanceFileHasHeader:             c.compactorCfg.CleanupGovernanceFileHasHeader,
+		TenantDeletionTokenPath:             c.compactorCfg.CleanupTenantDeletionTokenPath,
+		TenantDeletionTokenValidator:        tokenValidator,
+		QueryActivityProvider:               c.compactorCfg.CleanupQueryActivityProvider,
+		OnTenantCleaned:                     c.compactorCfg.CleanupOnTenantCleaned,
+		BlockDeleteFilter:                   c.compactorCfg.CleanupBlockDeleteFilter,
+		TenantShardFunc:                     c.compactorCfg.CleanupTenantShardFunc,
+		OrphanBlockPrefixPolicy:             c.compactorCfg.CleanupOrphanBlockPrefixPolicy,
+		Role:                                c.compactorCfg.CleanupRole,
+		MarkingConcurrency:                  c.compactorCfg.CleanupMarkingConcurrency,
+		SuccessRatioNaNWithoutDeletions:     c.compactorCfg.CleanupSuccessRatioNaNWithoutDeletions,
+		CorruptBlocksCheckEnabled:           c.compactorCfg.CleanupCorruptBlocksCheckEnabled,
+		CorruptBlocksMarkingGracePeriod:     c.compactorCfg.CleanupCorruptBlocksMarkingGracePeriod,
+		DeletionPlanApprovalPath:            c.compactorCfg.CleanupDeletionPlanApprovalPath,
+		DeletionPlanFormat:                  c.compactorCfg.CleanupDeletionPlanFormat,
+		DeletionPlanPath:                    c.compactorCfg.CleanupDeletionPlanPath,
+		PerDeletionTimeout:                  c.compactorCfg.CleanupPerDeletionTimeout,
+		PerTenantTimeout:                    c.compactorCfg.CleanupPerTenantTimeout,
+		RetentionByLabel:                    c.compactorCfg.CleanupRetentionByLabel,
+		RetentionLabel:                      c.compactorCfg.CleanupRetentionLabel,
+		InconsistentScanPolicy:              c.compactorCfg.CleanupInconsistentScanPolicy,
+		MetaCacheTTL:                        c.compactorCfg.CleanupMetaCacheTTL,
+		MetaCacheSize:                       c.compactorCfg.CleanupMetaCacheSize,
+		MetaCacheDir:                        c.compactorCfg.CleanupMetaCacheDir,
+		MaxBlocksMinRetention:               c.compactorCfg.CleanupMaxBlocksMinRetention,
+		MaxBlocksPerTenant:                  c.compactorCfg.CleanupMaxBlocksPerTenant,
+		DeleteRetryMinBackoff:               c.compactorCfg.CleanupDeleteRetryMinBackoff,
+		DeleteRetryMaxBackoff:               c.compactorCfg.CleanupDeleteRetryMaxBackoff,
+		DeleteRetries:                       c.compactorCfg.CleanupDeleteRetries,
+		DryRun:                              c.compactorCfg.CleanupDryRun,
+		EnabledTenants:                      c.compactorCfg.CleanupEnabledTenants,
+		DisabledTenants:                     c.compactorCfg.CleanupDisabledTenants,
+		WriteBucketIndex:                    c.compactorCfg.CleanupWriteBucketIndex,
+		PartialBlockDeletionDelay:           c.compactorCfg.CleanupPartialBlockDeletionDelay,
+		DeletionAuditor:                     deletionAuditor,
+		DeletionAuditPath:                   c.compactorCfg.CleanupDeletionAuditPath,
+		SkipUnchangedTenants:                c.compactorCfg.CleanupSkipUnchangedTenants,
+		OrphanObjectsMinAge:                 c.compactorCfg.CleanupOrphanObjectsMinAge,
+		DeleteRateLimit:                     c.compactorCfg.CleanupDeleteRateLimit,
+		TenantDeletionDelay:                 c.compactorCfg.CleanupTenantDeletionDelay,
+		TenantDeletionMarkDelay:             c.compactorCfg.CleanupTenantDeletionMarkDelay,
+		TenantDeletionProgressInterval:      c.compactorCfg.CleanupTenantDeletionProgressInterval,
+		CleanupOrder:                        c.compactorCfg.CleanupOrder,
+		KillSwitchPath:                      c.compactorCfg.CleanupKillSwitchPath,
+		DeletedBytesFromObjects:             c.compactorCfg.CleanupDeletedBytesFromObjects,
+		CleanupIntervalJitter:               c.compactorCfg.CleanupIntervalJitter,
+		FailedRunsMaxBackoff:                c.compactorCfg.CleanupFailedRunsMaxBackoff,
+		ShutdownGracePeriod:                 c.compactorCfg.CleanupShutdownGracePeriod,
+		DeleteEmptyTenants:                  c.compactorCfg.CleanupDeleteEmptyTenants,
+		DeleteBatchSize:                     c.compactorCfg.CleanupDeleteBatchSize,
+		AllowDeletionOnEmptyActiveUsers:     c.compactorCfg.CleanupAllowDeletionOnEmptyActiveUsers,
+		VerifyMarkBeforeDelete:              c.compactorCfg.CleanupVerifyMarkBeforeDelete,
+		DisablePartialBlocksCleanup:         !c.compactorCfg.CleanupPartialBlocks,
+		ReportMalformedBlockDirs:            c.compactorCfg.CleanupReportMalformedBlockDirs,
+		ArchiveDeletedMeta:                  c.compactorCfg.CleanupArchiveDeletedMeta,
+		MaxConcurrentBucketOps:              c.compactorCfg.CleanupMaxConcurrentBucketOps,
+		PerTenantMetaFilesMetrics:           c.compactorCfg.CleanupPerTenantMetaFilesMetrics,
+		MaxTenantsDeletedPerRun:             c.compactorCfg.CleanupMaxTenantsDeletedPerRun,
+	}
+	if err := cleanerCfg.Validate(); err != nil {
+		if c.ringSubservices != nil {
+			c.ringSubservices.StopAsync()
+		}
+		return errors.Wrap(err, "invalid blocks cleaner config")
+	}
+	c.blocksCleaner = NewBlocksCleaner(cleanerCfg, c.bucketClient, c.usersScanner, c.cfgProvider, c.parentLogger, c.registerer)
 
 	// Ensure an initial cleanup occurred before starting the compactor.
 	if err := services.StartAndAwaitRunning(ctx, c.blocksCleaner); err != nil {
-		c.ringSubservices.StopAsync()
+		if c.ringSubservices != nil {
+			c.ringSubservices.StopAsync()
+		}
 		return errors.Wrap(err, "failed to start the blocks cleaner")
 	}
 
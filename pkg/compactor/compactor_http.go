@@ -3,6 +3,7 @@ package compactor
 import (
 	"html/template"
 	"net/http"
+	"strconv"
 
 	"github.com/go-kit/kit/log/level"
 
@@ -51,3 +52,64 @@ func (c *Compactor) RingHandler(w http.ResponseWriter, req *http.Request) {
 
 	c.ring.ServeHTTP(w, req)
 }
+
+// CleanupHandler triggers an on-demand blocks cleanup run, without waiting for the next cleanup interval.
+// If the refetch parameter is true, the metas cached by the blocks cleaner are cleared before the run.
+func (c *Compactor) CleanupHandler(w http.ResponseWriter, req *http.Request) {
+	if c.State() != services.Running {
+		http.Error(w, "Compactor is not running yet.", http.StatusServiceUnavailable)
+		return
+	}
+
+	refetch := false
+	if value := req.FormValue("refetch"); value != "" {
+		var err error
+		if refetch, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid refetch parameter.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	trigger := c.blocksCleaner.TriggerCleanup
+	if refetch {
+		trigger = c.blocksCleaner.TriggerRefetchCleanup
+	}
+
+	switch err := trigger(); err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errCleanupInProgress, errCleanupPaused:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errCleanupNotRunning:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// TenantsMarkedForDeletionHandler serves, as JSON, the tenants marked for deletion discovered by the most
+// recent blocks cleanup run.
+func (c *Compactor) TenantsMarkedForDeletionHandler(w http.ResponseWriter, _ *http.Request) {
+	if c.State() != services.Running {
+		http.Error(w, "Compactor is not running yet.", http.StatusServiceUnavailable)
+		return
+	}
+
+	tenants, ok := c.blocksCleaner.TenantsMarkedForDeletion()
+	if !ok {
+		http.Error(w, "No blocks cleanup run has discovered the tenants yet.", http.StatusServiceUnavailable)
+		return
+	}
+
+	util.WriteJSONResponse(w, tenants)
+}
+
+// CleanerStatusHandler serves the status of the last blocks cleanup of each tenant.
+func (c *Compactor) CleanerStatusHandler(w http.ResponseWriter, req *http.Request) {
+	if c.State() != services.Running {
+		http.Error(w, "Compactor is not running yet.", http.StatusServiceUnavailable)
+		return
+	}
+
+	c.blocksCleaner.StatusHandler(w, req)
+}
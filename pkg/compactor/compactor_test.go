@@ -103,6 +103,68 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			expected: errors.Errorf(errInvalidBlockRanges, 30*time.Hour, 24*time.Hour).Error(),
 		},
+		"should fail with a multi-character governance file separator": {
+			setup: func(cfg *Config) {
+				cfg.CleanupGovernanceFile = "governance/expired-tenants.csv"
+				cfg.CleanupGovernanceFileSeparator = ";;"
+			},
+			expected: errInvalidGovernanceFileSep.Error(),
+		},
+		"should fail with a tenant deletion token path but no secret": {
+			setup: func(cfg *Config) {
+				cfg.CleanupTenantDeletionTokenPath = "control-plane/tenant-deletion-token.json"
+			},
+			expected: errMissingDeletionTokenSecret.Error(),
+		},
+		"should fail with an unsupported orphan block prefix policy": {
+			setup: func(cfg *Config) {
+				cfg.CleanupOrphanBlockPrefixPolicy = "unknown"
+			},
+			expected: errInvalidOrphanPolicy.Error(),
+		},
+		"should fail with an unsupported inconsistent scan policy": {
+			setup: func(cfg *Config) {
+				cfg.CleanupInconsistentScanPolicy = "ignore"
+			},
+			expected: errInvalidInconsistentPolicy.Error(),
+		},
+		"should fail with an unsupported cleanup role": {
+			setup: func(cfg *Config) {
+				cfg.CleanupRole = "leader"
+			},
+			expected: errInvalidCleanupRole.Error(),
+		},
+		"should fail with an unsupported cleanup order": {
+			setup: func(cfg *Config) {
+				cfg.CleanupOrder = "largest-first"
+			},
+			expected: errInvalidCleanupOrder.Error(),
+		},
+		"should fail with a cleanup interval jitter greater than or equal to 1": {
+			setup: func(cfg *Config) {
+				cfg.CleanupIntervalJitter = 1
+			},
+			expected: errInvalidCleanupJitter.Error(),
+		},
+		"should fail with an unsupported deletion plan format": {
+			setup: func(cfg *Config) {
+				cfg.CleanupDeletionPlanFormat = "yaml"
+			},
+			expected: errInvalidDeletionPlanFormat.Error(),
+		},
+		"should fail with the retention by label set without the retention label": {
+			setup: func(cfg *Config) {
+				cfg.CleanupRetentionByLabel = map[string]time.Duration{"debug": time.Hour}
+			},
+			expected: errMissingRetentionLabel.Error(),
+		},
+		"should fail with an invalid retention by label expression": {
+			setup: func(cfg *Config) {
+				cfg.CleanupRetentionLabel = "__stream__"
+				cfg.CleanupRetentionByLabel = map[string]time.Duration{"[debug": time.Hour}
+			},
+			expected: `invalid compactor cleanup retention by label expression "[debug": error parsing regexp: missing closing ]: ` + "`[debug)$`",
+		},
 	}
 
 	for testName, testData := range tests {
@@ -125,6 +187,7 @@ func TestCompactor_ShouldDoNothingOnNoUserBlocks(t *testing.T) {
 
 	// No user blocks stored in the bucket.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", []string{}, nil)
 
 	c, _, _, logs, registry, cleanup := prepare(t, prepareConfig(), bucketClient)
@@ -140,6 +203,7 @@ func TestCompactor_ShouldDoNothingOnNoUserBlocks(t *testing.T) {
 
 	assert.Equal(t, []string{
 		`level=info component=cleaner msg="started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
+		`level=debug component=cleaner msg="cleaning up tenants" tenants=0 configured_concurrency=20 effective_concurrency=0`,
 		`level=info component=cleaner msg="successfully completed hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
 		`level=info component=compactor msg="discovering users from bucket"`,
 		`level=info component=compactor msg="discovered users from bucket" users=0`,
@@ -268,6 +332,7 @@ func TestCompactor_ShouldRetryCompactionOnFailureWhileDiscoveringUsersFromBucket
 
 	// Fail to iterate over the bucket while discovering users.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", nil, errors.New("failed to iterate the bucket"))
 
 	c, _, _, logs, registry, cleanup := prepare(t, prepareConfig(), bucketClient)
@@ -418,6 +483,7 @@ func TestCompactor_ShouldIterateOverUsersAndRunCompaction(t *testing.T) {
 
 	// Mock the bucket to contain two users, each one with one block.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", []string{"user-1", "user-2"}, nil)
 	bucketClient.MockExists(path.Join("user-1", cortex_tsdb.TenantDeletionMarkPath), false, nil)
 	bucketClient.MockExists(path.Join("user-2", cortex_tsdb.TenantDeletionMarkPath), false, nil)
@@ -451,6 +517,7 @@ func TestCompactor_ShouldIterateOverUsersAndRunCompaction(t *testing.T) {
 
 	assert.ElementsMatch(t, []string{
 		`level=info component=cleaner msg="started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
+		`level=debug component=cleaner msg="cleaning up tenants" tenants=2 configured_concurrency=20 effective_concurrency=2`,
 		`level=info component=cleaner org_id=user-1 msg="started cleaning of blocks marked for deletion"`,
 		`level=info component=cleaner org_id=user-1 msg="cleaning of blocks marked for deletion done"`,
 		`level=info component=cleaner org_id=user-2 msg="started cleaning of blocks marked for deletion"`,
@@ -526,6 +593,7 @@ func TestCompactor_ShouldNotCompactBlocksMarkedForDeletion(t *testing.T) {
 
 	// Mock the bucket to contain two users, each one with one block.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", []string{"user-1"}, nil)
 	bucketClient.MockIter("user-1/", []string{"user-1/01DTVP434PA9VFXSW2JKB3392D", "user-1/01DTW0ZCPDDNV4BV83Q2SV4QAZ"}, nil)
 	bucketClient.MockExists(path.Join("user-1", cortex_tsdb.TenantDeletionMarkPath), false, nil)
@@ -564,11 +632,15 @@ func TestCompactor_ShouldNotCompactBlocksMarkedForDeletion(t *testing.T) {
 
 	assert.ElementsMatch(t, []string{
 		`level=info component=cleaner msg="started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
+		`level=debug component=cleaner msg="cleaning up tenants" tenants=1 configured_concurrency=20 effective_concurrency=1`,
+		`level=debug component=cleaner org_id=user-1 msg="block excluded while fetching blocks" block=01DTVP434PA9VFXSW2JKB3392D reason=marked-for-deletion`,
+		`level=debug component=cleaner org_id=user-1 msg="block excluded while fetching blocks" block=01DTW0ZCPDDNV4BV83Q2SV4QAZ reason=marked-for-deletion`,
 		`level=info component=cleaner org_id=user-1 msg="started cleaning of blocks marked for deletion"`,
 		`level=debug component=cleaner org_id=user-1 msg="deleted file" file=01DTW0ZCPDDNV4BV83Q2SV4QAZ/meta.json bucket=mock`,
 		`level=debug component=cleaner org_id=user-1 msg="deleted file" file=01DTW0ZCPDDNV4BV83Q2SV4QAZ/deletion-mark.json bucket=mock`,
 		`level=info component=cleaner org_id=user-1 msg="deleted block marked for deletion" block=01DTW0ZCPDDNV4BV83Q2SV4QAZ`,
 		`level=info component=cleaner org_id=user-1 msg="cleaning of blocks marked for deletion done"`,
+		`level=info component=cleaner msg="blocks cleanup run summary" tenant_delete_deleted=0 tenant_delete_failed=0 marked_delete_deleted=1 marked_delete_failed=0 partial_delete_deleted=0 partial_delete_failed=0`,
 		`level=info component=cleaner msg="successfully completed hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
 		`level=info component=compactor msg="discovering users from bucket"`,
 		`level=info component=compactor msg="discovered users from bucket" users=1`,
@@ -631,9 +703,11 @@ func TestCompactor_ShouldNotCompactBlocksForUsersMarkedForCompaction(t *testing.
 
 	cfg := prepareConfig()
 	cfg.DeletionDelay = 10 * time.Minute // Delete block after 10 minutes
+	cfg.CleanupAllowDeletionOnEmptyActiveUsers = true
 
 	// Mock the bucket to contain two users, each one with one block.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", []string{"user-1"}, nil)
 	bucketClient.MockIter("user-1/", []string{"user-1/01DTVP434PA9VFXSW2JKB3392D"}, nil)
 	bucketClient.MockExists(path.Join("user-1", cortex_tsdb.TenantDeletionMarkPath), true, nil)
@@ -668,11 +742,14 @@ func TestCompactor_ShouldNotCompactBlocksForUsersMarkedForCompaction(t *testing.
 
 	assert.ElementsMatch(t, []string{
 		`level=info component=cleaner msg="started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
-		`level=info component=cleaner org_id=user-1 msg="deleting blocks for user marked for deletion"`,
+		`level=warn component=cleaner msg="proceeding with blocks cleanup even if the tenants discovery found no active tenant but some tenants marked for deletion" deleted=1`,
+		`level=debug component=cleaner msg="cleaning up tenants" tenants=1 configured_concurrency=20 effective_concurrency=1`,
+		`level=info component=cleaner org_id=user-1 msg="deleting blocks for user marked for deletion" reason=tenant-deletion-mark`,
 		`level=debug component=cleaner org_id=user-1 msg="deleted file" file=01DTVP434PA9VFXSW2JKB3392D/meta.json bucket=mock`,
 		`level=debug component=cleaner org_id=user-1 msg="deleted file" file=01DTVP434PA9VFXSW2JKB3392D/index bucket=mock`,
 		`level=info component=cleaner org_id=user-1 msg="deleted block" block=01DTVP434PA9VFXSW2JKB3392D`,
 		`level=info component=cleaner org_id=user-1 msg="finished deleting blocks for user marked for deletion" deletedBlocks=1`,
+		`level=info component=cleaner msg="blocks cleanup run summary" tenant_delete_deleted=1 tenant_delete_failed=0 marked_delete_deleted=0 marked_delete_failed=0 partial_delete_deleted=0 partial_delete_failed=0`,
 		`level=info component=cleaner msg="successfully completed hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
 		`level=info component=compactor msg="discovering users from bucket"`,
 		`level=info component=compactor msg="discovered users from bucket" users=1`,
@@ -730,6 +807,7 @@ func TestCompactor_ShouldCompactAllUsersOnShardingEnabledButOnlyOneInstanceRunni
 
 	// Mock the bucket to contain two users, each one with one block.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", []string{"user-1", "user-2"}, nil)
 	bucketClient.MockExists(path.Join("user-1", cortex_tsdb.TenantDeletionMarkPath), false, nil)
 	bucketClient.MockExists(path.Join("user-2", cortex_tsdb.TenantDeletionMarkPath), false, nil)
@@ -771,6 +849,7 @@ func TestCompactor_ShouldCompactAllUsersOnShardingEnabledButOnlyOneInstanceRunni
 		`level=info component=compactor msg="waiting until compactor is ACTIVE in the ring"`,
 		`level=info component=compactor msg="compactor is ACTIVE in the ring"`,
 		`level=info component=cleaner msg="started hard deletion of blocks marked for deletion, and blocks for tenants marked for deletion"`,
+		`level=debug component=cleaner msg="cleaning up tenants" tenants=2 configured_concurrency=20 effective_concurrency=2`,
 		`level=info component=cleaner org_id=user-1 msg="started cleaning of blocks marked for deletion"`,
 		`level=info component=cleaner org_id=user-1 msg="cleaning of blocks marked for deletion done"`,
 		`level=info component=cleaner org_id=user-2 msg="started cleaning of blocks marked for deletion"`,
@@ -806,6 +885,7 @@ func TestCompactor_ShouldCompactOnlyUsersOwnedByTheInstanceOnShardingEnabledAndM
 
 	// Mock the bucket to contain all users, each one with one block.
 	bucketClient := &bucket.ClientMock{}
+	bucketClient.MockExists(defaultKillSwitchPath, false, nil)
 	bucketClient.MockIter("", userIDs, nil)
 	for _, userID := range userIDs {
 		bucketClient.MockIter(userID+"/", []string{userID + "/01DTVP434PA9VFXSW2JKB3392D"}, nil)
@@ -1026,7 +1106,7 @@ func prepare(t *testing.T, compactorCfg Config, bucketClient objstore.Bucket) (*
 	logger := log.NewLogfmtLogger(logs)
 	registry := prometheus.NewRegistry()
 
-	c, err := newCompactor(compactorCfg, storageCfg, logger, registry, func(ctx context.Context) (objstore.Bucket, tsdb.Compactor, compact.Planner, error) {
+	c, err := newCompactor(compactorCfg, storageCfg, newMockConfigProvider(), logger, registry, func(ctx context.Context) (objstore.Bucket, tsdb.Compactor, compact.Planner, error) {
 		return bucketClient, tsdbCompactor, tsdbPlanner, nil
 	})
 	require.NoError(t, err)
@@ -1138,3 +1218,35 @@ func TestAllowedUser(t *testing.T) {
 		})
 	}
 }
+
+type mockConfigProvider struct {
+	deletionDelays  map[string]time.Duration
+	cleanupDisabled map[string]bool
+	maxBlocks       map[string]int
+	retention       map[string]time.Duration
+}
+
+func newMockConfigProvider() *mockConfigProvider {
+	return &mockConfigProvider{
+		deletionDelays:  map[string]time.Duration{},
+		cleanupDisabled: map[string]bool{},
+		maxBlocks:       map[string]int{},
+		retention:       map[string]time.Duration{},
+	}
+}
+
+func (m *mockConfigProvider) CompactorBlocksDeletionDelay(userID string) time.Duration {
+	return m.deletionDelays[userID]
+}
+
+func (m *mockConfigProvider) CompactorBlocksCleanupEnabled(userID string) bool {
+	return !m.cleanupDisabled[userID]
+}
+
+func (m *mockConfigProvider) CompactorMaxBlocksPerTenant(userID string) int {
+	return m.maxBlocks[userID]
+}
+
+func (m *mockConfigProvider) CompactorBlocksRetentionPeriod(userID string) time.Duration {
+	return m.retention[userID]
+}
@@ -0,0 +1,29 @@
+package bucket
+
+import (
+	"context"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// BatchDeleter is implemented by the bucket clients able to delete multiple objects with a single request.
+type BatchDeleter interface {
+	// DeleteBatch removes the objects with the given names. Objects not found are not an error.
+	DeleteBatch(ctx context.Context, names []string) error
+}
+
+// DeleteBatch removes the objects with the given names with a single request if the bucket
+// is a BatchDeleter, or one by one otherwise. Objects not found are not an error.
+func DeleteBatch(ctx context.Context, bkt objstore.Bucket, names []string) error {
+	if deleter, ok := bkt.(BatchDeleter); ok {
+		return deleter.DeleteBatch(ctx, names)
+	}
+
+	for _, name := range names {
+		if err := bkt.Delete(ctx, name); err != nil && !bkt.IsObjNotFoundErr(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+func TestDeleteBatch(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should delete the objects one by one if the bucket doesn't support batch deletion", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		require.NoError(t, bkt.Upload(ctx, "a", bytes.NewReader([]byte("a"))))
+		require.NoError(t, bkt.Upload(ctx, "b", bytes.NewReader([]byte("b"))))
+		require.NoError(t, bkt.Upload(ctx, "c", bytes.NewReader([]byte("c"))))
+
+		require.NoError(t, DeleteBatch(ctx, bkt, []string{"a", "b", "missing"}))
+		assert.Equal(t, []string{"c"}, objectNames(bkt))
+	})
+
+	t.Run("should delete the objects with a single request if the bucket supports batch deletion", func(t *testing.T) {
+		bkt := &mockBatchDeleterBucket{Bucket: objstore.NewInMemBucket()}
+		require.NoError(t, bkt.Upload(ctx, "a", bytes.NewReader([]byte("a"))))
+		require.NoError(t, bkt.Upload(ctx, "b", bytes.NewReader([]byte("b"))))
+		require.NoError(t, bkt.Upload(ctx, "c", bytes.NewReader([]byte("c"))))
+
+		require.NoError(t, DeleteBatch(ctx, bkt, []string{"a", "b", "missing"}))
+		assert.Equal(t, [][]string{{"a", "b", "missing"}}, bkt.batches)
+		assert.Equal(t, []string{"c"}, objectNames(bkt.Bucket.(*objstore.InMemBucket)))
+	})
+}
+
+func objectNames(bkt *objstore.InMemBucket) []string {
+	var names []string
+	for name := range bkt.Objects() {
+		names = append(names, name)
+	}
+	return names
+}
+
+type mockBatchDeleterBucket struct {
+	objstore.Bucket
+	batches [][]string
+}
+
+func (b *mockBatchDeleterBucket) DeleteBatch(ctx context.Context, names []string) error {
+	b.batches = append(b.batches, names)
+
+	for _, name := range names {
+		if err := b.Bucket.Delete(ctx, name); err != nil && !b.Bucket.IsObjNotFoundErr(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -48,6 +48,17 @@ func (b *UserBucketClient) Delete(ctx context.Context, name string) error {
 	return b.bucket.Delete(ctx, b.fullName(name))
 }
 
+// DeleteBatch implements BatchDeleter, deleting the objects with a single request if the
+// wrapped bucket supports it.
+func (b *UserBucketClient) DeleteBatch(ctx context.Context, names []string) error {
+	fullNames := make([]string, 0, len(names))
+	for _, name := range names {
+		fullNames = append(fullNames, b.fullName(name))
+	}
+
+	return DeleteBatch(ctx, b.bucket, fullNames)
+}
+
 // Name returns the bucket name for the provider.
 func (b *UserBucketClient) Name() string { return b.bucket.Name() }
 
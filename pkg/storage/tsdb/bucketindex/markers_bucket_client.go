@@ -11,6 +11,8 @@ import (
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
 )
 
 // globalMarkersBucket is a bucket client which stores markers (eg. block deletion marks) in a per-tenant
@@ -70,6 +72,31 @@ func (b *globalMarkersBucket) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
+// DeleteBatch implements bucket.BatchDeleter. The block deletion marks are deleted last and one by
+// one, in order to delete them in the global markers location too.
+func (b *globalMarkersBucket) DeleteBatch(ctx context.Context, names []string) error {
+	var others, marks []string
+	for _, name := range names {
+		if _, ok := b.isBlockDeletionMark(name); ok {
+			marks = append(marks, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+
+	if err := bucket.DeleteBatch(ctx, b.parent, others); err != nil {
+		return err
+	}
+
+	for _, name := range marks {
+		if err := b.Delete(ctx, name); err != nil && !b.parent.IsObjNotFoundErr(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Name implements objstore.Bucket.
 func (b *globalMarkersBucket) Name() string {
 	return b.parent.Name()
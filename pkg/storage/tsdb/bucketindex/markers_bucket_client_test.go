@@ -2,12 +2,16 @@ package bucketindex
 
 import (
 	"context"
+	"path"
 	"strings"
 	"testing"
 
 	"github.com/oklog/ulid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
 )
 
 func TestGlobalMarkersBucket_Delete_ShouldSucceedIfDeletionMarkDoesNotExistInTheBlockButExistInTheGlobalLocation(t *testing.T) {
@@ -35,6 +39,38 @@ func TestGlobalMarkersBucket_Delete_ShouldSucceedIfDeletionMarkDoesNotExistInThe
 	require.False(t, ok)
 }
 
+func TestGlobalMarkersBucket_DeleteBatch_ShouldDeleteDeletionMarksInTheGlobalLocationToo(t *testing.T) {
+	bkt, cleanup := prepareFilesystemBucket(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bkt = BucketWithGlobalMarkers(bkt)
+
+	// Create a mocked block with a deletion mark, which is uploaded in the global location too.
+	blockID := ulid.MustNew(1, nil)
+	names := []string{
+		path.Join(blockID.String(), "index"),
+		path.Join(blockID.String(), "chunks", "000001"),
+		path.Join(blockID.String(), metadata.DeletionMarkFilename),
+	}
+	for _, name := range names {
+		require.NoError(t, bkt.Upload(ctx, name, strings.NewReader("{}")))
+	}
+
+	ok, err := bkt.Exists(ctx, BlockDeletionMarkFilepath(blockID))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Objects not found are not an error.
+	require.NoError(t, bkt.(bucket.BatchDeleter).DeleteBatch(ctx, append(names, path.Join(blockID.String(), "missing"))))
+
+	for _, name := range append(names, BlockDeletionMarkFilepath(blockID)) {
+		ok, err := bkt.Exists(ctx, name)
+		require.NoError(t, err)
+		assert.False(t, ok, name)
+	}
+}
+
 func TestGlobalMarkersBucket_isBlockDeletionMark(t *testing.T) {
 	block1 := ulid.MustNew(1, nil)
 
@@ -50,10 +50,34 @@ func (w *Writer) WriteIndex(ctx context.Context, old *Index) (*Index, error) {
 		return nil, errors.Wrap(err, "generate bucket index")
 	}
 
+	if err := writeIndex(ctx, w.bkt, idx); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// WriteIndex writes the input bucket index of the tenant to the storage.
+func WriteIndex(ctx context.Context, bkt objstore.Bucket, userID string, idx *Index) error {
+	return writeIndex(ctx, bucket.NewUserBucketClient(userID, bkt), idx)
+}
+
+// DeleteIndex deletes the bucket index of the tenant from the storage. No error is returned
+// if the index doesn't exist.
+func DeleteIndex(ctx context.Context, bkt objstore.Bucket, userID string) error {
+	userBkt := bucket.NewUserBucketClient(userID, bkt)
+
+	if err := userBkt.Delete(ctx, IndexCompressedFilename); err != nil && !userBkt.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete bucket index")
+	}
+	return nil
+}
+
+func writeIndex(ctx context.Context, userBkt objstore.Bucket, idx *Index) error {
 	// Marshal the index.
 	content, err := json.Marshal(idx)
 	if err != nil {
-		return nil, errors.Wrap(err, "marshal bucket index")
+		return errors.Wrap(err, "marshal bucket index")
 	}
 
 	// Compress it.
@@ -62,18 +86,18 @@ func (w *Writer) WriteIndex(ctx context.Context, old *Index) (*Index, error) {
 	gzip.Name = IndexFilename
 
 	if _, err := gzip.Write(content); err != nil {
-		return nil, errors.Wrap(err, "gzip bucket index")
+		return errors.Wrap(err, "gzip bucket index")
 	}
 	if err := gzip.Close(); err != nil {
-		return nil, errors.Wrap(err, "close gzip bucket index")
+		return errors.Wrap(err, "close gzip bucket index")
 	}
 
 	// Upload the index to the storage.
-	if err := w.bkt.Upload(ctx, IndexCompressedFilename, &gzipContent); err != nil {
-		return nil, errors.Wrap(err, "upload bucket index")
+	if err := userBkt.Upload(ctx, IndexCompressedFilename, &gzipContent); err != nil {
+		return errors.Wrap(err, "upload bucket index")
 	}
 
-	return idx, nil
+	return nil
 }
 
 // GenerateIndex generates the bucket index and returns it, without storing it to the storage.
@@ -181,6 +181,34 @@ func TestWriter_GenerateIndex_NoTenantInTheBucket(t *testing.T) {
 	}
 }
 
+func TestWriteIndex_ShouldWriteAndDeleteTheInputIndex(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, cleanup := prepareFilesystemBucket(t)
+	defer cleanup()
+
+	// Deleting a non existing index is not an error.
+	require.NoError(t, DeleteIndex(ctx, bkt, userID))
+
+	expected := &Index{
+		Version:            IndexVersion1,
+		Blocks:             Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, UploadedAt: 30}},
+		BlockDeletionMarks: []*BlockDeletionMark{{ID: ulid.MustNew(1, nil), DeletionTime: 40}},
+		UpdatedAt:          50,
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, expected))
+
+	actual, err := ReadIndex(ctx, bkt, userID, log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	require.NoError(t, DeleteIndex(ctx, bkt, userID))
+
+	_, err = ReadIndex(ctx, bkt, userID, log.NewNopLogger())
+	require.Equal(t, ErrIndexNotFound, err)
+}
+
 func prepareFilesystemBucket(t testing.TB) (objstore.Bucket, func()) {
 	storageDir, err := ioutil.TempDir(os.TempDir(), "")
 	require.NoError(t, err)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"path"
 	"time"
 
@@ -38,3 +39,29 @@ func WriteTenantDeletionMark(ctx context.Context, bkt objstore.Bucket, userID st
 	markerFile := path.Join(userID, TenantDeletionMarkPath)
 	return errors.Wrap(bkt.Upload(ctx, markerFile, bytes.NewReader(data)), "upload tenant deletion mark")
 }
+
+// Returns the tenant deletion mark, or nil if the tenant is not marked for deletion.
+func ReadTenantDeletionMark(ctx context.Context, bkt objstore.BucketReader, userID string) (*TenantDeletionMark, error) {
+	markerFile := path.Join(userID, TenantDeletionMarkPath)
+
+	r, err := bkt.Get(ctx, markerFile)
+	if bkt.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read tenant deletion mark")
+	}
+	defer r.Close() //nolint:errcheck
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read tenant deletion mark")
+	}
+
+	m := &TenantDeletionMark{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrap(err, "deserialize tenant deletion mark")
+	}
+
+	return m, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/thanos/pkg/objstore"
@@ -49,3 +50,23 @@ func TestTenantDeletionMarkExists(t *testing.T) {
 		})
 	}
 }
+
+func TestReadTenantDeletionMark(t *testing.T) {
+	const username = "user"
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	mark, err := ReadTenantDeletionMark(ctx, bkt, username)
+	require.NoError(t, err)
+	require.Nil(t, mark)
+
+	require.NoError(t, WriteTenantDeletionMark(ctx, bkt, username))
+	mark, err = ReadTenantDeletionMark(ctx, bkt, username)
+	require.NoError(t, err)
+	require.NotNil(t, mark)
+	require.InDelta(t, time.Now().Unix(), mark.DeletionTime, 5)
+
+	require.NoError(t, bkt.Upload(ctx, username+"/"+TenantDeletionMarkPath, bytes.NewReader([]byte("invalid"))))
+	_, err = ReadTenantDeletionMark(ctx, bkt, username)
+	require.Error(t, err)
+}
@@ -20,7 +20,7 @@ const (
 	GlobalIngestionRateStrategy = "global"
 )
 
-//LimitError are errors that do not comply with the limits specified.
+// LimitError are errors that do not comply with the limits specified.
 type LimitError string
 
 func (e LimitError) Error() string {
@@ -83,6 +83,12 @@ type Limits struct {
 	// Store-gateway.
 	StoreGatewayTenantShardSize int `yaml:"store_gateway_tenant_shard_size"`
 
+	// Compactor.
+	CompactorBlocksDeletionDelay   time.Duration `yaml:"compactor_blocks_deletion_delay"`
+	CompactorBlocksCleanupEnabled  bool          `yaml:"compactor_blocks_cleanup_enabled"`
+	CompactorMaxBlocksPerTenant    int           `yaml:"compactor_max_blocks_per_tenant"`
+	CompactorBlocksRetentionPeriod time.Duration `yaml:"compactor_blocks_retention_period"`
+
 	// Config for overrides, convenient if it goes here. [Deprecated in favor of RuntimeConfig flag in cortex.Config]
 	PerTenantOverrideConfig string        `yaml:"per_tenant_override_config"`
 	PerTenantOverridePeriod time.Duration `yaml:"per_tenant_override_period"`
@@ -139,6 +145,12 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 
 	// Store-gateway.
 	f.IntVar(&l.StoreGatewayTenantShardSize, "store-gateway.tenant-shard-size", 0, "The default tenant's shard size when the shuffle-sharding strategy is used. Must be set when the store-gateway sharding is enabled with the shuffle-sharding strategy. When this setting is specified in the per-tenant overrides, a value of 0 disables shuffle sharding for the tenant.")
+
+	// Compactor.
+	f.DurationVar(&l.CompactorBlocksDeletionDelay, "compactor.blocks-deletion-delay", 0, "Time before a block marked for deletion is deleted from bucket for a given tenant. 0 to use the -compactor.deletion-delay value, so a tenant can't override it to 0: set a small non-zero delay, like 1s, to delete the blocks at the next cleanup.")
+	f.BoolVar(&l.CompactorBlocksCleanupEnabled, "compactor.blocks-cleanup-enabled", true, "Whether the compactor blocks cleaner should delete blocks marked for deletion and partial blocks of the tenant.")
+	f.IntVar(&l.CompactorMaxBlocksPerTenant, "compactor.max-blocks-per-tenant", 0, "Max number of blocks a given tenant can retain. The oldest blocks exceeding it are marked for deletion by the compactor blocks cleaner. 0 to use the -compactor.cleanup-max-blocks-per-tenant value.")
+	f.DurationVar(&l.CompactorBlocksRetentionPeriod, "compactor.blocks-retention-period", 0, "Retention period of the blocks of a given tenant. The blocks containing only data older than it are marked for deletion by the compactor blocks cleaner, and deleted once the deletion delay has elapsed. 0 to disable.")
 }
 
 // Validate the limits config and returns an error if the validation
@@ -412,6 +424,26 @@ func (o *Overrides) StoreGatewayTenantShardSize(userID string) int {
 	return o.getOverridesForUser(userID).StoreGatewayTenantShardSize
 }
 
+// CompactorBlocksDeletionDelay returns the deletion delay of blocks marked for deletion for a given user.
+func (o *Overrides) CompactorBlocksDeletionDelay(userID string) time.Duration {
+	return o.getOverridesForUser(userID).CompactorBlocksDeletionDelay
+}
+
+// CompactorBlocksCleanupEnabled returns whether the blocks cleanup is enabled for a given user.
+func (o *Overrides) CompactorBlocksCleanupEnabled(userID string) bool {
+	return o.getOverridesForUser(userID).CompactorBlocksCleanupEnabled
+}
+
+// CompactorMaxBlocksPerTenant returns the max number of blocks a given user can retain.
+func (o *Overrides) CompactorMaxBlocksPerTenant(userID string) int {
+	return o.getOverridesForUser(userID).CompactorMaxBlocksPerTenant
+}
+
+// CompactorBlocksRetentionPeriod returns the retention period of the blocks of a given user.
+func (o *Overrides) CompactorBlocksRetentionPeriod(userID string) time.Duration {
+	return o.getOverridesForUser(userID).CompactorBlocksRetentionPeriod
+}
+
 func (o *Overrides) getOverridesForUser(userID string) *Limits {
 	if o.tenantLimits != nil {
 		l := o.tenantLimits(userID)